@@ -1,16 +1,382 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
 	"nbarbey.fr/url-shortener/urlshortener"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
-	var app *urlshortener.Application
-	if os.Getenv("DB_TYPE") == "memory" {
-		app = urlshortener.NewInMemoryApplication()
-	} else {
-		app = urlshortener.NewPGpplication()
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "migrate":
+			err = migrate(os.Args[2:])
+		case "import":
+			err = importLinks(os.Args[2:])
+		case "export":
+			err = exportLinks(os.Args[2:])
+		case "keys":
+			err = keys(os.Args[2:])
+		case "users":
+			err = users(os.Args[2:])
+		case "workspaces":
+			err = workspaces(os.Args[2:])
+		case "moderation":
+			err = moderation(os.Args[2:])
+		case "links":
+			err = links(os.Args[2:])
+		default:
+			err = fmt.Errorf("unknown command: %s", os.Args[1])
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
 	}
-	_ = app.Start()
+
+	_ = urlshortener.NewApplicationFromInfrastructure(newInfrastructure()).Start()
+}
+
+func newInfrastructure() *urlshortener.InfraStructure {
+	switch os.Getenv("DB_TYPE") {
+	case "memory":
+		return urlshortener.NewInMemoryInfrastructure()
+	case "redis":
+		return urlshortener.NewRedisInfrastructure()
+	default:
+		return urlshortener.NewPGInfrastructure()
+	}
+}
+
+// newApplication builds the application of the commands, without the
+// background jobs of the server.
+func newApplication() *urlshortener.Application {
+	return urlshortener.NewCommandApplicationFromInfrastructure(newInfrastructure())
+}
+
+func migrate(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s migrate up|down|status", os.Args[0])
+	}
+	migrator, err := urlshortener.NewMigrator(urlshortener.NewPGDB())
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "up":
+		return migrator.Up()
+	case "down":
+		return migrator.Down()
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied() {
+				state = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, state)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command: %s", args[0])
+	}
+}
+
+func importLinks(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "ndjson", "input format: csv or ndjson")
+	policy := flags.String("policy", "skip", "conflict policy: skip, overwrite or fail")
+	dryRun := flags.Bool("dry-run", false, "report what would be imported without writing")
+	_ = flags.Parse(args)
+
+	input, closeInput, err := openInput(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer closeInput()
+	reader, err := urlshortener.NewLinkRecordReader(*format, input)
+	if err != nil {
+		return err
+	}
+	conflictPolicy, err := urlshortener.ParseConflictPolicy(*policy)
+	if err != nil {
+		return err
+	}
+	report, err := newApplication().Import(reader, urlshortener.ImportOptions{
+		Policy:        conflictPolicy,
+		DryRun:        *dryRun,
+		ProgressEvery: 1000,
+		Progress: func(report urlshortener.ImportReport) {
+			fmt.Fprintf(os.Stderr, "%d records read\n", report.Read)
+		},
+	})
+	fmt.Fprintf(os.Stderr, "read %d, created %d, overwritten %d, skipped %d, failed %d (dry run: %t)\n",
+		report.Read, report.Created, report.Overwritten, report.Skipped, report.Failed, report.DryRun)
+	for _, e := range report.Errors {
+		fmt.Fprintf(os.Stderr, "record %d: %s\n", e.Record, e.Error)
+	}
+	return err
+}
+
+func exportLinks(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "ndjson", "output format: csv or ndjson")
+	_ = flags.Parse(args)
+
+	output := io.Writer(os.Stdout)
+	if flags.Arg(0) != "" && flags.Arg(0) != "-" {
+		file, err := os.Create(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		output = file
+	}
+	writer, err := urlshortener.NewLinkRecordWriter(*format, output)
+	if err != nil {
+		return err
+	}
+	exported, err := newApplication().Export(writer)
+	fmt.Fprintf(os.Stderr, "exported %d links\n", exported)
+	return err
+}
+
+func keys(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: %s keys issue|revoke|list", os.Args[0])
+	}
+	switch args[0] {
+	case "issue":
+		flags := flag.NewFlagSet("keys issue", flag.ExitOnError)
+		name := flags.String("name", "", "name describing the key holder")
+		scopes := flags.String("scopes", "links:write,links:read,stats:read", "comma separated scopes")
+		expires := flags.Duration("expires", 0, "lifetime of the key, 0 for no expiry")
+		user := flags.String("user", "", "user the key acts as")
+		workspace := flags.String("workspace", urlshortener.DefaultWorkspace, "workspace the key acts in")
+		_ = flags.Parse(args[1:])
+
+		parsed, err := urlshortener.ParseScopes(*scopes)
+		if err != nil {
+			return err
+		}
+		var expiresAt *time.Time
+		if *expires > 0 {
+			e := time.Now().Add(*expires)
+			expiresAt = &e
+		}
+		token, key, err := newApplication().IssueKey(urlshortener.APIKey{Name: *name, Scopes: parsed, ExpiresAt: expiresAt,
+			UserID: *user, WorkspaceID: *workspace})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "issued key %s, the token below is not stored and cannot be shown again\n", key.ID)
+		fmt.Println(token)
+		return nil
+	case "revoke":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: %s keys revoke <id>", os.Args[0])
+		}
+		return newApplication().RevokeKey(args[1])
+	case "list":
+		keys, err := newApplication().Keys()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			state := "active"
+			switch {
+			case key.RevokedAt != nil:
+				state = "revoked " + key.RevokedAt.Format("2006-01-02 15:04:05")
+			case !key.Active(time.Now()):
+				state = "expired " + key.ExpiresAt.Format("2006-01-02 15:04:05")
+			}
+			lastUsed := "never"
+			if key.LastUsedAt != nil {
+				lastUsed = key.LastUsedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\tlast used %s\n", key.ID, key.Name, key.WorkspaceID, key.UserID,
+				strings.Join(key.Scopes, ","), state, lastUsed)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown keys command: %s", args[0])
+	}
+}
+
+func users(args []string) error {
+	if len(args) != 2 || args[0] != "create" {
+		return fmt.Errorf("usage: %s users create <name>", os.Args[0])
+	}
+	user, err := newApplication().CreateUser(args[1])
+	if err != nil {
+		return err
+	}
+	fmt.Println(user.ID)
+	return nil
+}
+
+func workspaces(args []string) error {
+	switch {
+	case len(args) == 2 && args[0] == "create":
+		workspace, err := newApplication().CreateWorkspace(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Println(workspace.ID)
+		return nil
+	case (len(args) == 3 || len(args) == 4) && args[0] == "add-member":
+		role := urlshortener.DefaultMemberRole
+		if len(args) == 4 {
+			parsed, err := urlshortener.ParseRole(args[3])
+			if err != nil {
+				return err
+			}
+			role = parsed
+		}
+		return newApplication().AddMember(args[1], args[2], role)
+	case len(args) == 2 && args[0] == "members":
+		members, err := newApplication().Members(args[1])
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			fmt.Printf("%s\t%s\t%s\n", member.UserID, member.Role, member.CreatedAt.Format("2006-01-02 15:04:05"))
+		}
+		return nil
+	case (len(args) == 2 || len(args) == 3) && args[0] == "quota":
+		app := newApplication()
+		if len(args) == 3 {
+			limit, err := strconv.Atoi(args[2])
+			if err != nil {
+				return fmt.Errorf("invalid quota: %s", args[2])
+			}
+			if err := app.SetLimit(args[1], limit); err != nil {
+				return err
+			}
+		}
+		usage, err := app.UsageOf(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\t%d/%d links\tresets %s\n", usage.Period, usage.Used, usage.Limit, usage.ResetAt.Format("2006-01-02"))
+		return nil
+	default:
+		return fmt.Errorf("usage: %s workspaces create <name>|add-member <workspace> <user> [role]|members <workspace>|quota <workspace> [limit]", os.Args[0])
+	}
+}
+
+func moderation(args []string) error {
+	note := func(args []string) string {
+		return strings.Join(args, " ")
+	}
+	switch {
+	case (len(args) == 1 || len(args) == 2) && args[0] == "reports":
+		status := urlshortener.ReportOpen
+		if len(args) == 2 {
+			status = urlshortener.ReportStatus(args[1])
+		}
+		reports, err := newApplication().Reports(status)
+		if err != nil {
+			return err
+		}
+		for _, report := range reports {
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\n", report.ID, report.CreatedAt.Format("2006-01-02 15:04:05"), report.Shortened,
+				report.Source, report.Reason, report.Status)
+		}
+		return nil
+	case len(args) >= 2 && args[0] == "quarantine":
+		return newApplication().Quarantine(args[1], note(args[2:]))
+	case len(args) >= 2 && args[0] == "release":
+		return newApplication().Release(args[1], note(args[2:]))
+	case len(args) >= 2 && args[0] == "dismiss":
+		return newApplication().Dismiss(args[1], note(args[2:]))
+	case len(args) == 2 && args[0] == "audit":
+		entries, err := newApplication().Audit(args[1])
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			fmt.Printf("%s\t%s\t%s\t%s\n", entry.CreatedAt.Format("2006-01-02 15:04:05"), entry.Action, entry.Actor, entry.Note)
+		}
+		return nil
+	case len(args) == 1 && args[0] == "rescreen":
+		result, err := newApplication().Rescreen()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "checked %d links, flagged %d, quarantined %d\n", result.Checked, result.Flagged, result.Quarantined)
+		return nil
+	default:
+		return fmt.Errorf("usage: %s moderation reports [status]|quarantine <url> [note]|release <url> [note]|dismiss <report> [note]|audit <url>|rescreen", os.Args[0])
+	}
+}
+
+func links(args []string) error {
+	switch {
+	case len(args) == 1 && args[0] == "check":
+		result, err := newApplication().CheckAll(context.Background())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "checked %d links, %d broken\n", result.Checked, result.Broken)
+		return nil
+	case len(args) == 1 && args[0] == "broken":
+		broken, err := newApplication().Broken()
+		if err != nil {
+			return err
+		}
+		for _, link := range broken {
+			reason := link.Error
+			if reason == "" {
+				reason = strconv.Itoa(link.Status)
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n", link.BrokenSince.Format("2006-01-02 15:04:05"), link.Shortened, link.URL, reason)
+		}
+		return nil
+	case (len(args) == 1 || len(args) == 2) && args[0] == "reencrypt":
+		batchSize := 500
+		if len(args) == 2 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid batch size: %s", args[1])
+			}
+			batchSize = n
+		}
+		updated, err := urlshortener.ReencryptDestinations(urlshortener.NewPGDB(), batchSize)
+		fmt.Fprintf(os.Stderr, "re-encrypted %d rows\n", updated)
+		return err
+	case len(args) == 2 && args[0] == "find":
+		codes, err := urlshortener.FindLinks(urlshortener.NewPGDB(), args[1])
+		if err != nil {
+			return err
+		}
+		for _, code := range codes {
+			fmt.Println(code)
+		}
+		return nil
+	default:
+		return fmt.Errorf("usage: %s links check|broken|reencrypt [batch size]|find <url>", os.Args[0])
+	}
+}
+
+func openInput(path string) (io.Reader, func(), error) {
+	if path == "" || path == "-" {
+		return os.Stdin, func() {}, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, func() { _ = file.Close() }, nil
 }
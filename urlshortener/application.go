@@ -1,14 +1,29 @@
 package urlshortener
 
+import "context"
+
 type Application struct {
 	server *HTTPServer
+	stop   context.CancelFunc
 	*CountingUsecase
+	*ArchiveUsecase
+	*CampaignUsecase
+	*AuthUsecase
+	*WorkspaceUsecase
+	*QuotaUsecase
+	*ModerationUsecase
+	*LinkHealthUsecase
 }
 
 func (a *Application) Start() error {
 	return a.server.Start()
 }
 
+// Close stops the background jobs of the application.
+func (a *Application) Close() {
+	a.stop()
+}
+
 func NewInMemoryApplication() *Application {
 	return NewApplicationFromInfrastructure(NewInMemoryInfrastructure())
 }
@@ -17,10 +32,64 @@ func NewPGpplication() *Application {
 	return NewApplicationFromInfrastructure(NewPGInfrastructure())
 }
 
+func NewRedisApplication() *Application {
+	return NewApplicationFromInfrastructure(NewRedisInfrastructure())
+}
+
+// NewApplicationFromInfrastructure starts the background jobs configured in
+// the environment, which run until the application is closed.
 func NewApplicationFromInfrastructure(i *InfraStructure) *Application {
-	useCases := NewCountingUsecase(i.store, i.countStore)
+	return newApplicationFromInfrastructure(i, true)
+}
+
+// NewCommandApplicationFromInfrastructure builds the application of one-off
+// commands, which starts none of the background jobs.
+func NewCommandApplicationFromInfrastructure(i *InfraStructure) *Application {
+	return newApplicationFromInfrastructure(i, false)
+}
+
+func newApplicationFromInfrastructure(i *InfraStructure, jobs bool) *Application {
+	ctx, stop := context.WithCancel(context.Background())
+	useCases := NewCountingUsecase(i.store, i.countStore, i.transactor)
+	useCases.WithRedirectPolicy(redirectPolicyFromEnv())
+	useCases.WithCampaigns(i.campaignStore)
+	useCases.WithClickStore(i.clickStore)
+	screener := urlScreenerFromEnv()
+	useCases.WithScreener(screener)
+	useCases.WithSigner(codeSignerFromEnv())
+	quotas := NewQuotaUsecase(i.quotaStore, envInt("QUOTA_MONTHLY_LINKS", 0))
+	useCases.WithQuotas(quotas)
+	archive := NewArchiveUsecase(i.transactor, i.exporter)
+	archive.WithShortener(useCases.Usecase)
+	campaigns := NewCampaignUsecase(i.campaignStore)
+	auth := NewAuthUsecase(i.keyStore)
+	auth.WithWorkspaces(i.workspaces)
+	auth.WithJWT(jwtVerifierFromEnv())
+	serverAuth := auth
+	if !authRequiredFromEnv() {
+		serverAuth = nil
+	}
+	moderation := NewModerationUsecase(i.store, i.moderation, i.exporter, screener)
+	moderationFromEnv(moderation)
+	linkHealth := NewLinkHealthUsecase(i.store, i.linkHealth, i.exporter, linkCheckerFromEnv())
+	visitors := NewVisitorExtractorFromEnv()
+	if jobs {
+		watchModerationFromEnv(ctx, moderation)
+		watchLinkHealthFromEnv(ctx, linkHealth)
+		watchGeoIPFromEnv(ctx, visitors)
+	}
+	limits := NewRateLimiter(i.limiterStore, rateLimitsFromEnv(), visitors)
 	return &Application{
-		CountingUsecase: useCases,
-		server:          NewHTTPServer(useCases, i.countStore),
+		stop:              stop,
+		CountingUsecase:   useCases,
+		ArchiveUsecase:    archive,
+		CampaignUsecase:   campaigns,
+		AuthUsecase:       auth,
+		WorkspaceUsecase:  NewWorkspaceUsecase(i.workspaces),
+		QuotaUsecase:      quotas,
+		ModerationUsecase: moderation,
+		LinkHealthUsecase: linkHealth,
+		server: NewHTTPServer(useCases, archive, campaigns, serverAuth, quotas, moderation, linkHealth,
+			visitors, limits),
 	}
 }
@@ -0,0 +1,477 @@
+package urlshortener
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+var ErrUnauthorized = errors.New("unauthorized")
+var ErrForbidden = errors.New("forbidden")
+var ErrInvalidScope = errors.New("invalid scope")
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+const (
+	ScopeLinksWrite = "links:write"
+	ScopeLinksRead  = "links:read"
+	ScopeStatsRead  = "stats:read"
+	ScopeKeysManage = "keys:manage"
+	ScopeModeration = "moderation"
+)
+
+var knownScopes = []string{ScopeLinksWrite, ScopeLinksRead, ScopeStatsRead, ScopeKeysManage}
+
+// operatorScopes span every workspace. Only keys issued by the system carry
+// them: tokens never get them by default, and principals cannot grant them.
+var operatorScopes = []string{ScopeModeration}
+
+func validScope(scope string) bool {
+	return slices.Contains(knownScopes, scope) || slices.Contains(operatorScopes, scope)
+}
+
+const (
+	apiKeyPrefix = "sk_"
+	// lastUsedResolution limits how often a busy key has its last use written back.
+	lastUsedResolution = time.Minute
+)
+
+// APIKey is stored with the hash of its token only; the token itself is shown
+// once, when the key is issued.
+type APIKey struct {
+	ID     string `gorm:"primaryKey"`
+	Name   string
+	Hash   string
+	Scopes []string `gorm:"serializer:json"`
+	// UserID and WorkspaceID are who the key acts as; keys without them act
+	// anonymously in the default workspace.
+	UserID      string
+	WorkspaceID string
+	CreatedAt   time.Time
+	ExpiresAt   *time.Time
+	LastUsedAt  *time.Time
+	RevokedAt   *time.Time
+}
+
+func (k APIKey) Active(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+func (k APIKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope)
+}
+
+func ParseScopes(s string) ([]string, error) {
+	var parsed []string
+	for _, scope := range strings.Split(s, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		if !validScope(scope) {
+			return nil, ErrInvalidScope
+		}
+		parsed = append(parsed, scope)
+	}
+	if len(parsed) == 0 {
+		return nil, ErrInvalidScope
+	}
+	return parsed, nil
+}
+
+func hashAPIKeyToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// splitAPIKeyToken extracts the key ID from a token of the form sk_<id>.<secret>.
+func splitAPIKeyToken(token string) (string, bool) {
+	rest, ok := strings.CutPrefix(token, apiKeyPrefix)
+	if !ok {
+		return "", false
+	}
+	id, secret, ok := strings.Cut(rest, ".")
+	return id, ok && id != "" && secret != ""
+}
+
+// Principal is the authenticated caller of a request. Scopes bound what the
+// credentials may be used for, Role what the caller may do in its workspace.
+type Principal struct {
+	KeyID       string
+	UserID      string
+	WorkspaceID string
+	Role        Role
+	Scopes      []string
+}
+
+func (p Principal) HasScope(scope string) bool {
+	return slices.Contains(p.Scopes, scope)
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+// authRequiredFromEnv reads API_AUTH, which is "required" unless set to
+// "disabled" for deployments that sit behind their own authentication.
+func authRequiredFromEnv() bool {
+	switch mode := os.Getenv("API_AUTH"); mode {
+	case "", "required":
+		return true
+	case "disabled":
+		return false
+	default:
+		panic(fmt.Sprintf("invalid API_AUTH: %s", mode))
+	}
+}
+
+type APIKeyStorer interface {
+	Create(key APIKey) error
+	Get(id string) (APIKey, error)
+	List() ([]APIKey, error)
+	Revoke(id string, at time.Time) error
+	Touch(id string, at time.Time) error
+}
+
+type AuthUsecase struct {
+	keys       APIKeyStorer
+	workspaces WorkspaceStorer
+	jwt        *JWTVerifier
+	clock      clockwork.Clock
+	principal  *Principal
+}
+
+func NewAuthUsecase(keys APIKeyStorer) *AuthUsecase {
+	return &AuthUsecase{keys: keys, clock: clockwork.NewRealClock()}
+}
+
+// WithWorkspaces makes keys of users removed from their workspace stop
+// authenticating.
+func (a *AuthUsecase) WithWorkspaces(workspaces WorkspaceStorer) {
+	a.workspaces = workspaces
+}
+
+// WithJWT also accepts the tokens of an identity provider; a nil verifier
+// accepts API keys only.
+func (a *AuthUsecase) WithJWT(jwt *JWTVerifier) {
+	a.jwt = jwt
+}
+
+// As returns a copy of the use case managing the keys of the principal
+// workspace only.
+func (a *AuthUsecase) As(principal Principal) *AuthUsecase {
+	u := *a
+	u.principal = &principal
+	return &u
+}
+
+// role returns the role a key acts with: the current role of its user, so
+// that role changes apply to existing keys, or admin for service keys that
+// belong to no user.
+func (a *AuthUsecase) role(key APIKey) (Role, error) {
+	if a.workspaces == nil || key.UserID == "" {
+		return RoleAdmin, nil
+	}
+	membership, err := a.workspaces.Member(workspaceOrDefault(key.WorkspaceID), key.UserID)
+	if err != nil {
+		return "", err
+	}
+	return membership.Role, nil
+}
+
+// IssueKey creates a key from the name, scopes, expiry, user and workspace of
+// the template and returns the token to hand to its user. Principals issue
+// keys acting as themselves, with no more scopes than their own.
+func (a *AuthUsecase) IssueKey(template APIKey) (string, APIKey, error) {
+	if err := authorize(a.principal, ActionManageKeys); err != nil {
+		return "", APIKey{}, err
+	}
+	if a.principal != nil {
+		template.UserID = a.principal.UserID
+		template.WorkspaceID = workspaceOf(a.principal)
+	}
+	if len(template.Scopes) == 0 {
+		return "", APIKey{}, ErrInvalidScope
+	}
+	for _, scope := range template.Scopes {
+		if !validScope(scope) {
+			return "", APIKey{}, ErrInvalidScope
+		}
+		if a.principal != nil && !a.principal.HasScope(scope) {
+			return "", APIKey{}, ErrForbidden
+		}
+	}
+	if _, err := a.role(template); err != nil {
+		return "", APIKey{}, err
+	}
+	id, err := randomID()
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", APIKey{}, err
+	}
+	key := APIKey{
+		ID:          id,
+		Name:        template.Name,
+		Scopes:      template.Scopes,
+		UserID:      template.UserID,
+		WorkspaceID: workspaceOrDefault(template.WorkspaceID),
+		CreatedAt:   a.clock.Now(),
+		ExpiresAt:   template.ExpiresAt,
+	}
+	token := apiKeyPrefix + key.ID + "." + base64.RawURLEncoding.EncodeToString(secret)
+	key.Hash = hashAPIKeyToken(token)
+	if err := a.keys.Create(key); err != nil {
+		return "", APIKey{}, err
+	}
+	return token, key, nil
+}
+
+func (a *AuthUsecase) RevokeKey(id string) error {
+	if err := authorize(a.principal, ActionManageKeys); err != nil {
+		return err
+	}
+	key, err := a.keys.Get(id)
+	if err != nil {
+		return err
+	}
+	if !canAccess(a.principal, key.WorkspaceID) {
+		return ErrAPIKeyNotFound
+	}
+	return a.keys.Revoke(id, a.clock.Now())
+}
+
+func (a *AuthUsecase) Keys() ([]APIKey, error) {
+	if err := authorize(a.principal, ActionManageKeys); err != nil {
+		return nil, err
+	}
+	keys, err := a.keys.List()
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(keys, func(key APIKey) bool { return !canAccess(a.principal, key.WorkspaceID) }), nil
+}
+
+// Authenticate returns the principal of the active key matching the token, or
+// of the JWT when it is not an API key.
+func (a *AuthUsecase) Authenticate(token string) (Principal, error) {
+	if a.jwt != nil && !strings.HasPrefix(token, apiKeyPrefix) {
+		return a.authenticateJWT(token)
+	}
+	id, ok := splitAPIKeyToken(token)
+	if !ok {
+		return Principal{}, ErrUnauthorized
+	}
+	key, err := a.keys.Get(id)
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		return Principal{}, ErrUnauthorized
+	}
+	if err != nil {
+		return Principal{}, err
+	}
+	now := a.clock.Now()
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashAPIKeyToken(token))) != 1 || !key.Active(now) {
+		return Principal{}, ErrUnauthorized
+	}
+	role, err := a.role(key)
+	if errors.Is(err, ErrNotMember) {
+		return Principal{}, ErrUnauthorized
+	}
+	if err != nil {
+		return Principal{}, err
+	}
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= lastUsedResolution {
+		_ = a.keys.Touch(id, now)
+	}
+	return Principal{KeyID: key.ID, UserID: key.UserID, WorkspaceID: workspaceOrDefault(key.WorkspaceID), Role: role,
+		Scopes: key.Scopes}, nil
+}
+
+// authenticateJWT maps the subject of the token to the user, and takes the
+// workspace and role from their claims. Without a role claim the user must be
+// a member of the workspace; without a scope claim the role alone bounds what
+// the token may do.
+func (a *AuthUsecase) authenticateJWT(token string) (Principal, error) {
+	claims, err := a.jwt.Verify(token, a.clock.Now())
+	if errors.Is(err, ErrInvalidToken) {
+		return Principal{}, ErrUnauthorized
+	}
+	if err != nil {
+		return Principal{}, err
+	}
+	principal := Principal{UserID: claims.Subject, WorkspaceID: workspaceOrDefault(claims.Workspace), Scopes: knownScopes}
+	if claims.Scopes != nil {
+		principal.Scopes = slices.DeleteFunc(claims.Scopes, func(scope string) bool { return !slices.Contains(knownScopes, scope) })
+	}
+	switch {
+	case claims.Role != "":
+		principal.Role, err = ParseRole(claims.Role)
+		if err != nil {
+			return Principal{}, ErrUnauthorized
+		}
+	case a.workspaces != nil:
+		membership, err := a.workspaces.Member(principal.WorkspaceID, principal.UserID)
+		if errors.Is(err, ErrNotMember) {
+			return Principal{}, ErrUnauthorized
+		}
+		if err != nil {
+			return Principal{}, err
+		}
+		principal.Role = membership.Role
+	default:
+		return Principal{}, ErrUnauthorized
+	}
+	return principal, nil
+}
+
+type PGAPIKeyStore struct {
+	db *gorm.DB
+}
+
+func NewPGAPIKeyStoreFromDB(db *gorm.DB) *PGAPIKeyStore {
+	return &PGAPIKeyStore{db: db}
+}
+
+func (p *PGAPIKeyStore) Create(key APIKey) error {
+	return p.db.Create(&key).Error
+}
+
+func (p *PGAPIKeyStore) Get(id string) (APIKey, error) {
+	var key APIKey
+	err := p.db.First(&key, "id = ?", id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	return key, err
+}
+
+func (p *PGAPIKeyStore) List() ([]APIKey, error) {
+	var keys []APIKey
+	err := p.db.Order("created_at").Find(&keys).Error
+	return keys, err
+}
+
+func (p *PGAPIKeyStore) Revoke(id string, at time.Time) error {
+	tx := p.db.Model(&APIKey{}).Where("id = ?", id).Update("revoked_at", at)
+	if tx.Error == nil && tx.RowsAffected == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return tx.Error
+}
+
+func (p *PGAPIKeyStore) Touch(id string, at time.Time) error {
+	return p.db.Model(&APIKey{}).Where("id = ?", id).Update("last_used_at", at).Error
+}
+
+const redisAPIKeysKey = "api-keys"
+
+type RedisAPIKeyStore struct {
+	client *redis.Client
+}
+
+func NewRedisAPIKeyStoreFromClient(client *redis.Client) *RedisAPIKeyStore {
+	return &RedisAPIKeyStore{client: client}
+}
+
+func (r *RedisAPIKeyStore) Create(key APIKey) error {
+	value, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return r.client.HSet(context.Background(), redisAPIKeysKey, key.ID, value).Err()
+}
+
+func (r *RedisAPIKeyStore) Get(id string) (APIKey, error) {
+	value, err := r.client.HGet(context.Background(), redisAPIKeysKey, id).Result()
+	if errors.Is(err, redis.Nil) {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+	var key APIKey
+	err = json.Unmarshal([]byte(value), &key)
+	return key, err
+}
+
+func (r *RedisAPIKeyStore) List() ([]APIKey, error) {
+	values, err := r.client.HGetAll(context.Background(), redisAPIKeysKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]APIKey, 0, len(values))
+	for _, value := range values {
+		var key APIKey
+		if err := json.Unmarshal([]byte(value), &key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b APIKey) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return keys, nil
+}
+
+// update applies the change optimistically, retrying when the keys are
+// modified concurrently, so that a touch never writes back a key revoked in
+// the meantime.
+func (r *RedisAPIKeyStore) update(id string, f func(key *APIKey)) error {
+	ctx := context.Background()
+	for {
+		err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+			value, err := tx.HGet(ctx, redisAPIKeysKey, id).Result()
+			if errors.Is(err, redis.Nil) {
+				return ErrAPIKeyNotFound
+			}
+			if err != nil {
+				return err
+			}
+			var key APIKey
+			if err := json.Unmarshal([]byte(value), &key); err != nil {
+				return err
+			}
+			f(&key)
+			updated, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.HSet(ctx, redisAPIKeysKey, id, updated)
+				return nil
+			})
+			return err
+		}, redisAPIKeysKey)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+}
+
+func (r *RedisAPIKeyStore) Revoke(id string, at time.Time) error {
+	return r.update(id, func(key *APIKey) { key.RevokedAt = &at })
+}
+
+func (r *RedisAPIKeyStore) Touch(id string, at time.Time) error {
+	return r.update(id, func(key *APIKey) { key.LastUsedAt = &at })
+}
@@ -0,0 +1,170 @@
+package urlshortener
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/jonboulle/clockwork"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testAuthenticate(t *testing.T, keys APIKeyStorer) {
+	clock := clockwork.NewFakeClockAt(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	auth := &AuthUsecase{keys: keys, clock: clock}
+
+	expiresAt := clock.Now().Add(time.Hour)
+	token, issued, err := auth.IssueKey(APIKey{Name: "ci", Scopes: []string{ScopeLinksWrite}, ExpiresAt: &expiresAt})
+	require.NoError(t, err)
+	stored, err := keys.Get(issued.ID)
+	require.NoError(t, err)
+	assert.NotContains(t, stored.Hash, token)
+	assert.Nil(t, stored.LastUsedAt)
+
+	key, err := auth.Authenticate(token)
+	require.NoError(t, err)
+	assert.True(t, key.HasScope(ScopeLinksWrite))
+	assert.False(t, key.HasScope(ScopeStatsRead))
+	stored, _ = keys.Get(issued.ID)
+	require.NotNil(t, stored.LastUsedAt)
+	assert.True(t, stored.LastUsedAt.Equal(clock.Now()))
+
+	clock.Advance(30 * time.Second)
+	_, err = auth.Authenticate(token)
+	require.NoError(t, err)
+	stored, _ = keys.Get(issued.ID)
+	assert.True(t, stored.LastUsedAt.Equal(clock.Now().Add(-30*time.Second)))
+
+	_, err = auth.Authenticate(token + "x")
+	assert.ErrorIs(t, err, ErrUnauthorized)
+	_, err = auth.Authenticate("sk_unknown.secret")
+	assert.ErrorIs(t, err, ErrUnauthorized)
+	_, err = auth.Authenticate("")
+	assert.ErrorIs(t, err, ErrUnauthorized)
+
+	clock.Advance(time.Hour)
+	_, err = auth.Authenticate(token)
+	assert.ErrorIs(t, err, ErrUnauthorized)
+
+	token, issued, err = auth.IssueKey(APIKey{Name: "ops", Scopes: []string{ScopeStatsRead}})
+	require.NoError(t, err)
+	require.NoError(t, auth.RevokeKey(issued.ID))
+	_, err = auth.Authenticate(token)
+	assert.ErrorIs(t, err, ErrUnauthorized)
+	assert.ErrorIs(t, auth.RevokeKey("unknown"), ErrAPIKeyNotFound)
+
+	_, _, err = auth.IssueKey(APIKey{Name: "bad", Scopes: []string{"links:delete"}})
+	assert.ErrorIs(t, err, ErrInvalidScope)
+
+	listed, err := auth.Keys()
+	require.NoError(t, err)
+	require.Len(t, listed, 2)
+	assert.Equal(t, "ci", listed[0].Name)
+}
+
+func TestAuthenticate(t *testing.T) {
+	testAuthenticate(t, NewPGAPIKeyStoreFromDB(NewInMemoryDB()))
+}
+
+func TestRedisAuthenticate(t *testing.T) {
+	_, client := newMiniredisClient(t)
+	testAuthenticate(t, NewRedisAPIKeyStoreFromClient(client))
+}
+
+// interleavingHook runs between once the first HGET returns, standing for a
+// concurrent writer.
+type interleavingHook struct {
+	between func()
+}
+
+func (h *interleavingHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h *interleavingHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		if between := h.between; between != nil && cmd.Name() == "hget" {
+			h.between = nil
+			between()
+		}
+		return err
+	}
+}
+
+func (h *interleavingHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestRedisAPIKeyRevocationRace(t *testing.T) {
+	server, client := newMiniredisClient(t)
+	keys := NewRedisAPIKeyStoreFromClient(client)
+	require.NoError(t, keys.Create(APIKey{ID: "k1", Name: "ci", Scopes: []string{ScopeLinksRead}}))
+	revokedAt := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	revoker := NewRedisAPIKeyStoreFromClient(redis.NewClient(&redis.Options{Addr: server.Addr()}))
+	client.AddHook(&interleavingHook{between: func() {
+		require.NoError(t, revoker.Revoke("k1", revokedAt))
+	}})
+
+	require.NoError(t, keys.Touch("k1", revokedAt.Add(time.Second)))
+	key, err := keys.Get("k1")
+	require.NoError(t, err)
+	require.NotNil(t, key.RevokedAt, "a touch racing a revocation keeps the key revoked")
+	assert.True(t, revokedAt.Equal(*key.RevokedAt))
+	require.NotNil(t, key.LastUsedAt)
+	assert.ErrorIs(t, keys.Touch("unknown", revokedAt), ErrAPIKeyNotFound)
+}
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := ParseScopes("links:write, stats:read")
+	require.NoError(t, err)
+	assert.Equal(t, []string{ScopeLinksWrite, ScopeStatsRead}, scopes)
+	_, err = ParseScopes("")
+	assert.ErrorIs(t, err, ErrInvalidScope)
+	_, err = ParseScopes("links:write,admin")
+	assert.ErrorIs(t, err, ErrInvalidScope)
+}
+
+func TestHTTPAuth(t *testing.T) {
+	t.Setenv("API_AUTH", "required")
+	app := NewInMemoryApplication()
+	writer, _, err := app.IssueKey(APIKey{Name: "writer", Scopes: []string{ScopeLinksWrite}})
+	require.NoError(t, err)
+	reader, _, err := app.IssueKey(APIKey{Name: "reader", Scopes: []string{ScopeLinksRead}})
+	require.NoError(t, err)
+
+	testServer := httptest.NewServer(app.server.mux)
+	defer testServer.Close()
+	newClient := func() *HTTPClient {
+		return NewHTTPClientFromResty(resty.NewWithClient(testServer.Client()).SetBaseURL(testServer.URL))
+	}
+
+	_, err = newClient().Shorten("https://example.com/docs", nil)
+	assert.ErrorIs(t, err, ErrUnauthorized)
+	_, err = newClient().WithAPIKey(reader).Shorten("https://example.com/docs", nil)
+	assert.ErrorIs(t, err, ErrForbidden)
+	short, err := newClient().WithAPIKey(writer).Shorten("https://example.com/docs", nil)
+	require.NoError(t, err)
+
+	_, err = newClient().WithAPIKey(writer).Unshorten(short)
+	assert.ErrorIs(t, err, ErrForbidden)
+	long, err := newClient().WithAPIKey(reader).Unshorten(short)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/docs", long)
+
+	recorder := handle(app, httptest.NewRequest(http.MethodGet, short, nil))
+	assert.Equal(t, http.StatusTemporaryRedirect, recorder.Code)
+
+	request := httptest.NewRequest(http.MethodGet, "/count", nil)
+	recorder = handle(app, request)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.NotEmpty(t, recorder.Header().Get("WWW-Authenticate"))
+	request = httptest.NewRequest(http.MethodGet, "/api/v1/campaigns", nil)
+	request.Header.Set("X-API-Key", reader)
+	assert.Equal(t, http.StatusOK, handle(app, request).Code)
+}
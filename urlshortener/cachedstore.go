@@ -0,0 +1,258 @@
+package urlshortener
+
+import (
+	"container/list"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"golang.org/x/sync/singleflight"
+)
+
+var cacheMetrics = expvar.NewMap("store_cache")
+
+type CacheOptions struct {
+	Size        int
+	TTL         time.Duration
+	NegativeTTL time.Duration
+}
+
+type cacheEntry struct {
+	key       string
+	url       URL
+	found     bool
+	expiresAt time.Time
+}
+
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+	loads   map[string]*pendingLoads
+}
+
+// pendingLoads counts the loads of a key in flight and the invalidations of
+// the key since the first of them began.
+type pendingLoads struct {
+	count      int
+	generation uint64
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		loads:   make(map[string]*pendingLoads),
+	}
+}
+
+// begin registers a load of key and returns the generation that key must
+// still be at for the load to be cached.
+func (c *lruCache) begin(key string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending, ok := c.loads[key]
+	if !ok {
+		pending = &pendingLoads{}
+		c.loads[key] = pending
+	}
+	pending.count++
+	return pending.generation
+}
+
+func (c *lruCache) end(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pending, ok := c.loads[key]; ok {
+		if pending.count--; pending.count == 0 {
+			delete(c.loads, key)
+		}
+	}
+}
+
+func (c *lruCache) get(key string, now time.Time) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	entry := element.Value.(cacheEntry)
+	if !now.Before(entry.expiresAt) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return cacheEntry{}, false
+	}
+	c.order.MoveToFront(element)
+	return entry, true
+}
+
+// add caches the entry loaded at generation, unless its key was invalidated
+// since: the load may have read what the invalidating write replaced.
+func (c *lruCache) add(entry cacheEntry, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pending, ok := c.loads[entry.key]; ok && pending.generation != generation {
+		cacheMetrics.Add("stale_loads", 1)
+		return
+	}
+	if element, ok := c.entries[entry.key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(cacheEntry).key)
+		cacheMetrics.Add("evictions", 1)
+	}
+}
+
+func (c *lruCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pending, ok := c.loads[key]; ok {
+		pending.generation++
+	}
+	if element, ok := c.entries[key]; ok {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+type CachedStore struct {
+	store   Storer
+	cache   *lruCache
+	group   *singleflight.Group
+	options CacheOptions
+	clock   clockwork.Clock
+}
+
+func NewCachedStore(store Storer, options CacheOptions) *CachedStore {
+	return &CachedStore{
+		store:   store,
+		cache:   newLRUCache(options.Size),
+		group:   &singleflight.Group{},
+		options: options,
+		clock:   clockwork.NewRealClock(),
+	}
+}
+
+func (c *CachedStore) WithClock(clock clockwork.Clock) {
+	c.clock = clock
+}
+
+func (c *CachedStore) Get(shortened string) (URL, error) {
+	if entry, ok := c.cache.get(shortened, c.clock.Now()); ok {
+		if !entry.found {
+			cacheMetrics.Add("negative_hits", 1)
+			return URL{}, ErrNotFound
+		}
+		cacheMetrics.Add("hits", 1)
+		return entry.url, nil
+	}
+	cacheMetrics.Add("misses", 1)
+	result, err, _ := c.group.Do(shortened, func() (any, error) {
+		return c.load(shortened)
+	})
+	if err != nil {
+		return URL{}, err
+	}
+	return result.(URL), nil
+}
+
+func (c *CachedStore) load(shortened string) (URL, error) {
+	generation := c.cache.begin(shortened)
+	defer c.cache.end(shortened)
+	now := c.clock.Now()
+	u, err := c.store.Get(shortened)
+	if errors.Is(err, ErrNotFound) {
+		c.cache.add(cacheEntry{key: shortened, expiresAt: now.Add(c.options.NegativeTTL)}, generation)
+		return URL{}, err
+	}
+	if err != nil {
+		return URL{}, err
+	}
+	expiresAt := now.Add(c.options.TTL)
+	if u.Expiring() && u.expiration.Before(expiresAt) {
+		expiresAt = *u.expiration
+	}
+	if now.Before(expiresAt) {
+		c.cache.add(cacheEntry{key: shortened, url: u, found: true, expiresAt: expiresAt}, generation)
+	}
+	return u, nil
+}
+
+func (c *CachedStore) Save(association URLAssociation) error {
+	defer c.invalidate(association.Shortened)
+	return c.store.Save(association)
+}
+
+func (c *CachedStore) SaveBatch(associations []URLAssociation) ([]URLAssociation, int, error) {
+	defer func() {
+		for _, association := range associations {
+			c.invalidate(association.Shortened)
+		}
+	}()
+	return c.store.SaveBatch(associations)
+}
+
+func (c *CachedStore) Update(shortened string, update func(association *URLAssociation) error) error {
+	defer c.invalidate(shortened)
+	return c.store.Update(shortened, update)
+}
+
+func (c *CachedStore) Delete(shortened string) error {
+	defer c.invalidate(shortened)
+	return c.store.Delete(shortened)
+}
+
+func (c *CachedStore) invalidate(shortened string) {
+	c.group.Forget(shortened)
+	c.cache.remove(shortened)
+	cacheMetrics.Add("invalidations", 1)
+}
+
+func cacheOptionsFromEnv() CacheOptions {
+	return CacheOptions{
+		Size:        envInt("STORE_CACHE_SIZE", 0),
+		TTL:         envDuration("STORE_CACHE_TTL", 5*time.Minute),
+		NegativeTTL: envDuration("STORE_CACHE_NEGATIVE_TTL", 30*time.Second),
+	}
+}
+
+// writtenCodes records the codes written through a store bound to a
+// transaction, whose cache entries can only be invalidated once it is over:
+// until then other readers still load the rows it replaces.
+type writtenCodes struct {
+	Storer
+	codes []string
+}
+
+func (w *writtenCodes) Save(association URLAssociation) error {
+	w.codes = append(w.codes, association.Shortened)
+	return w.Storer.Save(association)
+}
+
+func (w *writtenCodes) SaveBatch(associations []URLAssociation) ([]URLAssociation, int, error) {
+	for _, association := range associations {
+		w.codes = append(w.codes, association.Shortened)
+	}
+	return w.Storer.SaveBatch(associations)
+}
+
+func (w *writtenCodes) Update(shortened string, update func(association *URLAssociation) error) error {
+	w.codes = append(w.codes, shortened)
+	return w.Storer.Update(shortened, update)
+}
+
+func (w *writtenCodes) Delete(shortened string) error {
+	w.codes = append(w.codes, shortened)
+	return w.Storer.Delete(shortened)
+}
@@ -0,0 +1,195 @@
+package urlshortener
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingStore struct {
+	Storer
+	gets atomic.Int32
+}
+
+func (c *countingStore) Get(shortened string) (URL, error) {
+	c.gets.Add(1)
+	return c.Storer.Get(shortened)
+}
+
+func newTestCachedStore(size int) (*CachedStore, *countingStore, clockwork.FakeClock) {
+	backend := &countingStore{Storer: NewInMemorySqlite()}
+	clock := clockwork.NewFakeClock()
+	cached := NewCachedStore(backend, CacheOptions{Size: size, TTL: time.Minute, NegativeTTL: 10 * time.Second})
+	cached.WithClock(clock)
+	return cached, backend, clock
+}
+
+func TestCachedStoreHit(t *testing.T) {
+	cached, backend, _ := newTestCachedStore(10)
+	require.NoError(t, cached.Save(NewURLAssociation("http://long.net", "http://short.uk", nil)))
+
+	for range 3 {
+		u, err := cached.Get("http://short.uk")
+		require.NoError(t, err)
+		assert.Equal(t, "http://long.net", u.String())
+	}
+	assert.Equal(t, int32(1), backend.gets.Load())
+}
+
+func TestCachedStoreNegative(t *testing.T) {
+	cached, backend, clock := newTestCachedStore(10)
+
+	_, err := cached.Get("http://short.uk")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = cached.Get("http://short.uk")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, int32(1), backend.gets.Load())
+
+	clock.Advance(11 * time.Second)
+	_, err = cached.Get("http://short.uk")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, int32(2), backend.gets.Load())
+}
+
+func TestCachedStoreInvalidation(t *testing.T) {
+	cached, _, _ := newTestCachedStore(10)
+	_, err := cached.Get("http://short.uk")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, cached.Save(NewURLAssociation("http://long.net", "http://short.uk", nil)))
+	u, err := cached.Get("http://short.uk")
+	require.NoError(t, err)
+	assert.Equal(t, "http://long.net", u.String())
+
+	require.NoError(t, cached.Delete("http://short.uk"))
+	_, err = cached.Get("http://short.uk")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestCachedStoreTTLCappedAtExpiration(t *testing.T) {
+	cached, backend, clock := newTestCachedStore(10)
+	expiration := clock.Now().Add(10 * time.Second)
+	require.NoError(t, cached.Save(NewURLAssociation("http://long.net", "http://short.uk", &expiration)))
+
+	_, err := cached.Get("http://short.uk")
+	require.NoError(t, err)
+	clock.Advance(20 * time.Second)
+	_, err = cached.Get("http://short.uk")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), backend.gets.Load())
+}
+
+func TestCachedStoreEviction(t *testing.T) {
+	cached, backend, _ := newTestCachedStore(1)
+	require.NoError(t, cached.Save(NewURLAssociation("http://long.net/1", "http://short.uk/1", nil)))
+	require.NoError(t, cached.Save(NewURLAssociation("http://long.net/2", "http://short.uk/2", nil)))
+
+	_, _ = cached.Get("http://short.uk/1")
+	_, _ = cached.Get("http://short.uk/2")
+	_, _ = cached.Get("http://short.uk/1")
+	assert.Equal(t, int32(3), backend.gets.Load())
+}
+
+func TestCachedStoreSingleflight(t *testing.T) {
+	backend := &slowStore{Storer: NewInMemorySqlite(), release: make(chan struct{})}
+	require.NoError(t, backend.Save(NewURLAssociation("http://long.net", "http://short.uk", nil)))
+	cached := NewCachedStore(backend, CacheOptions{Size: 10, TTL: time.Minute})
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cached.Get("http://short.uk")
+			assert.NoError(t, err)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+	assert.Equal(t, int32(1), backend.gets.Load())
+}
+
+type slowStore struct {
+	Storer
+	gets    atomic.Int32
+	release chan struct{}
+}
+
+func (s *slowStore) Get(shortened string) (URL, error) {
+	s.gets.Add(1)
+	<-s.release
+	return s.Storer.Get(shortened)
+}
+
+// staleStore reads a link, then holds it back until released, like a reader
+// overtaken by a concurrent write.
+type staleStore struct {
+	Storer
+	read    chan struct{}
+	release chan struct{}
+}
+
+func (s *staleStore) Get(shortened string) (URL, error) {
+	u, err := s.Storer.Get(shortened)
+	s.read <- struct{}{}
+	<-s.release
+	return u, err
+}
+
+func TestCachedStoreLoadOvertakenByInvalidation(t *testing.T) {
+	backend := &staleStore{Storer: NewInMemorySqlite(), read: make(chan struct{}), release: make(chan struct{})}
+	require.NoError(t, backend.Save(NewURLAssociation("http://long.net", "http://short.uk", nil)))
+	cached := NewCachedStore(backend, CacheOptions{Size: 10, TTL: time.Minute})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		u, err := cached.Get("http://short.uk")
+		assert.NoError(t, err)
+		assert.False(t, u.Quarantined())
+	}()
+	<-backend.read
+	require.NoError(t, cached.Update("http://short.uk", func(association *URLAssociation) error {
+		association.Quarantined = true
+		return nil
+	}))
+	close(backend.release)
+	<-done
+
+	go func() { <-backend.read }()
+	u, err := cached.Get("http://short.uk")
+	require.NoError(t, err)
+	assert.True(t, u.Quarantined(), "the load that began before the update is not cached")
+}
+
+func TestCachedStoreTransaction(t *testing.T) {
+	db := NewInMemoryDB()
+	cached := NewCachedStore(NewPGStoreFromDB(db), CacheOptions{Size: 10, TTL: time.Minute, NegativeTTL: time.Minute})
+	require.NoError(t, cached.Save(NewURLAssociation("http://long.net", "http://short.uk", nil)))
+	_, err := cached.Get("http://short.uk")
+	require.NoError(t, err)
+
+	err = NewPGTransactor(db, cached).Transaction(func(s Storer, _ CountStorer) error {
+		require.NoError(t, s.Update("http://short.uk", func(association *URLAssociation) error {
+			association.Quarantined = true
+			return nil
+		}))
+		u, err := s.Get("http://short.uk")
+		require.NoError(t, err)
+		assert.True(t, u.Quarantined(), "reads in the transaction bypass the cache")
+		u, err = cached.Get("http://short.uk")
+		require.NoError(t, err)
+		assert.False(t, u.Quarantined(), "the cache keeps serving the committed link")
+		return nil
+	})
+	require.NoError(t, err)
+	u, err := cached.Get("http://short.uk")
+	require.NoError(t, err)
+	assert.True(t, u.Quarantined(), "the link is invalidated once the transaction commits")
+}
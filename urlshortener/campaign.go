@@ -0,0 +1,222 @@
+package urlshortener
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrCampaignNotFound = errors.New("campaign not found")
+var ErrInvalidCampaign = errors.New("invalid campaign")
+
+type UTMParams struct {
+	Source   string `json:"utm_source,omitempty" gorm:"column:utm_source"`
+	Medium   string `json:"utm_medium,omitempty" gorm:"column:utm_medium"`
+	Campaign string `json:"utm_campaign,omitempty" gorm:"column:utm_campaign"`
+	Term     string `json:"utm_term,omitempty" gorm:"column:utm_term"`
+	Content  string `json:"utm_content,omitempty" gorm:"column:utm_content"`
+}
+
+func UTMParamsFromQuery(query url.Values) UTMParams {
+	return UTMParams{
+		Source:   query.Get("utm_source"),
+		Medium:   query.Get("utm_medium"),
+		Campaign: query.Get("utm_campaign"),
+		Term:     query.Get("utm_term"),
+		Content:  query.Get("utm_content"),
+	}
+}
+
+func (p UTMParams) values() [][2]string {
+	return [][2]string{
+		{"utm_source", p.Source},
+		{"utm_medium", p.Medium},
+		{"utm_campaign", p.Campaign},
+		{"utm_term", p.Term},
+		{"utm_content", p.Content},
+	}
+}
+
+// merge returns the parameters with the non-empty fields of override applied.
+func (p UTMParams) merge(override UTMParams) UTMParams {
+	pick := func(base, override string) string {
+		if override != "" {
+			return override
+		}
+		return base
+	}
+	return UTMParams{
+		Source:   pick(p.Source, override.Source),
+		Medium:   pick(p.Medium, override.Medium),
+		Campaign: pick(p.Campaign, override.Campaign),
+		Term:     pick(p.Term, override.Term),
+		Content:  pick(p.Content, override.Content),
+	}
+}
+
+// apply sets the parameters on the destination query string, replacing the
+// utm_* values it may already carry.
+func (p UTMParams) apply(rawURL string) (string, error) {
+	if p == (UTMParams{}) {
+		return rawURL, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", ErrInvalidURL
+	}
+	query := u.Query()
+	for _, value := range p.values() {
+		if value[1] != "" {
+			query.Set(value[0], value[1])
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+type Campaign struct {
+	Name        string `json:"name" gorm:"primaryKey"`
+	WorkspaceID string `json:"-"`
+	UTMParams   `gorm:"embedded"`
+}
+
+func (c Campaign) Validate() error {
+	if c.Name == "" || strings.ContainsAny(c.Name, "/?#") {
+		return ErrInvalidCampaign
+	}
+	return nil
+}
+
+// defaults returns the campaign parameters, utm_campaign falling back to the
+// campaign name.
+func (c Campaign) defaults() UTMParams {
+	params := c.UTMParams
+	if params.Campaign == "" {
+		params.Campaign = c.Name
+	}
+	return params
+}
+
+type CampaignStats struct {
+	Campaign string `json:"campaign"`
+	Links    int    `json:"links"`
+	Clicks   int    `json:"clicks"`
+}
+
+type CampaignStorer interface {
+	Get(name string) (Campaign, error)
+	Save(campaign Campaign) error
+	// List returns the campaigns of the workspace, or all of them for an
+	// empty workspace.
+	List(workspaceID string) ([]Campaign, error)
+	Stats(name string) (CampaignStats, error)
+}
+
+type CampaignUsecase struct {
+	campaigns CampaignStorer
+	principal *Principal
+}
+
+func NewCampaignUsecase(campaigns CampaignStorer) *CampaignUsecase {
+	return &CampaignUsecase{campaigns: campaigns}
+}
+
+func (c *CampaignUsecase) As(principal Principal) *CampaignUsecase {
+	u := *c
+	u.principal = &principal
+	return &u
+}
+
+// SaveCampaign creates the campaign in the principal workspace, or updates it
+// if it already belongs there. Campaign names are unique across workspaces.
+func (c *CampaignUsecase) SaveCampaign(campaign Campaign) error {
+	if err := authorize(c.principal, ActionManageCampaigns); err != nil {
+		return err
+	}
+	if err := campaign.Validate(); err != nil {
+		return err
+	}
+	if c.principal != nil || campaign.WorkspaceID == "" {
+		campaign.WorkspaceID = workspaceOf(c.principal)
+	}
+	existing, err := c.campaigns.Get(campaign.Name)
+	if err != nil && !errors.Is(err, ErrCampaignNotFound) {
+		return err
+	}
+	if err == nil && workspaceOrDefault(existing.WorkspaceID) != campaign.WorkspaceID {
+		return ErrInvalidCampaign
+	}
+	return c.campaigns.Save(campaign)
+}
+
+func (c *CampaignUsecase) Campaigns() ([]Campaign, error) {
+	if err := authorize(c.principal, ActionViewLinks); err != nil {
+		return nil, err
+	}
+	if c.principal == nil {
+		return c.campaigns.List("")
+	}
+	return c.campaigns.List(workspaceOf(c.principal))
+}
+
+func (c *CampaignUsecase) CampaignStats(name string) (CampaignStats, error) {
+	if err := authorize(c.principal, ActionViewStats); err != nil {
+		return CampaignStats{}, err
+	}
+	campaign, err := c.campaigns.Get(name)
+	if err != nil {
+		return CampaignStats{}, err
+	}
+	if !canAccess(c.principal, campaign.WorkspaceID) {
+		return CampaignStats{}, ErrCampaignNotFound
+	}
+	return c.campaigns.Stats(name)
+}
+
+type PGCampaignStore struct {
+	db *gorm.DB
+}
+
+func NewPGCampaignStoreFromDB(db *gorm.DB) *PGCampaignStore {
+	return &PGCampaignStore{db: db}
+}
+
+func (p *PGCampaignStore) Get(name string) (Campaign, error) {
+	var campaign Campaign
+	err := p.db.First(&campaign, "name = ?", name).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Campaign{}, ErrCampaignNotFound
+	}
+	return campaign, err
+}
+
+func (p *PGCampaignStore) Save(campaign Campaign) error {
+	return p.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&campaign).Error
+}
+
+func (p *PGCampaignStore) List(workspaceID string) ([]Campaign, error) {
+	var campaigns []Campaign
+	query := p.db.Order("name")
+	if workspaceID != "" {
+		query = query.Where("workspace_id = ?", workspaceID)
+	}
+	err := query.Find(&campaigns).Error
+	return campaigns, err
+}
+
+func (p *PGCampaignStore) Stats(name string) (CampaignStats, error) {
+	if _, err := p.Get(name); err != nil {
+		return CampaignStats{}, err
+	}
+	stats := CampaignStats{Campaign: name}
+	err := p.db.Model(&URLAssociation{}).
+		Select("count(*) AS links, coalesce(sum(count_store_rows.hits), 0) AS clicks").
+		Joins("LEFT JOIN count_store_rows ON count_store_rows.url = url_associations.shortened").
+		Where("url_associations.campaign = ?", name).
+		Scan(&stats).Error
+	stats.Campaign = name
+	return stats, err
+}
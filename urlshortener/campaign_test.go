@@ -0,0 +1,84 @@
+package urlshortener
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUTMParamsApply(t *testing.T) {
+	got, err := UTMParams{Source: "news letter", Campaign: "spring&sale"}.apply("https://localhost/page?utm_source=old&ref=1#top")
+	require.NoError(t, err)
+	assert.Equal(t, "https://localhost/page?ref=1&utm_campaign=spring%26sale&utm_source=news+letter#top", got)
+
+	got, err = UTMParams{}.apply("https://localhost/page?b=1&a=2")
+	require.NoError(t, err)
+	assert.Equal(t, "https://localhost/page?b=1&a=2", got)
+}
+
+func testCampaignStats(t *testing.T, app *Application) {
+	require.NoError(t, app.SaveCampaign(Campaign{Name: "spring", UTMParams: UTMParams{Source: "newsletter", Medium: "email"}}))
+	assert.ErrorIs(t, app.SaveCampaign(Campaign{Name: "a/b"}), ErrInvalidCampaign)
+
+	short, err := app.ShortenWithOptions(ShortenRequest{URL: "https://example.com/a", Campaign: "spring", UTM: UTMParams{Medium: "social"}})
+	require.NoError(t, err)
+	got, err := app.Unshorten(short)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/a?utm_campaign=spring&utm_medium=social&utm_source=newsletter", got)
+
+	results, err := app.ShortenBatch([]ShortenRequest{{URL: "https://example.com/b", Campaign: "spring"}, {URL: "https://example.com/c"}})
+	require.NoError(t, err)
+	_, err = app.Unshorten(results[0].Shortened)
+	require.NoError(t, err)
+
+	_, err = app.Shorten("https://example.com/d", nil)
+	require.NoError(t, err)
+	_, err = app.ShortenWithOptions(ShortenRequest{URL: "https://example.com/e", Campaign: "unknown"})
+	assert.ErrorIs(t, err, ErrCampaignNotFound)
+
+	stats, err := app.CampaignStats("spring")
+	require.NoError(t, err)
+	assert.Equal(t, CampaignStats{Campaign: "spring", Links: 2, Clicks: 2}, stats)
+
+	require.NoError(t, app.Delete(short))
+	stats, err = app.CampaignStats("spring")
+	require.NoError(t, err)
+	assert.Equal(t, CampaignStats{Campaign: "spring", Links: 1, Clicks: 1}, stats)
+
+	_, err = app.CampaignStats("unknown")
+	assert.ErrorIs(t, err, ErrCampaignNotFound)
+}
+
+func TestCampaignStats(t *testing.T) {
+	testCampaignStats(t, NewInMemoryApplication())
+}
+
+func TestRedisCampaignStats(t *testing.T) {
+	_, client := newMiniredisClient(t)
+	testCampaignStats(t, NewApplicationFromInfrastructure(NewRedisInfrastructureFromClient(client, false)))
+}
+
+func TestHTTPCampaigns(t *testing.T) {
+	app := NewInMemoryApplication()
+	recorder := handle(app, httptest.NewRequest(http.MethodPost, "/api/v1/campaigns",
+		strings.NewReader(`{"name": "launch", "utm_source": "twitter"}`)))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	recorder = handle(app, httptest.NewRequest(http.MethodPost, "/shorten?url="+url.QueryEscape("https://example.com/x")+
+		"&campaign=launch&utm_content=banner", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	recorder = handle(app, httptest.NewRequest(http.MethodGet, "/api/v1/campaigns", nil))
+	assert.JSONEq(t, `{"campaigns": [{"name": "launch", "utm_source": "twitter"}]}`, recorder.Body.String())
+
+	recorder = handle(app, httptest.NewRequest(http.MethodGet, "/api/v1/campaigns/launch/stats", nil))
+	assert.JSONEq(t, `{"campaign": "launch", "links": 1, "clicks": 0}`, recorder.Body.String())
+
+	recorder = handle(app, httptest.NewRequest(http.MethodGet, "/api/v1/campaigns/unknown/stats", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
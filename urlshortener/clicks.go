@@ -0,0 +1,124 @@
+package urlshortener
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+var ErrUnknownDimension = errors.New("unknown analytics dimension")
+
+const redisClicksPrefix = "clicks:"
+
+// ClickEvent is recorded for every redirect served to a visitor.
+type ClickEvent struct {
+	ID        uint `gorm:"primaryKey"`
+	Shortened string
+	ClickedAt time.Time
+	Rule      string
+	Country   string
+	Variant   string
+}
+
+// dimensions lists the click event columns clicks can be grouped by.
+var dimensions = []string{"rule", "country", "variant"}
+
+func (e ClickEvent) dimension(name string) string {
+	switch name {
+	case "rule":
+		return e.Rule
+	case "country":
+		return e.Country
+	case "variant":
+		return e.Variant
+	default:
+		return ""
+	}
+}
+
+type ClickStorer interface {
+	Record(event ClickEvent) error
+	CountBy(shortened, dimension string) (map[string]int, error)
+}
+
+type PGClickStore struct {
+	db *gorm.DB
+}
+
+func NewPGClickStoreFromDB(db *gorm.DB) *PGClickStore {
+	return &PGClickStore{db: db}
+}
+
+func (p *PGClickStore) Record(event ClickEvent) error {
+	return p.db.Create(&event).Error
+}
+
+func (p *PGClickStore) CountBy(shortened, dimension string) (map[string]int, error) {
+	if !slices.Contains(dimensions, dimension) {
+		return nil, ErrUnknownDimension
+	}
+	var rows []struct {
+		Value string
+		Count int
+	}
+	// dimension is one of the known column names, never user input
+	err := p.db.Model(&ClickEvent{}).
+		Select(dimension+" AS value, count(*) AS count").
+		Where("shortened = ?", shortened).
+		Group(dimension).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(rows))
+	for _, row := range rows {
+		counts[row.Value] += row.Count
+	}
+	return counts, nil
+}
+
+// RedisClickStore only keeps per-dimension counters, not individual events.
+type RedisClickStore struct {
+	client *redis.Client
+}
+
+func NewRedisClickStoreFromClient(client *redis.Client) *RedisClickStore {
+	return &RedisClickStore{client: client}
+}
+
+func redisClicksKey(shortened, dimension string) string {
+	return redisClicksPrefix + dimension + ":" + shortened
+}
+
+func (r *RedisClickStore) Record(event ClickEvent) error {
+	ctx := context.Background()
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, dimension := range dimensions {
+			pipe.HIncrBy(ctx, redisClicksKey(event.Shortened, dimension), event.dimension(dimension), 1)
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *RedisClickStore) CountBy(shortened, dimension string) (map[string]int, error) {
+	if !slices.Contains(dimensions, dimension) {
+		return nil, ErrUnknownDimension
+	}
+	values, err := r.client.HGetAll(context.Background(), redisClicksKey(shortened, dimension)).Result()
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(values))
+	for value, count := range values {
+		if counts[value], err = strconv.Atoi(count); err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
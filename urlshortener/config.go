@@ -0,0 +1,32 @@
+package urlshortener
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+func envInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		panic(fmt.Sprintf("invalid integer in %s: %s", key, value))
+	}
+	return i
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		panic(fmt.Sprintf("invalid duration in %s: %s", key, value))
+	}
+	return d
+}
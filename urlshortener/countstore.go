@@ -2,17 +2,16 @@ package urlshortener
 
 import (
 	"errors"
-	"fmt"
-	"os"
 
-	"gorm.io/driver/postgres"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type CountStorer interface {
 	Increment(url string) error
 	Get(url string) (int, error)
+	Set(url string, hits int) error
+	Delete(url string) error
 }
 
 type PGCountStore struct {
@@ -35,30 +34,23 @@ func (pcs *PGCountStore) Get(url string) (int, error) {
 	return row.Hits, tx.Error
 }
 
+func (pcs *PGCountStore) Set(url string, hits int) error {
+	return pcs.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&CountStoreRow{URL: url, Hits: hits}).Error
+}
+
+func (pcs *PGCountStore) Delete(url string) error {
+	return pcs.db.Delete(&CountStoreRow{}, "url = ?", url).Error
+}
+
 type CountStoreRow struct {
 	URL  string `gorm:"primaryKey"`
 	Hits int
 }
 
 func NewInMemoryCountStore() *PGCountStore {
-	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
-	if err != nil {
-		panic("failed to connect database")
-	}
-	err = db.AutoMigrate(&CountStoreRow{})
-	if err != nil {
-		panic("failed to migrate to schema")
-	}
-	return &PGCountStore{db: db}
+	return NewPGCountStoreFromDB(NewInMemoryDB())
 }
 
-func NewPGCountStore() *PGCountStore {
-	dsn := fmt.Sprintf("host=%s dbname=%s port=5432 user=%s password=%s",
-		os.Getenv("DB_HOST"), os.Getenv("DB_NAME"), os.Getenv("DB_USERNAME"), os.Getenv("DB_PASSWORD"))
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
-	if err != nil {
-		panic("failed to connect database")
-	}
-	_ = db.AutoMigrate(&CountStoreRow{})
+func NewPGCountStoreFromDB(db *gorm.DB) *PGCountStore {
 	return &PGCountStore{db: db}
 }
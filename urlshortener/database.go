@@ -0,0 +1,224 @@
+package urlshortener
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+)
+
+type PoolOptions struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	PrepareStmt     bool
+}
+
+func poolOptionsFromEnv() PoolOptions {
+	return PoolOptions{
+		MaxOpenConns:    envInt("DB_MAX_OPEN_CONNS", 25),
+		MaxIdleConns:    envInt("DB_MAX_IDLE_CONNS", 10),
+		ConnMaxLifetime: envDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute),
+		ConnMaxIdleTime: envDuration("DB_CONN_MAX_IDLE_TIME", 5*time.Minute),
+		PrepareStmt:     os.Getenv("DB_PREPARE_STMT") != "false",
+	}
+}
+
+func NewPGDB() *gorm.DB {
+	return NewPGDBWithOptions(poolOptionsFromEnv())
+}
+
+func NewPGDBWithOptions(options PoolOptions) *gorm.DB {
+	db, err := gorm.Open(postgres.Open(pgDSN(os.Getenv("DB_HOST"))), &gorm.Config{PrepareStmt: options.PrepareStmt, TranslateError: true})
+	if err != nil {
+		panic("failed to connect database")
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		panic("failed to access database pool")
+	}
+	sqlDB.SetMaxOpenConns(options.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(options.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(options.ConnMaxLifetime)
+	sqlDB.SetConnMaxIdleTime(options.ConnMaxIdleTime)
+	var replicas []gorm.Dialector
+	for _, dsn := range replicaDSNsFromEnv() {
+		replicas = append(replicas, postgres.Open(dsn))
+	}
+	if len(replicas) > 0 {
+		registerReadReplicas(db, replicas, options)
+	}
+	return db
+}
+
+func pgDSN(host string) string {
+	return fmt.Sprintf("host=%s dbname=%s port=5432 user=%s password=%s",
+		host, os.Getenv("DB_NAME"), os.Getenv("DB_USERNAME"), os.Getenv("DB_PASSWORD"))
+}
+
+// replicaDSNsFromEnv reads DB_REPLICA_DSNS, a semicolon separated list of
+// connection strings for replicas with their own credentials or database
+// name, and DB_REPLICA_HOSTS, a comma separated list of hosts sharing those
+// of the primary.
+func replicaDSNsFromEnv() []string {
+	var dsns []string
+	for _, dsn := range strings.Split(os.Getenv("DB_REPLICA_DSNS"), ";") {
+		if dsn = strings.TrimSpace(dsn); dsn != "" {
+			dsns = append(dsns, dsn)
+		}
+	}
+	for _, host := range strings.Split(os.Getenv("DB_REPLICA_HOSTS"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			dsns = append(dsns, pgDSN(host))
+		}
+	}
+	return dsns
+}
+
+func registerReadReplicas(db *gorm.DB, replicas []gorm.Dialector, options PoolOptions) {
+	resolver := dbresolver.Register(dbresolver.Config{
+		Replicas: replicas,
+		Policy:   dbresolver.RandomPolicy{},
+	}).
+		SetMaxOpenConns(options.MaxOpenConns).
+		SetMaxIdleConns(options.MaxIdleConns).
+		SetConnMaxLifetime(options.ConnMaxLifetime).
+		SetConnMaxIdleTime(options.ConnMaxIdleTime)
+	if err := db.Use(resolver); err != nil {
+		panic("failed to connect read replicas")
+	}
+}
+
+func hasReadReplicas(db *gorm.DB) bool {
+	_, ok := db.Config.Plugins[(&dbresolver.DBResolver{}).Name()]
+	return ok
+}
+
+// NewInMemoryDB keeps a single connection open: every new connection to
+// "file::memory:" would otherwise see its own empty database.
+func NewInMemoryDB() *gorm.DB {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{TranslateError: true})
+	if err != nil {
+		panic("failed to connect database")
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		panic("failed to access database pool")
+	}
+	sqlDB.SetMaxOpenConns(1)
+	sqlDB.SetConnMaxLifetime(0)
+	sqlDB.SetConnMaxIdleTime(0)
+	mustMigrate(db)
+	return db
+}
+
+type Transactor interface {
+	Transaction(f func(store Storer, countStore CountStorer) error) error
+}
+
+type PGTransactor struct {
+	db     *gorm.DB
+	cache  *CachedStore
+	cipher *URLCipher
+}
+
+// NewPGTransactor takes the cache in front of the main store, if any. Reads
+// in a transaction bypass it, and the codes written in a transaction are
+// invalidated once it is over.
+func NewPGTransactor(db *gorm.DB, cache *CachedStore) *PGTransactor {
+	return &PGTransactor{db: db, cache: cache}
+}
+
+// WithCipher encrypts the destinations saved in transactions.
+func (t *PGTransactor) WithCipher(cipher *URLCipher) {
+	t.cipher = cipher
+}
+
+func (t *PGTransactor) Transaction(f func(store Storer, countStore CountStorer) error) error {
+	written := &writtenCodes{}
+	err := t.db.Transaction(func(tx *gorm.DB) error {
+		store := NewPGStoreFromDB(tx)
+		store.WithCipher(t.cipher)
+		written.Storer = store
+		return f(written, NewPGCountStoreFromDB(tx))
+	})
+	if t.cache != nil {
+		for _, shortened := range written.codes {
+			t.cache.invalidate(shortened)
+		}
+	}
+	return err
+}
+
+type PGLinkExporter struct {
+	db     *gorm.DB
+	cipher *URLCipher
+}
+
+func NewPGLinkExporter(db *gorm.DB) *PGLinkExporter {
+	return &PGLinkExporter{db: db}
+}
+
+// WithCipher decrypts the exported destinations.
+func (e *PGLinkExporter) WithCipher(cipher *URLCipher) {
+	e.cipher = cipher
+}
+
+type exportRow struct {
+	URLAssociation
+	Hits sql.NullInt64
+}
+
+func (e *PGLinkExporter) ExportLinks(workspaceID string, f func(LinkRecord) error) error {
+	query := e.db.Model(&URLAssociation{}).
+		Select("url_associations.*, count_store_rows.hits").
+		Joins("LEFT JOIN count_store_rows ON count_store_rows.url = url_associations.shortened").
+		Order("url_associations.shortened")
+	if workspaceID != "" {
+		query = query.Where("url_associations.workspace_id = ?", workspaceID)
+	}
+	rows, err := query.Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row exportRow
+		if err := e.db.ScanRows(rows, &row); err != nil {
+			return err
+		}
+		destination, err := decryptURL(e.cipher, row.URL)
+		if err != nil {
+			return fmt.Errorf("%s: %w", row.Shortened, err)
+		}
+		row.URL = destination
+		record := LinkRecord{Shortened: row.Shortened, URL: row.URL, Hits: int(row.Hits.Int64), Options: row.Options,
+			Targets: row.Targets, GeoTargets: row.GeoTargets, Variants: row.Variants,
+			Workspace: exportedWorkspace(row.WorkspaceID), CreatedBy: row.CreatedBy}
+		if row.Expiration.Valid {
+			record.Expiration = &row.Expiration.Time
+		}
+		if err := f(record); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// sequentialTransactor runs operations directly against stores that cannot
+// share a transaction; a failure part way leaves earlier writes in place.
+type sequentialTransactor struct {
+	store      Storer
+	countStore CountStorer
+}
+
+func (t sequentialTransactor) Transaction(f func(store Storer, countStore CountStorer) error) error {
+	return f(t.store, t.countStore)
+}
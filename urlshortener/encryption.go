@@ -0,0 +1,340 @@
+package urlshortener
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+)
+
+var ErrInvalidEncryptionKey = errors.New("invalid encryption key")
+var ErrUnknownEncryptionKey = errors.New("unknown encryption key")
+var ErrInvalidCiphertext = errors.New("invalid ciphertext")
+var ErrEncryptionDisabled = errors.New("encryption is not enabled")
+
+const (
+	// encryptedURLPrefix tells encrypted destinations apart from the ones
+	// stored before encryption was enabled, which are read as they are.
+	encryptedURLPrefix = "enc:v1:"
+	dataKeySize        = 32
+	minHashKeySize     = 32
+)
+
+// URLCipher encrypts destinations with envelope encryption: each destination
+// is sealed with AES-GCM under its own random data key, itself sealed under
+// a key-encryption key named by its key id. Rotating a key then only takes
+// sealing the data keys again.
+type URLCipher struct {
+	keys     map[string]cipher.AEAD
+	activeID string
+	hashKey  []byte
+}
+
+// NewURLCipher takes AES keys of 16, 24 or 32 bytes and a separate key for
+// the keyed hash of destinations, which stays the same across rotations.
+func NewURLCipher(activeID string, keys map[string][]byte, hashKey []byte) (*URLCipher, error) {
+	aeads := make(map[string]cipher.AEAD, len(keys))
+	for id, key := range keys {
+		if id == "" || strings.Trim(id, base62Digits) != "" {
+			return nil, fmt.Errorf("%w: key id %q is not alphanumeric", ErrInvalidEncryptionKey, id)
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: key %s: %s", ErrInvalidEncryptionKey, id, err)
+		}
+		aeads[id] = aead
+	}
+	if _, ok := aeads[activeID]; !ok {
+		return nil, fmt.Errorf("%w: unknown active key %q", ErrInvalidEncryptionKey, activeID)
+	}
+	if len(hashKey) < minHashKeySize {
+		return nil, fmt.Errorf("%w: hash key is shorter than %d bytes", ErrInvalidEncryptionKey, minHashKeySize)
+	}
+	return &URLCipher{keys: aeads, activeID: activeID, hashKey: hashKey}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrInvalidCiphertext
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	return plaintext, nil
+}
+
+// Encrypt returns enc:v1:<key id>:<sealed data key>:<sealed destination>.
+func (c *URLCipher) Encrypt(plaintext string) (string, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	sealedKey, err := c.sealDataKey(dataKey)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+	sealedURL, err := seal(aead, []byte(plaintext), nil)
+	if err != nil {
+		return "", err
+	}
+	return encryptedURLPrefix + c.activeID + ":" + sealedKey + ":" + base64.RawURLEncoding.EncodeToString(sealedURL), nil
+}
+
+// sealDataKey binds the data key to the key id it is sealed under.
+func (c *URLCipher) sealDataKey(dataKey []byte) (string, error) {
+	sealed, err := seal(c.keys[c.activeID], dataKey, []byte(c.activeID))
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+type encryptedURL struct {
+	keyID     string
+	sealedKey []byte
+	sealedURL []byte
+}
+
+func parseEncryptedURL(value string) (encryptedURL, error) {
+	parts := strings.Split(strings.TrimPrefix(value, encryptedURLPrefix), ":")
+	if len(parts) != 3 {
+		return encryptedURL{}, ErrInvalidCiphertext
+	}
+	sealedKey, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return encryptedURL{}, ErrInvalidCiphertext
+	}
+	sealedURL, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return encryptedURL{}, ErrInvalidCiphertext
+	}
+	return encryptedURL{keyID: parts[0], sealedKey: sealedKey, sealedURL: sealedURL}, nil
+}
+
+func (c *URLCipher) dataKey(encrypted encryptedURL) ([]byte, error) {
+	kek, ok := c.keys[encrypted.keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownEncryptionKey, encrypted.keyID)
+	}
+	return open(kek, encrypted.sealedKey, []byte(encrypted.keyID))
+}
+
+// Decrypt returns the destinations stored before encryption as they are.
+func (c *URLCipher) Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedURLPrefix) {
+		return value, nil
+	}
+	encrypted, err := parseEncryptedURL(value)
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := c.dataKey(encrypted)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(aead, encrypted.sealedURL, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Reencrypt encrypts plaintext destinations and seals again under the active
+// key the data keys sealed under other keys. It tells whether the value
+// changed.
+func (c *URLCipher) Reencrypt(value string) (string, bool, error) {
+	if !strings.HasPrefix(value, encryptedURLPrefix) {
+		encrypted, err := c.Encrypt(value)
+		return encrypted, err == nil, err
+	}
+	encrypted, err := parseEncryptedURL(value)
+	if err != nil {
+		return "", false, err
+	}
+	if encrypted.keyID == c.activeID {
+		return value, false, nil
+	}
+	dataKey, err := c.dataKey(encrypted)
+	if err != nil {
+		return "", false, err
+	}
+	sealedKey, err := c.sealDataKey(dataKey)
+	if err != nil {
+		return "", false, err
+	}
+	return encryptedURLPrefix + c.activeID + ":" + sealedKey + ":" +
+		base64.RawURLEncoding.EncodeToString(encrypted.sealedURL), true, nil
+}
+
+// Hash is a keyed hash of the destination, which finds and compares
+// destinations without decrypting them.
+func (c *URLCipher) Hash(plaintext string) string {
+	mac := hmac.New(sha256.New, c.hashKey)
+	mac.Write([]byte(plaintext))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// decryptURL fails on encrypted destinations when there is no cipher to
+// decrypt them.
+func decryptURL(c *URLCipher, value string) (string, error) {
+	if c == nil {
+		if strings.HasPrefix(value, encryptedURLPrefix) {
+			return "", ErrEncryptionDisabled
+		}
+		return value, nil
+	}
+	return c.Decrypt(value)
+}
+
+// urlCipherFromEnv reads URL_ENCRYPTION_KEYS, a comma separated list of
+// <key id>:<base64 key>, and encrypts with URL_ENCRYPTION_KEY_ID, the first
+// key by default. URL_HASH_KEY is the base64 key of the keyed hash.
+func urlCipherFromEnv() *URLCipher {
+	value := os.Getenv("URL_ENCRYPTION_KEYS")
+	if value == "" {
+		return nil
+	}
+	keys := map[string][]byte{}
+	activeID := os.Getenv("URL_ENCRYPTION_KEY_ID")
+	for _, entry := range strings.Split(value, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if !ok || err != nil {
+			panic(fmt.Sprintf("invalid key in URL_ENCRYPTION_KEYS: %q", id))
+		}
+		keys[id] = key
+		if activeID == "" {
+			activeID = id
+		}
+	}
+	hashKey, err := base64.StdEncoding.DecodeString(os.Getenv("URL_HASH_KEY"))
+	if err != nil {
+		panic("invalid URL_HASH_KEY")
+	}
+	c, err := NewURLCipher(activeID, keys, hashKey)
+	if err != nil {
+		panic(fmt.Sprintf("invalid URL_ENCRYPTION_KEYS: %s", err))
+	}
+	return c
+}
+
+// encryptedRow holds the encrypted columns of the tables keyed by code.
+type encryptedRow struct {
+	Shortened string
+	URL       string
+	URLHash   string
+	FinalURL  string
+}
+
+// reencryptTable re-encrypts the columns of the table batch by batch, filling
+// in the keyed hash of the url column if asked to, and returns how many rows
+// changed. A row written in the meantime is left as is: writes encrypt under
+// the active key already.
+func reencryptTable(db *gorm.DB, c *URLCipher, table string, batchSize int, hashed bool, columns ...string) (int, error) {
+	if c == nil {
+		return 0, ErrEncryptionDisabled
+	}
+	updated, last := 0, ""
+	for {
+		var rows []encryptedRow
+		err := db.Clauses(dbresolver.Write).Table(table).Where("shortened > ?", last).Order("shortened").
+			Limit(batchSize).Find(&rows).Error
+		if err != nil || len(rows) == 0 {
+			return updated, err
+		}
+		for _, row := range rows {
+			values := map[string]*string{"url": &row.URL, "final_url": &row.FinalURL}
+			changes := map[string]any{}
+			query := db.Table(table).Where("shortened = ?", row.Shortened)
+			for _, column := range columns {
+				value := *values[column]
+				if value == "" {
+					continue
+				}
+				reencrypted, changed, err := c.Reencrypt(value)
+				if err != nil {
+					return updated, fmt.Errorf("%s: %w", row.Shortened, err)
+				}
+				if changed {
+					changes[column] = reencrypted
+					query = query.Where(column+" = ?", value)
+				}
+			}
+			if hashed && row.URLHash == "" {
+				destination, err := c.Decrypt(row.URL)
+				if err != nil {
+					return updated, fmt.Errorf("%s: %w", row.Shortened, err)
+				}
+				changes["url_hash"] = c.Hash(destination)
+			}
+			if len(changes) == 0 {
+				continue
+			}
+			result := query.Updates(changes)
+			if result.Error != nil {
+				return updated, result.Error
+			}
+			updated += int(result.RowsAffected)
+		}
+		last = rows[len(rows)-1].Shortened
+	}
+}
+
+// ReencryptDestinations encrypts under the active key of URL_ENCRYPTION_KEYS
+// the destinations stored in plaintext or under other keys, so that those
+// keys can be removed. It returns how many rows changed.
+func ReencryptDestinations(db *gorm.DB, batchSize int) (int, error) {
+	c := urlCipherFromEnv()
+	store := NewPGStoreFromDB(db)
+	store.WithCipher(c)
+	links, err := store.Reencrypt(batchSize)
+	if err != nil {
+		return links, err
+	}
+	health := NewPGLinkHealthStoreFromDB(db)
+	health.WithCipher(c)
+	checks, err := health.Reencrypt(batchSize)
+	return links + checks, err
+}
+
+// FindLinks returns the codes of the links to the destination.
+func FindLinks(db *gorm.DB, destination string) ([]string, error) {
+	store := NewPGStoreFromDB(db)
+	store.WithCipher(urlCipherFromEnv())
+	return store.Find(destination)
+}
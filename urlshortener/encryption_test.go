@@ -0,0 +1,207 @@
+package urlshortener
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func newTestURLCipher(t *testing.T, activeID string, ids ...string) *URLCipher {
+	keys := map[string][]byte{}
+	for _, id := range ids {
+		keys[id] = newTestKey(id[len(id)-1])
+	}
+	c, err := NewURLCipher(activeID, keys, newTestKey('h'))
+	require.NoError(t, err)
+	return c
+}
+
+func TestURLCipher(t *testing.T) {
+	c := newTestURLCipher(t, "k1", "k1")
+	destination := "https://example.com/reset?token=secret"
+	encrypted, err := c.Encrypt(destination)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encrypted, "enc:v1:k1:"))
+	assert.NotContains(t, encrypted, "secret")
+	again, err := c.Encrypt(destination)
+	require.NoError(t, err)
+	assert.NotEqual(t, encrypted, again, "each destination gets its own data key and nonce")
+	decrypted, err := c.Decrypt(encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, destination, decrypted)
+	decrypted, err = c.Decrypt(destination)
+	require.NoError(t, err)
+	assert.Equal(t, destination, decrypted, "destinations stored before encryption are read as they are")
+
+	tampered := encrypted[:len(encrypted)-2] + "AA"
+	if tampered == encrypted {
+		tampered = encrypted[:len(encrypted)-2] + "BB"
+	}
+	_, err = c.Decrypt(tampered)
+	assert.ErrorIs(t, err, ErrInvalidCiphertext)
+	_, err = c.Decrypt("enc:v1:k1:garbage")
+	assert.ErrorIs(t, err, ErrInvalidCiphertext)
+	_, err = c.Decrypt(strings.Replace(encrypted, ":k1:", ":k2:", 1))
+	assert.ErrorIs(t, err, ErrUnknownEncryptionKey)
+	_, err = decryptURL(nil, encrypted)
+	assert.ErrorIs(t, err, ErrEncryptionDisabled)
+
+	rotated := newTestURLCipher(t, "k2", "k1", "k2")
+	_, err = rotated.Decrypt(strings.Replace(encrypted, ":k1:", ":k2:", 1))
+	assert.ErrorIs(t, err, ErrInvalidCiphertext, "data keys are bound to the key id sealing them")
+	reencrypted, changed, err := rotated.Reencrypt(encrypted)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.True(t, strings.HasPrefix(reencrypted, "enc:v1:k2:"))
+	assert.Equal(t, encrypted[strings.LastIndex(encrypted, ":"):], reencrypted[strings.LastIndex(reencrypted, ":"):],
+		"only the data key is sealed again")
+	_, changed, err = rotated.Reencrypt(reencrypted)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	decrypted, err = newTestURLCipher(t, "k2", "k2").Decrypt(reencrypted)
+	require.NoError(t, err)
+	assert.Equal(t, destination, decrypted)
+
+	assert.Equal(t, c.Hash(destination), rotated.Hash(destination), "hashes survive key rotations")
+	assert.NotEqual(t, c.Hash(destination), c.Hash("https://example.com/"))
+	otherHashKey, err := NewURLCipher("k1", map[string][]byte{"k1": newTestKey(1)}, newTestKey('o'))
+	require.NoError(t, err)
+	assert.NotEqual(t, c.Hash(destination), otherHashKey.Hash(destination))
+
+	_, err = NewURLCipher("k1", map[string][]byte{"k1": []byte("short")}, newTestKey('h'))
+	assert.ErrorIs(t, err, ErrInvalidEncryptionKey)
+	_, err = NewURLCipher("k:1", map[string][]byte{"k:1": newTestKey(1)}, newTestKey('h'))
+	assert.ErrorIs(t, err, ErrInvalidEncryptionKey)
+	_, err = NewURLCipher("k2", map[string][]byte{"k1": newTestKey(1)}, newTestKey('h'))
+	assert.ErrorIs(t, err, ErrInvalidEncryptionKey)
+	_, err = NewURLCipher("k1", map[string][]byte{"k1": newTestKey(1)}, []byte("short"))
+	assert.ErrorIs(t, err, ErrInvalidEncryptionKey)
+}
+
+func storedURL(t *testing.T, db *gorm.DB, shortened string) string {
+	var association URLAssociation
+	require.NoError(t, db.First(&association, "shortened = ?", shortened).Error)
+	return association.URL
+}
+
+func TestEncryptedPGStore(t *testing.T) {
+	db := NewInMemoryDB()
+	plain := NewPGStoreFromDB(db)
+	require.NoError(t, plain.Save(NewURLAssociation("https://example.com/legacy?token=old", "legacy", nil)))
+	store := NewPGStoreFromDB(db)
+	store.WithCipher(newTestURLCipher(t, "k1", "k1"))
+
+	require.NoError(t, store.Save(NewURLAssociation("https://example.com/reset?token=secret", "reset", nil)))
+	assert.True(t, strings.HasPrefix(storedURL(t, db, "reset"), encryptedURLPrefix))
+	u, err := store.Get("reset")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/reset?token=secret", u.String())
+	u, err = store.Get("legacy")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/legacy?token=old", u.String())
+	_, err = plain.Get("reset")
+	assert.ErrorIs(t, err, ErrEncryptionDisabled)
+
+	require.NoError(t, store.Update("reset", func(association *URLAssociation) error {
+		assert.Equal(t, "https://example.com/reset?token=secret", association.URL)
+		association.Quarantined = true
+		return nil
+	}))
+	u, err = store.Get("reset")
+	require.NoError(t, err)
+	assert.True(t, u.Quarantined())
+	assert.True(t, strings.HasPrefix(storedURL(t, db, "reset"), encryptedURLPrefix))
+
+	stored, _, err := store.SaveBatch([]URLAssociation{
+		NewURLAssociation("https://example.com/reset?token=secret", "reset", nil),
+		NewURLAssociation("https://example.com/other", "legacy", nil),
+		NewURLAssociation("https://example.com/new", "new", nil)})
+	require.NoError(t, err)
+	destinations := map[string]string{}
+	for _, association := range stored {
+		destinations[association.Shortened] = association.URL
+	}
+	assert.Equal(t, map[string]string{"reset": "https://example.com/reset?token=secret",
+		"legacy": "https://example.com/legacy?token=old", "new": "https://example.com/new"}, destinations)
+
+	codes, err := store.Find("https://example.com/reset?token=secret")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"reset"}, codes)
+	codes, err = store.Find("https://example.com/legacy?token=old")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"legacy"}, codes, "plaintext destinations are found until they are encrypted")
+
+	var records []LinkRecord
+	exporter := NewPGLinkExporter(db)
+	exporter.WithCipher(store.cipher)
+	require.NoError(t, exporter.ExportLinks("", func(record LinkRecord) error {
+		records = append(records, record)
+		return nil
+	}))
+	require.Len(t, records, 3)
+	assert.Equal(t, "https://example.com/reset?token=secret", records[2].URL)
+
+	updated, err := store.Reencrypt(2)
+	require.NoError(t, err)
+	assert.Equal(t, 1, updated, "only the plaintext destination changes")
+	assert.True(t, strings.HasPrefix(storedURL(t, db, "legacy"), encryptedURLPrefix))
+	codes, err = store.Find("https://example.com/legacy?token=old")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"legacy"}, codes, "re-encrypted destinations are found through their hash")
+
+	rotated := NewPGStoreFromDB(db)
+	rotated.WithCipher(newTestURLCipher(t, "k2", "k1", "k2"))
+	updated, err = rotated.Reencrypt(2)
+	require.NoError(t, err)
+	assert.Equal(t, 3, updated)
+	retired := NewPGStoreFromDB(db)
+	retired.WithCipher(newTestURLCipher(t, "k2", "k2"))
+	for _, code := range []string{"legacy", "reset", "new"} {
+		_, err := retired.Get(code)
+		assert.NoError(t, err, code)
+	}
+	_, err = plain.Reencrypt(10)
+	assert.ErrorIs(t, err, ErrEncryptionDisabled)
+}
+
+func TestEncryptedApplication(t *testing.T) {
+	t.Setenv("URL_ENCRYPTION_KEYS", "k1:"+base64.StdEncoding.EncodeToString(newTestKey(1)))
+	t.Setenv("URL_HASH_KEY", base64.StdEncoding.EncodeToString(newTestKey('h')))
+	infra := NewInMemoryInfrastructure()
+	app := NewApplicationFromInfrastructure(infra)
+	db := infra.store.(*PGStore).db
+
+	shortened, err := app.Shorten("https://example.com/reset?token=secret", nil)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(storedURL(t, db, shortened), encryptedURLPrefix))
+	redirect, err := app.Resolve(shortened, Visitor{})
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/reset?token=secret", redirect.Location)
+	results, err := app.ShortenBatch([]ShortenRequest{{URL: "https://example.com/reset?token=secret"}})
+	require.NoError(t, err)
+	assert.Equal(t, []ShortenResult{{Shortened: shortened}}, results, "the batch dedupes the existing link")
+	codes, err := FindLinks(db, "https://example.com/reset?token=secret")
+	require.NoError(t, err)
+	assert.Equal(t, []string{shortened}, codes)
+
+	require.NoError(t, infra.linkHealth.Save(LinkHealth{Shortened: shortened, WorkspaceID: DefaultWorkspace,
+		URL: "https://example.com/reset?token=secret", FinalURL: "https://example.com/login?token=secret", Broken: true}))
+	var raw LinkHealth
+	require.NoError(t, db.First(&raw, "shortened = ?", shortened).Error)
+	assert.NotContains(t, raw.URL+raw.FinalURL, "secret")
+	broken, err := infra.linkHealth.Broken("")
+	require.NoError(t, err)
+	require.Len(t, broken, 1)
+	assert.Equal(t, "https://example.com/login?token=secret", broken[0].FinalURL)
+
+	t.Setenv("URL_ENCRYPTION_KEYS", "k2:"+base64.StdEncoding.EncodeToString(newTestKey(2))+
+		",k1:"+base64.StdEncoding.EncodeToString(newTestKey(1)))
+	updated, err := ReencryptDestinations(db, 100)
+	require.NoError(t, err)
+	assert.Equal(t, 2, updated, "links and link checks are re-encrypted")
+	assert.True(t, strings.HasPrefix(storedURL(t, db, shortened), encryptedURLPrefix+"k2:"))
+}
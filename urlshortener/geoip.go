@@ -0,0 +1,206 @@
+package urlshortener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+var ErrNoGeoIPDatabase = errors.New("no GeoIP database loaded")
+
+type CountryResolver interface {
+	Country(ip netip.Addr) (string, error)
+}
+
+// MMDBCountryResolver looks countries up in a MaxMind-format database that is
+// read fully in memory so that the file can be replaced while serving.
+type MMDBCountryResolver struct {
+	path     string
+	reader   atomic.Pointer[maxminddb.Reader]
+	mutex    sync.Mutex
+	modified time.Time
+}
+
+type mmdbCountryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+func NewMMDBCountryResolver(path string) (*MMDBCountryResolver, error) {
+	r := &MMDBCountryResolver{path: path}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the database again if the file changed since the last load.
+func (r *MMDBCountryResolver) Reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return err
+	}
+	if r.reader.Load() != nil && info.ModTime().Equal(r.modified) {
+		return nil
+	}
+	content, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	reader, err := maxminddb.FromBytes(content)
+	if err != nil {
+		return err
+	}
+	r.reader.Store(reader)
+	r.modified = info.ModTime()
+	return nil
+}
+
+// Watch reloads the database every interval until the context is done; a
+// broken file keeps the previously loaded database in use.
+func (r *MMDBCountryResolver) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_ = r.Reload()
+		}
+	}
+}
+
+func (r *MMDBCountryResolver) Country(ip netip.Addr) (string, error) {
+	reader := r.reader.Load()
+	if reader == nil {
+		return "", ErrNoGeoIPDatabase
+	}
+	var record mmdbCountryRecord
+	if err := reader.Lookup(net.IP(ip.Unmap().AsSlice()), &record); err != nil {
+		return "", err
+	}
+	return record.Country.ISOCode, nil
+}
+
+// VisitorExtractor builds the Visitor of a redirect request.
+type VisitorExtractor struct {
+	countries      CountryResolver
+	trustedProxies []netip.Prefix
+}
+
+func NewVisitorExtractor(countries CountryResolver, trustedProxies []netip.Prefix) *VisitorExtractor {
+	return &VisitorExtractor{countries: countries, trustedProxies: trustedProxies}
+}
+
+// NewVisitorExtractorFromEnv resolves countries with the GeoIP database of
+// GEOIP_DB_PATH, if any, behind the proxies of TRUSTED_PROXIES.
+func NewVisitorExtractorFromEnv() *VisitorExtractor {
+	proxies, err := ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		panic(err.Error())
+	}
+	path := os.Getenv("GEOIP_DB_PATH")
+	if path == "" {
+		return NewVisitorExtractor(nil, proxies)
+	}
+	countries, err := NewMMDBCountryResolver(path)
+	if err != nil {
+		panic(fmt.Sprintf("failed to load GeoIP database: %s", err))
+	}
+	return NewVisitorExtractor(countries, proxies)
+}
+
+// watchGeoIPFromEnv reloads the GeoIP database of the extractor, if any,
+// every GEOIP_RELOAD_INTERVAL until the context is done.
+func watchGeoIPFromEnv(ctx context.Context, visitors *VisitorExtractor) {
+	if countries, ok := visitors.countries.(*MMDBCountryResolver); ok {
+		go countries.Watch(ctx, envDuration("GEOIP_RELOAD_INTERVAL", time.Minute))
+	}
+}
+
+// ParseTrustedProxies reads a comma separated list of addresses or CIDR ranges.
+func ParseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", field, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", field, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func (e *VisitorExtractor) Visitor(request *http.Request) Visitor {
+	visitor := Visitor{
+		Platform:  platformFromUserAgent(request.UserAgent()),
+		Languages: languagesFromHeader(request.Header.Get("Accept-Language")),
+	}
+	visitor.ID, visitor.identified = e.visitorID(request)
+	if e.countries != nil {
+		if ip, ok := e.clientIP(request); ok {
+			visitor.Country, _ = e.countries.Country(ip)
+		}
+	}
+	return visitor
+}
+
+func (e *VisitorExtractor) trusted(ip netip.Addr) bool {
+	for _, prefix := range e.trustedProxies {
+		if prefix.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP walks X-Forwarded-For from the closest hop and stops at the first
+// address that is not a trusted proxy, which cannot have been forged by it.
+func (e *VisitorExtractor) clientIP(request *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	var hops []string
+	for _, header := range request.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0 && e.trusted(ip); i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		ip = hop
+	}
+	return ip.Unmap(), true
+}
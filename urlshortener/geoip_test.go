@@ -0,0 +1,125 @@
+package urlshortener
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestMMDB(t *testing.T, path string, networks map[string]string) {
+	tree, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: "GeoIP2-Country", RecordSize: 24})
+	require.NoError(t, err)
+	for cidr, country := range networks {
+		_, network, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		require.NoError(t, tree.Insert(network, mmdbtype.Map{
+			"country": mmdbtype.Map{"iso_code": mmdbtype.String(country)},
+		}))
+	}
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	defer file.Close()
+	_, err = tree.WriteTo(file)
+	require.NoError(t, err)
+}
+
+func TestMMDBCountryResolverReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	writeTestMMDB(t, path, map[string]string{"1.2.3.0/24": "FR"})
+	resolver, err := NewMMDBCountryResolver(path)
+	require.NoError(t, err)
+
+	country, err := resolver.Country(netip.MustParseAddr("1.2.3.4"))
+	require.NoError(t, err)
+	assert.Equal(t, "FR", country)
+	country, err = resolver.Country(netip.MustParseAddr("::ffff:5.6.7.8"))
+	require.NoError(t, err)
+	assert.Empty(t, country)
+
+	writeTestMMDB(t, path, map[string]string{"1.2.3.0/24": "BE"})
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	require.NoError(t, resolver.Reload())
+	country, err = resolver.Country(netip.MustParseAddr("1.2.3.4"))
+	require.NoError(t, err)
+	assert.Equal(t, "BE", country)
+
+	require.NoError(t, os.WriteFile(path, []byte("corrupted"), 0o644))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute)))
+	assert.Error(t, resolver.Reload())
+	country, _ = resolver.Country(netip.MustParseAddr("1.2.3.4"))
+	assert.Equal(t, "BE", country)
+}
+
+func TestVisitorClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	require.NoError(t, err)
+	extractor := NewVisitorExtractor(nil, proxies)
+
+	for _, test := range []struct {
+		remoteAddr   string
+		forwardedFor string
+		expected     string
+	}{
+		{"203.0.113.9:1234", "1.2.3.4", "203.0.113.9"},
+		{"10.1.1.1:1234", "1.2.3.4", "1.2.3.4"},
+		{"10.1.1.1:1234", "6.6.6.6, 1.2.3.4, 192.0.2.1", "1.2.3.4"},
+		{"10.1.1.1:1234", "", "10.1.1.1"},
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/u/abc", nil)
+		request.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			request.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		ip, ok := extractor.clientIP(request)
+		require.True(t, ok)
+		assert.Equal(t, test.expected, ip.String())
+	}
+
+	_, err = ParseTrustedProxies("10.0.0.0/99")
+	assert.Error(t, err)
+}
+
+func TestHTTPGeoTargets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	writeTestMMDB(t, path, map[string]string{"1.2.3.0/24": "FR", "5.6.7.0/24": "DE"})
+	t.Setenv("GEOIP_DB_PATH", path)
+	t.Setenv("TRUSTED_PROXIES", "192.0.2.0/24")
+	app := NewInMemoryApplication()
+	t.Cleanup(app.Close)
+
+	short, err := app.ShortenWithOptions(ShortenRequest{URL: "https://example.com/en", Options: LinkOptions{RedirectStatus: 308},
+		GeoTargets: map[string]string{"FR": "https://example.com/fr", "DE": "https://example.com/de"}})
+	require.NoError(t, err)
+
+	for forwardedFor, location := range map[string]string{
+		"1.2.3.4": "https://example.com/fr",
+		"5.6.7.8": "https://example.com/de",
+		"8.8.8.8": "https://example.com/en",
+	} {
+		request := httptest.NewRequest(http.MethodGet, short, nil)
+		request.Header.Set("X-Forwarded-For", forwardedFor)
+		recorder := handle(app, request)
+		assert.Equal(t, location, recorder.Header().Get("Location"))
+		assert.Equal(t, "private, max-age=86400", recorder.Header().Get("Cache-Control"))
+	}
+
+	counts, err := app.Clicks(short, "country")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"FR": 1, "DE": 1, "": 1}, counts)
+	counts, err = app.Clicks(short, "rule")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"country-FR": 1, "country-DE": 1, "default": 1}, counts)
+
+	_, err = app.ShortenWithOptions(ShortenRequest{URL: "https://example.com/en", GeoTargets: map[string]string{"fr": "https://example.com/fr"}})
+	assert.ErrorIs(t, err, ErrInvalidTarget)
+}
@@ -0,0 +1,81 @@
+package urlshortener
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const maxImportBodySize = 64 << 20
+
+func withImportHandler(a *ArchiveUsecase, mws ...middleware) muxModifier {
+	return func(mux *http.ServeMux) *http.ServeMux {
+		handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			query := request.URL.Query()
+			reader, err := NewLinkRecordReader(query.Get("format"), http.MaxBytesReader(writer, request.Body, maxImportBodySize))
+			if err != nil {
+				writeError(writer, http.StatusBadRequest, err)
+				return
+			}
+			policy, err := ParseConflictPolicy(query.Get("policy"))
+			if err != nil {
+				writeError(writer, http.StatusBadRequest, err)
+				return
+			}
+			report, err := actingAs(a, request).Import(reader, ImportOptions{Policy: policy, DryRun: query.Get("dry_run") == "true"})
+			writer.Header().Set("Content-Type", "application/json")
+			var tooLarge *http.MaxBytesError
+			switch {
+			case err == nil:
+			case errors.Is(err, ErrForbidden):
+				writeError(writer, http.StatusForbidden, err)
+				return
+			case errors.Is(err, ErrConflict):
+				writer.WriteHeader(http.StatusConflict)
+			case errors.As(err, &tooLarge):
+				writer.WriteHeader(http.StatusRequestEntityTooLarge)
+			case errors.Is(err, ErrCorruptedStream):
+				writer.WriteHeader(http.StatusBadRequest)
+			default:
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_ = json.NewEncoder(writer).Encode(report)
+		})
+		mux.Handle("POST /api/v1/links:import", middlewares(mws).Handler(handler))
+		return mux
+	}
+}
+
+func withExportHandler(a *ArchiveUsecase, mws ...middleware) muxModifier {
+	return func(mux *http.ServeMux) *http.ServeMux {
+		handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			format := request.URL.Query().Get("format")
+			recordWriter, err := NewLinkRecordWriter(format, writer)
+			if err != nil {
+				writeError(writer, http.StatusBadRequest, err)
+				return
+			}
+			if format == "csv" {
+				writer.Header().Set("Content-Type", "text/csv")
+			} else {
+				writer.Header().Set("Content-Type", "application/x-ndjson")
+			}
+			// the export is authorized before any record is written; once
+			// streaming starts the status is sent, errors can only cut the body short
+			_, err = actingAs(a, request).Export(recordWriter)
+			if errors.Is(err, ErrForbidden) {
+				writer.Header().Set("Content-Type", "application/json")
+				writeError(writer, http.StatusForbidden, err)
+			}
+		})
+		mux.Handle("GET /api/v1/links:export", middlewares(mws).Handler(handler))
+		return mux
+	}
+}
+
+func writeError(writer http.ResponseWriter, status int, err error) {
+	writer.WriteHeader(status)
+	_, _ = writer.Write([]byte(fmt.Sprintf(`{"error": "%s"}`, err.Error())))
+}
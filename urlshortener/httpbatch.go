@@ -0,0 +1,139 @@
+package urlshortener
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+)
+
+var ErrInvalidBatch = errors.New("invalid batch")
+var ErrInvalidBatchItem = errors.New("invalid batch item")
+var ErrBatchTooLarge = errors.New("batch too large")
+
+const (
+	maxBatchItems    = 10000
+	maxBatchBodySize = 16 << 20
+)
+
+type batchItem struct {
+	URL        string            `json:"url"`
+	Expiration *time.Time        `json:"expiration,omitempty"`
+	Campaign   string            `json:"campaign,omitempty"`
+	Targets    []Target          `json:"targets,omitempty"`
+	GeoTargets map[string]string `json:"geo_targets,omitempty"`
+	Variants   []Variant         `json:"variants,omitempty"`
+	Signed     bool              `json:"signed,omitempty"`
+	LinkOptions
+	UTMParams
+}
+
+type batchItemResult struct {
+	URL       string `json:"url"`
+	Shortened string `json:"shortened,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Results []batchItemResult `json:"results"`
+}
+
+func withBatchShortenerHandler(u *Usecase, mws ...middleware) muxModifier {
+	return func(mux *http.ServeMux) *http.ServeMux {
+		handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			rawItems, err := decodeBatch(writer, request)
+			if err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				_, _ = writer.Write([]byte(fmt.Sprintf(`{"error": "%s"}`, err.Error())))
+				return
+			}
+
+			results := make([]batchItemResult, len(rawItems))
+			requests := make([]ShortenRequest, 0, len(rawItems))
+			indexes := make([]int, 0, len(rawItems))
+			for i, raw := range rawItems {
+				var item batchItem
+				if err := json.Unmarshal(raw, &item); err != nil {
+					results[i].Error = ErrInvalidBatchItem.Error()
+					continue
+				}
+				results[i].URL = item.URL
+				requests = append(requests, ShortenRequest{URL: item.URL, Expiration: item.Expiration, Options: item.LinkOptions,
+					Campaign: item.Campaign, UTM: item.UTMParams, Targets: item.Targets,
+					GeoTargets: item.GeoTargets, Variants: item.Variants, Signed: item.Signed})
+				indexes = append(indexes, i)
+			}
+
+			shortened, err := actingAs(u, request).ShortenBatch(requests)
+			if errors.Is(err, ErrForbidden) {
+				writeError(writer, http.StatusForbidden, err)
+				return
+			}
+			if err != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			for j, result := range shortened {
+				if result.Err != nil {
+					results[indexes[j]].Error = result.Err.Error()
+					continue
+				}
+				results[indexes[j]].Shortened = result.Shortened
+			}
+
+			writer.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(writer).Encode(batchResponse{Results: results})
+		})
+		mux.Handle("POST /api/v1/links:batch", middlewares(mws).Handler(handler))
+		return mux
+	}
+}
+
+// decodeBatch accepts either a JSON array or a stream of newline-delimited
+// JSON objects, depending on the request content type, of at most
+// maxBatchBodySize bytes.
+func decodeBatch(writer http.ResponseWriter, request *http.Request) ([]json.RawMessage, error) {
+	decoder := json.NewDecoder(http.MaxBytesReader(writer, request.Body, maxBatchBodySize))
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	var items []json.RawMessage
+	if mediaType == "application/x-ndjson" {
+		for {
+			var raw json.RawMessage
+			err := decoder.Decode(&raw)
+			if errors.Is(err, io.EOF) {
+				return items, nil
+			}
+			if err != nil {
+				return nil, batchError(err)
+			}
+			if items = append(items, raw); len(items) > maxBatchItems {
+				return nil, ErrBatchTooLarge
+			}
+		}
+	}
+
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return nil, batchError(err)
+	}
+	for decoder.More() {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return nil, batchError(err)
+		}
+		if items = append(items, raw); len(items) > maxBatchItems {
+			return nil, ErrBatchTooLarge
+		}
+	}
+	return items, nil
+}
+
+func batchError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return ErrBatchTooLarge
+	}
+	return ErrInvalidBatch
+}
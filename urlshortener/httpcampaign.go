@@ -0,0 +1,70 @@
+package urlshortener
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+type campaignsResponse struct {
+	Campaigns []Campaign `json:"campaigns"`
+}
+
+// withCampaignHandlers takes the middlewares of the write, read and stats
+// routes.
+func withCampaignHandlers(c *CampaignUsecase, write, read, stats []middleware) muxModifier {
+	return func(mux *http.ServeMux) *http.ServeMux {
+		save := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			var campaign Campaign
+			if err := json.NewDecoder(request.Body).Decode(&campaign); err != nil {
+				writeError(writer, http.StatusBadRequest, ErrInvalidCampaign)
+				return
+			}
+			err := actingAs(c, request).SaveCampaign(campaign)
+			switch {
+			case errors.Is(err, ErrInvalidCampaign):
+				writeError(writer, http.StatusBadRequest, err)
+			case errors.Is(err, ErrForbidden):
+				writeError(writer, http.StatusForbidden, err)
+				return
+			case err != nil:
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			writer.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(writer).Encode(campaign)
+		})
+		list := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			campaigns, err := actingAs(c, request).Campaigns()
+			if errors.Is(err, ErrForbidden) {
+				writeError(writer, http.StatusForbidden, err)
+				return
+			}
+			if err != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			writer.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(writer).Encode(campaignsResponse{Campaigns: campaigns})
+		})
+		campaignStats := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			stats, err := actingAs(c, request).CampaignStats(request.PathValue("name"))
+			switch {
+			case errors.Is(err, ErrCampaignNotFound):
+				writeError(writer, http.StatusNotFound, err)
+			case errors.Is(err, ErrForbidden):
+				writeError(writer, http.StatusForbidden, err)
+				return
+			case err != nil:
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			writer.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(writer).Encode(stats)
+		})
+		mux.Handle("POST /api/v1/campaigns", middlewares(write).Handler(save))
+		mux.Handle("GET /api/v1/campaigns", middlewares(read).Handler(list))
+		mux.Handle("GET /api/v1/campaigns/{name}/stats", middlewares(stats).Handler(campaignStats))
+		return mux
+	}
+}
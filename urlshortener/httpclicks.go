@@ -0,0 +1,43 @@
+package urlshortener
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+type clicksResponse struct {
+	Shortened string         `json:"shortened"`
+	By        string         `json:"by"`
+	Counts    map[string]int `json:"counts"`
+}
+
+func withClicksHandler(u *CountingUsecase, mws ...middleware) muxModifier {
+	return func(mux *http.ServeMux) *http.ServeMux {
+		handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			shortened := NewShortURL(request.PathValue("code")).String()
+			dimension := request.URL.Query().Get("by")
+			if dimension == "" {
+				dimension = "rule"
+			}
+			counts, err := actingAs(u, request).Clicks(shortened, dimension)
+			switch {
+			case errors.Is(err, ErrUnknownDimension):
+				writeError(writer, http.StatusBadRequest, err)
+				return
+			case errors.Is(err, ErrNotFound):
+				writeError(writer, http.StatusNotFound, err)
+			case errors.Is(err, ErrForbidden):
+				writeError(writer, http.StatusForbidden, err)
+				return
+			case err != nil:
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			writer.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(writer).Encode(clicksResponse{Shortened: shortened, By: dimension, Counts: counts})
+		})
+		mux.Handle("GET /api/v1/links/{code}/clicks", middlewares(mws).Handler(handler))
+		return mux
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-resty/resty/v2"
@@ -20,10 +22,62 @@ type shortenResponse struct {
 }
 
 func (c HTTPClient) Shorten(rawURL string, expiration *time.Time) (string, error) {
+	return c.ShortenWithOptions(ShortenRequest{URL: rawURL, Expiration: expiration})
+}
+
+func (c HTTPClient) ShortenWithOptions(shortenRequest ShortenRequest) (string, error) {
 	request := c.client.R().
-		SetQueryParam("url", url.QueryEscape(rawURL))
-	if expiration != nil {
-		request.SetQueryParam("expiration", url.QueryEscape(expiration.Format("2006-01-02_15:04:05")))
+		SetQueryParam("url", url.QueryEscape(shortenRequest.URL))
+	if shortenRequest.Expiration != nil {
+		request.SetQueryParam("expiration", url.QueryEscape(shortenRequest.Expiration.Format("2006-01-02_15:04:05")))
+	}
+	options := shortenRequest.Options
+	if options.RedirectStatus != 0 {
+		request.SetQueryParam("redirect_status", strconv.Itoa(options.RedirectStatus))
+	}
+	if options.ReferrerPolicy != "" {
+		request.SetQueryParam("referrer_policy", options.ReferrerPolicy)
+	}
+	if options.RobotsTag != "" {
+		request.SetQueryParam("robots_tag", options.RobotsTag)
+	}
+	if options.QueryPassthrough != QueryDrop {
+		request.SetQueryParam("query_passthrough", string(options.QueryPassthrough))
+	}
+	if options.PathPassthrough {
+		request.SetQueryParam("path_passthrough", "true")
+	}
+	if shortenRequest.Signed {
+		request.SetQueryParam("signed", "true")
+	}
+	if len(shortenRequest.Targets) > 0 {
+		targets, err := json.Marshal(shortenRequest.Targets)
+		if err != nil {
+			return "", err
+		}
+		request.SetQueryParam("targets", string(targets))
+	}
+	if len(shortenRequest.GeoTargets) > 0 {
+		geoTargets, err := json.Marshal(shortenRequest.GeoTargets)
+		if err != nil {
+			return "", err
+		}
+		request.SetQueryParam("geo_targets", string(geoTargets))
+	}
+	if len(shortenRequest.Variants) > 0 {
+		variants, err := json.Marshal(shortenRequest.Variants)
+		if err != nil {
+			return "", err
+		}
+		request.SetQueryParam("variants", string(variants))
+	}
+	if shortenRequest.Campaign != "" {
+		request.SetQueryParam("campaign", shortenRequest.Campaign)
+	}
+	for _, value := range shortenRequest.UTM.values() {
+		if value[1] != "" {
+			request.SetQueryParam(value[0], value[1])
+		}
 	}
 	httpResponse, err := request.Post("/shorten")
 	if err != nil {
@@ -32,7 +86,8 @@ func (c HTTPClient) Shorten(rawURL string, expiration *time.Time) (string, error
 	switch httpResponse.StatusCode() {
 	case http.StatusOK:
 		return shortendUrlFromBody(httpResponse)
-	case http.StatusBadRequest:
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusConflict,
+		http.StatusTooManyRequests:
 		return "", errorFromBody(httpResponse.Body())
 	default:
 		return "", errors.New("unexpected error")
@@ -62,7 +117,7 @@ func (c HTTPClient) Unshorten(rawURL string) (string, error) {
 	switch httpResponse.StatusCode() {
 	case http.StatusOK:
 		return unshortendUrlFromBody(httpResponse)
-	case http.StatusBadRequest:
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
 		return "", errorFromBody(httpResponse.Body())
 	default:
 		return "", errors.New("unexpected error")
@@ -85,27 +140,105 @@ type errorBody struct {
 func errorFromBody(body []byte) error {
 	var e errorBody
 	_ = json.Unmarshal(body, &e)
-	switch e.Error {
-	case ErrNotFound.Error():
-		return ErrNotFound
-	case ErrMissingScheme.Error():
-		return ErrMissingScheme
-	case ErrMissingHostname.Error():
-		return ErrMissingHostname
-	case ErrInvalidURL.Error():
-		return ErrInvalidURL
-	case ErrExpired.Error():
-		return ErrExpired
-	default:
+	err, ok := knownError(e.Error)
+	if !ok {
 		panic(fmt.Sprintf("unexpected error: %s", e.Error))
 	}
-	return nil
+	return err
+}
+
+func knownError(message string) (error, bool) {
+	for _, err := range []error{ErrNotFound, ErrMissingScheme, ErrMissingHostname, ErrInvalidURL, ErrExpired,
+		ErrConflict, ErrInvalidBatch, ErrInvalidBatchItem, ErrBatchTooLarge, ErrInvalidRedirectStatus,
+		ErrInvalidReferrerPolicy, ErrInvalidRobotsTag, ErrInvalidQueryPassthrough,
+		ErrCampaignNotFound, ErrInvalidCampaign, ErrInvalidTarget,
+		ErrInvalidVariant, ErrUnauthorized, ErrForbidden, ErrRateLimited, ErrQuotaExceeded,
+		ErrForbiddenScheme, ErrPrivateDestination, ErrNonCanonicalAddress, ErrBlockedDomain, ErrDomainNotAllowed,
+		ErrThreatMatch, ErrNestedShortener, ErrSigningDisabled, ErrInvalidSignature} {
+		if message == err.Error() {
+			return err, true
+		}
+	}
+	return nil, false
+}
+
+func (c HTTPClient) SetVariants(rawURL string, variants []Variant) error {
+	short, err := NewURL(rawURL, nil)
+	if err != nil {
+		return err
+	}
+	httpResponse, err := c.client.R().
+		SetHeader("Content-Type", "application/json").
+		SetBody(variants).
+		Put("/api/v1/links/" + strings.TrimPrefix(short.Path, "/u/") + "/variants")
+	if err != nil {
+		return err
+	}
+	switch httpResponse.StatusCode() {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		return errorFromBody(httpResponse.Body())
+	default:
+		return errors.New("unexpected error")
+	}
+}
+
+func (c HTTPClient) ShortenBatch(requests []ShortenRequest) ([]ShortenResult, error) {
+	items := make([]batchItem, 0, len(requests))
+	for _, request := range requests {
+		items = append(items, batchItem{URL: request.URL, Expiration: request.Expiration, LinkOptions: request.Options,
+			Campaign: request.Campaign, UTMParams: request.UTM, Targets: request.Targets,
+			GeoTargets: request.GeoTargets, Variants: request.Variants})
+	}
+	httpResponse, err := c.client.R().
+		SetHeader("Content-Type", "application/json").
+		SetBody(items).
+		Post("/api/v1/links:batch")
+	if err != nil {
+		return nil, err
+	}
+	switch httpResponse.StatusCode() {
+	case http.StatusOK:
+		return batchResultsFromBody(httpResponse)
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		return nil, errorFromBody(httpResponse.Body())
+	default:
+		return nil, errors.New("unexpected error")
+	}
+}
+
+func batchResultsFromBody(httpResponse *resty.Response) ([]ShortenResult, error) {
+	var response batchResponse
+	err := json.Unmarshal(httpResponse.Body(), &response)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]ShortenResult, 0, len(response.Results))
+	for _, item := range response.Results {
+		if item.Error == "" {
+			results = append(results, ShortenResult{Shortened: item.Shortened})
+			continue
+		}
+		err, ok := knownError(item.Error)
+		if !ok {
+			err = errors.New(item.Error)
+		}
+		results = append(results, ShortenResult{Err: err})
+	}
+	return results, nil
 }
 
 func NewHTTPClientFromResty(client *resty.Client) *HTTPClient {
 	return &HTTPClient{client: client}
 }
 
+// WithAPIKey sends the key as a bearer token with every request.
+func (c *HTTPClient) WithAPIKey(key string) *HTTPClient {
+	c.client.SetAuthToken(key)
+	return c
+}
+
 func NewHTTPClient() *HTTPClient {
 	client := resty.New()
 	return NewHTTPClientFromResty(client)
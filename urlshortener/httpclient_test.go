@@ -1,10 +1,12 @@
 package urlshortener
 
 import (
+	"encoding/json"
 	"github.com/goccha/logging/restylog"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -77,3 +79,68 @@ func TestHTTPShortenWithExpiration(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, 1, count)
 }
+
+func TestHTTPShortenBatch(t *testing.T) {
+	app := NewInMemoryApplication()
+	testServer := httptest.NewServer(app.server.mux)
+	client := NewHTTPClientFromResty(resty.NewWithClient(testServer.Client()).SetBaseURL(testServer.URL))
+
+	expiration := time.Now().Add(1 * time.Hour)
+	results, err := client.ShortenBatch([]ShortenRequest{
+		{URL: "https://example.com/first"},
+		{URL: "toto.com"},
+		{URL: "https://example.com/second", Expiration: &expiration},
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+
+	require.NoError(t, results[0].Err)
+	got, err := client.Unshorten(results[0].Shortened)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/first", got)
+
+	assert.ErrorIs(t, results[1].Err, ErrMissingScheme)
+
+	require.NoError(t, results[2].Err)
+	got, err = client.Unshorten(results[2].Shortened)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/second", got)
+}
+
+func TestHTTPShortenBatchNDJSON(t *testing.T) {
+	app := NewInMemoryApplication()
+	body := strings.NewReader(`{"url": "https://example.com/first"}
+{"url": 42}
+{"url": "https://example.com/second"}
+`)
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/links:batch", body)
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	recorder := handle(app, request)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var response batchResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	require.Len(t, response.Results, 3)
+	assert.NotEmpty(t, response.Results[0].Shortened)
+	assert.Equal(t, ErrInvalidBatchItem.Error(), response.Results[1].Error)
+	assert.NotEmpty(t, response.Results[2].Shortened)
+}
+
+func TestHTTPShortenBatchInvalidBody(t *testing.T) {
+	app := NewInMemoryApplication()
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/links:batch", strings.NewReader(`{"url": "https://localhost"}`))
+	recorder := handle(app, request)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, `{"error": "invalid batch"}`, recorder.Body.String())
+}
+
+func TestHTTPShortenBatchTooLarge(t *testing.T) {
+	app := NewInMemoryApplication()
+	body := `[{"url": "https://example.com/` + strings.Repeat("a", maxBatchBodySize) + `"}]`
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/links:batch", strings.NewReader(body))
+	recorder := handle(app, request)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, `{"error": "batch too large"}`, recorder.Body.String())
+}
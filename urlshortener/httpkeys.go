@@ -0,0 +1,101 @@
+package urlshortener
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+type issueKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// apiKeyResponse never carries the hash; the token is only set when the key
+// is issued.
+type apiKeyResponse struct {
+	ID          string     `json:"id"`
+	Token       string     `json:"token,omitempty"`
+	Name        string     `json:"name"`
+	Scopes      []string   `json:"scopes"`
+	UserID      string     `json:"user_id,omitempty"`
+	WorkspaceID string     `json:"workspace_id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+}
+
+func newAPIKeyResponse(key APIKey) apiKeyResponse {
+	return apiKeyResponse{ID: key.ID, Name: key.Name, Scopes: key.Scopes, UserID: key.UserID, WorkspaceID: key.WorkspaceID,
+		CreatedAt: key.CreatedAt, ExpiresAt: key.ExpiresAt, LastUsedAt: key.LastUsedAt, RevokedAt: key.RevokedAt}
+}
+
+type keysResponse struct {
+	Keys []apiKeyResponse `json:"keys"`
+}
+
+func withKeysHandlers(auth *AuthUsecase, mws ...middleware) muxModifier {
+	return func(mux *http.ServeMux) *http.ServeMux {
+		issue := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			var body issueKeyRequest
+			if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+				writeError(writer, http.StatusBadRequest, ErrInvalidScope)
+				return
+			}
+			token, key, err := actingAs(auth, request).IssueKey(APIKey{Name: body.Name, Scopes: body.Scopes, ExpiresAt: body.ExpiresAt})
+			switch {
+			case errors.Is(err, ErrInvalidScope):
+				writeError(writer, http.StatusBadRequest, err)
+				return
+			case errors.Is(err, ErrForbidden):
+				writeError(writer, http.StatusForbidden, err)
+				return
+			case err != nil:
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			response := newAPIKeyResponse(key)
+			response.Token = token
+			writer.Header().Set("Content-Type", "application/json")
+			writer.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(writer).Encode(response)
+		})
+		list := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			keys, err := actingAs(auth, request).Keys()
+			if errors.Is(err, ErrForbidden) {
+				writeError(writer, http.StatusForbidden, err)
+				return
+			}
+			if err != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			response := keysResponse{Keys: make([]apiKeyResponse, 0, len(keys))}
+			for _, key := range keys {
+				response.Keys = append(response.Keys, newAPIKeyResponse(key))
+			}
+			writer.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(writer).Encode(response)
+		})
+		revoke := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			err := actingAs(auth, request).RevokeKey(request.PathValue("id"))
+			switch {
+			case err == nil:
+				writer.WriteHeader(http.StatusNoContent)
+			case errors.Is(err, ErrAPIKeyNotFound):
+				writeError(writer, http.StatusNotFound, err)
+			case errors.Is(err, ErrForbidden):
+				writeError(writer, http.StatusForbidden, err)
+			default:
+				writer.WriteHeader(http.StatusInternalServerError)
+			}
+		})
+		mux.Handle("POST /api/v1/keys", middlewares(mws).Handler(issue))
+		mux.Handle("GET /api/v1/keys", middlewares(mws).Handler(list))
+		mux.Handle("DELETE /api/v1/keys/{id}", middlewares(mws).Handler(revoke))
+		return mux
+	}
+}
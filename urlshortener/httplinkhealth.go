@@ -0,0 +1,49 @@
+package urlshortener
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+type brokenLinksResponse struct {
+	Links []LinkHealth `json:"links"`
+}
+
+func writeLinkHealthError(writer http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrLinkNotChecked):
+		writeError(writer, http.StatusNotFound, err)
+	case errors.Is(err, ErrForbidden):
+		writeError(writer, http.StatusForbidden, err)
+	default:
+		writer.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func withLinkHealthHandlers(l *LinkHealthUsecase, mws ...middleware) muxModifier {
+	return func(mux *http.ServeMux) *http.ServeMux {
+		broken := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			links, err := actingAs(l, request).Broken()
+			if err != nil {
+				writeLinkHealthError(writer, err)
+				return
+			}
+			writer.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(writer).Encode(brokenLinksResponse{Links: append([]LinkHealth{}, links...)})
+		})
+		health := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			shortened := NewShortURL(request.PathValue("code")).String()
+			link, err := actingAs(l, request).Health(shortened)
+			if err != nil {
+				writeLinkHealthError(writer, err)
+				return
+			}
+			writer.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(writer).Encode(link)
+		})
+		mux.Handle("GET /api/v1/links:broken", middlewares(mws).Handler(broken))
+		mux.Handle("GET /api/v1/links/{code}/health", middlewares(mws).Handler(health))
+		return mux
+	}
+}
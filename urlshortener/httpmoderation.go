@@ -0,0 +1,140 @@
+package urlshortener
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+type reportRequest struct {
+	URL     string `json:"url"`
+	Reason  string `json:"reason"`
+	Details string `json:"details,omitempty"`
+}
+
+type reportResponse struct {
+	ID     string       `json:"id"`
+	Status ReportStatus `json:"status"`
+}
+
+type reportsResponse struct {
+	Reports []AbuseReport `json:"reports"`
+}
+
+type auditResponse struct {
+	Entries []AuditEntry `json:"entries"`
+}
+
+// moderationRequest names the link a moderator acts on, and why.
+type moderationRequest struct {
+	URL  string `json:"url"`
+	Note string `json:"note,omitempty"`
+}
+
+func writeModerationError(writer http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidReport):
+		writeError(writer, http.StatusBadRequest, err)
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrReportNotFound):
+		writeError(writer, http.StatusNotFound, err)
+	case errors.Is(err, ErrForbidden):
+		writeError(writer, http.StatusForbidden, err)
+	default:
+		writer.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// withReportHandler takes the middlewares of a public route: anyone may
+// report a link.
+func withReportHandler(m *ModerationUsecase, mws ...middleware) muxModifier {
+	return func(mux *http.ServeMux) *http.ServeMux {
+		handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			var body reportRequest
+			if err := json.NewDecoder(http.MaxBytesReader(writer, request.Body, 2*maxReportDetails)).Decode(&body); err != nil {
+				writeError(writer, http.StatusBadRequest, ErrInvalidReport)
+				return
+			}
+			report, err := m.Report(body.URL, body.Reason, body.Details)
+			if err != nil {
+				writeModerationError(writer, err)
+				return
+			}
+			writer.Header().Set("Content-Type", "application/json")
+			writer.WriteHeader(http.StatusAccepted)
+			_ = json.NewEncoder(writer).Encode(reportResponse{ID: report.ID, Status: report.Status})
+		})
+		mux.Handle("POST /report", middlewares(mws).Handler(handler))
+		return mux
+	}
+}
+
+func withModerationHandlers(m *ModerationUsecase, mws ...middleware) muxModifier {
+	return func(mux *http.ServeMux) *http.ServeMux {
+		queue := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			status := ReportStatus(request.URL.Query().Get("status"))
+			if status == "" {
+				status = ReportOpen
+			}
+			reports, err := actingAs(m, request).Reports(status)
+			if err != nil {
+				writeModerationError(writer, err)
+				return
+			}
+			writer.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(writer).Encode(reportsResponse{Reports: append([]AbuseReport{}, reports...)})
+		})
+		act := func(action func(m *ModerationUsecase, rawURL, note string) error) http.HandlerFunc {
+			return func(writer http.ResponseWriter, request *http.Request) {
+				var body moderationRequest
+				if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+					writeError(writer, http.StatusBadRequest, ErrInvalidURL)
+					return
+				}
+				if err := action(actingAs(m, request), body.URL, body.Note); err != nil {
+					writeModerationError(writer, err)
+					return
+				}
+				writer.WriteHeader(http.StatusNoContent)
+			}
+		}
+		dismiss := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			var body moderationRequest
+			if request.ContentLength != 0 {
+				if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+					writeError(writer, http.StatusBadRequest, ErrInvalidReport)
+					return
+				}
+			}
+			if err := actingAs(m, request).Dismiss(request.PathValue("id"), body.Note); err != nil {
+				writeModerationError(writer, err)
+				return
+			}
+			writer.WriteHeader(http.StatusNoContent)
+		})
+		audit := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			entries, err := actingAs(m, request).Audit(request.URL.Query().Get("url"))
+			if err != nil {
+				writeModerationError(writer, err)
+				return
+			}
+			writer.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(writer).Encode(auditResponse{Entries: append([]AuditEntry{}, entries...)})
+		})
+		rescreen := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			result, err := actingAs(m, request).Rescreen()
+			if err != nil {
+				writeModerationError(writer, err)
+				return
+			}
+			writer.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(writer).Encode(result)
+		})
+		mux.Handle("GET /api/v1/moderation/reports", middlewares(mws).Handler(queue))
+		mux.Handle("POST /api/v1/moderation/reports/{id}/dismiss", middlewares(mws).Handler(dismiss))
+		mux.Handle("POST /api/v1/moderation/quarantine", middlewares(mws).Handler(act((*ModerationUsecase).Quarantine)))
+		mux.Handle("POST /api/v1/moderation/release", middlewares(mws).Handler(act((*ModerationUsecase).Release)))
+		mux.Handle("GET /api/v1/moderation/audit", middlewares(mws).Handler(audit))
+		mux.Handle("POST /api/v1/moderation/rescreen", middlewares(mws).Handler(rescreen))
+		return mux
+	}
+}
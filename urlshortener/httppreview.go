@@ -0,0 +1,48 @@
+package urlshortener
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"html/template"
+	"net/http"
+)
+
+//go:embed templates
+var templateFiles embed.FS
+
+var previewTemplate = template.Must(template.ParseFS(templateFiles, "templates/preview.html"))
+var warningTemplate = template.Must(template.ParseFS(templateFiles, "templates/warning.html"))
+
+type previewPage struct {
+	LinkPreview
+	ContinuePath string
+}
+
+// servePreview serves a warning instead for quarantined links, which is also
+// what their visitors get in place of the redirect.
+func servePreview(writer http.ResponseWriter, p Previewer, code string) {
+	shortened := NewShortURL(code)
+	preview, err := p.Preview(shortened.String())
+	switch {
+	case errors.Is(err, ErrNotFound):
+		writeError(writer, http.StatusNotFound, err)
+		return
+	case err != nil:
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	pageTemplate := previewTemplate
+	if preview.Quarantined {
+		pageTemplate = warningTemplate
+	}
+	var page bytes.Buffer
+	if err := pageTemplate.Execute(&page, previewPage{LinkPreview: preview, ContinuePath: "/" + shortened.Path}); err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.Header().Set("X-Robots-Tag", "noindex")
+	_, _ = writer.Write(page.Bytes())
+}
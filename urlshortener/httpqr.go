@@ -0,0 +1,52 @@
+package urlshortener
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+)
+
+func withQRHandler(u Unshortener, signer *CodeSigner, renderer *QRRenderer, mws ...middleware) muxModifier {
+	return func(mux *http.ServeMux) *http.ServeMux {
+		handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if err := signer.Verify(request.PathValue("path")); err != nil {
+				writeError(writer, http.StatusNotFound, err)
+				return
+			}
+			options, err := ParseQROptions(request.URL.Query())
+			if err != nil {
+				writeError(writer, http.StatusBadRequest, err)
+				return
+			}
+			shortened := NewShortURL(request.PathValue("path")).String()
+			_, err = u.Unshorten(shortened)
+			switch {
+			case errors.Is(err, ErrNotFound), errors.Is(err, ErrExpired):
+				writeError(writer, http.StatusNotFound, err)
+				return
+			case err != nil:
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			etag := options.ETag(shortened)
+			writer.Header().Set("Cache-Control", "public, max-age=86400")
+			writer.Header().Set("ETag", etag)
+			if request.Header.Get("If-None-Match") == etag {
+				writer.WriteHeader(http.StatusNotModified)
+				return
+			}
+			var image bytes.Buffer
+			if err := renderer.Render(&image, shortened, options); err != nil {
+				writer.Header().Del("Cache-Control")
+				writer.Header().Del("ETag")
+				writeError(writer, http.StatusBadRequest, err)
+				return
+			}
+			writer.Header().Set("Content-Type", options.ContentType())
+			_, _ = writer.Write(image.Bytes())
+		})
+		mux.Handle("GET /u/{path}/qr", middlewares(mws).Handler(handler))
+		return mux
+	}
+}
@@ -0,0 +1,27 @@
+package urlshortener
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+func withQuotaHandler(q *QuotaUsecase, mws ...middleware) muxModifier {
+	return func(mux *http.ServeMux) *http.ServeMux {
+		handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			usage, err := actingAs(q, request).Usage()
+			switch {
+			case errors.Is(err, ErrForbidden):
+				writeError(writer, http.StatusForbidden, err)
+				return
+			case err != nil:
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			writer.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(writer).Encode(usage)
+		})
+		mux.Handle("GET /api/v1/quota", middlewares(mws).Handler(handler))
+		return mux
+	}
+}
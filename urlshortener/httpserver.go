@@ -1,10 +1,14 @@
 package urlshortener
 
 import (
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/MadAppGang/httplog"
@@ -14,17 +18,51 @@ type HTTPServer struct {
 	mux *http.ServeMux
 }
 
-func NewHTTPServer(s ShortenUnshortener, c CountStorer) *HTTPServer {
+// NewHTTPServer protects the management routes with auth; the redirect, QR
+// and report routes stay public. A nil auth disables API key checks and key
+// management. Each class of routes has its own rate limit.
+func NewHTTPServer(u *CountingUsecase, a *ArchiveUsecase, c *CampaignUsecase, auth *AuthUsecase, q *QuotaUsecase,
+	m *ModerationUsecase, l *LinkHealthUsecase, visitors *VisitorExtractor, limits *RateLimiter) *HTTPServer {
 	mux := http.NewServeMux()
-	mws := []middleware{newRateLimiterMiddleware(), middlewareFunc(httplog.Logger)}
-	mux = withShortenerHandler(s, mws...)(mux)
-	mux = withUnhortenerHandler(s, mws...)(mux)
-	mux = withCount(c)(mux)
-	mux = withURedirectHandler(s, mws...)(mux)
+	mws := []middleware{middlewareFunc(httplog.Logger)}
+	write := withAuth(auth, ScopeLinksWrite, limits, RouteCreate, mws)
+	read := withAuth(auth, ScopeLinksRead, limits, RouteRead, mws)
+	stats := withAuth(auth, ScopeStatsRead, limits, RouteStats, mws)
+	public := append([]middleware{limits.middleware(RouteRedirect)}, mws...)
+	renderer := NewQRRendererFromEnv()
+	mux = withShortenerHandler(u.Usecase, renderer, write...)(mux)
+	mux = withBatchShortenerHandler(u.Usecase, write...)(mux)
+	mux = withUnhortenerHandler(u, read...)(mux)
+	mux = withCount(u, stats...)(mux)
+	mux = withURedirectHandler(u, u.Usecase, u, u.signer, visitors, public...)(mux)
+	mux = withQRHandler(u.Usecase, u.signer, renderer, public...)(mux)
+	mux = withImportHandler(a, write...)(mux)
+	mux = withExportHandler(a, read...)(mux)
+	mux = withCampaignHandlers(c, write, read, stats)(mux)
+	mux = withQuotaHandler(q, stats...)(mux)
+	mux = withClicksHandler(u, stats...)(mux)
+	mux = withVariantsHandler(u.Usecase, write...)(mux)
+	mux = withLinkHealthHandlers(l, read...)(mux)
+	mux = withReportHandler(m, append([]middleware{limits.middleware(RouteCreate)}, mws...)...)(mux)
+	mux = withModerationHandlers(m, withAuth(auth, ScopeModeration, limits, RouteCreate, mws)...)(mux)
+	if auth != nil {
+		// without authentication anyone could issue keys
+		mux = withKeysHandlers(auth, withAuth(auth, ScopeKeysManage, limits, RouteCreate, mws)...)(mux)
+	}
+	mux = withMetrics(stats...)(mux)
 	return &HTTPServer{mux: mux}
 }
 
-func withCount(c CountStorer, mws ...middleware) func(mux *http.ServeMux) *http.ServeMux {
+// actingAs binds the use case to the principal authenticated by the request,
+// if any.
+func actingAs[T interface{ As(Principal) T }](u T, request *http.Request) T {
+	if principal, ok := PrincipalFromContext(request.Context()); ok {
+		return u.As(principal)
+	}
+	return u
+}
+
+func withCount(c *CountingUsecase, mws ...middleware) func(mux *http.ServeMux) *http.ServeMux {
 	return func(mux *http.ServeMux) *http.ServeMux {
 		handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 			escapedURL := request.URL.Query().Get("url")
@@ -33,7 +71,11 @@ func withCount(c CountStorer, mws ...middleware) func(mux *http.ServeMux) *http.
 				writer.WriteHeader(http.StatusBadRequest)
 				return
 			}
-			count, _ := c.Get(rawURL)
+			count, err := actingAs(c, request).Count(rawURL)
+			if errors.Is(err, ErrForbidden) {
+				writeError(writer, http.StatusForbidden, err)
+				return
+			}
 			writer.Write([]byte(fmt.Sprintf(`{"count": %d}`, count)))
 		})
 		mux.Handle("/count", middlewares(mws).Handler(handler))
@@ -41,13 +83,22 @@ func withCount(c CountStorer, mws ...middleware) func(mux *http.ServeMux) *http.
 	}
 }
 
+// withMetrics serves the expvar counters, which tell about the traffic and
+// the link checks, to the holders of stats keys only.
+func withMetrics(mws ...middleware) muxModifier {
+	return func(mux *http.ServeMux) *http.ServeMux {
+		mux.Handle("/debug/vars", middlewares(mws).Handler(expvar.Handler()))
+		return mux
+	}
+}
+
 func (s *HTTPServer) Start() error {
 	return http.ListenAndServe(":8080", s.mux)
 }
 
 type muxModifier func(mux *http.ServeMux) *http.ServeMux
 
-func withShortenerHandler(s Shortener, mws ...middleware) muxModifier {
+func withShortenerHandler(u *Usecase, renderer *QRRenderer, mws ...middleware) muxModifier {
 	return func(mux *http.ServeMux) *http.ServeMux {
 		var handler http.Handler
 		handler = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
@@ -78,10 +129,68 @@ func withShortenerHandler(s Shortener, mws ...middleware) muxModifier {
 
 				expiration = &e
 			}
-			shortened, err := s.Shorten(rawURL, expiration)
+			var qrOptions *QROptions
+			if format := request.URL.Query().Get("qr"); format != "" {
+				query := request.URL.Query()
+				query.Set("format", format)
+				options, err := ParseQROptions(query)
+				if err == nil {
+					err = renderer.Check(options)
+				}
+				if err != nil {
+					writeError(writer, http.StatusBadRequest, err)
+					return
+				}
+				qrOptions = &options
+			}
+			options, err := linkOptionsFromQuery(request.URL.Query())
+			if err != nil {
+				writeError(writer, http.StatusBadRequest, err)
+				return
+			}
+			query := request.URL.Query()
+			var targets []Target
+			if rawTargets := query.Get("targets"); rawTargets != "" {
+				if err := json.Unmarshal([]byte(rawTargets), &targets); err != nil {
+					writeError(writer, http.StatusBadRequest, ErrInvalidTarget)
+					return
+				}
+			}
+			var geoTargets map[string]string
+			if rawGeoTargets := query.Get("geo_targets"); rawGeoTargets != "" {
+				if err := json.Unmarshal([]byte(rawGeoTargets), &geoTargets); err != nil {
+					writeError(writer, http.StatusBadRequest, ErrInvalidTarget)
+					return
+				}
+			}
+			var variants []Variant
+			if rawVariants := query.Get("variants"); rawVariants != "" {
+				if err := json.Unmarshal([]byte(rawVariants), &variants); err != nil {
+					writeError(writer, http.StatusBadRequest, ErrInvalidVariant)
+					return
+				}
+			}
+			shortened, err := actingAs(u, request).ShortenWithOptions(ShortenRequest{URL: rawURL, Expiration: expiration, Options: options,
+				Campaign: query.Get("campaign"), UTM: UTMParamsFromQuery(query), Targets: targets, GeoTargets: geoTargets,
+				Variants: variants, Signed: query.Get("signed") == "true"})
+			if err == nil && qrOptions != nil {
+				dataURI, err := renderer.DataURI(shortened, *qrOptions)
+				if err != nil {
+					writer.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				_, _ = writer.Write([]byte(fmt.Sprintf(`{"shortened": "%s", "qr": "%s"}`, shortened, dataURI)))
+				return
+			}
 			switch {
 			case err == nil:
 				_, _ = writer.Write([]byte(fmt.Sprintf(`{"shortened": "%s"}`, shortened)))
+			case errors.Is(err, ErrForbidden):
+				writeError(writer, http.StatusForbidden, err)
+			case errors.Is(err, ErrConflict):
+				writeError(writer, http.StatusConflict, err)
+			case errors.Is(err, ErrQuotaExceeded):
+				writeTooManyRequests(writer, err, quotaResetAt(u.clock.Now()))
 			case errors.Is(err, ErrNotFound):
 				fallthrough
 			case errors.Is(err, ErrMissingScheme):
@@ -89,6 +198,24 @@ func withShortenerHandler(s Shortener, mws ...middleware) muxModifier {
 			case errors.Is(err, ErrMissingHostname):
 				fallthrough
 			case errors.Is(err, ErrInvalidURL):
+				fallthrough
+			case errors.Is(err, ErrInvalidRedirectStatus):
+				fallthrough
+			case errors.Is(err, ErrInvalidReferrerPolicy):
+				fallthrough
+			case errors.Is(err, ErrInvalidRobotsTag):
+				fallthrough
+			case errors.Is(err, ErrInvalidQueryPassthrough):
+				fallthrough
+			case errors.Is(err, ErrCampaignNotFound):
+				fallthrough
+			case errors.Is(err, ErrInvalidTarget):
+				fallthrough
+			case errors.Is(err, ErrInvalidVariant):
+				fallthrough
+			case errors.Is(err, ErrForbiddenScheme), errors.Is(err, ErrPrivateDestination), errors.Is(err, ErrNonCanonicalAddress),
+				errors.Is(err, ErrBlockedDomain), errors.Is(err, ErrDomainNotAllowed), errors.Is(err, ErrThreatMatch),
+				errors.Is(err, ErrNestedShortener), errors.Is(err, ErrSigningDisabled):
 				writer.WriteHeader(http.StatusBadRequest)
 				_, _ = writer.Write([]byte(fmt.Sprintf(`{"error": "%s"}`, err.Error())))
 			default:
@@ -101,7 +228,24 @@ func withShortenerHandler(s Shortener, mws ...middleware) muxModifier {
 	}
 }
 
-func withUnhortenerHandler(u Unshortener, mws ...middleware) muxModifier {
+func linkOptionsFromQuery(query url.Values) (LinkOptions, error) {
+	options := LinkOptions{
+		ReferrerPolicy:   query.Get("referrer_policy"),
+		RobotsTag:        query.Get("robots_tag"),
+		QueryPassthrough: QueryPassthrough(query.Get("query_passthrough")),
+		PathPassthrough:  query.Get("path_passthrough") == "true",
+	}
+	if status := query.Get("redirect_status"); status != "" {
+		s, err := strconv.Atoi(status)
+		if err != nil {
+			return LinkOptions{}, ErrInvalidRedirectStatus
+		}
+		options.RedirectStatus = s
+	}
+	return options, options.Validate()
+}
+
+func withUnhortenerHandler(u *CountingUsecase, mws ...middleware) muxModifier {
 	return func(mux *http.ServeMux) *http.ServeMux {
 		handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 			escapedURL := request.URL.Query().Get("url")
@@ -110,8 +254,10 @@ func withUnhortenerHandler(u Unshortener, mws ...middleware) muxModifier {
 				writer.WriteHeader(http.StatusBadRequest)
 				return
 			}
-			shortened, err := u.Unshorten(rawURL)
+			shortened, err := actingAs(u, request).Unshorten(rawURL)
 			switch {
+			case errors.Is(err, ErrForbidden):
+				writeError(writer, http.StatusForbidden, err)
 			case errors.Is(err, ErrNotFound):
 				fallthrough
 			case errors.Is(err, ErrMissingScheme):
@@ -135,13 +281,34 @@ func withUnhortenerHandler(u Unshortener, mws ...middleware) muxModifier {
 	}
 }
 
-func withURedirectHandler(u Unshortener, mws ...middleware) muxModifier {
+// withURedirectHandler answers HEAD requests from the non-counting resolver
+// so that link checkers and crawlers do not inflate click counts. Codes with
+// a wrong signature are rejected before any lookup, so that scanning random
+// codes never reaches the store.
+func withURedirectHandler(r Resolver, head Resolver, p Previewer, signer *CodeSigner, visitors *VisitorExtractor,
+	mws ...middleware) muxModifier {
 	return func(mux *http.ServeMux) *http.ServeMux {
 		handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 			path := request.PathValue("path")
+			if code, _, _ := strings.Cut(path, "/"); signer.Verify(strings.TrimSuffix(code, "+")) != nil {
+				writeError(writer, http.StatusBadRequest, ErrInvalidSignature)
+				return
+			}
+			if code, ok := strings.CutSuffix(path, "+"); ok || request.URL.Query().Get("preview") == "1" {
+				servePreview(writer, p, code)
+				return
+			}
 
-			rawURL := fmt.Sprintf("https://localhost:8080/u/%s", path)
-			unshortened, err := u.Unshorten(rawURL)
+			resolver := r
+			if request.Method == http.MethodHead {
+				resolver = head
+			}
+			rawURL := "https://localhost:8080" + request.URL.EscapedPath()
+			if request.URL.RawQuery != "" {
+				rawURL += "?" + request.URL.RawQuery
+			}
+			visitor := visitors.Visitor(request)
+			redirect, err := resolver.Resolve(rawURL, visitor)
 			switch {
 			case errors.Is(err, ErrNotFound):
 				fallthrough
@@ -150,16 +317,23 @@ func withURedirectHandler(u Unshortener, mws ...middleware) muxModifier {
 			case errors.Is(err, ErrMissingHostname):
 				fallthrough
 			case errors.Is(err, ErrInvalidURL):
+				fallthrough
+			case errors.Is(err, ErrExpired):
 				writer.WriteHeader(http.StatusBadRequest)
 				_, _ = writer.Write([]byte(fmt.Sprintf(`{"error": "%s"}`, err.Error())))
+			case errors.Is(err, ErrQuarantined):
+				code, _, _ := strings.Cut(path, "/")
+				servePreview(writer, p, code)
 			case err == nil:
-				writer.Header().Set("Location", unshortened)
-				writer.WriteHeader(http.StatusTemporaryRedirect)
+				if redirect.SetVisitorCookie {
+					setVisitorCookie(writer, visitor.ID)
+				}
+				writeRedirect(writer, redirect)
 			default:
 				writer.WriteHeader(http.StatusInternalServerError)
 			}
 		})
-		mux.Handle("/u/{path}", middlewares(mws).Handler(handler))
+		mux.Handle("GET /u/{path...}", middlewares(mws).Handler(handler))
 		return mux
 	}
 }
@@ -0,0 +1,34 @@
+package urlshortener
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+func withVariantsHandler(u *Usecase, mws ...middleware) muxModifier {
+	return func(mux *http.ServeMux) *http.ServeMux {
+		handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			var variants []Variant
+			if err := json.NewDecoder(request.Body).Decode(&variants); err != nil {
+				writeError(writer, http.StatusBadRequest, ErrInvalidVariant)
+				return
+			}
+			err := actingAs(u, request).SetVariants(NewShortURL(request.PathValue("code")).String(), variants)
+			switch {
+			case err == nil:
+				writer.WriteHeader(http.StatusNoContent)
+			case errors.Is(err, ErrInvalidVariant), errors.As(err, new(*ScreeningError)):
+				writeError(writer, http.StatusBadRequest, err)
+			case errors.Is(err, ErrNotFound):
+				writeError(writer, http.StatusNotFound, err)
+			case errors.Is(err, ErrForbidden):
+				writeError(writer, http.StatusForbidden, err)
+			default:
+				writer.WriteHeader(http.StatusInternalServerError)
+			}
+		})
+		mux.Handle("PUT /api/v1/links/{code}/variants", middlewares(mws).Handler(handler))
+		return mux
+	}
+}
@@ -0,0 +1,604 @@
+package urlshortener
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+var ErrUnknownFormat = errors.New("unknown format")
+var ErrUnknownConflictPolicy = errors.New("unknown conflict policy")
+var ErrCorruptedStream = errors.New("corrupted record stream")
+
+type LinkRecord struct {
+	Shortened  string            `json:"shortened"`
+	URL        string            `json:"url"`
+	Expiration *time.Time        `json:"expiration,omitempty"`
+	Hits       int               `json:"hits"`
+	Options    LinkOptions       `json:"options,omitzero"`
+	Targets    []Target          `json:"targets,omitempty"`
+	GeoTargets map[string]string `json:"geo_targets,omitempty"`
+	Variants   []Variant         `json:"variants,omitempty"`
+	Workspace  string            `json:"workspace,omitempty"`
+	CreatedBy  string            `json:"created_by,omitempty"`
+}
+
+// exportedWorkspace leaves the default workspace out of the records, which
+// then read the same as before workspaces existed.
+func exportedWorkspace(workspaceID string) string {
+	if workspaceOrDefault(workspaceID) == DefaultWorkspace {
+		return ""
+	}
+	return workspaceID
+}
+
+type LinkExporter interface {
+	// ExportLinks walks the links of the workspace, or every link for an
+	// empty workspace.
+	ExportLinks(workspaceID string, f func(LinkRecord) error) error
+}
+
+type LinkRecordReader interface {
+	Read() (LinkRecord, error)
+}
+
+type LinkRecordWriter interface {
+	Write(record LinkRecord) error
+	Flush() error
+}
+
+type ConflictPolicy string
+
+const (
+	ConflictSkip      ConflictPolicy = "skip"
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	ConflictFail      ConflictPolicy = "fail"
+)
+
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(s); policy {
+	case ConflictSkip, ConflictOverwrite, ConflictFail:
+		return policy, nil
+	case "":
+		return ConflictSkip, nil
+	default:
+		return "", ErrUnknownConflictPolicy
+	}
+}
+
+type ImportOptions struct {
+	Policy        ConflictPolicy
+	DryRun        bool
+	ProgressEvery int
+	Progress      func(ImportReport)
+}
+
+type ImportError struct {
+	Record int    `json:"record"`
+	Error  string `json:"error"`
+}
+
+type ImportReport struct {
+	Read        int           `json:"read"`
+	Created     int           `json:"created"`
+	Overwritten int           `json:"overwritten"`
+	Skipped     int           `json:"skipped"`
+	Failed      int           `json:"failed"`
+	DryRun      bool          `json:"dry_run"`
+	Errors      []ImportError `json:"errors,omitempty"`
+}
+
+const maxReportedImportErrors = 100
+
+func (r *ImportReport) fail(record int, err error) {
+	r.Failed++
+	if len(r.Errors) < maxReportedImportErrors {
+		r.Errors = append(r.Errors, ImportError{Record: record, Error: err.Error()})
+	}
+}
+
+type ArchiveUsecase struct {
+	transactor Transactor
+	exporter   LinkExporter
+	links      *Usecase
+	clock      clockwork.Clock
+	principal  *Principal
+}
+
+func NewArchiveUsecase(transactor Transactor, exporter LinkExporter) *ArchiveUsecase {
+	return &ArchiveUsecase{transactor: transactor, exporter: exporter, clock: clockwork.NewRealClock()}
+}
+
+// WithShortener holds the imported links to the rules of the links the
+// shortener creates, starting with the monthly quotas of their workspace.
+func (a *ArchiveUsecase) WithShortener(links *Usecase) {
+	a.links = links
+}
+
+// As returns a copy of the use case exporting only the principal workspace,
+// and importing into it.
+func (a *ArchiveUsecase) As(principal Principal) *ArchiveUsecase {
+	u := *a
+	u.principal = &principal
+	return &u
+}
+
+func (a *ArchiveUsecase) Export(writer LinkRecordWriter) (int, error) {
+	if err := authorize(a.principal, ActionViewLinks); err != nil {
+		return 0, err
+	}
+	exported := 0
+	workspaceID := ""
+	if a.principal != nil {
+		workspaceID = workspaceOf(a.principal)
+	}
+	err := a.exporter.ExportLinks(workspaceID, func(record LinkRecord) error {
+		exported++
+		return writer.Write(record)
+	})
+	if err != nil {
+		return exported, err
+	}
+	return exported, writer.Flush()
+}
+
+// importChunkSize bounds the records written in a single transaction.
+const importChunkSize = 500
+
+// importedLink is a record read and validated, waiting to be written.
+type importedLink struct {
+	LinkRecord
+	index     int
+	shortened string
+}
+
+// Import reads and validates the records chunk by chunk, then writes each
+// chunk in its own transaction, so that no transaction stays open while the
+// records are read. Under the fail policy every record is read and checked
+// for conflicts before anything is written, so that a conflict leaves the
+// stores untouched; a conflict appearing in the meantime only rolls back its
+// own chunk.
+func (a *ArchiveUsecase) Import(reader LinkRecordReader, options ImportOptions) (ImportReport, error) {
+	if err := authorize(a.principal, ActionCreateLinks); err != nil {
+		return ImportReport{}, err
+	}
+	if options.Policy == ConflictOverwrite {
+		if err := authorize(a.principal, ActionRetargetLinks); err != nil {
+			return ImportReport{}, err
+		}
+	}
+	report := ImportReport{DryRun: options.DryRun}
+	var chunks [][]importedLink
+	chunk := make([]importedLink, 0, importChunkSize)
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		report.Read++
+		if errors.Is(err, ErrCorruptedStream) {
+			return report, err
+		}
+		if err == nil {
+			var link importedLink
+			if link, err = a.prepareRecord(record, report.Read); err == nil {
+				chunk = append(chunk, link)
+			}
+		}
+		if err != nil {
+			report.fail(report.Read, err)
+		}
+		if options.Progress != nil && options.ProgressEvery > 0 && report.Read%options.ProgressEvery == 0 {
+			options.Progress(report)
+		}
+		if len(chunk) < importChunkSize {
+			continue
+		}
+		if options.Policy == ConflictFail {
+			chunks = append(chunks, chunk)
+		} else if err := a.importChunk(chunk, options, &report); err != nil {
+			return report, err
+		}
+		chunk = make([]importedLink, 0, importChunkSize)
+	}
+	if options.Policy != ConflictFail {
+		return report, a.importChunk(chunk, options, &report)
+	}
+	chunks = append(chunks, chunk)
+	if err := a.checkConflicts(chunks); err != nil {
+		return report, err
+	}
+	for _, chunk := range chunks {
+		if err := a.importChunk(chunk, options, &report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// prepareRecord validates and screens the record, which needs no store.
+func (a *ArchiveUsecase) prepareRecord(record LinkRecord, index int) (importedLink, error) {
+	shortened, err := shortURLFromRecord(record.Shortened)
+	if err != nil {
+		return importedLink{}, err
+	}
+	if err := a.verifyCode(strings.TrimPrefix(shortened, NewShortURL("").String())); err != nil {
+		return importedLink{}, err
+	}
+	u, err := NewURL(record.URL, record.Expiration)
+	if err == nil {
+		err = u.Validate()
+	}
+	if err != nil {
+		return importedLink{}, err
+	}
+	if a.links != nil {
+		err := a.links.screen(record.URL, ShortenRequest{Targets: record.Targets, GeoTargets: record.GeoTargets,
+			Variants: record.Variants})
+		if err != nil {
+			return importedLink{}, err
+		}
+	}
+	return importedLink{LinkRecord: record, index: index, shortened: shortened}, nil
+}
+
+// checkConflicts fails on the first code that is already taken, or that
+// appears twice in the import.
+func (a *ArchiveUsecase) checkConflicts(chunks [][]importedLink) error {
+	seen := map[string]bool{}
+	for _, chunk := range chunks {
+		err := a.transactor.Transaction(func(store Storer, _ CountStorer) error {
+			for _, link := range chunk {
+				_, err := store.Get(link.shortened)
+				if err != nil && !errors.Is(err, ErrNotFound) {
+					return err
+				}
+				if err == nil || seen[link.shortened] {
+					return fmt.Errorf("record %d: %w", link.index, ErrConflict)
+				}
+				seen[link.shortened] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importChunk only counts the links of the chunk in the report once the
+// chunk is written.
+func (a *ArchiveUsecase) importChunk(chunk []importedLink, options ImportOptions, report *ImportReport) error {
+	if len(chunk) == 0 {
+		return nil
+	}
+	quota, err := a.reserveQuota(chunk, options)
+	if err != nil {
+		return err
+	}
+	var chunkReport ImportReport
+	err = a.transactor.Transaction(func(store Storer, countStore CountStorer) error {
+		for _, link := range chunk {
+			if err := a.importLink(store, countStore, link, options, &chunkReport, quota); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		clear(quota.created)
+	}
+	a.releaseUnusedQuota(quota)
+	if err != nil {
+		return err
+	}
+	report.Created += chunkReport.Created
+	report.Overwritten += chunkReport.Overwritten
+	report.Skipped += chunkReport.Skipped
+	report.Failed += chunkReport.Failed
+	for _, e := range chunkReport.Errors {
+		if len(report.Errors) < maxReportedImportErrors {
+			report.Errors = append(report.Errors, e)
+		}
+	}
+	return nil
+}
+
+// chunkQuota holds the quota reserved for the records of a chunk, keyed by
+// record, and the records created with it.
+type chunkQuota struct {
+	reserved map[int]string
+	created  map[int]bool
+}
+
+// reserveQuota reserves the quota of every record of the chunk before its
+// transaction, as the quota store is not part of it. The records left without
+// quota fail if they would create a link.
+func (a *ArchiveUsecase) reserveQuota(chunk []importedLink, options ImportOptions) (chunkQuota, error) {
+	quota := chunkQuota{reserved: map[int]string{}, created: map[int]bool{}}
+	if options.DryRun || a.links == nil || a.links.quotas == nil {
+		return quota, nil
+	}
+	for _, link := range chunk {
+		workspaceID := a.importedWorkspace(link)
+		err := a.links.quotas.consume(workspaceID, 1)
+		if errors.Is(err, ErrQuotaExceeded) {
+			continue
+		}
+		if err != nil {
+			a.releaseUnusedQuota(quota)
+			return quota, err
+		}
+		quota.reserved[link.index] = workspaceID
+	}
+	return quota, nil
+}
+
+// releaseUnusedQuota gives back the quota of the records that did not create
+// a link, because they overwrote or skipped one, or because the chunk rolled
+// back.
+func (a *ArchiveUsecase) releaseUnusedQuota(quota chunkQuota) {
+	released := map[string]int{}
+	for index, workspaceID := range quota.reserved {
+		if !quota.created[index] {
+			released[workspaceID]++
+		}
+	}
+	for workspaceID, n := range released {
+		a.links.quotas.release(workspaceID, n)
+	}
+}
+
+func (a *ArchiveUsecase) withinQuota(link importedLink, quota chunkQuota) bool {
+	if a.links == nil || a.links.quotas == nil {
+		return true
+	}
+	_, ok := quota.reserved[link.index]
+	return ok
+}
+
+// importedWorkspace is the workspace of the links imported by a principal, or
+// the one of the record when the system imports it.
+func (a *ArchiveUsecase) importedWorkspace(link importedLink) string {
+	if a.principal != nil {
+		return workspaceOf(a.principal)
+	}
+	return workspaceOrDefault(link.Workspace)
+}
+
+func (a *ArchiveUsecase) importLink(store Storer, countStore CountStorer, link importedLink, options ImportOptions,
+	report *ImportReport, quota chunkQuota) error {
+	shortened := link.shortened
+	existing, err := store.Get(shortened)
+	exists := err == nil
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if exists && !canAccess(a.principal, existing.Workspace()) {
+		// another workspace owns the code, it can never be overwritten from here
+		report.fail(link.index, ErrConflict)
+		return nil
+	}
+	if exists {
+		switch options.Policy {
+		case ConflictOverwrite:
+		case ConflictFail:
+			return fmt.Errorf("record %d: %w", link.index, ErrConflict)
+		default:
+			report.Skipped++
+			return nil
+		}
+	}
+
+	if !options.DryRun {
+		association := newURLAssociationAt(link.URL, shortened, link.Expiration, a.clock.Now())
+		association.Options = link.Options
+		association.Targets = link.Targets
+		association.GeoTargets = link.GeoTargets
+		association.Variants = link.Variants
+		association.WorkspaceID = a.importedWorkspace(link)
+		association.CreatedBy = link.CreatedBy
+		if a.principal != nil {
+			association.CreatedBy = a.principal.UserID
+		}
+		// only moderators release quarantined links
+		association.Quarantined = exists && existing.Quarantined()
+		if !exists && !a.withinQuota(link, quota) {
+			report.fail(link.index, ErrQuotaExceeded)
+			return nil
+		}
+		if exists {
+			if err := store.Delete(shortened); err != nil {
+				return err
+			}
+		}
+		if err := store.Save(association); err != nil {
+			return err
+		}
+		if err := countStore.Set(shortened, link.Hits); err != nil {
+			return err
+		}
+		quota.created[link.index] = !exists
+	}
+	if exists {
+		report.Overwritten++
+	} else {
+		report.Created++
+	}
+	return nil
+}
+
+// verifyCode checks the codes the way redirects do, so that no forged signed
+// code gets in. Signed codes cannot be checked without signing keys.
+func (a *ArchiveUsecase) verifyCode(code string) error {
+	var signer *CodeSigner
+	if a.links != nil {
+		signer = a.links.signer
+	}
+	if signer == nil && strings.Contains(code, signedCodeSeparator) {
+		return ErrSigningDisabled
+	}
+	return signer.Verify(code)
+}
+
+// shortURLFromRecord accepts either a full short URL, as exported, or a bare
+// code coming from another shortener.
+func shortURLFromRecord(shortened string) (string, error) {
+	if shortened == "" {
+		return "", ErrInvalidURL
+	}
+	u, err := NewURL(shortened, nil)
+	if err == nil && u.Validate() == nil {
+		return shortened, nil
+	}
+	return NewShortURL(shortened).String(), nil
+}
+
+// NewLinkRecordReader stops at the first error reading r, after which no
+// record can be read.
+func NewLinkRecordReader(format string, r io.Reader) (LinkRecordReader, error) {
+	r = streamReader{reader: r}
+	switch format {
+	case "csv":
+		return newCSVRecordReader(r), nil
+	case "ndjson", "":
+		return &ndjsonRecordReader{decoder: json.NewDecoder(r)}, nil
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
+
+func NewLinkRecordWriter(format string, w io.Writer) (LinkRecordWriter, error) {
+	switch format {
+	case "csv":
+		return &csvRecordWriter{writer: csv.NewWriter(w)}, nil
+	case "ndjson", "":
+		buffered := bufio.NewWriter(w)
+		return &ndjsonRecordWriter{buffered: buffered, encoder: json.NewEncoder(buffered)}, nil
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
+
+// streamReader tells the errors of the underlying reader apart from the
+// errors of a single record.
+type streamReader struct {
+	reader io.Reader
+}
+
+func (s streamReader) Read(p []byte) (int, error) {
+	n, err := s.reader.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		err = fmt.Errorf("%w: %w", ErrCorruptedStream, err)
+	}
+	return n, err
+}
+
+var csvHeader = []string{"shortened", "url", "expiration", "hits"}
+
+type csvRecordReader struct {
+	reader *csv.Reader
+	header bool
+}
+
+func newCSVRecordReader(r io.Reader) *csvRecordReader {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	return &csvRecordReader{reader: reader}
+}
+
+func (c *csvRecordReader) Read() (LinkRecord, error) {
+	fields, err := c.reader.Read()
+	if err != nil {
+		return LinkRecord{}, err
+	}
+	if !c.header {
+		c.header = true
+		if len(fields) > 0 && fields[0] == csvHeader[0] {
+			return c.Read()
+		}
+	}
+	if len(fields) < 2 {
+		return LinkRecord{}, ErrInvalidURL
+	}
+	record := LinkRecord{Shortened: fields[0], URL: fields[1]}
+	if len(fields) > 2 && fields[2] != "" {
+		expiration, err := time.Parse(time.RFC3339, fields[2])
+		if err != nil {
+			return LinkRecord{}, err
+		}
+		record.Expiration = &expiration
+	}
+	if len(fields) > 3 && fields[3] != "" {
+		if record.Hits, err = strconv.Atoi(fields[3]); err != nil {
+			return LinkRecord{}, err
+		}
+	}
+	return record, nil
+}
+
+type csvRecordWriter struct {
+	writer *csv.Writer
+	header bool
+}
+
+func (c *csvRecordWriter) Write(record LinkRecord) error {
+	if !c.header {
+		c.header = true
+		if err := c.writer.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+	expiration := ""
+	if record.Expiration != nil {
+		expiration = record.Expiration.Format(time.RFC3339)
+	}
+	return c.writer.Write([]string{record.Shortened, record.URL, expiration, strconv.Itoa(record.Hits)})
+}
+
+func (c *csvRecordWriter) Flush() error {
+	if !c.header {
+		c.header = true
+		if err := c.writer.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+type ndjsonRecordReader struct {
+	decoder *json.Decoder
+}
+
+func (n *ndjsonRecordReader) Read() (LinkRecord, error) {
+	var record LinkRecord
+	err := n.decoder.Decode(&record)
+	var syntaxError *json.SyntaxError
+	if errors.As(err, &syntaxError) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return record, fmt.Errorf("%w: %w", ErrCorruptedStream, err)
+	}
+	return record, err
+}
+
+type ndjsonRecordWriter struct {
+	buffered *bufio.Writer
+	encoder  *json.Encoder
+}
+
+func (n *ndjsonRecordWriter) Write(record LinkRecord) error {
+	return n.encoder.Encode(record)
+}
+
+func (n *ndjsonRecordWriter) Flush() error {
+	return n.buffered.Flush()
+}
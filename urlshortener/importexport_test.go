@@ -0,0 +1,205 @@
+package urlshortener
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const importCSV = `shortened,url,expiration,hits
+abc,https://example.com/a,,12
+https://localhost:8080/u/def,https://example.com/d,2030-01-01T00:00:00Z,3
+ghi,not a url,,0
+`
+
+func TestImportExportRoundTrip(t *testing.T) {
+	app := NewInMemoryApplication()
+	reader, err := NewLinkRecordReader("csv", strings.NewReader(importCSV))
+	require.NoError(t, err)
+
+	report, err := app.Import(reader, ImportOptions{Policy: ConflictSkip})
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Read)
+	assert.Equal(t, 2, report.Created)
+	assert.Equal(t, 1, report.Failed)
+
+	got, err := app.Unshorten("https://localhost:8080/u/abc")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/a", got)
+
+	var output bytes.Buffer
+	writer, err := NewLinkRecordWriter("ndjson", &output)
+	require.NoError(t, err)
+	exported, err := app.Export(writer)
+	require.NoError(t, err)
+	assert.Equal(t, 2, exported)
+	assert.Equal(t, `{"shortened":"https://localhost:8080/u/abc","url":"https://example.com/a","hits":13}
+{"shortened":"https://localhost:8080/u/def","url":"https://example.com/d","expiration":"2030-01-01T00:00:00Z","hits":3}
+`, output.String())
+
+	other := NewInMemoryApplication()
+	reader, err = NewLinkRecordReader("ndjson", &output)
+	require.NoError(t, err)
+	report, err = other.Import(reader, ImportOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Created)
+	hits, err := other.countStore.Get("https://localhost:8080/u/abc")
+	require.NoError(t, err)
+	assert.Equal(t, 13, hits)
+}
+
+func TestImportConflictPolicies(t *testing.T) {
+	records := `{"shortened":"abc","url":"https://example.com/new","hits":5}`
+	setup := func(t *testing.T) *Application {
+		app := NewInMemoryApplication()
+		reader, err := NewLinkRecordReader("ndjson", strings.NewReader(`{"shortened":"abc","url":"https://example.com/old"}`))
+		require.NoError(t, err)
+		_, err = app.Import(reader, ImportOptions{})
+		require.NoError(t, err)
+		return app
+	}
+	destination := func(t *testing.T, app *Application) string {
+		got, err := app.Unshorten("https://localhost:8080/u/abc")
+		require.NoError(t, err)
+		return got
+	}
+
+	t.Run("skip", func(t *testing.T) {
+		app := setup(t)
+		reader, _ := NewLinkRecordReader("ndjson", strings.NewReader(records))
+		report, err := app.Import(reader, ImportOptions{Policy: ConflictSkip})
+		require.NoError(t, err)
+		assert.Equal(t, 1, report.Skipped)
+		assert.Equal(t, "https://example.com/old", destination(t, app))
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		app := setup(t)
+		reader, _ := NewLinkRecordReader("ndjson", strings.NewReader(records))
+		report, err := app.Import(reader, ImportOptions{Policy: ConflictOverwrite})
+		require.NoError(t, err)
+		assert.Equal(t, 1, report.Overwritten)
+		assert.Equal(t, "https://example.com/new", destination(t, app))
+	})
+
+	t.Run("overwrite_quarantined", func(t *testing.T) {
+		app := setup(t)
+		require.NoError(t, app.Quarantine("https://localhost:8080/u/abc", "phishing"))
+		reader, _ := NewLinkRecordReader("ndjson", strings.NewReader(records))
+		report, err := app.Import(reader, ImportOptions{Policy: ConflictOverwrite})
+		require.NoError(t, err)
+		assert.Equal(t, 1, report.Overwritten)
+		_, err = app.Resolve("https://localhost:8080/u/abc", Visitor{})
+		assert.ErrorIs(t, err, ErrQuarantined, "an import does not release quarantined links")
+	})
+
+	t.Run("overwrite_dry_run", func(t *testing.T) {
+		app := setup(t)
+		reader, _ := NewLinkRecordReader("ndjson", strings.NewReader(records))
+		report, err := app.Import(reader, ImportOptions{Policy: ConflictOverwrite, DryRun: true})
+		require.NoError(t, err)
+		assert.Equal(t, 1, report.Overwritten)
+		assert.Equal(t, "https://example.com/old", destination(t, app))
+	})
+
+	t.Run("fail_rolls_back", func(t *testing.T) {
+		app := setup(t)
+		reader, _ := NewLinkRecordReader("ndjson", strings.NewReader(`{"shortened":"xyz","url":"https://example.com/x"}
+`+records))
+		_, err := app.Import(reader, ImportOptions{Policy: ConflictFail})
+		assert.ErrorIs(t, err, ErrConflict)
+		_, err = app.Unshorten("https://localhost:8080/u/xyz")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+}
+
+type countingTransactor struct {
+	Transactor
+	transactions int
+}
+
+func (c *countingTransactor) Transaction(f func(store Storer, countStore CountStorer) error) error {
+	c.transactions++
+	return c.Transactor.Transaction(f)
+}
+
+func TestImportChunks(t *testing.T) {
+	app := NewInMemoryApplication()
+	transactor := &countingTransactor{Transactor: app.ArchiveUsecase.transactor}
+	app.ArchiveUsecase.transactor = transactor
+	records := func(from, to int) string {
+		var b strings.Builder
+		for i := from; i < to; i++ {
+			fmt.Fprintf(&b, `{"shortened":"code%d","url":"https://example.com/%d"}`+"\n", i, i)
+		}
+		return b.String()
+	}
+
+	reader, _ := NewLinkRecordReader("ndjson", strings.NewReader(records(0, 2*importChunkSize+1)))
+	report, err := app.Import(reader, ImportOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 2*importChunkSize+1, report.Created)
+	assert.Equal(t, 3, transactor.transactions, "each chunk is written in its own transaction")
+
+	reader, _ = NewLinkRecordReader("ndjson", strings.NewReader(records(2*importChunkSize+1, 4*importChunkSize)+
+		records(0, 1)))
+	_, err = app.Import(reader, ImportOptions{Policy: ConflictFail})
+	assert.ErrorIs(t, err, ErrConflict)
+	_, err = app.Unshorten(NewShortURL(fmt.Sprintf("code%d", 2*importChunkSize+1)).String())
+	assert.ErrorIs(t, err, ErrNotFound, "a conflict in the last chunk leaves the stores untouched")
+
+	reader, _ = NewLinkRecordReader("ndjson", strings.NewReader(`{"shortened":"dup","url":"https://example.com/1"}
+{"shortened":"dup","url":"https://example.com/2"}`))
+	_, err = app.Import(reader, ImportOptions{Policy: ConflictFail})
+	assert.ErrorIs(t, err, ErrConflict, "codes appearing twice in the import conflict")
+
+	reader, _ = NewLinkRecordReader("csv", io.MultiReader(strings.NewReader(importCSV),
+		iotest.ErrReader(errors.New("connection reset"))))
+	_, err = app.Import(reader, ImportOptions{})
+	assert.ErrorIs(t, err, ErrCorruptedStream, "the import stops at the first error reading the input")
+}
+
+func TestHTTPImportExport(t *testing.T) {
+	app := NewInMemoryApplication()
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/links:import?format=csv&policy=fail", strings.NewReader(importCSV))
+	recorder := handle(app, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"read": 3, "created": 2, "overwritten": 0, "skipped": 0, "failed": 1, "dry_run": false,
+		"errors": [{"record": 3, "error": "missing scheme"}]}`, recorder.Body.String())
+
+	recorder = handle(app, httptest.NewRequest(http.MethodGet, "/api/v1/links:export?format=csv", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "text/csv", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, `shortened,url,expiration,hits
+https://localhost:8080/u/abc,https://example.com/a,,12
+https://localhost:8080/u/def,https://example.com/d,2030-01-01T00:00:00Z,3
+`, recorder.Body.String())
+
+	recorder = handle(app, httptest.NewRequest(http.MethodPost, "/api/v1/links:import?policy=whatever", strings.NewReader("")))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestHTTPExportForbidden(t *testing.T) {
+	app := NewInMemoryApplication()
+	withoutRole := middlewareFunc(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			h.ServeHTTP(writer, request.WithContext(WithPrincipal(request.Context(), Principal{WorkspaceID: DefaultWorkspace})))
+		})
+	})
+	mux := withExportHandler(app.ArchiveUsecase, withoutRole)(http.NewServeMux())
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/links:export?format=csv", nil))
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, `{"error": "forbidden"}`, recorder.Body.String())
+}
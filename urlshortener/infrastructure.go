@@ -1,20 +1,95 @@
 package urlshortener
 
+import (
+	"os"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/ulule/limiter/v3"
+	"gorm.io/gorm"
+)
+
 type InfraStructure struct {
-	store      Storer
-	countStore CountStorer
+	store         Storer
+	countStore    CountStorer
+	campaignStore CampaignStorer
+	clickStore    ClickStorer
+	keyStore      APIKeyStorer
+	workspaces    WorkspaceStorer
+	quotaStore    QuotaStorer
+	moderation    ModerationStorer
+	linkHealth    LinkHealthStorer
+	transactor    Transactor
+	exporter      LinkExporter
+	limiterStore  limiter.Store
 }
 
 func NewInMemoryInfrastructure() *InfraStructure {
+	return newGormInfrastructure(NewInMemoryDB(), CacheOptions{})
+}
+
+func NewPGInfrastructure() *InfraStructure {
+	db := NewPGDB()
+	applyStartupMigrations(db)
+	return newGormInfrastructure(db, cacheOptionsFromEnv())
+}
+
+// newGormInfrastructure encrypts destinations with URL_ENCRYPTION_KEYS, if
+// set, and caches links when the cache has a size.
+func newGormInfrastructure(db *gorm.DB, cacheOptions CacheOptions) *InfraStructure {
+	cipher := urlCipherFromEnv()
+	pgStore := NewPGStoreFromDB(db)
+	pgStore.WithCipher(cipher)
+	var store Storer = pgStore
+	var cache *CachedStore
+	if cacheOptions.Size > 0 {
+		cache = NewCachedStore(pgStore, cacheOptions)
+		store = cache
+	}
+	linkHealth := NewPGLinkHealthStoreFromDB(db)
+	linkHealth.WithCipher(cipher)
+	transactor := NewPGTransactor(db, cache)
+	transactor.WithCipher(cipher)
+	exporter := NewPGLinkExporter(db)
+	exporter.WithCipher(cipher)
 	return &InfraStructure{
-		store:      NewInMemorySqlite(),
-		countStore: NewInMemoryCountStore(),
+		store:         store,
+		countStore:    NewPGCountStoreFromDB(db),
+		campaignStore: NewPGCampaignStoreFromDB(db),
+		clickStore:    NewPGClickStoreFromDB(db),
+		keyStore:      NewPGAPIKeyStoreFromDB(db),
+		workspaces:    NewPGWorkspaceStoreFromDB(db),
+		quotaStore:    NewPGQuotaStoreFromDB(db),
+		moderation:    NewPGModerationStoreFromDB(db),
+		linkHealth:    linkHealth,
+		transactor:    transactor,
+		exporter:      exporter,
+		limiterStore:  newMemoryLimiterStore(),
 	}
 }
 
-func NewPGInfrastructure() *InfraStructure {
+func NewRedisInfrastructure() *InfraStructure {
+	return NewRedisInfrastructureFromClient(NewRedisClient(), os.Getenv("REDIS_RATE_LIMIT") == "shared")
+}
+
+func NewRedisInfrastructureFromClient(client *redis.Client, sharedRateLimit bool) *InfraStructure {
+	limiterStore := newMemoryLimiterStore()
+	if sharedRateLimit {
+		limiterStore = newRedisLimiterStore(client)
+	}
+	store := NewRedisStoreFromClient(client)
+	countStore := NewRedisCountStoreFromClient(client)
 	return &InfraStructure{
-		store:      NewPG(),
-		countStore: NewPGCountStore(),
+		store:         store,
+		countStore:    countStore,
+		campaignStore: NewRedisCampaignStoreFromClient(client),
+		clickStore:    NewRedisClickStoreFromClient(client),
+		keyStore:      NewRedisAPIKeyStoreFromClient(client),
+		workspaces:    NewRedisWorkspaceStoreFromClient(client),
+		quotaStore:    NewRedisQuotaStoreFromClient(client),
+		moderation:    NewRedisModerationStoreFromClient(client),
+		linkHealth:    NewRedisLinkHealthStoreFromClient(client),
+		transactor:    sequentialTransactor{store: store, countStore: countStore},
+		exporter:      &RedisLinkExporter{client: client},
+		limiterStore:  limiterStore,
 	}
 }
@@ -0,0 +1,366 @@
+package urlshortener
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+var ErrUnknownSigningKey = errors.New("unknown signing key")
+
+const (
+	// jwksMinRefreshInterval bounds how often tokens signed by unknown keys
+	// can make us fetch the JWKS document again.
+	jwksMinRefreshInterval = time.Minute
+)
+
+// JWKS caches the public keys of an identity provider. They are fetched again
+// once the TTL is over, or when a token names a key the cache does not know,
+// which is how rotated keys are picked up.
+type JWKS struct {
+	url    string
+	client *http.Client
+	clock  clockwork.Clock
+	ttl    time.Duration
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+func NewJWKS(url string, client *http.Client, ttl time.Duration) *JWKS {
+	return &JWKS{url: url, client: client, clock: clockwork.NewRealClock(), ttl: ttl}
+}
+
+// Key returns the public key with the given ID. Stale keys keep being served
+// while the identity provider cannot be reached.
+func (j *JWKS) Key(kid string) (crypto.PublicKey, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	since := j.clock.Since(j.fetchedAt)
+	_, known := j.keys[kid]
+	if j.keys == nil || since >= j.ttl || (!known && since >= jwksMinRefreshInterval) {
+		if err := j.refresh(); err != nil && j.keys == nil {
+			return nil, err
+		}
+	}
+	key, ok := j.keys[kid]
+	if !ok {
+		return nil, ErrUnknownSigningKey
+	}
+	return key, nil
+}
+
+func (j *JWKS) Refresh() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.refresh()
+}
+
+func (j *JWKS) refresh() error {
+	response, err := j.client.Get(j.url)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch JWKS: %s", response.Status)
+	}
+	var document struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&document); err != nil {
+		return fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(document.Keys))
+	for _, k := range document.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			// a key of an unsupported type must not hide the others
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	j.keys = keys
+	j.fetchedAt = j.clock.Now()
+	return nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// JWTOptions tells which tokens to accept and where their claims put the
+// user, workspace, role and scopes of the caller.
+type JWTOptions struct {
+	Issuer   string
+	Audience string
+	// Skew is the clock difference tolerated with the identity provider.
+	Skew           time.Duration
+	WorkspaceClaim string
+	RoleClaim      string
+}
+
+type JWTVerifier struct {
+	keys    *JWKS
+	options JWTOptions
+}
+
+func NewJWTVerifier(keys *JWKS, options JWTOptions) *JWTVerifier {
+	if options.WorkspaceClaim == "" {
+		options.WorkspaceClaim = "workspace"
+	}
+	if options.RoleClaim == "" {
+		options.RoleClaim = "role"
+	}
+	return &JWTVerifier{keys: keys, options: options}
+}
+
+// jwtVerifierFromEnv returns nil unless JWT_JWKS_URL is set.
+func jwtVerifierFromEnv() *JWTVerifier {
+	url := os.Getenv("JWT_JWKS_URL")
+	if url == "" {
+		return nil
+	}
+	keys := NewJWKS(url, &http.Client{Timeout: 10 * time.Second}, envDuration("JWT_JWKS_TTL", time.Hour))
+	return NewJWTVerifier(keys, JWTOptions{
+		Issuer:         os.Getenv("JWT_ISSUER"),
+		Audience:       os.Getenv("JWT_AUDIENCE"),
+		Skew:           envDuration("JWT_CLOCK_SKEW", time.Minute),
+		WorkspaceClaim: os.Getenv("JWT_WORKSPACE_CLAIM"),
+		RoleClaim:      os.Getenv("JWT_ROLE_CLAIM"),
+	})
+}
+
+// jwtClaims are the claims of a verified token that map to a principal.
+type jwtClaims struct {
+	Subject   string
+	Workspace string
+	Role      string
+	Scopes    []string
+}
+
+// Verify checks the signature, issuer, audience and validity period of the
+// token at the given time and returns its claims. Errors other than
+// ErrInvalidToken mean the token could not be checked at all.
+func (v *JWTVerifier) Verify(token string, now time.Time) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtClaims{}, ErrInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return jwtClaims{}, ErrInvalidToken
+	}
+	key, err := v.keys.Key(header.Kid)
+	if errors.Is(err, ErrUnknownSigningKey) {
+		return jwtClaims{}, ErrInvalidToken
+	}
+	if err != nil {
+		return jwtClaims{}, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature) {
+		return jwtClaims{}, ErrInvalidToken
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return jwtClaims{}, ErrInvalidToken
+	}
+	if err := v.checkTimes(claims, now); err != nil {
+		return jwtClaims{}, err
+	}
+	if v.options.Issuer != "" && claims["iss"] != v.options.Issuer {
+		return jwtClaims{}, ErrInvalidToken
+	}
+	if v.options.Audience != "" && !audienceContains(claims["aud"], v.options.Audience) {
+		return jwtClaims{}, ErrInvalidToken
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return jwtClaims{}, ErrInvalidToken
+	}
+	workspace, _ := claims[v.options.WorkspaceClaim].(string)
+	role, _ := claims[v.options.RoleClaim].(string)
+	return jwtClaims{Subject: subject, Workspace: workspace, Role: role, Scopes: scopesClaim(claims["scope"])}, nil
+}
+
+// checkTimes requires an expiry, and tolerates the configured skew on it as
+// on the not-before and issued-at times.
+func (v *JWTVerifier) checkTimes(claims map[string]any, now time.Time) error {
+	exp, ok := numericDate(claims["exp"])
+	if !ok || !now.Before(exp.Add(v.options.Skew)) {
+		return ErrInvalidToken
+	}
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Add(v.options.Skew).Before(nbf) {
+		return ErrInvalidToken
+	}
+	if iat, ok := numericDate(claims["iat"]); ok && now.Add(v.options.Skew).Before(iat) {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// verifySignature only accepts the asymmetric algorithms matching the type of
+// the key, so that neither "none" nor a public key used as an HMAC secret can
+// get a forged token through.
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) bool {
+	var h hash.Hash
+	var hashID crypto.Hash
+	switch alg[min(len(alg), 2):] {
+	case "256":
+		h, hashID = sha256.New(), crypto.SHA256
+	case "384":
+		h, hashID = sha512.New384(), crypto.SHA384
+	case "512":
+		h, hashID = sha512.New(), crypto.SHA512
+	default:
+		return false
+	}
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(key, hashID, digest, signature) == nil
+		case "PS":
+			return rsa.VerifyPSS(key, hashID, digest, signature, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(signature) != 2*size || hashID.Size() != size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+func numericDate(v any) (time.Time, bool) {
+	seconds, ok := v.(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+func audienceContains(v any, audience string) bool {
+	switch aud := v.(type) {
+	case string:
+		return aud == audience
+	case []any:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scopesClaim reads the space separated scope claim of OAuth 2.0 access
+// tokens, or a list of scopes.
+func scopesClaim(v any) []string {
+	switch scope := v.(type) {
+	case string:
+		return strings.Fields(scope)
+	case []any:
+		var scopes []string
+		for _, s := range scope {
+			if s, ok := s.(string); ok {
+				scopes = append(scopes, s)
+			}
+		}
+		return scopes
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package urlshortener
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testIdentityProvider serves the JWKS document of its keys and signs tokens
+// with them.
+type testIdentityProvider struct {
+	server  *httptest.Server
+	fetches atomic.Int32
+	rsaKeys map[string]*rsa.PrivateKey
+	ecKey   *ecdsa.PrivateKey
+}
+
+func newTestIdentityProvider(t *testing.T) *testIdentityProvider {
+	p := &testIdentityProvider{rsaKeys: map[string]*rsa.PrivateKey{}}
+	p.rotate(t, "rsa-1")
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	p.ecKey = ecKey
+	p.server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		p.fetches.Add(1)
+		encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+		keys := []map[string]string{{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": encode(p.ecKey.X.FillBytes(make([]byte, 32))),
+			"y": encode(p.ecKey.Y.FillBytes(make([]byte, 32)))}}
+		for kid, key := range p.rsaKeys {
+			keys = append(keys, map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": encode(key.N.Bytes()),
+				"e": encode(big.NewInt(int64(key.E)).Bytes())})
+		}
+		_ = json.NewEncoder(writer).Encode(map[string]any{"keys": keys})
+	}))
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *testIdentityProvider) rotate(t *testing.T, kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	p.rsaKeys[kid] = key
+}
+
+func (p *testIdentityProvider) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch alg {
+	case "RS256":
+		key, ok := p.rsaKeys[kid]
+		if !ok {
+			// tokens naming a key the provider does not publish
+			key = p.rsaKeys["rsa-1"]
+		}
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, p.ecKey, digest[:])
+		require.NoError(t, err)
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (p *testIdentityProvider) verifier(clock clockwork.Clock) *JWTVerifier {
+	keys := NewJWKS(p.server.URL, p.server.Client(), time.Hour)
+	keys.clock = clock
+	return NewJWTVerifier(keys, JWTOptions{Issuer: "https://idp.example.com", Audience: "url-shortener", Skew: time.Minute})
+}
+
+func TestJWTVerifier(t *testing.T) {
+	provider := newTestIdentityProvider(t)
+	clock := clockwork.NewFakeClockAt(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	verifier := provider.verifier(clock)
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{"iss": "https://idp.example.com", "aud": []string{"url-shortener"}, "sub": "alice",
+			"exp": clock.Now().Add(5 * time.Minute).Unix(), "iat": clock.Now().Unix(), "workspace": "team", "role": "editor",
+			"scope": "links:write links:read"}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+
+	verified, err := verifier.Verify(provider.sign(t, "RS256", "rsa-1", claims(nil)), clock.Now())
+	require.NoError(t, err)
+	assert.Equal(t, jwtClaims{Subject: "alice", Workspace: "team", Role: "editor", Scopes: []string{ScopeLinksWrite, ScopeLinksRead}}, verified)
+	_, err = verifier.Verify(provider.sign(t, "ES256", "ec-1", claims(nil)), clock.Now())
+	require.NoError(t, err)
+
+	tests := map[string]string{
+		"expired":         provider.sign(t, "RS256", "rsa-1", claims(map[string]any{"exp": clock.Now().Add(-2 * time.Minute).Unix()})),
+		"no expiry":       provider.sign(t, "RS256", "rsa-1", claims(map[string]any{"exp": nil})),
+		"not yet valid":   provider.sign(t, "RS256", "rsa-1", claims(map[string]any{"nbf": clock.Now().Add(2 * time.Minute).Unix()})),
+		"issuer":          provider.sign(t, "RS256", "rsa-1", claims(map[string]any{"iss": "https://evil.example.com"})),
+		"audience":        provider.sign(t, "RS256", "rsa-1", claims(map[string]any{"aud": "other"})),
+		"no subject":      provider.sign(t, "RS256", "rsa-1", claims(map[string]any{"sub": ""})),
+		"algorithm none":  provider.sign(t, "none", "rsa-1", claims(nil)),
+		"algorithm mixup": provider.sign(t, "ES256", "rsa-1", claims(nil)),
+		"unknown key":     provider.sign(t, "RS256", "unknown", claims(nil)),
+		"tampered":        provider.sign(t, "RS256", "rsa-1", claims(nil))[:40] + "x" + provider.sign(t, "RS256", "rsa-1", claims(nil))[41:],
+		"malformed":       "not-a-jwt",
+	}
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := verifier.Verify(token, clock.Now())
+			assert.ErrorIs(t, err, ErrInvalidToken)
+		})
+	}
+
+	skewed := provider.sign(t, "RS256", "rsa-1", claims(map[string]any{"exp": clock.Now().Add(-30 * time.Second).Unix(),
+		"iat": clock.Now().Add(30 * time.Second).Unix()}))
+	_, err = verifier.Verify(skewed, clock.Now())
+	assert.NoError(t, err)
+}
+
+func TestJWKSRefresh(t *testing.T) {
+	provider := newTestIdentityProvider(t)
+	clock := clockwork.NewFakeClockAt(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	verifier := provider.verifier(clock)
+	claims := func() map[string]any {
+		return map[string]any{"iss": "https://idp.example.com", "aud": "url-shortener", "sub": "alice",
+			"exp": clock.Now().Add(5 * time.Minute).Unix()}
+	}
+
+	for range 3 {
+		_, err := verifier.Verify(provider.sign(t, "RS256", "rsa-1", claims()), clock.Now())
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(1), provider.fetches.Load())
+
+	provider.rotate(t, "rsa-2")
+	_, err := verifier.Verify(provider.sign(t, "RS256", "rsa-2", claims()), clock.Now())
+	assert.ErrorIs(t, err, ErrInvalidToken, "unknown keys are not fetched more than once a minute")
+	clock.Advance(jwksMinRefreshInterval)
+	_, err = verifier.Verify(provider.sign(t, "RS256", "rsa-2", claims()), clock.Now())
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), provider.fetches.Load())
+
+	clock.Advance(time.Hour)
+	provider.server.Close()
+	_, err = verifier.Verify(provider.sign(t, "RS256", "rsa-1", claims()), clock.Now())
+	assert.NoError(t, err, "stale keys are served while the provider is down")
+
+	unreachable := NewJWTVerifier(NewJWKS(provider.server.URL, http.DefaultClient, time.Hour), JWTOptions{})
+	_, err = unreachable.Verify(provider.sign(t, "RS256", "rsa-1", claims()), clock.Now())
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestHTTPJWTAuth(t *testing.T) {
+	t.Setenv("API_AUTH", "required")
+	provider := newTestIdentityProvider(t)
+	clock := clockwork.NewFakeClockAt(time.Now())
+	app := NewInMemoryApplication()
+	app.AuthUsecase.clock = clock
+	app.AuthUsecase.WithJWT(provider.verifier(clock))
+	member := newTestWorkspaceMember(t, app, "alice")
+	token := func(claims map[string]any) string {
+		claims["iss"], claims["aud"], claims["exp"] = "https://idp.example.com", "url-shortener", clock.Now().Add(time.Minute).Unix()
+		return provider.sign(t, "RS256", "rsa-1", claims)
+	}
+
+	testServer := httptest.NewServer(app.server.mux)
+	defer testServer.Close()
+	newClient := func(token string) *HTTPClient {
+		return NewHTTPClientFromResty(resty.NewWithClient(testServer.Client()).SetBaseURL(testServer.URL)).WithAPIKey(token)
+	}
+
+	short, err := newClient(token(map[string]any{"sub": member.user.ID, "workspace": member.workspace.ID})).
+		Shorten("https://example.com/docs", nil)
+	require.NoError(t, err)
+	stored, err := app.store.Get(short)
+	require.NoError(t, err)
+	assert.Equal(t, member.workspace.ID, stored.Workspace())
+	assert.Equal(t, member.user.ID, stored.CreatedBy())
+
+	_, err = newClient(token(map[string]any{"sub": "service", "workspace": member.workspace.ID, "role": "viewer"})).
+		Shorten("https://example.com/docs", nil)
+	assert.ErrorIs(t, err, ErrForbidden)
+	_, err = newClient(token(map[string]any{"sub": "service", "workspace": member.workspace.ID, "role": "editor",
+		"scope": "links:read"})).Shorten("https://example.com/docs", nil)
+	assert.ErrorIs(t, err, ErrForbidden)
+	_, err = newClient(token(map[string]any{"sub": "stranger", "workspace": member.workspace.ID})).Shorten("https://example.com/docs", nil)
+	assert.ErrorIs(t, err, ErrUnauthorized)
+
+	expiring := token(map[string]any{"sub": member.user.ID, "workspace": member.workspace.ID})
+	clock.Advance(2 * time.Minute)
+	_, err = newClient(expiring).Shorten("https://example.com/docs", nil)
+	assert.ErrorIs(t, err, ErrUnauthorized)
+
+	apiKey, _, err := app.IssueKey(APIKey{Name: "ci", Scopes: []string{ScopeLinksRead}})
+	require.NoError(t, err)
+	_, err = newClient(apiKey).Unshorten(short)
+	assert.NoError(t, err, "API keys keep working next to JWTs")
+}
@@ -0,0 +1,617 @@
+package urlshortener
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrLinkNotChecked = errors.New("link was not checked yet")
+
+var linkCheckMetrics = expvar.NewMap("link_checker")
+
+// LinkHealth is the outcome of the last check of the destination of a link.
+type LinkHealth struct {
+	Shortened   string `json:"shortened" gorm:"primaryKey"`
+	WorkspaceID string `json:"-"`
+	URL         string `json:"url"`
+	Status      int    `json:"status,omitempty"`
+	// FinalURL is where the redirects of the destination led.
+	FinalURL  string    `json:"final_url,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Broken    bool      `json:"broken"`
+	CheckedAt time.Time `json:"checked_at"`
+	// BrokenSince is the first of the checks the destination failed in a row.
+	BrokenSince *time.Time `json:"broken_since,omitempty"`
+}
+
+func (LinkHealth) TableName() string {
+	return "link_health"
+}
+
+// brokenStatus leaves out the statuses of pages that exist but are private or
+// rate limited: only missing pages and failing servers count as broken.
+func brokenStatus(status int) bool {
+	return status == http.StatusNotFound || status == http.StatusGone || status >= http.StatusInternalServerError
+}
+
+type LinkHealthStorer interface {
+	Save(health LinkHealth) error
+	Get(shortened string) (LinkHealth, error)
+	// Broken lists the broken links of the workspace, or of every workspace
+	// for an empty one.
+	Broken(workspaceID string) ([]LinkHealth, error)
+	Delete(shortened string) error
+}
+
+type LinkCheckerOptions struct {
+	// Concurrency is how many destinations are checked at once.
+	Concurrency int
+	// HostInterval is the least time between two requests to the same host.
+	HostInterval time.Duration
+	// Timeout bounds the requests of each check, redirects included. The time
+	// spent waiting for a host, see HostInterval, does not count.
+	Timeout   time.Duration
+	UserAgent string
+	// AllowPrivate lets the checker reach private addresses, which it
+	// otherwise refuses so that link owners cannot probe the internal network.
+	AllowPrivate bool
+}
+
+func DefaultLinkCheckerOptions() LinkCheckerOptions {
+	return LinkCheckerOptions{Concurrency: 8, HostInterval: time.Second, Timeout: 10 * time.Second,
+		UserAgent: "url-shortener-link-checker/1.0"}
+}
+
+// LinkChecker requests destinations with HEAD, falling back to GET for the
+// servers that do not support it. It follows the redirects itself, to wait
+// for each host outside of the timeout.
+type LinkChecker struct {
+	client  *http.Client
+	hosts   *hostSlots
+	options LinkCheckerOptions
+}
+
+func NewLinkChecker(options LinkCheckerOptions) *LinkChecker {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if !options.AllowPrivate {
+		dialer := &net.Dialer{Timeout: options.Timeout, Control: refusePrivateAddresses}
+		transport.DialContext = dialer.DialContext
+	}
+	client := &http.Client{Transport: transport, CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	return &LinkChecker{client: client, hosts: newHostSlots(options.HostInterval), options: options}
+}
+
+// refusePrivateAddresses runs on the resolved address, so that host names
+// pointing at private addresses are refused as well.
+func refusePrivateAddresses(_, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	addr := addrPort.Addr().Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() {
+		return fmt.Errorf("%w: %s", ErrPrivateDestination, addr)
+	}
+	return nil
+}
+
+// Check returns the status and final URL of the destination. It fails with
+// ErrLinkNotChecked when the context ends while waiting for a host.
+func (c *LinkChecker) Check(ctx context.Context, rawURL string) (int, string, error) {
+	status, finalURL, err := c.request(ctx, http.MethodHead, rawURL)
+	if err == nil && headUnsupported(status) {
+		return c.request(ctx, http.MethodGet, rawURL)
+	}
+	return status, finalURL, err
+}
+
+func headUnsupported(status int) bool {
+	switch status {
+	case http.StatusBadRequest, http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return true
+	default:
+		return false
+	}
+}
+
+// maxLinkCheckRedirects is how many redirects a check follows, as many as
+// the HTTP client does.
+const maxLinkCheckRedirects = 10
+
+func (c *LinkChecker) request(ctx context.Context, method, rawURL string) (int, string, error) {
+	remaining := c.options.Timeout
+	for redirects := 0; ; redirects++ {
+		request, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+		if err != nil {
+			return 0, "", err
+		}
+		if err := c.hosts.wait(ctx, request.URL.Host); err != nil {
+			return 0, "", fmt.Errorf("%w: %w", ErrLinkNotChecked, err)
+		}
+		start := time.Now()
+		response, err := c.do(request, remaining)
+		if err != nil {
+			return 0, "", err
+		}
+		remaining -= time.Since(start)
+		location, err := response.Location()
+		if errors.Is(err, http.ErrNoLocation) || !redirectStatus(response.StatusCode) {
+			return response.StatusCode, rawURL, nil
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		if redirects == maxLinkCheckRedirects {
+			return 0, "", fmt.Errorf("stopped after %d redirects", maxLinkCheckRedirects)
+		}
+		rawURL = location.String()
+	}
+}
+
+func redirectStatus(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect,
+		http.StatusPermanentRedirect:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *LinkChecker) do(request *http.Request, timeout time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(request.Context(), timeout)
+	defer cancel()
+	request = request.WithContext(ctx)
+	request.Header.Set("User-Agent", c.options.UserAgent)
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	// the body is not read: the status is all the checker needs
+	_ = response.Body.Close()
+	return response, nil
+}
+
+// maxPoliteHosts is how many hosts are remembered before the ones that can
+// be requested again right away are forgotten.
+const maxPoliteHosts = 1024
+
+// hostSlots spaces the requests made to each host.
+type hostSlots struct {
+	interval time.Duration
+
+	mu    sync.Mutex
+	slots map[string]time.Time
+}
+
+func newHostSlots(interval time.Duration) *hostSlots {
+	return &hostSlots{interval: interval, slots: map[string]time.Time{}}
+}
+
+// wait returns once the host can be requested, or the context error.
+func (h *hostSlots) wait(ctx context.Context, host string) error {
+	if h.interval <= 0 {
+		return nil
+	}
+	h.mu.Lock()
+	now := time.Now()
+	slot := h.slots[host]
+	if slot.Before(now) {
+		slot = now
+	}
+	h.slots[host] = slot.Add(h.interval)
+	if len(h.slots) > maxPoliteHosts {
+		for host, next := range h.slots {
+			if next.Before(now) {
+				delete(h.slots, host)
+			}
+		}
+	}
+	h.mu.Unlock()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(slot.Sub(now)):
+		return nil
+	}
+}
+
+// LinkCheckResult sums up a pass over the stored links.
+type LinkCheckResult struct {
+	Checked int `json:"checked"`
+	Broken  int `json:"broken"`
+}
+
+type LinkHealthUsecase struct {
+	urls      Storer
+	health    LinkHealthStorer
+	links     LinkExporter
+	checker   *LinkChecker
+	clock     clockwork.Clock
+	principal *Principal
+}
+
+func NewLinkHealthUsecase(urls Storer, health LinkHealthStorer, links LinkExporter, checker *LinkChecker) *LinkHealthUsecase {
+	return &LinkHealthUsecase{urls: urls, health: health, links: links, checker: checker, clock: clockwork.NewRealClock()}
+}
+
+func (l *LinkHealthUsecase) As(principal Principal) *LinkHealthUsecase {
+	u := *l
+	u.principal = &principal
+	return &u
+}
+
+// CheckAll checks the destination of every link that has not expired. It is
+// left to the system: it requests every destination of every workspace.
+func (l *LinkHealthUsecase) CheckAll(ctx context.Context) (LinkCheckResult, error) {
+	if l.principal != nil {
+		return LinkCheckResult{}, ErrForbidden
+	}
+	now := l.clock.Now()
+	var records []LinkRecord
+	// the links are walked first, since some stores cannot be written while
+	// they are read
+	err := l.links.ExportLinks("", func(record LinkRecord) error {
+		if record.Expiration == nil || record.Expiration.After(now) {
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return LinkCheckResult{}, err
+	}
+
+	var mu sync.Mutex
+	var result LinkCheckResult
+	var firstErr error
+	work := make(chan LinkRecord)
+	var wg sync.WaitGroup
+	for range max(l.checker.options.Concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for record := range work {
+				health, err := l.check(ctx, record)
+				mu.Lock()
+				if !errors.Is(err, ErrLinkNotChecked) {
+					result.Checked++
+				}
+				if health.Broken {
+					result.Broken++
+				}
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, record := range records {
+		if ctx.Err() != nil {
+			break
+		}
+		work <- record
+	}
+	close(work)
+	wg.Wait()
+
+	linkCheckMetrics.Add("checks", int64(result.Checked))
+	brokenLinks := new(expvar.Int)
+	brokenLinks.Set(int64(result.Broken))
+	linkCheckMetrics.Set("broken_links", brokenLinks)
+	return result, firstErr
+}
+
+func (l *LinkHealthUsecase) check(ctx context.Context, record LinkRecord) (LinkHealth, error) {
+	status, finalURL, err := l.checker.Check(ctx, record.URL)
+	if errors.Is(err, ErrLinkNotChecked) {
+		// the last check of the link stands
+		return LinkHealth{}, err
+	}
+	health := LinkHealth{Shortened: record.Shortened, WorkspaceID: workspaceOrDefault(record.Workspace), URL: record.URL,
+		Status: status, FinalURL: finalURL, CheckedAt: l.clock.Now()}
+	if err != nil {
+		health.Error = err.Error()
+		linkCheckMetrics.Add("errors", 1)
+	}
+	health.Broken = err != nil || brokenStatus(status)
+	if health.Broken {
+		previous, err := l.health.Get(record.Shortened)
+		if err != nil && !errors.Is(err, ErrLinkNotChecked) {
+			return health, err
+		}
+		if previous.BrokenSince != nil {
+			health.BrokenSince = previous.BrokenSince
+		} else {
+			health.BrokenSince = &health.CheckedAt
+		}
+	}
+	return health, l.health.Save(health)
+}
+
+// Health returns the last check of the link.
+func (l *LinkHealthUsecase) Health(rawURL string) (LinkHealth, error) {
+	if err := authorize(l.principal, ActionViewLinks); err != nil {
+		return LinkHealth{}, err
+	}
+	u, err := l.urls.Get(rawURL)
+	if err != nil || !canAccess(l.principal, u.Workspace()) {
+		return LinkHealth{}, ErrNotFound
+	}
+	return l.health.Get(rawURL)
+}
+
+// Broken lists the broken links of the principal workspace, or of every
+// workspace for the system. The checks of links deleted since are dropped.
+func (l *LinkHealthUsecase) Broken() ([]LinkHealth, error) {
+	if err := authorize(l.principal, ActionViewLinks); err != nil {
+		return nil, err
+	}
+	workspaceID := ""
+	if l.principal != nil {
+		workspaceID = workspaceOf(l.principal)
+	}
+	broken, err := l.health.Broken(workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	links := make([]LinkHealth, 0, len(broken))
+	for _, health := range broken {
+		if _, err := l.urls.Get(health.Shortened); errors.Is(err, ErrNotFound) {
+			_ = l.health.Delete(health.Shortened)
+			continue
+		}
+		links = append(links, health)
+	}
+	return links, nil
+}
+
+// Watch checks every link each interval until the context is done.
+func (l *LinkHealthUsecase) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, _ = l.CheckAll(ctx)
+		}
+	}
+}
+
+// linkCheckerFromEnv reads LINK_CHECK_CONCURRENCY, LINK_CHECK_HOST_INTERVAL
+// and LINK_CHECK_TIMEOUT. LINK_CHECK_ALLOW_PRIVATE lets it reach private
+// addresses.
+func linkCheckerFromEnv() *LinkChecker {
+	options := DefaultLinkCheckerOptions()
+	options.Concurrency = envInt("LINK_CHECK_CONCURRENCY", options.Concurrency)
+	options.HostInterval = envDuration("LINK_CHECK_HOST_INTERVAL", options.HostInterval)
+	options.Timeout = envDuration("LINK_CHECK_TIMEOUT", options.Timeout)
+	options.AllowPrivate = os.Getenv("LINK_CHECK_ALLOW_PRIVATE") == "true"
+	return NewLinkChecker(options)
+}
+
+// watchLinkHealthFromEnv checks every link each LINK_CHECK_INTERVAL, 0 to
+// never.
+func watchLinkHealthFromEnv(ctx context.Context, l *LinkHealthUsecase) {
+	if interval := envDuration("LINK_CHECK_INTERVAL", 0); interval > 0 {
+		go l.Watch(ctx, interval)
+	}
+}
+
+type PGLinkHealthStore struct {
+	db     *gorm.DB
+	cipher *URLCipher
+}
+
+func NewPGLinkHealthStoreFromDB(db *gorm.DB) *PGLinkHealthStore {
+	return &PGLinkHealthStore{db: db}
+}
+
+// WithCipher encrypts the destinations of the checks like those of the
+// links.
+func (p *PGLinkHealthStore) WithCipher(cipher *URLCipher) {
+	p.cipher = cipher
+}
+
+func (p *PGLinkHealthStore) Save(health LinkHealth) error {
+	if p.cipher != nil {
+		for _, value := range []*string{&health.URL, &health.FinalURL} {
+			if *value == "" {
+				continue
+			}
+			encrypted, err := p.cipher.Encrypt(*value)
+			if err != nil {
+				return err
+			}
+			*value = encrypted
+		}
+	}
+	return p.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&health).Error
+}
+
+func (p *PGLinkHealthStore) open(health *LinkHealth) error {
+	for _, value := range []*string{&health.URL, &health.FinalURL} {
+		decrypted, err := decryptURL(p.cipher, *value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", health.Shortened, err)
+		}
+		*value = decrypted
+	}
+	return nil
+}
+
+func (p *PGLinkHealthStore) Get(shortened string) (LinkHealth, error) {
+	var checks []LinkHealth
+	if err := p.db.Where("shortened = ?", shortened).Limit(1).Find(&checks).Error; err != nil {
+		return LinkHealth{}, err
+	}
+	if len(checks) == 0 {
+		return LinkHealth{}, ErrLinkNotChecked
+	}
+	return checks[0], p.open(&checks[0])
+}
+
+func (p *PGLinkHealthStore) Broken(workspaceID string) ([]LinkHealth, error) {
+	query := p.db.Where("broken = ?", true).Order("broken_since, shortened")
+	if workspaceID != "" {
+		query = query.Where("workspace_id = ?", workspaceID)
+	}
+	var broken []LinkHealth
+	if err := query.Find(&broken).Error; err != nil {
+		return nil, err
+	}
+	for i := range broken {
+		if err := p.open(&broken[i]); err != nil {
+			return nil, err
+		}
+	}
+	return broken, nil
+}
+
+// Reencrypt encrypts the destinations of the checks under the active key,
+// batch by batch, and returns how many checks changed.
+func (p *PGLinkHealthStore) Reencrypt(batchSize int) (int, error) {
+	return reencryptTable(p.db, p.cipher, "link_health", batchSize, false, "url", "final_url")
+}
+
+func (p *PGLinkHealthStore) Delete(shortened string) error {
+	return p.db.Delete(&LinkHealth{}, "shortened = ?", shortened).Error
+}
+
+const (
+	redisLinkHealthKey     = "link-health"
+	redisBrokenLinksPrefix = "broken-links:"
+)
+
+// redisLinkHealth keeps the workspace, which the API representation leaves
+// out.
+type redisLinkHealth struct {
+	LinkHealth
+	WorkspaceID string `json:"workspace_id"`
+}
+
+type RedisLinkHealthStore struct {
+	client *redis.Client
+}
+
+func NewRedisLinkHealthStoreFromClient(client *redis.Client) *RedisLinkHealthStore {
+	return &RedisLinkHealthStore{client: client}
+}
+
+// Save indexes the broken links by workspace.
+func (r *RedisLinkHealthStore) Save(health LinkHealth) error {
+	ctx := context.Background()
+	b, err := json.Marshal(redisLinkHealth{LinkHealth: health, WorkspaceID: health.WorkspaceID})
+	if err != nil {
+		return err
+	}
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, redisLinkHealthKey, health.Shortened, b)
+		if health.Broken {
+			pipe.SAdd(ctx, redisBrokenLinksPrefix+health.WorkspaceID, health.Shortened)
+		} else {
+			pipe.SRem(ctx, redisBrokenLinksPrefix+health.WorkspaceID, health.Shortened)
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *RedisLinkHealthStore) Get(shortened string) (LinkHealth, error) {
+	b, err := r.client.HGet(context.Background(), redisLinkHealthKey, shortened).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return LinkHealth{}, ErrLinkNotChecked
+	}
+	if err != nil {
+		return LinkHealth{}, err
+	}
+	return decodeRedisLinkHealth(b)
+}
+
+func decodeRedisLinkHealth(b []byte) (LinkHealth, error) {
+	var health redisLinkHealth
+	if err := json.Unmarshal(b, &health); err != nil {
+		return LinkHealth{}, err
+	}
+	health.LinkHealth.WorkspaceID = health.WorkspaceID
+	return health.LinkHealth, nil
+}
+
+func (r *RedisLinkHealthStore) Broken(workspaceID string) ([]LinkHealth, error) {
+	ctx := context.Background()
+	var values []string
+	if workspaceID == "" {
+		all, err := r.client.HVals(ctx, redisLinkHealthKey).Result()
+		if err != nil {
+			return nil, err
+		}
+		values = all
+	} else {
+		codes, err := r.client.SMembers(ctx, redisBrokenLinksPrefix+workspaceID).Result()
+		if err != nil || len(codes) == 0 {
+			return nil, err
+		}
+		found, err := r.client.HMGet(ctx, redisLinkHealthKey, codes...).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, value := range found {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	var broken []LinkHealth
+	for _, value := range values {
+		health, err := decodeRedisLinkHealth([]byte(value))
+		if err != nil {
+			return nil, err
+		}
+		if health.Broken {
+			broken = append(broken, health)
+		}
+	}
+	slices.SortFunc(broken, func(a, b LinkHealth) int {
+		return cmp.Or(a.BrokenSince.Compare(*b.BrokenSince), strings.Compare(a.Shortened, b.Shortened))
+	})
+	return broken, nil
+}
+
+func (r *RedisLinkHealthStore) Delete(shortened string) error {
+	ctx := context.Background()
+	health, err := r.Get(shortened)
+	if errors.Is(err, ErrLinkNotChecked) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, redisLinkHealthKey, shortened)
+		pipe.SRem(ctx, redisBrokenLinksPrefix+health.WorkspaceID, shortened)
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,276 @@
+package urlshortener
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDestinations serves destinations in every state a link checker may
+// find them in, on localhost: the applications shortening them must not
+// screen their links, see withoutScreening.
+func newTestDestinations(t *testing.T) (*httptest.Server, string, *atomic.Bool) {
+	gone := &atomic.Bool{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(writer http.ResponseWriter, request *http.Request) {})
+	mux.HandleFunc("/moved", func(writer http.ResponseWriter, request *http.Request) {
+		http.Redirect(writer, request, "/ok", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/no-head", func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method == http.MethodHead {
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/flaky", func(writer http.ResponseWriter, request *http.Request) {
+		if gone.Load() {
+			writer.WriteHeader(http.StatusGone)
+		}
+	})
+	mux.HandleFunc("/failing", func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusBadGateway)
+	})
+	mux.HandleFunc("/slow", func(writer http.ResponseWriter, request *http.Request) {
+		select {
+		case <-request.Context().Done():
+		case <-time.After(time.Second):
+		}
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, strings.Replace(server.URL, "127.0.0.1", "localhost", 1), gone
+}
+
+// withoutScreening lets the application shorten the test destinations, which
+// screening rejects as private.
+func withoutScreening(app *Application) *Application {
+	app.WithScreener(nil)
+	return app
+}
+
+func newTestLinkChecker() *LinkChecker {
+	return NewLinkChecker(LinkCheckerOptions{Concurrency: 4, Timeout: 200 * time.Millisecond, AllowPrivate: true})
+}
+
+func TestLinkChecker(t *testing.T) {
+	_, base, _ := newTestDestinations(t)
+	checker := newTestLinkChecker()
+	for _, test := range []struct {
+		path     string
+		status   int
+		finalURL string
+		err      bool
+	}{
+		{path: "/ok", status: http.StatusOK, finalURL: base + "/ok"},
+		{path: "/moved", status: http.StatusOK, finalURL: base + "/ok"},
+		{path: "/no-head", status: http.StatusOK, finalURL: base + "/no-head"},
+		{path: "/missing", status: http.StatusNotFound, finalURL: base + "/missing"},
+		{path: "/failing", status: http.StatusBadGateway, finalURL: base + "/failing"},
+		{path: "/slow", err: true},
+	} {
+		t.Run(test.path, func(t *testing.T) {
+			status, finalURL, err := checker.Check(context.Background(), base+test.path)
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.status, status)
+			assert.Equal(t, test.finalURL, finalURL)
+		})
+	}
+
+	_, _, err := NewLinkChecker(DefaultLinkCheckerOptions()).Check(context.Background(), base+"/ok")
+	assert.ErrorIs(t, err, ErrPrivateDestination, "names resolving to private addresses are refused")
+}
+
+func TestLinkCheckerLimits(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	var mu sync.Mutex
+	requests := map[string][]time.Time{}
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mu.Lock()
+		requests[request.Host] = append(requests[request.Host], time.Now())
+		mu.Unlock()
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			seen := maxInFlight.Load()
+			if n <= seen || maxInFlight.CompareAndSwap(seen, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	})
+	app := withoutScreening(NewInMemoryApplication())
+	for range 4 {
+		server := httptest.NewServer(handler)
+		t.Cleanup(server.Close)
+		base := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+		for _, path := range []string{"/a", "/b"} {
+			_, err := app.Shorten(base+path, nil)
+			require.NoError(t, err)
+		}
+	}
+	app.LinkHealthUsecase.checker = NewLinkChecker(LinkCheckerOptions{Concurrency: 2, HostInterval: 50 * time.Millisecond,
+		Timeout: time.Second, AllowPrivate: true})
+
+	result, err := app.CheckAll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, LinkCheckResult{Checked: 8}, result)
+	assert.LessOrEqual(t, maxInFlight.Load(), int32(2))
+	require.Len(t, requests, 4)
+	for host, times := range requests {
+		require.Len(t, times, 2, host)
+		assert.GreaterOrEqual(t, times[1].Sub(times[0]), 45*time.Millisecond, "requests to %s are spaced", host)
+	}
+}
+
+func TestLinkCheckerBusyHost(t *testing.T) {
+	_, base, _ := newTestDestinations(t)
+	app := withoutScreening(NewInMemoryApplication())
+	for _, path := range []string{"/ok", "/no-head", "/moved"} {
+		_, err := app.Shorten(base+path, nil)
+		require.NoError(t, err)
+	}
+	app.LinkHealthUsecase.checker = NewLinkChecker(LinkCheckerOptions{Concurrency: 3, HostInterval: 150 * time.Millisecond,
+		Timeout: 100 * time.Millisecond, AllowPrivate: true})
+
+	result, err := app.CheckAll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, LinkCheckResult{Checked: 3}, result, "waiting for the host does not time the checks out")
+
+	app.LinkHealthUsecase.checker = NewLinkChecker(LinkCheckerOptions{Concurrency: 3, HostInterval: time.Second,
+		Timeout: time.Second, AllowPrivate: true})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	result, err = app.CheckAll(ctx)
+	assert.ErrorIs(t, err, ErrLinkNotChecked)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Zero(t, result.Broken, "the links still waiting for their host are not broken")
+	assert.Less(t, result.Checked, 3, "nor checked")
+	broken, err := app.Broken()
+	require.NoError(t, err)
+	assert.Empty(t, broken)
+}
+
+func testLinkHealth(t *testing.T, app *Application) {
+	withoutScreening(app)
+	_, base, gone := newTestDestinations(t)
+	app.LinkHealthUsecase.checker = newTestLinkChecker()
+	moved, err := app.Shorten(base+"/moved", nil)
+	require.NoError(t, err)
+	flaky, err := app.Shorten(base+"/flaky", nil)
+	require.NoError(t, err)
+	failing, err := app.Shorten(base+"/failing", nil)
+	require.NoError(t, err)
+	expiration := time.Now().Add(-time.Hour)
+	_, err = app.Shorten(base+"/missing", &expiration)
+	require.NoError(t, err)
+
+	_, err = app.Health(moved)
+	assert.ErrorIs(t, err, ErrLinkNotChecked)
+	result, err := app.CheckAll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, LinkCheckResult{Checked: 3, Broken: 1}, result, "expired links are not checked")
+
+	health, err := app.Health(moved)
+	require.NoError(t, err)
+	assert.False(t, health.Broken)
+	assert.Equal(t, http.StatusOK, health.Status)
+	assert.Equal(t, base+"/ok", health.FinalURL)
+	assert.False(t, health.CheckedAt.IsZero())
+
+	gone.Store(true)
+	_, err = app.CheckAll(context.Background())
+	require.NoError(t, err)
+	broken, err := app.Broken()
+	require.NoError(t, err)
+	require.Len(t, broken, 2)
+	assert.Equal(t, []string{failing, flaky}, []string{broken[0].Shortened, broken[1].Shortened})
+	assert.Equal(t, http.StatusGone, broken[1].Status)
+	since := *broken[0].BrokenSince
+
+	_, err = app.CheckAll(context.Background())
+	require.NoError(t, err)
+	health, err = app.Health(failing)
+	require.NoError(t, err)
+	assert.True(t, since.Equal(*health.BrokenSince), "a link stays broken since its first failed check")
+
+	gone.Store(false)
+	_, err = app.CheckAll(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, app.Delete(failing))
+	broken, err = app.Broken()
+	require.NoError(t, err)
+	assert.Empty(t, broken)
+	_, err = app.Health(failing)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = app.LinkHealthUsecase.As(Principal{Role: RoleOwner}).CheckAll(context.Background())
+	assert.ErrorIs(t, err, ErrForbidden)
+}
+
+func TestLinkHealth(t *testing.T) {
+	testLinkHealth(t, NewInMemoryApplication())
+}
+
+func TestRedisLinkHealth(t *testing.T) {
+	_, client := newMiniredisClient(t)
+	testLinkHealth(t, NewApplicationFromInfrastructure(NewRedisInfrastructureFromClient(client, false)))
+}
+
+func TestHTTPLinkHealth(t *testing.T) {
+	t.Setenv("API_AUTH", "required")
+	_, base, _ := newTestDestinations(t)
+	app := withoutScreening(NewInMemoryApplication())
+	app.LinkHealthUsecase.checker = newTestLinkChecker()
+	alice := newTestWorkspaceMember(t, app, "alice")
+	broken, err := app.CountingUsecase.As(alice.principal()).Shorten(base+"/failing", nil)
+	require.NoError(t, err)
+	_, err = app.Shorten(base+"/missing", nil)
+	require.NoError(t, err)
+	_, err = app.CheckAll(context.Background())
+	require.NoError(t, err)
+	aliceKey, _, err := app.IssueKey(APIKey{Name: "alice", Scopes: knownScopes, UserID: alice.user.ID,
+		WorkspaceID: alice.workspace.ID})
+	require.NoError(t, err)
+	statsKey, _, err := app.IssueKey(APIKey{Name: "stats", Scopes: []string{ScopeStatsRead}})
+	require.NoError(t, err)
+
+	get := func(target, key string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, target, nil)
+		request.Header.Set("X-API-Key", key)
+		return handle(app, request)
+	}
+	assert.Equal(t, http.StatusForbidden, get("/api/v1/links:broken", statsKey).Code)
+	recorder := get("/api/v1/links:broken", aliceKey)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var links brokenLinksResponse
+	require.NoError(t, json.NewDecoder(recorder.Body).Decode(&links))
+	require.Len(t, links.Links, 1, "only the links of the workspace are listed")
+	assert.Equal(t, broken, links.Links[0].Shortened)
+	assert.Equal(t, http.StatusBadGateway, links.Links[0].Status)
+
+	code := strings.TrimPrefix(broken, NewShortURL("").String())
+	recorder = get("/api/v1/links/"+code+"/health", aliceKey)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var health LinkHealth
+	require.NoError(t, json.NewDecoder(recorder.Body).Decode(&health))
+	assert.True(t, health.Broken)
+	assert.Equal(t, base+"/failing", health.FinalURL)
+	assert.Equal(t, http.StatusNotFound, get("/api/v1/links/unknown/health", aliceKey).Code)
+
+	assert.Equal(t, http.StatusUnauthorized, handle(app, httptest.NewRequest(http.MethodGet, "/debug/vars", nil)).Code)
+	recorder = get("/debug/vars", statsKey)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"link_checker"`)
+}
@@ -0,0 +1,13 @@
+package urlshortener
+
+import (
+	"os"
+	"testing"
+)
+
+// TestMain turns API key checks off for the tests exercising the routes
+// themselves; auth tests turn them back on with t.Setenv.
+func TestMain(m *testing.M) {
+	_ = os.Setenv("API_AUTH", "disabled")
+	os.Exit(m.Run())
+}
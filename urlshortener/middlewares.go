@@ -1,12 +1,20 @@
 package urlshortener
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/redis/go-redis/v9"
 	"github.com/ulule/limiter/v3"
-	"github.com/ulule/limiter/v3/drivers/middleware/stdlib"
 	"github.com/ulule/limiter/v3/drivers/store/memory"
+	sredis "github.com/ulule/limiter/v3/drivers/store/redis"
 )
 
 type middleware interface {
@@ -26,9 +34,222 @@ func (mws middlewares) Handler(h http.Handler) http.Handler {
 	return h
 }
 
-func newRateLimiterMiddleware() *stdlib.Middleware {
-	return stdlib.NewMiddleware(limiter.New(memory.NewStore(), limiter.Rate{
-		Period: 1 * time.Hour,
-		Limit:  1000,
-	}))
+// newAuthMiddleware requires an active API key or a valid JWT with the given
+// scope, sent as a bearer token or in the X-API-Key header. A nil AuthUsecase lets every
+// request through, for deployments running with API_AUTH=disabled. The
+// callers failing authentication are limited by address, before their
+// credentials are checked again.
+func newAuthMiddleware(auth *AuthUsecase, scope string, limits *RateLimiter) middleware {
+	return middlewareFunc(func(h http.Handler) http.Handler {
+		if auth == nil {
+			return h
+		}
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			blocked, resetAt, err := limits.authBlocked(request)
+			if err != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if blocked {
+				writeTooManyRequests(writer, ErrRateLimited, resetAt)
+				return
+			}
+			token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+			if !ok {
+				token = request.Header.Get("X-API-Key")
+			}
+			principal, err := auth.Authenticate(token)
+			switch {
+			case errors.Is(err, ErrUnauthorized):
+				if err := limits.authFailed(request); err != nil {
+					writer.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				writer.Header().Set("WWW-Authenticate", `Bearer realm="url-shortener"`)
+				writeError(writer, http.StatusUnauthorized, err)
+				return
+			case err != nil:
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			case !principal.HasScope(scope):
+				writeError(writer, http.StatusForbidden, ErrForbidden)
+				return
+			}
+			h.ServeHTTP(writer, request.WithContext(WithPrincipal(request.Context(), principal)))
+		})
+	})
+}
+
+// withAuth runs the auth check right before the rate limit of the class,
+// which is keyed by the authenticated caller, so that logging also covers
+// rejected requests.
+func withAuth(auth *AuthUsecase, scope string, limits *RateLimiter, class RouteClass, mws []middleware) []middleware {
+	return append([]middleware{limits.middleware(class), newAuthMiddleware(auth, scope, limits)}, mws...)
+}
+
+// RouteClass groups the routes sharing a rate limit.
+type RouteClass string
+
+const (
+	RouteCreate   RouteClass = "create"
+	RouteRead     RouteClass = "read"
+	RouteStats    RouteClass = "stats"
+	RouteRedirect RouteClass = "redirect"
+	// RouteAuthFailure limits the requests failing authentication, whatever
+	// their route, so that guessing credentials is throttled.
+	RouteAuthFailure RouteClass = "auth_failure"
+)
+
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+var defaultRate = limiter.Rate{Period: time.Hour, Limit: 1000}
+
+// RateLimits are the rates allowed per route class, to every API key, or to
+// every workspace when ByWorkspace is set. Anonymous callers are limited per
+// address.
+type RateLimits struct {
+	Rates       map[RouteClass]limiter.Rate
+	ByWorkspace bool
+}
+
+// rateLimitsFromEnv reads RATE_LIMIT_CREATE, RATE_LIMIT_READ, RATE_LIMIT_STATS,
+// RATE_LIMIT_REDIRECT and RATE_LIMIT_AUTH_FAILURE, in the "1000-H" format, and
+// RATE_LIMIT_BY, either "key" or "workspace".
+func rateLimitsFromEnv() RateLimits {
+	limits := RateLimits{Rates: map[RouteClass]limiter.Rate{}}
+	for _, class := range []RouteClass{RouteCreate, RouteRead, RouteStats, RouteRedirect, RouteAuthFailure} {
+		key := "RATE_LIMIT_" + strings.ToUpper(string(class))
+		value := os.Getenv(key)
+		if value == "" {
+			limits.Rates[class] = defaultRate
+			continue
+		}
+		rate, err := limiter.NewRateFromFormatted(value)
+		if err != nil {
+			panic(fmt.Sprintf("invalid rate in %s: %s", key, value))
+		}
+		limits.Rates[class] = rate
+	}
+	switch by := os.Getenv("RATE_LIMIT_BY"); by {
+	case "", "key":
+	case "workspace":
+		limits.ByWorkspace = true
+	default:
+		panic(fmt.Sprintf("invalid RATE_LIMIT_BY: %s", by))
+	}
+	return limits
+}
+
+type RateLimiter struct {
+	store    limiter.Store
+	limits   RateLimits
+	visitors *VisitorExtractor
+	failures *limiter.Limiter
+}
+
+// NewRateLimiter tells anonymous callers apart by the client address the
+// visitors extractor finds behind the trusted proxies.
+func NewRateLimiter(store limiter.Store, limits RateLimits, visitors *VisitorExtractor) *RateLimiter {
+	r := &RateLimiter{store: store, limits: limits, visitors: visitors}
+	r.failures = r.limiter(RouteAuthFailure)
+	return r
+}
+
+func (r *RateLimiter) limiter(class RouteClass) *limiter.Limiter {
+	rate, ok := r.limits.Rates[class]
+	if !ok {
+		rate = defaultRate
+	}
+	return limiter.New(r.store, rate)
+}
+
+// authBlocked tells whether the address of the caller used up the
+// authentication failures it is allowed, without counting the request.
+func (r *RateLimiter) authBlocked(request *http.Request) (bool, time.Time, error) {
+	if r == nil {
+		return false, time.Time{}, nil
+	}
+	context, err := r.failures.Peek(request.Context(), string(RouteAuthFailure)+":"+r.key(r.failures, request))
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	return context.Remaining == 0, time.Unix(context.Reset, 0), nil
+}
+
+func (r *RateLimiter) authFailed(request *http.Request) error {
+	if r == nil {
+		return nil
+	}
+	_, err := r.failures.Increment(request.Context(), string(RouteAuthFailure)+":"+r.key(r.failures, request), 1)
+	return err
+}
+
+// middleware limits a class of routes. It must run after authentication to
+// tell the callers apart.
+func (r *RateLimiter) middleware(class RouteClass) middleware {
+	l := r.limiter(class)
+	return middlewareFunc(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			context, err := l.Get(request.Context(), string(class)+":"+r.key(l, request))
+			if err != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			writer.Header().Set("X-RateLimit-Limit", strconv.FormatInt(context.Limit, 10))
+			writer.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(context.Remaining, 10))
+			writer.Header().Set("X-RateLimit-Reset", strconv.FormatInt(context.Reset, 10))
+			if context.Reached {
+				writeTooManyRequests(writer, ErrRateLimited, time.Unix(context.Reset, 0))
+				return
+			}
+			h.ServeHTTP(writer, request)
+		})
+	})
+}
+
+func (r *RateLimiter) key(l *limiter.Limiter, request *http.Request) string {
+	principal, ok := PrincipalFromContext(request.Context())
+	switch {
+	case ok && r.limits.ByWorkspace:
+		return "workspace:" + workspaceOf(&principal)
+	case ok && principal.KeyID != "":
+		return "key:" + principal.KeyID
+	case ok:
+		return "user:" + principal.WorkspaceID + ":" + principal.UserID
+	default:
+		if r.visitors != nil {
+			if ip, ok := r.visitors.clientIP(request); ok {
+				return "ip:" + ip.String()
+			}
+		}
+		return "ip:" + l.GetIPKey(request)
+	}
+}
+
+type tooManyRequestsResponse struct {
+	Error      string    `json:"error"`
+	RetryAfter int       `json:"retry_after"`
+	ResetAt    time.Time `json:"reset_at"`
+}
+
+// writeTooManyRequests tells the client when to retry, in the Retry-After
+// header and in the body.
+func writeTooManyRequests(writer http.ResponseWriter, err error, resetAt time.Time) {
+	retryAfter := max(int(math.Ceil(time.Until(resetAt).Seconds())), 0)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writer.WriteHeader(http.StatusTooManyRequests)
+	_ = json.NewEncoder(writer).Encode(tooManyRequestsResponse{Error: err.Error(), RetryAfter: retryAfter, ResetAt: resetAt.UTC()})
+}
+
+func newMemoryLimiterStore() limiter.Store {
+	return memory.NewStore()
+}
+
+func newRedisLimiterStore(client *redis.Client) limiter.Store {
+	store, err := sredis.NewStore(client)
+	if err != nil {
+		panic("failed to create redis rate limiter store")
+	}
+	return store
 }
@@ -0,0 +1,129 @@
+package urlshortener
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimits(t *testing.T) {
+	t.Setenv("API_AUTH", "required")
+	t.Setenv("RATE_LIMIT_CREATE", "2-M")
+	t.Setenv("RATE_LIMIT_REDIRECT", "1-M")
+	app := NewInMemoryApplication()
+	first, _, err := app.IssueKey(APIKey{Name: "first", Scopes: knownScopes})
+	require.NoError(t, err)
+	second, _, err := app.IssueKey(APIKey{Name: "second", Scopes: knownScopes})
+	require.NoError(t, err)
+	created := 0
+	shorten := func(key string) *httptest.ResponseRecorder {
+		created++
+		request := httptest.NewRequest(http.MethodPost, "/shorten?url="+url.QueryEscape(fmt.Sprintf("https://example.com/%d", created)), nil)
+		request.Header.Set("X-API-Key", key)
+		return handle(app, request)
+	}
+
+	recorder := shorten(first)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "2", recorder.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "1", recorder.Header().Get("X-RateLimit-Remaining"))
+	assert.NotEmpty(t, recorder.Header().Get("X-RateLimit-Reset"))
+	require.Equal(t, http.StatusOK, shorten(first).Code)
+	recorder = shorten(first)
+	require.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.NotEmpty(t, recorder.Header().Get("Retry-After"))
+	var body tooManyRequestsResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+	assert.Equal(t, ErrRateLimited.Error(), body.Error)
+	assert.Positive(t, body.RetryAfter)
+
+	assert.Equal(t, http.StatusOK, shorten(second).Code, "keys have their own limits")
+	var shortened struct{ Shortened string }
+	require.NoError(t, json.Unmarshal(shorten(second).Body.Bytes(), &shortened))
+
+	redirect := httptest.NewRequest(http.MethodGet, shortened.Shortened, nil)
+	assert.Equal(t, http.StatusTemporaryRedirect, handle(app, redirect).Code, "redirects have their own limit")
+	assert.Equal(t, http.StatusTooManyRequests, handle(app, redirect).Code)
+}
+
+func TestRateLimitsAuthFailures(t *testing.T) {
+	t.Setenv("API_AUTH", "required")
+	t.Setenv("RATE_LIMIT_AUTH_FAILURE", "2-M")
+	app := NewInMemoryApplication()
+	t.Cleanup(app.Close)
+	key, _, err := app.IssueKey(APIKey{Name: "key", Scopes: knownScopes})
+	require.NoError(t, err)
+	shorten := func(key, address string) int {
+		request := httptest.NewRequest(http.MethodPost, "/shorten?url="+url.QueryEscape("https://example.com/"), nil)
+		request.Header.Set("X-API-Key", key)
+		request.RemoteAddr = address + ":4242"
+		return handle(app, request).Code
+	}
+
+	assert.Equal(t, http.StatusOK, shorten(key, "198.51.100.1"), "successes are not counted")
+	assert.Equal(t, http.StatusUnauthorized, shorten("guess-1", "198.51.100.1"))
+	assert.Equal(t, http.StatusUnauthorized, shorten("", "198.51.100.1"))
+	assert.Equal(t, http.StatusTooManyRequests, shorten("guess-2", "198.51.100.1"))
+	assert.Equal(t, http.StatusTooManyRequests, shorten(key, "198.51.100.1"),
+		"the address is blocked before its credentials are checked")
+	assert.Equal(t, http.StatusUnauthorized, shorten("guess-3", "198.51.100.2"), "addresses have their own limits")
+}
+
+func TestRateLimitsBehindProxy(t *testing.T) {
+	t.Setenv("RATE_LIMIT_REDIRECT", "1-M")
+	t.Setenv("TRUSTED_PROXIES", "192.0.2.0/24")
+	app := NewInMemoryApplication()
+	t.Cleanup(app.Close)
+	shortened, err := app.Shorten("https://example.com/", nil)
+	require.NoError(t, err)
+	redirect := func(client string) int {
+		request := httptest.NewRequest(http.MethodGet, shortened, nil)
+		request.RemoteAddr = "192.0.2.1:4242"
+		request.Header.Set("X-Forwarded-For", client)
+		return handle(app, request).Code
+	}
+
+	assert.Equal(t, http.StatusTemporaryRedirect, redirect("198.51.100.1"))
+	assert.Equal(t, http.StatusTooManyRequests, redirect("198.51.100.1"))
+	assert.Equal(t, http.StatusTemporaryRedirect, redirect("198.51.100.2"),
+		"clients behind a trusted proxy have their own limits")
+	assert.Equal(t, http.StatusTooManyRequests, redirect("203.0.113.1, 198.51.100.2"),
+		"hops added by the client are not trusted")
+}
+
+func TestRateLimitsByWorkspace(t *testing.T) {
+	t.Setenv("API_AUTH", "required")
+	t.Setenv("RATE_LIMIT_STATS", "1-M")
+	t.Setenv("RATE_LIMIT_BY", "workspace")
+	app := NewInMemoryApplication()
+	member := newTestWorkspaceMember(t, app, "alice")
+	other := newTestWorkspaceMember(t, app, "bob")
+	count := func(m testWorkspaceMember) int {
+		key, _, err := app.IssueKey(APIKey{Name: m.user.Name, Scopes: knownScopes, UserID: m.user.ID, WorkspaceID: m.workspace.ID})
+		require.NoError(t, err)
+		request := httptest.NewRequest(http.MethodGet, "/count?url="+url.QueryEscape("https://localhost:8080/u/abc"), nil)
+		request.Header.Set("X-API-Key", key)
+		return handle(app, request).Code
+	}
+
+	assert.Equal(t, http.StatusOK, count(member))
+	assert.Equal(t, http.StatusTooManyRequests, count(member), "keys of a workspace share its limit")
+	assert.Equal(t, http.StatusOK, count(other))
+}
+
+func TestRateLimitsFromEnv(t *testing.T) {
+	t.Setenv("RATE_LIMIT_READ", "10-S")
+	limits := rateLimitsFromEnv()
+	assert.Equal(t, int64(10), limits.Rates[RouteRead].Limit)
+	assert.Equal(t, defaultRate, limits.Rates[RouteCreate])
+	assert.False(t, limits.ByWorkspace)
+
+	t.Setenv("RATE_LIMIT_BY", "address")
+	assert.Panics(t, func() { rateLimitsFromEnv() })
+}
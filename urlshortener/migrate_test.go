@@ -0,0 +1,66 @@
+package urlshortener
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func newTestMigrator(t *testing.T) (*Migrator, *gorm.DB) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	sqlDB.SetMaxOpenConns(1)
+	migrator, err := NewMigrator(db)
+	require.NoError(t, err)
+	return migrator, db
+}
+
+func TestMigratorUpDown(t *testing.T) {
+	migrator, db := newTestMigrator(t)
+	assert.ErrorIs(t, migrator.Check(), ErrSchemaNotMigrated)
+
+	require.NoError(t, migrator.Up())
+	require.NoError(t, migrator.Check())
+	assert.True(t, db.Migrator().HasTable(&URLAssociation{}))
+	assert.True(t, db.Migrator().HasTable(&CountStoreRow{}))
+
+	statuses, err := migrator.Status()
+	require.NoError(t, err)
+	for _, status := range statuses {
+		assert.True(t, status.Applied(), status.Name)
+	}
+
+	for range statuses {
+		require.NoError(t, migrator.Down())
+	}
+	assert.ErrorIs(t, migrator.Down(), ErrNoMigrationToRollback)
+	assert.False(t, db.Migrator().HasTable(&URLAssociation{}))
+	assert.ErrorIs(t, migrator.Check(), ErrSchemaNotMigrated)
+}
+
+func TestMigratorUpIsIdempotent(t *testing.T) {
+	migrator, _ := newTestMigrator(t)
+	require.NoError(t, migrator.Up())
+	require.NoError(t, migrator.Up())
+}
+
+func TestMigrationsMatchAcrossDialects(t *testing.T) {
+	postgres, err := loadMigrations("postgres")
+	require.NoError(t, err)
+	sqlite, err := loadMigrations("sqlite")
+	require.NoError(t, err)
+	require.Equal(t, len(postgres), len(sqlite))
+	for i := range postgres {
+		assert.Equal(t, postgres[i].Version, sqlite[i].Version)
+		assert.Equal(t, postgres[i].Name, sqlite[i].Name)
+		assert.NotEmpty(t, postgres[i].up)
+		assert.NotEmpty(t, postgres[i].down)
+		assert.NotEmpty(t, sqlite[i].up)
+		assert.NotEmpty(t, sqlite[i].down)
+	}
+}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS count_store_rows;
+DROP TABLE IF EXISTS url_associations;
@@ -0,0 +1 @@
+ALTER TABLE url_associations ADD COLUMN created_at timestamptz;
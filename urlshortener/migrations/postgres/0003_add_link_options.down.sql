@@ -0,0 +1 @@
+ALTER TABLE url_associations DROP COLUMN options;
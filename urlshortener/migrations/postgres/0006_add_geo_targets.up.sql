@@ -0,0 +1,2 @@
+ALTER TABLE url_associations ADD COLUMN geo_targets text;
+ALTER TABLE click_events ADD COLUMN country text;
@@ -0,0 +1,2 @@
+ALTER TABLE click_events DROP COLUMN variant;
+ALTER TABLE url_associations DROP COLUMN variants;
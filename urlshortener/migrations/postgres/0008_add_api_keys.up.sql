@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+    id           text PRIMARY KEY,
+    name         text,
+    hash         text,
+    scopes       text,
+    created_at   timestamptz,
+    expires_at   timestamptz,
+    last_used_at timestamptz,
+    revoked_at   timestamptz
+);
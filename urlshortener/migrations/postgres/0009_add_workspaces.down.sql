@@ -0,0 +1,9 @@
+ALTER TABLE api_keys DROP COLUMN workspace_id;
+ALTER TABLE api_keys DROP COLUMN user_id;
+ALTER TABLE campaigns DROP COLUMN workspace_id;
+DROP INDEX IF EXISTS url_associations_workspace_id_idx;
+ALTER TABLE url_associations DROP COLUMN created_by;
+ALTER TABLE url_associations DROP COLUMN workspace_id;
+DROP TABLE IF EXISTS workspace_members;
+DROP TABLE IF EXISTS workspaces;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS users (
+    id         text PRIMARY KEY,
+    name       text,
+    created_at timestamptz
+);
+
+CREATE TABLE IF NOT EXISTS workspaces (
+    id         text PRIMARY KEY,
+    name       text,
+    created_at timestamptz
+);
+INSERT INTO workspaces (id, name, created_at) VALUES ('default', 'Default', now());
+
+CREATE TABLE IF NOT EXISTS workspace_members (
+    workspace_id text REFERENCES workspaces (id),
+    user_id      text REFERENCES users (id),
+    created_at   timestamptz,
+    PRIMARY KEY (workspace_id, user_id)
+);
+
+ALTER TABLE url_associations ADD COLUMN workspace_id text NOT NULL DEFAULT 'default';
+ALTER TABLE url_associations ADD COLUMN created_by text;
+CREATE INDEX url_associations_workspace_id_idx ON url_associations (workspace_id);
+
+ALTER TABLE campaigns ADD COLUMN workspace_id text NOT NULL DEFAULT 'default';
+
+ALTER TABLE api_keys ADD COLUMN user_id text;
+ALTER TABLE api_keys ADD COLUMN workspace_id text;
@@ -0,0 +1 @@
+ALTER TABLE workspace_members ADD COLUMN role text NOT NULL DEFAULT 'editor';
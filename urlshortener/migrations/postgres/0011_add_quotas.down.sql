@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS quota_usages;
+DROP TABLE IF EXISTS workspace_quotas;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS workspace_quotas (
+    workspace_id  text PRIMARY KEY,
+    monthly_links integer NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS quota_usages (
+    workspace_id text,
+    period       text,
+    links        integer NOT NULL DEFAULT 0,
+    PRIMARY KEY (workspace_id, period)
+);
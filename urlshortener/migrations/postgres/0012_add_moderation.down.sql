@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS moderation_audit;
+DROP TABLE IF EXISTS abuse_reports;
+ALTER TABLE url_associations DROP COLUMN quarantined;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS url_associations (
+    url        text,
+    shortened  text PRIMARY KEY,
+    expiration datetime
+);
+
+CREATE TABLE IF NOT EXISTS count_store_rows (
+    url  text PRIMARY KEY,
+    hits integer
+);
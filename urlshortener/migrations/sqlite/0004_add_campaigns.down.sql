@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS url_associations_campaign_idx;
+ALTER TABLE url_associations DROP COLUMN campaign;
+DROP TABLE IF EXISTS campaigns;
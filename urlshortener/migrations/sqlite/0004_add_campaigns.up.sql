@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS campaigns (
+    name         text PRIMARY KEY,
+    utm_source   text,
+    utm_medium   text,
+    utm_campaign text,
+    utm_term     text,
+    utm_content  text
+);
+
+ALTER TABLE url_associations ADD COLUMN campaign text;
+CREATE INDEX url_associations_campaign_idx ON url_associations (campaign);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS click_events;
+ALTER TABLE url_associations DROP COLUMN targets;
@@ -0,0 +1,9 @@
+ALTER TABLE url_associations ADD COLUMN targets text;
+
+CREATE TABLE IF NOT EXISTS click_events (
+    id         integer PRIMARY KEY AUTOINCREMENT,
+    shortened  text,
+    clicked_at datetime,
+    rule       text
+);
+CREATE INDEX click_events_shortened_idx ON click_events (shortened);
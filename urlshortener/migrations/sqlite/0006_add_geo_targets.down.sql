@@ -0,0 +1,2 @@
+ALTER TABLE click_events DROP COLUMN country;
+ALTER TABLE url_associations DROP COLUMN geo_targets;
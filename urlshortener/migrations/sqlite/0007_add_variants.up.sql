@@ -0,0 +1,2 @@
+ALTER TABLE url_associations ADD COLUMN variants text;
+ALTER TABLE click_events ADD COLUMN variant text;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+    id           text PRIMARY KEY,
+    name         text,
+    hash         text,
+    scopes       text,
+    created_at   datetime,
+    expires_at   datetime,
+    last_used_at datetime,
+    revoked_at   datetime
+);
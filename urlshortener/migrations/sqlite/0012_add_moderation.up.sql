@@ -0,0 +1,26 @@
+ALTER TABLE url_associations ADD COLUMN quarantined boolean NOT NULL DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS abuse_reports (
+    id          text PRIMARY KEY,
+    shortened   text NOT NULL,
+    source      text NOT NULL,
+    reason      text,
+    details     text,
+    status      text NOT NULL,
+    created_at  datetime,
+    resolved_at datetime,
+    resolved_by text
+);
+CREATE INDEX abuse_reports_shortened_idx ON abuse_reports (shortened);
+CREATE INDEX abuse_reports_status_idx ON abuse_reports (status, created_at);
+
+CREATE TABLE IF NOT EXISTS moderation_audit (
+    id         integer PRIMARY KEY AUTOINCREMENT,
+    shortened  text NOT NULL,
+    report_id  text,
+    action     text NOT NULL,
+    actor      text NOT NULL,
+    note       text,
+    created_at datetime
+);
+CREATE INDEX moderation_audit_shortened_idx ON moderation_audit (shortened);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS link_health (
+    shortened    text PRIMARY KEY,
+    workspace_id text NOT NULL,
+    url          text NOT NULL,
+    status       integer,
+    final_url    text,
+    error        text,
+    broken       boolean NOT NULL DEFAULT false,
+    checked_at   datetime,
+    broken_since datetime
+);
+CREATE INDEX link_health_broken_idx ON link_health (workspace_id, broken);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS url_associations_url_hash_idx;
+ALTER TABLE url_associations DROP COLUMN url_hash;
@@ -0,0 +1,2 @@
+ALTER TABLE url_associations ADD COLUMN url_hash text;
+CREATE INDEX url_associations_url_hash_idx ON url_associations (url_hash);
@@ -0,0 +1,545 @@
+package urlshortener
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+var ErrQuarantined = errors.New("link is quarantined")
+var ErrReportNotFound = errors.New("report not found")
+var ErrInvalidReport = errors.New("invalid report")
+
+var moderationMetrics = expvar.NewMap("moderation")
+
+type ReportSource string
+
+const (
+	// ReportSourceVisitor reports come from the public report endpoint.
+	ReportSourceVisitor ReportSource = "visitor"
+	// ReportSourceScreening reports come from screening stored links again.
+	ReportSourceScreening ReportSource = "screening"
+)
+
+type ReportStatus string
+
+const (
+	ReportOpen        ReportStatus = "open"
+	ReportQuarantined ReportStatus = "quarantined"
+	ReportDismissed   ReportStatus = "dismissed"
+)
+
+// reportReasons are the reasons visitors may give; screening reports carry
+// the screening error instead.
+var reportReasons = []string{"phishing", "malware", "spam", "illegal", "other"}
+
+const maxReportDetails = 2000
+
+// AbuseReport is an entry of the review queue until a moderator quarantines
+// its link or dismisses it.
+type AbuseReport struct {
+	ID         string       `json:"id" gorm:"primaryKey"`
+	Shortened  string       `json:"shortened"`
+	Source     ReportSource `json:"source"`
+	Reason     string       `json:"reason"`
+	Details    string       `json:"details,omitempty"`
+	Status     ReportStatus `json:"status"`
+	CreatedAt  time.Time    `json:"created_at"`
+	ResolvedAt *time.Time   `json:"resolved_at,omitempty"`
+	ResolvedBy string       `json:"resolved_by,omitempty"`
+}
+
+func (AbuseReport) TableName() string {
+	return "abuse_reports"
+}
+
+type ModerationAction string
+
+const (
+	ModerationReported    ModerationAction = "reported"
+	ModerationFlagged     ModerationAction = "flagged"
+	ModerationQuarantined ModerationAction = "quarantined"
+	ModerationReleased    ModerationAction = "released"
+	ModerationDismissed   ModerationAction = "dismissed"
+)
+
+// AuditEntry records who did what to a link, and why.
+type AuditEntry struct {
+	ID        uint             `json:"id" gorm:"primaryKey"`
+	Shortened string           `json:"shortened"`
+	ReportID  string           `json:"report_id,omitempty"`
+	Action    ModerationAction `json:"action"`
+	Actor     string           `json:"actor"`
+	Note      string           `json:"note,omitempty"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+func (AuditEntry) TableName() string {
+	return "moderation_audit"
+}
+
+type ModerationStorer interface {
+	SaveReport(report AbuseReport) error
+	Report(id string) (AbuseReport, error)
+	// Reports lists the reports of the link, or of every link for an empty
+	// one, with the given status, or any for an empty one, oldest first.
+	Reports(shortened string, status ReportStatus) ([]AbuseReport, error)
+	Record(entry AuditEntry) error
+	// Audit lists the entries of the link, oldest first.
+	Audit(shortened string) ([]AuditEntry, error)
+}
+
+// RescreenResult sums up a pass over the stored links.
+type RescreenResult struct {
+	Checked     int `json:"checked"`
+	Flagged     int `json:"flagged"`
+	Quarantined int `json:"quarantined"`
+}
+
+// ModerationUsecase takes abuse reports from anyone, and lets operators
+// review them. Every action is recorded in the audit trail of the link.
+type ModerationUsecase struct {
+	store      Storer
+	moderation ModerationStorer
+	links      LinkExporter
+	screener   URLScreener
+	clock      clockwork.Clock
+	// autoQuarantine quarantines the links screening rejects instead of only
+	// queuing them for review.
+	autoQuarantine bool
+	principal      *Principal
+}
+
+func NewModerationUsecase(store Storer, moderation ModerationStorer, links LinkExporter, screener URLScreener) *ModerationUsecase {
+	return &ModerationUsecase{store: store, moderation: moderation, links: links, screener: screener,
+		clock: clockwork.NewRealClock()}
+}
+
+func (m *ModerationUsecase) As(principal Principal) *ModerationUsecase {
+	u := *m
+	u.principal = &principal
+	return &u
+}
+
+func (m *ModerationUsecase) WithAutoQuarantine(autoQuarantine bool) {
+	m.autoQuarantine = autoQuarantine
+}
+
+// authorizeModeration lets the system and the holders of the moderation
+// scope through: moderators act on the links of every workspace.
+func authorizeModeration(principal *Principal) error {
+	if principal == nil || principal.HasScope(ScopeModeration) {
+		return nil
+	}
+	return ErrForbidden
+}
+
+// actorOf names the principal in the audit trail.
+func actorOf(principal *Principal) string {
+	switch {
+	case principal == nil:
+		return "system"
+	case principal.UserID != "":
+		return "user:" + principal.UserID
+	default:
+		return "key:" + principal.KeyID
+	}
+}
+
+// Report queues a report for review; anyone can report a link.
+func (m *ModerationUsecase) Report(rawURL, reason, details string) (AbuseReport, error) {
+	if !slices.Contains(reportReasons, reason) || len(details) > maxReportDetails {
+		return AbuseReport{}, ErrInvalidReport
+	}
+	if _, err := m.store.Get(rawURL); err != nil {
+		return AbuseReport{}, ErrNotFound
+	}
+	report, err := m.open(rawURL, ReportSourceVisitor, reason, details)
+	if err != nil {
+		return AbuseReport{}, err
+	}
+	moderationMetrics.Add("reports", 1)
+	return report, m.record(report.Shortened, report.ID, ModerationReported, "visitor", reason)
+}
+
+func (m *ModerationUsecase) open(shortened string, source ReportSource, reason, details string) (AbuseReport, error) {
+	id, err := randomID()
+	if err != nil {
+		return AbuseReport{}, err
+	}
+	report := AbuseReport{ID: id, Shortened: shortened, Source: source, Reason: reason, Details: details, Status: ReportOpen,
+		CreatedAt: m.clock.Now()}
+	return report, m.moderation.SaveReport(report)
+}
+
+func (m *ModerationUsecase) record(shortened, reportID string, action ModerationAction, actor, note string) error {
+	return m.moderation.Record(AuditEntry{Shortened: shortened, ReportID: reportID, Action: action, Actor: actor, Note: note,
+		CreatedAt: m.clock.Now()})
+}
+
+// Reports returns the review queue for the open status.
+func (m *ModerationUsecase) Reports(status ReportStatus) ([]AbuseReport, error) {
+	if err := authorizeModeration(m.principal); err != nil {
+		return nil, err
+	}
+	return m.moderation.Reports("", status)
+}
+
+// Quarantine makes the link serve a warning instead of redirecting, and
+// resolves its open reports.
+func (m *ModerationUsecase) Quarantine(rawURL, note string) error {
+	if err := authorizeModeration(m.principal); err != nil {
+		return err
+	}
+	return m.quarantine(rawURL, actorOf(m.principal), note)
+}
+
+func (m *ModerationUsecase) quarantine(rawURL, actor, note string) error {
+	if err := m.setQuarantined(rawURL, true); err != nil {
+		return err
+	}
+	if err := m.resolve(rawURL, ReportQuarantined, actor); err != nil {
+		return err
+	}
+	moderationMetrics.Add("quarantined", 1)
+	return m.record(rawURL, "", ModerationQuarantined, actor, note)
+}
+
+// Release lets the link redirect again.
+func (m *ModerationUsecase) Release(rawURL, note string) error {
+	if err := authorizeModeration(m.principal); err != nil {
+		return err
+	}
+	if err := m.setQuarantined(rawURL, false); err != nil {
+		return err
+	}
+	return m.record(rawURL, "", ModerationReleased, actorOf(m.principal), note)
+}
+
+func (m *ModerationUsecase) setQuarantined(rawURL string, quarantined bool) error {
+	return m.store.Update(rawURL, func(association *URLAssociation) error {
+		association.Quarantined = quarantined
+		return nil
+	})
+}
+
+func (m *ModerationUsecase) resolve(rawURL string, status ReportStatus, actor string) error {
+	reports, err := m.moderation.Reports(rawURL, ReportOpen)
+	if err != nil {
+		return err
+	}
+	now := m.clock.Now()
+	for _, report := range reports {
+		report.Status, report.ResolvedAt, report.ResolvedBy = status, &now, actor
+		if err := m.moderation.SaveReport(report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Dismiss closes a report without acting on its link.
+func (m *ModerationUsecase) Dismiss(reportID, note string) error {
+	if err := authorizeModeration(m.principal); err != nil {
+		return err
+	}
+	report, err := m.moderation.Report(reportID)
+	if err != nil {
+		return err
+	}
+	if report.Status != ReportOpen {
+		return ErrInvalidReport
+	}
+	now := m.clock.Now()
+	report.Status, report.ResolvedAt, report.ResolvedBy = ReportDismissed, &now, actorOf(m.principal)
+	if err := m.moderation.SaveReport(report); err != nil {
+		return err
+	}
+	return m.record(report.Shortened, report.ID, ModerationDismissed, report.ResolvedBy, note)
+}
+
+func (m *ModerationUsecase) Audit(rawURL string) ([]AuditEntry, error) {
+	if err := authorizeModeration(m.principal); err != nil {
+		return nil, err
+	}
+	return m.moderation.Audit(rawURL)
+}
+
+// Rescreen runs every stored link through the current screening rules. The
+// links they now reject are queued for review once, or quarantined right
+// away with auto quarantine.
+func (m *ModerationUsecase) Rescreen() (RescreenResult, error) {
+	if err := authorizeModeration(m.principal); err != nil {
+		return RescreenResult{}, err
+	}
+	var result RescreenResult
+	if m.screener == nil {
+		return result, nil
+	}
+	rejections := map[string]error{}
+	// the links are walked first, since some stores cannot be written while
+	// they are read
+	err := m.links.ExportLinks("", func(record LinkRecord) error {
+		result.Checked++
+		request := ShortenRequest{Targets: record.Targets, GeoTargets: record.GeoTargets, Variants: record.Variants}
+		for _, rawURL := range screenedURLs(record.URL, request) {
+			if err := ScreenRawURL(m.screener, rawURL); err != nil {
+				rejections[record.Shortened] = err
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	for shortened, rejection := range rejections {
+		flagged, quarantined, err := m.flag(shortened, rejection)
+		if err != nil {
+			return result, err
+		}
+		if flagged {
+			result.Flagged++
+		}
+		if quarantined {
+			result.Quarantined++
+		}
+	}
+	moderationMetrics.Add("rescreened", int64(result.Checked))
+	moderationMetrics.Add("flagged", int64(result.Flagged))
+	return result, nil
+}
+
+// flag skips the links already quarantined or waiting for review.
+func (m *ModerationUsecase) flag(shortened string, rejection error) (bool, bool, error) {
+	u, err := m.store.Get(shortened)
+	if errors.Is(err, ErrNotFound) || (err == nil && u.Quarantined()) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	reports, err := m.moderation.Reports(shortened, ReportOpen)
+	if err != nil {
+		return false, false, err
+	}
+	if slices.ContainsFunc(reports, func(r AbuseReport) bool { return r.Source == ReportSourceScreening }) {
+		return false, false, nil
+	}
+	var rule string
+	var screeningErr *ScreeningError
+	if errors.As(rejection, &screeningErr) {
+		rule = screeningErr.Rule
+	}
+	report, err := m.open(shortened, ReportSourceScreening, rejection.Error(), rule)
+	if err != nil {
+		return false, false, err
+	}
+	if err := m.record(shortened, report.ID, ModerationFlagged, "system", rejection.Error()); err != nil {
+		return true, false, err
+	}
+	if !m.autoQuarantine {
+		return true, false, nil
+	}
+	return true, true, m.quarantine(shortened, "system", "automatic quarantine: "+rejection.Error())
+}
+
+// Watch rescreens the stored links every interval until the context is done.
+func (m *ModerationUsecase) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, _ = m.Rescreen()
+		}
+	}
+}
+
+type PGModerationStore struct {
+	db *gorm.DB
+}
+
+func NewPGModerationStoreFromDB(db *gorm.DB) *PGModerationStore {
+	return &PGModerationStore{db: db}
+}
+
+func (p *PGModerationStore) SaveReport(report AbuseReport) error {
+	return p.db.Save(&report).Error
+}
+
+func (p *PGModerationStore) Report(id string) (AbuseReport, error) {
+	var reports []AbuseReport
+	if err := p.db.Where("id = ?", id).Limit(1).Find(&reports).Error; err != nil {
+		return AbuseReport{}, err
+	}
+	if len(reports) == 0 {
+		return AbuseReport{}, ErrReportNotFound
+	}
+	return reports[0], nil
+}
+
+func (p *PGModerationStore) Reports(shortened string, status ReportStatus) ([]AbuseReport, error) {
+	query := p.db.Order("created_at, id")
+	if shortened != "" {
+		query = query.Where("shortened = ?", shortened)
+	}
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	var reports []AbuseReport
+	return reports, query.Find(&reports).Error
+}
+
+func (p *PGModerationStore) Record(entry AuditEntry) error {
+	return p.db.Create(&entry).Error
+}
+
+func (p *PGModerationStore) Audit(shortened string) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	return entries, p.db.Where("shortened = ?", shortened).Order("id").Find(&entries).Error
+}
+
+const (
+	redisReportsKey        = "abuse-reports"
+	redisOpenReportsKey    = "abuse-reports:open"
+	redisLinkReportsPrefix = "link-reports:"
+	redisAuditPrefix       = "moderation-audit:"
+	redisAuditSequenceKey  = "moderation-audit-sequence"
+)
+
+type RedisModerationStore struct {
+	client *redis.Client
+}
+
+func NewRedisModerationStoreFromClient(client *redis.Client) *RedisModerationStore {
+	return &RedisModerationStore{client: client}
+}
+
+// SaveReport keeps the open reports in a sorted set, so that the review queue
+// does not read the resolved ones.
+func (r *RedisModerationStore) SaveReport(report AbuseReport) error {
+	ctx := context.Background()
+	b, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, redisReportsKey, report.ID, b)
+		pipe.SAdd(ctx, redisLinkReportsPrefix+report.Shortened, report.ID)
+		if report.Status == ReportOpen {
+			pipe.ZAdd(ctx, redisOpenReportsKey, redis.Z{Score: float64(report.CreatedAt.UnixNano()), Member: report.ID})
+		} else {
+			pipe.ZRem(ctx, redisOpenReportsKey, report.ID)
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *RedisModerationStore) Report(id string) (AbuseReport, error) {
+	b, err := r.client.HGet(context.Background(), redisReportsKey, id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return AbuseReport{}, ErrReportNotFound
+	}
+	if err != nil {
+		return AbuseReport{}, err
+	}
+	var report AbuseReport
+	return report, json.Unmarshal(b, &report)
+}
+
+func (r *RedisModerationStore) Reports(shortened string, status ReportStatus) ([]AbuseReport, error) {
+	ctx := context.Background()
+	var ids []string
+	var err error
+	switch {
+	case shortened != "":
+		ids, err = r.client.SMembers(ctx, redisLinkReportsPrefix+shortened).Result()
+	case status == ReportOpen:
+		ids, err = r.client.ZRange(ctx, redisOpenReportsKey, 0, -1).Result()
+	default:
+		ids, err = r.client.HKeys(ctx, redisReportsKey).Result()
+	}
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	values, err := r.client.HMGet(ctx, redisReportsKey, ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	var reports []AbuseReport
+	for _, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var report AbuseReport
+		if err := json.Unmarshal([]byte(s), &report); err != nil {
+			return nil, err
+		}
+		if status == "" || report.Status == status {
+			reports = append(reports, report)
+		}
+	}
+	slices.SortFunc(reports, func(a, b AbuseReport) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), strings.Compare(a.ID, b.ID))
+	})
+	return reports, nil
+}
+
+func (r *RedisModerationStore) Record(entry AuditEntry) error {
+	ctx := context.Background()
+	id, err := r.client.Incr(ctx, redisAuditSequenceKey).Result()
+	if err != nil {
+		return err
+	}
+	entry.ID = uint(id)
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return r.client.RPush(ctx, redisAuditPrefix+entry.Shortened, b).Err()
+}
+
+func (r *RedisModerationStore) Audit(shortened string) ([]AuditEntry, error) {
+	values, err := r.client.LRange(context.Background(), redisAuditPrefix+shortened, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]AuditEntry, 0, len(values))
+	for _, value := range values {
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// moderationFromEnv reads RESCREEN_QUARANTINE, which quarantines the links
+// that fail to be screened again without waiting for review.
+func moderationFromEnv(m *ModerationUsecase) {
+	m.WithAutoQuarantine(os.Getenv("RESCREEN_QUARANTINE") == "true")
+}
+
+// watchModerationFromEnv screens the stored links again every
+// RESCREEN_INTERVAL, 0 to never.
+func watchModerationFromEnv(ctx context.Context, m *ModerationUsecase) {
+	if interval := envDuration("RESCREEN_INTERVAL", 0); interval > 0 {
+		go m.Watch(ctx, interval)
+	}
+}
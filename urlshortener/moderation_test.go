@@ -0,0 +1,201 @@
+package urlshortener
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testModeration(t *testing.T, app *Application) {
+	reported, err := app.Shorten("https://example.com/login", nil)
+	require.NoError(t, err)
+	other, err := app.Shorten("https://example.org/", nil)
+	require.NoError(t, err)
+
+	_, err = app.Report(reported, "boring", "")
+	assert.ErrorIs(t, err, ErrInvalidReport)
+	_, err = app.Report(NewShortURL("unknown").String(), "phishing", "")
+	assert.ErrorIs(t, err, ErrNotFound)
+	report, err := app.Report(reported, "phishing", "asks for my bank password")
+	require.NoError(t, err)
+	otherReport, err := app.Report(other, "spam", "")
+	require.NoError(t, err)
+
+	queue, err := app.Reports(ReportOpen)
+	require.NoError(t, err)
+	assert.Equal(t, []string{report.ID, otherReport.ID}, reportIDs(queue))
+	viewer := app.ModerationUsecase.As(Principal{UserID: "alice", Role: RoleOwner, Scopes: knownScopes})
+	_, err = viewer.Reports(ReportOpen)
+	assert.ErrorIs(t, err, ErrForbidden)
+	assert.ErrorIs(t, viewer.Quarantine(reported, ""), ErrForbidden)
+
+	moderator := app.ModerationUsecase.As(Principal{KeyID: "mod", Scopes: []string{ScopeModeration}})
+	require.NoError(t, moderator.Quarantine(reported, "confirmed phishing"))
+	_, err = app.Resolve(reported, Visitor{})
+	assert.ErrorIs(t, err, ErrQuarantined)
+	count, _ := app.countStore.Get(reported)
+	assert.Zero(t, count, "warnings are not clicks")
+	resolved, err := app.moderation.Report(report.ID)
+	require.NoError(t, err)
+	assert.Equal(t, ReportQuarantined, resolved.Status)
+	assert.Equal(t, "key:mod", resolved.ResolvedBy)
+
+	require.NoError(t, moderator.Dismiss(otherReport.ID, "not spam"))
+	assert.ErrorIs(t, moderator.Dismiss(otherReport.ID, ""), ErrInvalidReport)
+	assert.ErrorIs(t, moderator.Dismiss("unknown", ""), ErrReportNotFound)
+	queue, err = app.Reports(ReportOpen)
+	require.NoError(t, err)
+	assert.Empty(t, queue)
+
+	require.NoError(t, moderator.Release(reported, "domain owner cleaned up"))
+	_, err = app.Resolve(reported, Visitor{})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, moderator.Quarantine(NewShortURL("unknown").String(), ""), ErrNotFound)
+
+	entries, err := moderator.Audit(reported)
+	require.NoError(t, err)
+	var actions []ModerationAction
+	for _, entry := range entries {
+		actions = append(actions, entry.Action)
+	}
+	assert.Equal(t, []ModerationAction{ModerationReported, ModerationQuarantined, ModerationReleased}, actions)
+	assert.Equal(t, "visitor", entries[0].Actor)
+	assert.Equal(t, report.ID, entries[0].ReportID)
+	assert.Equal(t, "key:mod", entries[1].Actor)
+	assert.Equal(t, "confirmed phishing", entries[1].Note)
+}
+
+func reportIDs(reports []AbuseReport) []string {
+	var ids []string
+	for _, report := range reports {
+		ids = append(ids, report.ID)
+	}
+	return ids
+}
+
+func TestModeration(t *testing.T) {
+	testModeration(t, NewInMemoryApplication())
+}
+
+func TestRedisModeration(t *testing.T) {
+	_, client := newMiniredisClient(t)
+	testModeration(t, NewApplicationFromInfrastructure(NewRedisInfrastructureFromClient(client, false)))
+}
+
+func TestRescreen(t *testing.T) {
+	app := NewInMemoryApplication()
+	safe, err := app.Shorten("https://example.com/", nil)
+	require.NoError(t, err)
+	phishing, err := app.Shorten("https://login.evil.example/", nil)
+	require.NoError(t, err)
+	retargeted, err := app.ShortenWithOptions(ShortenRequest{URL: "https://example.com/app",
+		Targets: []Target{{Platforms: []string{PlatformAndroid}, URL: "https://evil.example/app.apk"}}})
+	require.NoError(t, err)
+	app.ModerationUsecase.screener = DomainListScreener{Blocked: []string{"evil.example"}}
+
+	result, err := app.Rescreen()
+	require.NoError(t, err)
+	assert.Equal(t, RescreenResult{Checked: 3, Flagged: 2}, result)
+	queue, err := app.Reports(ReportOpen)
+	require.NoError(t, err)
+	require.Len(t, queue, 2)
+	assert.ElementsMatch(t, []string{phishing, retargeted}, []string{queue[0].Shortened, queue[1].Shortened})
+	assert.Equal(t, ReportSourceScreening, queue[0].Source)
+	assert.Equal(t, ErrBlockedDomain.Error(), queue[0].Reason)
+	assert.Equal(t, "evil.example", queue[0].Details)
+
+	result, err = app.Rescreen()
+	require.NoError(t, err)
+	assert.Equal(t, RescreenResult{Checked: 3}, result, "links waiting for review are not flagged again")
+
+	app.ModerationUsecase.WithAutoQuarantine(true)
+	app.ModerationUsecase.screener = DomainListScreener{Blocked: []string{"evil.example", "example.com"}}
+	result, err = app.Rescreen()
+	require.NoError(t, err)
+	assert.Equal(t, RescreenResult{Checked: 3, Flagged: 1, Quarantined: 1}, result)
+	_, err = app.Resolve(safe, Visitor{})
+	assert.ErrorIs(t, err, ErrQuarantined)
+	entries, err := app.Audit(safe)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, ModerationFlagged, entries[0].Action)
+	assert.Equal(t, ModerationQuarantined, entries[1].Action)
+	assert.Equal(t, "system", entries[1].Actor)
+}
+
+func TestHTTPModeration(t *testing.T) {
+	t.Setenv("API_AUTH", "required")
+	app := NewInMemoryApplication()
+	short, err := app.Shorten("https://example.com/login", nil)
+	require.NoError(t, err)
+	moderatorKey, _, err := app.IssueKey(APIKey{Name: "moderator", Scopes: []string{ScopeModeration}})
+	require.NoError(t, err)
+	writerKey, _, err := app.IssueKey(APIKey{Name: "writer", Scopes: knownScopes})
+	require.NoError(t, err)
+	_, err = ParseScopes("links:write,moderation")
+	assert.NoError(t, err)
+
+	post := func(target, key string, body any) *httptest.ResponseRecorder {
+		b, err := json.Marshal(body)
+		require.NoError(t, err)
+		request := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(b))
+		if key != "" {
+			request.Header.Set("X-API-Key", key)
+		}
+		return handle(app, request)
+	}
+
+	recorder := post("/report", "", reportRequest{URL: short, Reason: "phishing", Details: "fake login page"})
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	var report reportResponse
+	require.NoError(t, json.NewDecoder(recorder.Body).Decode(&report))
+	assert.Equal(t, ReportOpen, report.Status)
+	assert.Equal(t, http.StatusBadRequest, post("/report", "", reportRequest{URL: short, Reason: "boring"}).Code)
+	assert.Equal(t, http.StatusNotFound, post("/report", "", reportRequest{URL: NewShortURL("unknown").String(),
+		Reason: "spam"}).Code)
+
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/moderation/reports", nil)
+	assert.Equal(t, http.StatusUnauthorized, handle(app, request).Code)
+	request.Header.Set("X-API-Key", writerKey)
+	assert.Equal(t, http.StatusForbidden, handle(app, request).Code)
+	request.Header.Set("X-API-Key", moderatorKey)
+	recorder = handle(app, request)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var queue reportsResponse
+	require.NoError(t, json.NewDecoder(recorder.Body).Decode(&queue))
+	require.Len(t, queue.Reports, 1)
+	assert.Equal(t, "fake login page", queue.Reports[0].Details)
+
+	assert.Equal(t, http.StatusForbidden, post("/api/v1/moderation/quarantine", writerKey, moderationRequest{URL: short}).Code)
+	assert.Equal(t, http.StatusNoContent, post("/api/v1/moderation/quarantine", moderatorKey,
+		moderationRequest{URL: short, Note: "confirmed"}).Code)
+
+	recorder = handle(app, httptest.NewRequest(http.MethodGet, short, nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Empty(t, recorder.Header().Get("Location"))
+	assert.Equal(t, "no-store", recorder.Header().Get("Cache-Control"))
+	assert.Contains(t, recorder.Body.String(), "This link may be unsafe")
+	assert.Contains(t, recorder.Body.String(), "https://example.com/login")
+	recorder = handle(app, httptest.NewRequest(http.MethodGet, short+"+", nil))
+	assert.Contains(t, recorder.Body.String(), "This link may be unsafe", "previews do not offer to continue either")
+
+	assert.Equal(t, http.StatusNoContent, post("/api/v1/moderation/release", moderatorKey, moderationRequest{URL: short}).Code)
+	recorder = handle(app, httptest.NewRequest(http.MethodGet, short, nil))
+	assert.Equal(t, http.StatusTemporaryRedirect, recorder.Code)
+
+	request = httptest.NewRequest(http.MethodGet, "/api/v1/moderation/audit?url="+url.QueryEscape(short), nil)
+	request.Header.Set("X-API-Key", moderatorKey)
+	recorder = handle(app, request)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var audit auditResponse
+	require.NoError(t, json.NewDecoder(recorder.Body).Decode(&audit))
+	require.Len(t, audit.Entries, 3)
+	assert.True(t, strings.HasPrefix(audit.Entries[1].Actor, "key:"))
+}
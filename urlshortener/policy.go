@@ -0,0 +1,64 @@
+package urlshortener
+
+import (
+	"errors"
+	"slices"
+)
+
+var ErrInvalidRole = errors.New("invalid role")
+
+// Role is what a member may do in a workspace, whatever transport the
+// request came through.
+type Role string
+
+const (
+	RoleOwner   Role = "owner"
+	RoleAdmin   Role = "admin"
+	RoleEditor  Role = "editor"
+	RoleViewer  Role = "viewer"
+	RoleAnalyst Role = "analyst"
+)
+
+type Action string
+
+const (
+	ActionCreateLinks     Action = "links:create"
+	ActionRetargetLinks   Action = "links:retarget"
+	ActionDeleteLinks     Action = "links:delete"
+	ActionViewLinks       Action = "links:view"
+	ActionManageCampaigns Action = "campaigns:manage"
+	ActionViewStats       Action = "stats:view"
+	ActionManageKeys      Action = "keys:manage"
+	ActionManageMembers   Action = "members:manage"
+)
+
+var permissions = map[Role][]Action{
+	RoleOwner: {ActionCreateLinks, ActionRetargetLinks, ActionDeleteLinks, ActionViewLinks, ActionManageCampaigns,
+		ActionViewStats, ActionManageKeys, ActionManageMembers},
+	RoleAdmin: {ActionCreateLinks, ActionRetargetLinks, ActionDeleteLinks, ActionViewLinks, ActionManageCampaigns,
+		ActionViewStats, ActionManageKeys},
+	RoleEditor:  {ActionCreateLinks, ActionRetargetLinks, ActionViewLinks, ActionManageCampaigns, ActionViewStats},
+	RoleViewer:  {ActionViewLinks},
+	RoleAnalyst: {ActionViewLinks, ActionViewStats},
+}
+
+func ParseRole(s string) (Role, error) {
+	role := Role(s)
+	if _, ok := permissions[role]; !ok {
+		return "", ErrInvalidRole
+	}
+	return role, nil
+}
+
+func (r Role) Can(action Action) bool {
+	return slices.Contains(permissions[r], action)
+}
+
+// authorize lets the system, a nil principal, do everything, and the others
+// what their role in their workspace allows.
+func authorize(principal *Principal, action Action) error {
+	if principal == nil || principal.Role.Can(action) {
+		return nil
+	}
+	return ErrForbidden
+}
@@ -0,0 +1,162 @@
+package urlshortener
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPermissions(t *testing.T) {
+	// owners do everything; admins everything but managing members; editors
+	// create, retarget and run campaigns but neither delete links nor manage
+	// access; viewers only view links, and analysts view links and stats
+	matrix := []struct {
+		action                                Action
+		owner, admin, editor, viewer, analyst bool
+	}{
+		{ActionCreateLinks, true, true, true, false, false},
+		{ActionRetargetLinks, true, true, true, false, false},
+		{ActionDeleteLinks, true, true, false, false, false},
+		{ActionViewLinks, true, true, true, true, true},
+		{ActionManageCampaigns, true, true, true, false, false},
+		{ActionViewStats, true, true, true, false, true},
+		{ActionManageKeys, true, true, false, false, false},
+		{ActionManageMembers, true, false, false, false, false},
+	}
+	for _, row := range matrix {
+		for role, allowed := range map[Role]bool{RoleOwner: row.owner, RoleAdmin: row.admin, RoleEditor: row.editor,
+			RoleViewer: row.viewer, RoleAnalyst: row.analyst, "": false} {
+			t.Run(fmt.Sprintf("%s %s", role, row.action), func(t *testing.T) {
+				principal := &Principal{WorkspaceID: DefaultWorkspace, Role: role}
+				if allowed {
+					assert.NoError(t, authorize(principal, row.action))
+				} else {
+					assert.ErrorIs(t, authorize(principal, row.action), ErrForbidden)
+				}
+			})
+		}
+	}
+	assert.NoError(t, authorize(nil, ActionManageMembers))
+}
+
+func TestParseRole(t *testing.T) {
+	role, err := ParseRole("analyst")
+	require.NoError(t, err)
+	assert.Equal(t, RoleAnalyst, role)
+	_, err = ParseRole("root")
+	assert.ErrorIs(t, err, ErrInvalidRole)
+}
+
+func TestRoles(t *testing.T) {
+	app := NewInMemoryApplication()
+	owner := newTestWorkspaceMember(t, app, "owner")
+	as := func(role Role) testWorkspaceMember {
+		user, err := app.CreateUser(string(role))
+		require.NoError(t, err)
+		require.NoError(t, app.AddMember(owner.workspace.ID, user.ID, role))
+		return testWorkspaceMember{user: user, workspace: owner.workspace, role: role}
+	}
+	editor, viewer, analyst := as(RoleEditor), as(RoleViewer), as(RoleAnalyst)
+
+	short, err := app.CountingUsecase.As(editor.principal()).Shorten("https://example.com/docs", nil)
+	require.NoError(t, err)
+	_, err = app.CountingUsecase.As(viewer.principal()).Shorten("https://example.com/docs", nil)
+	assert.ErrorIs(t, err, ErrForbidden)
+	_, err = app.CountingUsecase.As(viewer.principal()).ShortenBatch([]ShortenRequest{{URL: "https://example.com/docs"}})
+	assert.ErrorIs(t, err, ErrForbidden)
+	long, err := app.CountingUsecase.As(viewer.principal()).Unshorten(short)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/docs", long)
+
+	_, err = app.CountingUsecase.As(analyst.principal()).Clicks(short, "rule")
+	assert.NoError(t, err)
+	_, err = app.CountingUsecase.As(viewer.principal()).Clicks(short, "rule")
+	assert.ErrorIs(t, err, ErrForbidden)
+	assert.ErrorIs(t, app.CountingUsecase.As(analyst.principal()).SetVariants(short, splitVariants), ErrForbidden)
+	assert.NoError(t, app.CountingUsecase.As(editor.principal()).SetVariants(short, splitVariants))
+
+	assert.ErrorIs(t, app.CampaignUsecase.As(analyst.principal()).SaveCampaign(Campaign{Name: "launch"}), ErrForbidden)
+	assert.NoError(t, app.CampaignUsecase.As(editor.principal()).SaveCampaign(Campaign{Name: "launch"}))
+	_, err = app.CampaignUsecase.As(analyst.principal()).CampaignStats("launch")
+	assert.NoError(t, err)
+
+	reader, err := NewLinkRecordReader("ndjson", strings.NewReader(""))
+	require.NoError(t, err)
+	_, err = app.ArchiveUsecase.As(viewer.principal()).Import(reader, ImportOptions{})
+	assert.ErrorIs(t, err, ErrForbidden)
+	_, err = app.ArchiveUsecase.As(editor.principal()).Import(reader, ImportOptions{})
+	assert.NoError(t, err)
+
+	_, _, err = app.AuthUsecase.As(editor.principal()).IssueKey(APIKey{Name: "ci", Scopes: []string{ScopeLinksWrite}})
+	assert.ErrorIs(t, err, ErrForbidden)
+	assert.ErrorIs(t, app.WorkspaceUsecase.As(editor.principal()).AddMember(owner.workspace.ID, viewer.user.ID, RoleOwner),
+		ErrForbidden)
+	require.NoError(t, app.WorkspaceUsecase.As(owner.principal()).AddMember(owner.workspace.ID, viewer.user.ID, RoleEditor))
+	_, err = app.CountingUsecase.As(Principal{UserID: viewer.user.ID, WorkspaceID: owner.workspace.ID, Role: RoleEditor}).
+		Shorten("https://example.com/promoted", nil)
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, app.CountingUsecase.As(editor.principal()).Delete(short), ErrForbidden)
+	assert.NoError(t, app.CountingUsecase.As(owner.principal()).Delete(short))
+}
+
+func TestHTTPRoles(t *testing.T) {
+	t.Setenv("API_AUTH", "required")
+	app := NewInMemoryApplication()
+	owner := newTestWorkspaceMember(t, app, "owner")
+	newKey := func(role Role) string {
+		user, err := app.CreateUser(string(role))
+		require.NoError(t, err)
+		require.NoError(t, app.AddMember(owner.workspace.ID, user.ID, role))
+		token, _, err := app.IssueKey(APIKey{Name: string(role), Scopes: knownScopes, UserID: user.ID, WorkspaceID: owner.workspace.ID})
+		require.NoError(t, err)
+		return token
+	}
+	adminKey, viewerKey, analystKey := newKey(RoleAdmin), newKey(RoleViewer), newKey(RoleAnalyst)
+
+	testServer := httptest.NewServer(app.server.mux)
+	defer testServer.Close()
+	newClient := func(key string) *HTTPClient {
+		return NewHTTPClientFromResty(resty.NewWithClient(testServer.Client()).SetBaseURL(testServer.URL)).WithAPIKey(key)
+	}
+
+	_, err := newClient(viewerKey).Shorten("https://example.com/docs", nil)
+	assert.ErrorIs(t, err, ErrForbidden)
+	short, err := newClient(adminKey).Shorten("https://example.com/docs", nil)
+	require.NoError(t, err)
+	assert.ErrorIs(t, newClient(analystKey).SetVariants(short, splitVariants), ErrForbidden)
+
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/links/"+strings.TrimPrefix(short, "https://localhost:8080/u/")+"/clicks?by=rule", nil)
+	request.Header.Set("X-API-Key", analystKey)
+	assert.Equal(t, http.StatusOK, handle(app, request).Code)
+	request.Header.Set("X-API-Key", viewerKey)
+	assert.Equal(t, http.StatusForbidden, handle(app, request).Code)
+
+	request = httptest.NewRequest(http.MethodPost, "/api/v1/keys", bytes.NewBufferString(`{"name": "ci", "scopes": ["links:read"]}`))
+	request.Header.Set("X-API-Key", analystKey)
+	assert.Equal(t, http.StatusForbidden, handle(app, request).Code)
+	request = httptest.NewRequest(http.MethodPost, "/api/v1/keys", bytes.NewBufferString(`{"name": "ci", "scopes": ["links:read"]}`))
+	request.Header.Set("X-API-Key", adminKey)
+	recorder := handle(app, request)
+	require.Equal(t, http.StatusCreated, recorder.Code)
+	var issued apiKeyResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &issued))
+	assert.Equal(t, owner.workspace.ID, issued.WorkspaceID)
+	long, err := newClient(issued.Token).Unshorten(short)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/docs", long)
+
+	request = httptest.NewRequest(http.MethodDelete, "/api/v1/keys/"+issued.ID, nil)
+	request.Header.Set("X-API-Key", adminKey)
+	assert.Equal(t, http.StatusNoContent, handle(app, request).Code)
+	_, err = newClient(issued.Token).Unshorten(short)
+	assert.ErrorIs(t, err, ErrUnauthorized)
+}
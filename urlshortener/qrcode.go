@@ -0,0 +1,253 @@
+package urlshortener
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/boombuler/barcode/qr"
+)
+
+var ErrInvalidQROptions = errors.New("invalid QR code options")
+var ErrMissingQRLogo = errors.New("no QR code logo configured")
+
+const (
+	maxQRSize   = 2048
+	maxQRMargin = 16
+	// logoRatio is the share of the QR code width covered by the logo; level H
+	// error correction restores up to 30% of damaged modules.
+	logoRatio = 0.2
+)
+
+type QROptions struct {
+	Format     string
+	Size       int
+	Level      qr.ErrorCorrectionLevel
+	Margin     int
+	Foreground color.RGBA
+	Background color.RGBA
+	Logo       bool
+}
+
+func DefaultQROptions() QROptions {
+	return QROptions{
+		Format:     "png",
+		Size:       256,
+		Level:      qr.M,
+		Margin:     4,
+		Foreground: color.RGBA{A: 0xff},
+		Background: color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+	}
+}
+
+func ParseQROptions(query url.Values) (QROptions, error) {
+	options := DefaultQROptions()
+	if format := query.Get("format"); format != "" {
+		if format != "png" && format != "svg" {
+			return QROptions{}, ErrInvalidQROptions
+		}
+		options.Format = format
+	}
+	if size := query.Get("size"); size != "" {
+		s, err := strconv.Atoi(size)
+		if err != nil || s <= 0 || s > maxQRSize {
+			return QROptions{}, ErrInvalidQROptions
+		}
+		options.Size = s
+	}
+	if margin := query.Get("margin"); margin != "" {
+		m, err := strconv.Atoi(margin)
+		if err != nil || m < 0 || m > maxQRMargin {
+			return QROptions{}, ErrInvalidQROptions
+		}
+		options.Margin = m
+	}
+	if level := query.Get("level"); level != "" {
+		l, ok := map[string]qr.ErrorCorrectionLevel{"L": qr.L, "M": qr.M, "Q": qr.Q, "H": qr.H}[strings.ToUpper(level)]
+		if !ok {
+			return QROptions{}, ErrInvalidQROptions
+		}
+		options.Level = l
+	}
+	var err error
+	if fg := query.Get("fg"); fg != "" {
+		if options.Foreground, err = parseHexColor(fg); err != nil {
+			return QROptions{}, err
+		}
+	}
+	if bg := query.Get("bg"); bg != "" {
+		if options.Background, err = parseHexColor(bg); err != nil {
+			return QROptions{}, err
+		}
+	}
+	options.Logo = query.Get("logo") == "true"
+	if options.Logo {
+		options.Level = qr.H
+	}
+	return options, nil
+}
+
+func parseHexColor(s string) (color.RGBA, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "#"))
+	if err != nil || len(b) != 3 {
+		return color.RGBA{}, ErrInvalidQROptions
+	}
+	return color.RGBA{R: b[0], G: b[1], B: b[2], A: 0xff}, nil
+}
+
+func (o QROptions) ContentType() string {
+	if o.Format == "svg" {
+		return "image/svg+xml"
+	}
+	return "image/png"
+}
+
+func (o QROptions) ETag(content string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%+v", content, o)))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+type QRRenderer struct {
+	logo image.Image
+}
+
+func NewQRRenderer(logo image.Image) *QRRenderer {
+	return &QRRenderer{logo: logo}
+}
+
+func NewQRRendererFromEnv() *QRRenderer {
+	path := os.Getenv("QR_LOGO_PATH")
+	if path == "" {
+		return NewQRRenderer(nil)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		panic("failed to open QR code logo")
+	}
+	defer file.Close()
+	logo, _, err := image.Decode(file)
+	if err != nil {
+		panic("failed to decode QR code logo")
+	}
+	return NewQRRenderer(logo)
+}
+
+// qrProbeCode is longer than any code, signed or not, so that a short URL
+// rendering with it renders with every code.
+var qrProbeCode = strings.Repeat("z", 64)
+
+// Check tells, before a link is created, whether the QR code of its short URL
+// can be rendered.
+func (r *QRRenderer) Check(options QROptions) error {
+	if options.Logo && r.logo == nil {
+		return ErrMissingQRLogo
+	}
+	_, err := qr.Encode(NewShortURL(qrProbeCode).String(), options.Level, qr.Auto)
+	return err
+}
+
+func (r *QRRenderer) Render(w io.Writer, content string, options QROptions) error {
+	if options.Logo && r.logo == nil {
+		return ErrMissingQRLogo
+	}
+	code, err := qr.Encode(content, options.Level, qr.Auto)
+	if err != nil {
+		return err
+	}
+	modules := code.Bounds().Dx()
+	total := modules + 2*options.Margin
+	dark := func(x, y int) bool {
+		c, _, _, _ := code.At(x, y).RGBA()
+		return c == 0
+	}
+	if options.Format == "svg" {
+		return r.renderSVG(w, modules, total, dark, options)
+	}
+	return r.renderPNG(w, modules, total, dark, options)
+}
+
+func (r *QRRenderer) renderPNG(w io.Writer, modules, total int, dark func(x, y int) bool, options QROptions) error {
+	img := image.NewRGBA(image.Rect(0, 0, options.Size, options.Size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(options.Background), image.Point{}, draw.Src)
+	for py := 0; py < options.Size; py++ {
+		y := py*total/options.Size - options.Margin
+		for px := 0; px < options.Size; px++ {
+			x := px*total/options.Size - options.Margin
+			if x >= 0 && y >= 0 && x < modules && y < modules && dark(x, y) {
+				img.SetRGBA(px, py, options.Foreground)
+			}
+		}
+	}
+	if options.Logo {
+		side := int(float64(options.Size) * logoRatio)
+		offset := (options.Size - side) / 2
+		drawScaled(img, image.Rect(offset, offset, offset+side, offset+side), r.logo)
+	}
+	return png.Encode(w, img)
+}
+
+// drawScaled draws src over dst within the rectangle using nearest-neighbour scaling.
+func drawScaled(dst draw.Image, rect image.Rectangle, src image.Image) {
+	bounds := src.Bounds()
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		sy := bounds.Min.Y + (y-rect.Min.Y)*bounds.Dy()/rect.Dy()
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			sx := bounds.Min.X + (x-rect.Min.X)*bounds.Dx()/rect.Dx()
+			draw.Draw(dst, image.Rect(x, y, x+1, y+1), src, image.Pt(sx, sy), draw.Over)
+		}
+	}
+}
+
+func (r *QRRenderer) renderSVG(w io.Writer, modules, total int, dark func(x, y int) bool, options QROptions) error {
+	var path strings.Builder
+	for y := 0; y < modules; y++ {
+		for x := 0; x < modules; x++ {
+			if dark(x, y) {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x+options.Margin, y+options.Margin)
+			}
+		}
+	}
+	var svg bytes.Buffer
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		options.Size, options.Size, total, total)
+	fmt.Fprintf(&svg, `<rect width="%d" height="%d" fill="%s"/>`, total, total, hexColor(options.Background))
+	fmt.Fprintf(&svg, `<path d="%s" fill="%s"/>`, path.String(), hexColor(options.Foreground))
+	if options.Logo {
+		var logo bytes.Buffer
+		if err := png.Encode(&logo, r.logo); err != nil {
+			return err
+		}
+		side := float64(total) * logoRatio
+		offset := (float64(total) - side) / 2
+		fmt.Fprintf(&svg, `<image x="%g" y="%g" width="%g" height="%g" href="data:image/png;base64,%s"/>`,
+			offset, offset, side, side, base64.StdEncoding.EncodeToString(logo.Bytes()))
+	}
+	svg.WriteString(`</svg>`)
+	_, err := w.Write(svg.Bytes())
+	return err
+}
+
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func (r *QRRenderer) DataURI(content string, options QROptions) (string, error) {
+	var buffer bytes.Buffer
+	if err := r.Render(&buffer, content, options); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("data:%s;base64,%s", options.ContentType(), base64.StdEncoding.EncodeToString(buffer.Bytes())), nil
+}
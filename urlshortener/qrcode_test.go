@@ -0,0 +1,120 @@
+package urlshortener
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQRRenderPNG(t *testing.T) {
+	options, err := ParseQROptions(url.Values{"size": {"300"}, "margin": {"2"}, "fg": {"#112233"}, "bg": {"ffeedd"}})
+	require.NoError(t, err)
+
+	var buffer bytes.Buffer
+	require.NoError(t, NewQRRenderer(nil).Render(&buffer, "https://localhost:8080/u/abc", options))
+	img, err := png.Decode(&buffer)
+	require.NoError(t, err)
+
+	assert.Equal(t, image.Rect(0, 0, 300, 300), img.Bounds())
+	assert.Equal(t, color.RGBA{R: 0xff, G: 0xee, B: 0xdd, A: 0xff}, color.RGBAModel.Convert(img.At(0, 0)))
+	// the top-left finder pattern starts right after the margin
+	assert.Equal(t, color.RGBA{R: 0x11, G: 0x22, B: 0x33, A: 0xff}, color.RGBAModel.Convert(img.At(20, 20)))
+}
+
+func TestQRRenderSVGWithLogo(t *testing.T) {
+	logo := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	options, err := ParseQROptions(url.Values{"format": {"svg"}, "logo": {"true"}, "level": {"L"}})
+	require.NoError(t, err)
+
+	var buffer bytes.Buffer
+	require.NoError(t, NewQRRenderer(logo).Render(&buffer, "https://localhost:8080/u/abc", options))
+	svg := buffer.String()
+	assert.True(t, strings.HasPrefix(svg, `<svg xmlns="http://www.w3.org/2000/svg" width="256" height="256"`))
+	assert.Contains(t, svg, `fill="#000000"`)
+	assert.Contains(t, svg, `href="data:image/png;base64,`)
+
+	err = NewQRRenderer(nil).Render(&buffer, "https://localhost:8080/u/abc", options)
+	assert.ErrorIs(t, err, ErrMissingQRLogo)
+}
+
+func TestParseQROptionsInvalid(t *testing.T) {
+	for _, query := range []url.Values{
+		{"format": {"gif"}},
+		{"size": {"0"}},
+		{"size": {"99999"}},
+		{"margin": {"-1"}},
+		{"level": {"X"}},
+		{"fg": {"#12345"}},
+		{"bg": {"zzzzzz"}},
+	} {
+		_, err := ParseQROptions(query)
+		assert.ErrorIs(t, err, ErrInvalidQROptions, query.Encode())
+	}
+}
+
+func TestHTTPQRCode(t *testing.T) {
+	app := NewInMemoryApplication()
+	short, err := app.Shorten("https://developer.hashicorp.com/vault/tutorials/get-started/understand-static-dynamic-secrets", nil)
+	require.NoError(t, err)
+
+	recorder := handle(app, httptest.NewRequest(http.MethodGet, short+"/qr?size=128", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "image/png", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "public, max-age=86400", recorder.Header().Get("Cache-Control"))
+	etag := recorder.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	img, err := png.Decode(recorder.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 128, img.Bounds().Dx())
+
+	request := httptest.NewRequest(http.MethodGet, short+"/qr?size=128", nil)
+	request.Header.Set("If-None-Match", etag)
+	recorder = handle(app, request)
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+
+	count, _ := app.countStore.Get(short)
+	assert.Equal(t, 0, count)
+
+	recorder = handle(app, httptest.NewRequest(http.MethodGet, "/u/unknown/qr", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestHTTPShortenWithQRCode(t *testing.T) {
+	app := NewInMemoryApplication()
+	request := httptest.NewRequest(http.MethodPost, "/shorten?url="+url.QueryEscape("https://example.com/qr")+"&qr=svg", nil)
+	recorder := handle(app, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var response struct {
+		Shortened string `json:"shortened"`
+		QR        string `json:"qr"`
+	}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.NotEmpty(t, response.Shortened)
+	assert.True(t, strings.HasPrefix(response.QR, "data:image/svg+xml;base64,"))
+}
+
+func TestHTTPShortenWithInvalidQRCode(t *testing.T) {
+	app := NewInMemoryApplication()
+	request := httptest.NewRequest(http.MethodPost, "/shorten?url="+url.QueryEscape("https://example.com/qr")+
+		"&qr=png&logo=true", nil)
+	recorder := handle(app, request)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), ErrMissingQRLogo.Error())
+
+	_, err := app.Shorten("https://example.com/qr", nil)
+	require.NoError(t, err)
+	usage, err := app.QuotaUsecase.Usage()
+	require.NoError(t, err)
+	assert.Equal(t, 1, usage.Used, "the link is only created once its QR code can be rendered")
+}
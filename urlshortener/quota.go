@@ -0,0 +1,260 @@
+package urlshortener
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrQuotaExceeded = errors.New("monthly link quota exceeded")
+
+// QuotaUsage is what a workspace created in the current month; a zero limit
+// means no quota.
+type QuotaUsage struct {
+	WorkspaceID string    `json:"workspace_id"`
+	Period      string    `json:"period"`
+	Used        int       `json:"used"`
+	Limit       int       `json:"limit"`
+	Remaining   int       `json:"remaining"`
+	ResetAt     time.Time `json:"reset_at"`
+}
+
+type QuotaStorer interface {
+	// Limit returns the quota set for the workspace, if any.
+	Limit(workspaceID string) (int, bool, error)
+	SetLimit(workspaceID string, limit int) error
+	Used(workspaceID, period string) (int, error)
+	// Consume adds n to the usage unless it would go over a non-zero limit,
+	// in which case it returns ErrQuotaExceeded. A negative n gives back what
+	// was consumed.
+	Consume(workspaceID, period string, n, limit int) error
+}
+
+type QuotaUsecase struct {
+	quotas       QuotaStorer
+	defaultLimit int
+	clock        clockwork.Clock
+	principal    *Principal
+}
+
+func NewQuotaUsecase(quotas QuotaStorer, defaultLimit int) *QuotaUsecase {
+	return &QuotaUsecase{quotas: quotas, defaultLimit: defaultLimit, clock: clockwork.NewRealClock()}
+}
+
+func (q *QuotaUsecase) As(principal Principal) *QuotaUsecase {
+	u := *q
+	u.principal = &principal
+	return &u
+}
+
+// period is the UTC month quotas are counted in.
+func (q *QuotaUsecase) period() (string, time.Time) {
+	now := q.clock.Now()
+	return now.UTC().Format("2006-01"), quotaResetAt(now)
+}
+
+// quotaResetAt is the start of the next UTC month.
+func quotaResetAt(now time.Time) time.Time {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (q *QuotaUsecase) limit(workspaceID string) (int, error) {
+	limit, ok, err := q.quotas.Limit(workspaceID)
+	if err != nil || !ok {
+		return q.defaultLimit, err
+	}
+	return limit, nil
+}
+
+// Usage returns the usage of the principal workspace.
+func (q *QuotaUsecase) Usage() (QuotaUsage, error) {
+	if err := authorize(q.principal, ActionViewStats); err != nil {
+		return QuotaUsage{}, err
+	}
+	return q.UsageOf(workspaceOf(q.principal))
+}
+
+func (q *QuotaUsecase) UsageOf(workspaceID string) (QuotaUsage, error) {
+	if !canAccess(q.principal, workspaceID) {
+		return QuotaUsage{}, ErrWorkspaceNotFound
+	}
+	limit, err := q.limit(workspaceID)
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+	period, resetAt := q.period()
+	used, err := q.quotas.Used(workspaceID, period)
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+	usage := QuotaUsage{WorkspaceID: workspaceID, Period: period, Used: used, Limit: limit, ResetAt: resetAt}
+	if limit > 0 {
+		usage.Remaining = max(limit-used, 0)
+	}
+	return usage, nil
+}
+
+// SetLimit is left to operators: workspace owners could otherwise lift their
+// own quota.
+func (q *QuotaUsecase) SetLimit(workspaceID string, limit int) error {
+	if q.principal != nil {
+		return ErrForbidden
+	}
+	return q.quotas.SetLimit(workspaceID, max(limit, 0))
+}
+
+func (q *QuotaUsecase) consume(workspaceID string, n int) error {
+	limit, err := q.limit(workspaceID)
+	if err != nil {
+		return err
+	}
+	period, _ := q.period()
+	return q.quotas.Consume(workspaceID, period, n, limit)
+}
+
+// release gives back links consumed for a creation that failed.
+func (q *QuotaUsecase) release(workspaceID string, n int) {
+	period, _ := q.period()
+	_ = q.quotas.Consume(workspaceID, period, -n, 0)
+}
+
+type workspaceQuota struct {
+	WorkspaceID  string `gorm:"primaryKey"`
+	MonthlyLinks int
+}
+
+func (workspaceQuota) TableName() string {
+	return "workspace_quotas"
+}
+
+type quotaUsage struct {
+	WorkspaceID string `gorm:"primaryKey"`
+	Period      string `gorm:"primaryKey"`
+	Links       int
+}
+
+func (quotaUsage) TableName() string {
+	return "quota_usages"
+}
+
+type PGQuotaStore struct {
+	db *gorm.DB
+}
+
+func NewPGQuotaStoreFromDB(db *gorm.DB) *PGQuotaStore {
+	return &PGQuotaStore{db: db}
+}
+
+// Limit and Used are read on every creation, where not finding a row is no
+// error worth logging.
+func (p *PGQuotaStore) Limit(workspaceID string) (int, bool, error) {
+	var quotas []workspaceQuota
+	err := p.db.Where("workspace_id = ?", workspaceID).Limit(1).Find(&quotas).Error
+	if err != nil || len(quotas) == 0 {
+		return 0, false, err
+	}
+	return quotas[0].MonthlyLinks, true, nil
+}
+
+func (p *PGQuotaStore) SetLimit(workspaceID string, limit int) error {
+	return p.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&workspaceQuota{WorkspaceID: workspaceID, MonthlyLinks: limit}).Error
+}
+
+func (p *PGQuotaStore) Used(workspaceID, period string) (int, error) {
+	var usages []quotaUsage
+	err := p.db.Where("workspace_id = ? AND period = ?", workspaceID, period).Limit(1).Find(&usages).Error
+	if err != nil || len(usages) == 0 {
+		return 0, err
+	}
+	return usages[0].Links, nil
+}
+
+// Consume checks the limit in the upsert itself, so that concurrent creations
+// cannot go over it together.
+func (p *PGQuotaStore) Consume(workspaceID, period string, n, limit int) error {
+	if n < 0 {
+		return p.db.Exec("UPDATE quota_usages SET links = links - ? WHERE workspace_id = ? AND period = ? AND links >= ?",
+			-n, workspaceID, period, -n).Error
+	}
+	if limit > 0 && n > limit {
+		return ErrQuotaExceeded
+	}
+	result := p.db.Exec(`INSERT INTO quota_usages (workspace_id, period, links) VALUES (?, ?, ?)
+ON CONFLICT (workspace_id, period) DO UPDATE SET links = quota_usages.links + excluded.links
+WHERE ? = 0 OR quota_usages.links + excluded.links <= ?`, workspaceID, period, n, limit, limit)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+const (
+	redisWorkspaceQuotasKey = "workspace-quotas"
+	redisQuotaUsagePrefix   = "quota-usage:"
+)
+
+// consumeScript increments the usage unless it goes over the limit, in one
+// step.
+var consumeScript = redis.NewScript(`
+local used = tonumber(redis.call("GET", KEYS[1]) or "0")
+local n, limit = tonumber(ARGV[1]), tonumber(ARGV[2])
+if n > 0 and limit > 0 and used + n > limit then
+	return -1
+end
+used = math.max(used + n, 0)
+redis.call("SET", KEYS[1], used, "EX", ARGV[3])
+return used
+`)
+
+type RedisQuotaStore struct {
+	client *redis.Client
+}
+
+func NewRedisQuotaStoreFromClient(client *redis.Client) *RedisQuotaStore {
+	return &RedisQuotaStore{client: client}
+}
+
+func (r *RedisQuotaStore) Limit(workspaceID string) (int, bool, error) {
+	limit, err := r.client.HGet(context.Background(), redisWorkspaceQuotasKey, workspaceID).Int()
+	if errors.Is(err, redis.Nil) {
+		return 0, false, nil
+	}
+	return limit, err == nil, err
+}
+
+func (r *RedisQuotaStore) SetLimit(workspaceID string, limit int) error {
+	return r.client.HSet(context.Background(), redisWorkspaceQuotasKey, workspaceID, limit).Err()
+}
+
+func (r *RedisQuotaStore) Used(workspaceID, period string) (int, error) {
+	used, err := r.client.Get(context.Background(), redisQuotaUsagePrefix+workspaceID+":"+period).Int()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return used, err
+}
+
+// Consume keeps the usage of a month for two months, long enough to be read
+// until the month is over.
+func (r *RedisQuotaStore) Consume(workspaceID, period string, n, limit int) error {
+	ttl := strconv.Itoa(int((62 * 24 * time.Hour).Seconds()))
+	used, err := consumeScript.Run(context.Background(), r.client, []string{redisQuotaUsagePrefix + workspaceID + ":" + period},
+		n, limit, ttl).Int()
+	if err != nil {
+		return err
+	}
+	if used < 0 {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
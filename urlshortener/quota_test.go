@@ -0,0 +1,126 @@
+package urlshortener
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testQuotas(t *testing.T, store QuotaStorer) {
+	clock := clockwork.NewFakeClockAt(time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC))
+	quotas := &QuotaUsecase{quotas: store, defaultLimit: 3, clock: clock}
+	app := NewInMemoryApplication()
+	app.WithQuotas(quotas)
+
+	for _, u := range []string{"https://example.com/a", "https://example.com/b"} {
+		_, err := app.Shorten(u, nil)
+		require.NoError(t, err)
+	}
+	results, err := app.ShortenBatch([]ShortenRequest{{URL: "https://example.com/c"}, {URL: "https://example.com/d"}})
+	require.NoError(t, err)
+	for _, result := range results {
+		assert.ErrorIs(t, result.Err, ErrQuotaExceeded, "batches are all or nothing")
+	}
+	_, err = app.Shorten("https://example.com/c", nil)
+	require.NoError(t, err)
+	_, err = app.Shorten("https://example.com/d", nil)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	_, err = app.Shorten("not a url", nil)
+	assert.Error(t, err)
+
+	usage, err := quotas.UsageOf(DefaultWorkspace)
+	require.NoError(t, err)
+	assert.Equal(t, QuotaUsage{WorkspaceID: DefaultWorkspace, Period: "2024-01", Used: 3, Limit: 3, Remaining: 0,
+		ResetAt: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)}, usage)
+
+	require.NoError(t, quotas.SetLimit(DefaultWorkspace, 4))
+	_, err = app.Shorten("https://example.com/d", nil)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, quotas.As(Principal{Role: RoleOwner}).SetLimit(DefaultWorkspace, 100), ErrForbidden)
+
+	clock.Advance(time.Hour)
+	usage, err = quotas.UsageOf(DefaultWorkspace)
+	require.NoError(t, err)
+	assert.Equal(t, "2024-02", usage.Period)
+	assert.Equal(t, 0, usage.Used)
+
+	reader, err := NewLinkRecordReader("csv", strings.NewReader("e,https://example.com/e\nf,https://example.com/f\n"+
+		"g,https://example.com/g\nh,https://example.com/h\ni,https://example.com/i\n"))
+	require.NoError(t, err)
+	report, err := app.Import(reader, ImportOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 4, report.Created)
+	assert.Equal(t, []ImportError{{Record: 5, Error: ErrQuotaExceeded.Error()}}, report.Errors,
+		"imported links count against the quota")
+	usage, err = quotas.UsageOf(DefaultWorkspace)
+	require.NoError(t, err)
+	assert.Equal(t, 4, usage.Used)
+
+	require.NoError(t, quotas.SetLimit(DefaultWorkspace, 8))
+	for range 3 {
+		results, err := app.ShortenBatch([]ShortenRequest{{URL: "https://example.com/x"}, {URL: "https://example.com/y"}})
+		require.NoError(t, err)
+		for _, result := range results {
+			require.NoError(t, result.Err)
+		}
+	}
+	usage, err = quotas.UsageOf(DefaultWorkspace)
+	require.NoError(t, err)
+	assert.Equal(t, 6, usage.Used, "batches only pay for the links they create")
+
+	require.NoError(t, store.Consume("team", "2024-02", 2, 2))
+	quotas.release("team", 1)
+	used, err := store.Used("team", "2024-02")
+	require.NoError(t, err)
+	assert.Equal(t, 1, used)
+	assert.NoError(t, store.Consume("team", "2024-02", 10, 0), "a zero limit is no limit")
+}
+
+func TestQuotas(t *testing.T) {
+	testQuotas(t, NewPGQuotaStoreFromDB(NewInMemoryDB()))
+}
+
+func TestRedisQuotas(t *testing.T) {
+	_, client := newMiniredisClient(t)
+	testQuotas(t, NewRedisQuotaStoreFromClient(client))
+}
+
+func TestHTTPQuotas(t *testing.T) {
+	t.Setenv("API_AUTH", "required")
+	t.Setenv("QUOTA_MONTHLY_LINKS", "1")
+	app := NewInMemoryApplication()
+	member := newTestWorkspaceMember(t, app, "alice")
+	key, _, err := app.IssueKey(APIKey{Name: "alice", Scopes: knownScopes, UserID: member.user.ID, WorkspaceID: member.workspace.ID})
+	require.NoError(t, err)
+	shorten := func(u string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/shorten?url="+url.QueryEscape(u), nil)
+		request.Header.Set("X-API-Key", key)
+		return handle(app, request)
+	}
+
+	require.Equal(t, http.StatusOK, shorten("https://example.com/a").Code)
+	recorder := shorten("https://example.com/b")
+	require.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	var body tooManyRequestsResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+	assert.Equal(t, ErrQuotaExceeded.Error(), body.Error)
+	assert.Equal(t, quotaResetAt(time.Now()), body.ResetAt)
+
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/quota", nil)
+	request.Header.Set("X-API-Key", key)
+	recorder = handle(app, request)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var usage QuotaUsage
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &usage))
+	assert.Equal(t, member.workspace.ID, usage.WorkspaceID)
+	assert.Equal(t, 1, usage.Used)
+	assert.Equal(t, 1, usage.Limit)
+}
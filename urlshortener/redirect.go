@@ -0,0 +1,222 @@
+package urlshortener
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidRedirectStatus = errors.New("invalid redirect status")
+var ErrInvalidReferrerPolicy = errors.New("invalid referrer policy")
+var ErrInvalidRobotsTag = errors.New("invalid robots tag")
+var ErrInvalidQueryPassthrough = errors.New("invalid query passthrough")
+
+var referrerPolicies = map[string]bool{
+	"no-referrer":                     true,
+	"no-referrer-when-downgrade":      true,
+	"origin":                          true,
+	"origin-when-cross-origin":        true,
+	"same-origin":                     true,
+	"strict-origin":                   true,
+	"strict-origin-when-cross-origin": true,
+	"unsafe-url":                      true,
+}
+
+// QueryPassthrough tells how the query string of a short link request is
+// merged into the destination; by default it is dropped.
+type QueryPassthrough string
+
+const (
+	QueryDrop              QueryPassthrough = ""
+	QueryPreferDestination QueryPassthrough = "destination"
+	QueryPreferRequest     QueryPassthrough = "request"
+	QueryAppend            QueryPassthrough = "append"
+)
+
+type LinkOptions struct {
+	RedirectStatus   int              `json:"redirect_status,omitempty"`
+	ReferrerPolicy   string           `json:"referrer_policy,omitempty"`
+	RobotsTag        string           `json:"robots_tag,omitempty"`
+	QueryPassthrough QueryPassthrough `json:"query_passthrough,omitempty"`
+	PathPassthrough  bool             `json:"path_passthrough,omitempty"`
+}
+
+func (o LinkOptions) Validate() error {
+	if o.RedirectStatus != 0 && !validRedirectStatus(o.RedirectStatus) {
+		return ErrInvalidRedirectStatus
+	}
+	if o.ReferrerPolicy != "" && !referrerPolicies[o.ReferrerPolicy] {
+		return ErrInvalidReferrerPolicy
+	}
+	if strings.ContainsAny(o.RobotsTag, "\r\n") {
+		return ErrInvalidRobotsTag
+	}
+	switch o.QueryPassthrough {
+	case QueryDrop, QueryPreferDestination, QueryPreferRequest, QueryAppend:
+	default:
+		return ErrInvalidQueryPassthrough
+	}
+	return nil
+}
+
+// passthrough returns a copy of the destination extended with the extra path
+// segments and query parameters of the incoming request.
+func (o LinkOptions) passthrough(destination URL, extraPath string, query url.Values) URL {
+	target := *destination.URL
+	if extraPath != "" {
+		// cleaning against the root first keeps ".." from climbing above the destination path
+		target = *target.JoinPath(path.Clean("/" + extraPath))
+	}
+	if len(query) > 0 && o.QueryPassthrough != QueryDrop {
+		merged := target.Query()
+		for key, values := range query {
+			switch o.QueryPassthrough {
+			case QueryPreferDestination:
+				if !merged.Has(key) {
+					merged[key] = values
+				}
+			case QueryPreferRequest:
+				merged[key] = values
+			case QueryAppend:
+				merged[key] = append(merged[key], values...)
+			}
+		}
+		target.RawQuery = merged.Encode()
+	}
+	destination.URL = &target
+	return destination
+}
+
+// splitShortURL separates a short link from the extra path segments and query
+// string a visitor appended to it.
+func splitShortURL(rawURL string) (string, string, url.Values) {
+	u, err := url.Parse(rawURL)
+	if err != nil || !strings.HasPrefix(u.Path, "/u/") {
+		return rawURL, "", nil
+	}
+	code, extraPath, _ := strings.Cut(strings.TrimPrefix(u.Path, "/u/"), "/")
+	query := u.Query()
+	u.Path, u.RawPath, u.RawQuery = "/u/"+code, "", ""
+	return u.String(), extraPath, query
+}
+
+func validRedirectStatus(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	default:
+		return false
+	}
+}
+
+func permanentRedirect(status int) bool {
+	return status == http.StatusMovedPermanently || status == http.StatusPermanentRedirect
+}
+
+// RedirectPolicy holds the global defaults applied to links that do not
+// override them.
+type RedirectPolicy struct {
+	Status         int
+	MaxAge         time.Duration
+	ReferrerPolicy string
+	RobotsTag      string
+}
+
+func DefaultRedirectPolicy() RedirectPolicy {
+	return RedirectPolicy{Status: http.StatusTemporaryRedirect, MaxAge: 24 * time.Hour}
+}
+
+func redirectPolicyFromEnv() RedirectPolicy {
+	policy := DefaultRedirectPolicy()
+	if status := os.Getenv("REDIRECT_STATUS"); status != "" {
+		s, err := strconv.Atoi(status)
+		if err != nil || !validRedirectStatus(s) {
+			panic(fmt.Sprintf("invalid REDIRECT_STATUS: %s", status))
+		}
+		policy.Status = s
+	}
+	policy.MaxAge = envDuration("REDIRECT_MAX_AGE", policy.MaxAge)
+	policy.ReferrerPolicy = os.Getenv("REDIRECT_REFERRER_POLICY")
+	policy.RobotsTag = os.Getenv("REDIRECT_ROBOTS_TAG")
+	if err := (LinkOptions{ReferrerPolicy: policy.ReferrerPolicy, RobotsTag: policy.RobotsTag}).Validate(); err != nil {
+		panic(err.Error())
+	}
+	return policy
+}
+
+type Redirect struct {
+	Shortened string
+	Rule      string
+	Variant   string
+	Vary      []string
+	// SetVisitorCookie asks to persist the visitor ID a variant was chosen for
+	SetVisitorCookie bool
+	Location         string
+	Status           int
+	CacheControl     string
+	ReferrerPolicy   string
+	RobotsTag        string
+}
+
+type Resolver interface {
+	Resolve(rawURL string, visitor Visitor) (Redirect, error)
+}
+
+func (p RedirectPolicy) redirectFor(u URL, now time.Time) Redirect {
+	options := u.Options()
+	redirect := Redirect{
+		Location:       u.String(),
+		Status:         p.Status,
+		ReferrerPolicy: p.ReferrerPolicy,
+		RobotsTag:      p.RobotsTag,
+	}
+	if options.RedirectStatus != 0 {
+		redirect.Status = options.RedirectStatus
+	}
+	if options.ReferrerPolicy != "" {
+		redirect.ReferrerPolicy = options.ReferrerPolicy
+	}
+	if options.RobotsTag != "" {
+		redirect.RobotsTag = options.RobotsTag
+	}
+	redirect.CacheControl = p.cacheControl(u, redirect.Status, now)
+	return redirect
+}
+
+// cacheControl only lets shared caches keep permanent redirects: temporary
+// ones may be retargeted and every hit must reach the counter.
+func (p RedirectPolicy) cacheControl(u URL, status int, now time.Time) string {
+	if !permanentRedirect(status) {
+		return "no-store"
+	}
+	maxAge := p.MaxAge
+	if u.Expiring() {
+		maxAge = min(maxAge, u.expiration.Sub(now))
+	}
+	if maxAge <= 0 {
+		return "no-store"
+	}
+	return fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds()))
+}
+
+func writeRedirect(writer http.ResponseWriter, redirect Redirect) {
+	header := writer.Header()
+	header.Set("Location", redirect.Location)
+	header.Set("Cache-Control", redirect.CacheControl)
+	if redirect.ReferrerPolicy != "" {
+		header.Set("Referrer-Policy", redirect.ReferrerPolicy)
+	}
+	if redirect.RobotsTag != "" {
+		header.Set("X-Robots-Tag", redirect.RobotsTag)
+	}
+	if len(redirect.Vary) > 0 {
+		header.Set("Vary", strings.Join(redirect.Vary, ", "))
+	}
+	writer.WriteHeader(redirect.Status)
+}
@@ -0,0 +1,124 @@
+package urlshortener
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveCacheControl(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local)
+	inOneHour := now.Add(time.Hour)
+	usecase := NewUsecase(NewInMemorySqlite())
+	usecase.WithClock(clockwork.NewFakeClockAt(now))
+	usecase.WithRedirectPolicy(RedirectPolicy{Status: http.StatusFound, MaxAge: 24 * time.Hour, RobotsTag: "noindex"})
+
+	for _, test := range []struct {
+		name         string
+		request      ShortenRequest
+		status       int
+		cacheControl string
+	}{
+		{"global temporary", ShortenRequest{URL: "https://example.com/a"}, http.StatusFound, "no-store"},
+		{"permanent", ShortenRequest{URL: "https://example.com/b", Options: LinkOptions{RedirectStatus: 308}}, 308, "public, max-age=86400"},
+		{"permanent expiring", ShortenRequest{URL: "https://example.com/c", Expiration: &inOneHour, Options: LinkOptions{RedirectStatus: 301}}, 301, "public, max-age=3600"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			short, err := usecase.ShortenWithOptions(test.request)
+			require.NoError(t, err)
+			redirect, err := usecase.Resolve(short, Visitor{})
+			require.NoError(t, err)
+			assert.Equal(t, test.request.URL, redirect.Location)
+			assert.Equal(t, test.status, redirect.Status)
+			assert.Equal(t, test.cacheControl, redirect.CacheControl)
+			assert.Equal(t, "noindex", redirect.RobotsTag)
+		})
+	}
+}
+
+func TestShortenInvalidLinkOptions(t *testing.T) {
+	usecase := NewUsecase(NewInMemorySqlite())
+	for options, expected := range map[LinkOptions]error{
+		{RedirectStatus: 200}:            ErrInvalidRedirectStatus,
+		{ReferrerPolicy: "everywhere"}:   ErrInvalidReferrerPolicy,
+		{RobotsTag: "noindex\r\nX-A: b"}: ErrInvalidRobotsTag,
+	} {
+		_, err := usecase.ShortenWithOptions(ShortenRequest{URL: "https://example.com/a", Options: options})
+		assert.ErrorIs(t, err, expected)
+	}
+}
+
+func TestHTTPRedirectHeaders(t *testing.T) {
+	app := NewInMemoryApplication()
+	request := httptest.NewRequest(http.MethodPost, "/shorten?url="+url.QueryEscape("https://example.com/headers")+
+		"&redirect_status=301&referrer_policy=no-referrer&robots_tag=noindex,nofollow", nil)
+	require.Equal(t, http.StatusOK, handle(app, request).Code)
+	short := "https://localhost:8080/u/" + MustNewURL("https://example.com/headers", nil).encode()
+
+	recorder := handle(app, httptest.NewRequest(http.MethodHead, short, nil))
+	assert.Equal(t, http.StatusMovedPermanently, recorder.Code)
+	assert.Equal(t, "https://example.com/headers", recorder.Header().Get("Location"))
+	assert.Equal(t, "public, max-age=86400", recorder.Header().Get("Cache-Control"))
+	assert.Equal(t, "no-referrer", recorder.Header().Get("Referrer-Policy"))
+	assert.Equal(t, "noindex,nofollow", recorder.Header().Get("X-Robots-Tag"))
+	count, _ := app.countStore.Get(short)
+	assert.Equal(t, 0, count)
+
+	recorder = handle(app, httptest.NewRequest(http.MethodGet, short, nil))
+	assert.Equal(t, http.StatusMovedPermanently, recorder.Code)
+	count, _ = app.countStore.Get(short)
+	assert.Equal(t, 1, count)
+
+	request = httptest.NewRequest(http.MethodPost, "/shorten?url="+url.QueryEscape("https://example.com/x")+"&redirect_status=200", nil)
+	assert.Equal(t, http.StatusBadRequest, handle(app, request).Code)
+}
+
+func TestResolvePassthrough(t *testing.T) {
+	usecase := NewUsecase(NewInMemorySqlite())
+	for _, test := range []struct {
+		name     string
+		options  LinkOptions
+		suffix   string
+		expected string
+	}{
+		{"dropped by default", LinkOptions{}, "?utm_source=x", "https://example.com/dest?a=1"},
+		{"prefer destination", LinkOptions{QueryPassthrough: QueryPreferDestination}, "?a=2&utm_source=x", "https://example.com/dest?a=1&utm_source=x"},
+		{"prefer request", LinkOptions{QueryPassthrough: QueryPreferRequest}, "?a=2", "https://example.com/dest?a=2"},
+		{"append", LinkOptions{QueryPassthrough: QueryAppend}, "?a=2", "https://example.com/dest?a=1&a=2"},
+		{"path", LinkOptions{PathPassthrough: true, QueryPassthrough: QueryPreferRequest}, "/extra/../../path?b=3", "https://example.com/dest/path?a=1&b=3"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			usecase := NewUsecase(NewInMemorySqlite())
+			short, err := usecase.ShortenWithOptions(ShortenRequest{URL: "https://example.com/dest?a=1", Options: test.options})
+			require.NoError(t, err)
+			redirect, err := usecase.Resolve(short+test.suffix, Visitor{})
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, redirect.Location)
+			assert.Equal(t, short, redirect.Shortened)
+		})
+	}
+
+	short, err := usecase.Shorten("https://example.com/dest", nil)
+	require.NoError(t, err)
+	_, err = usecase.Resolve(short+"/extra", Visitor{})
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestHTTPRedirectPassthrough(t *testing.T) {
+	app := NewInMemoryApplication()
+	short, err := app.ShortenWithOptions(ShortenRequest{URL: "https://example.com/docs",
+		Options: LinkOptions{PathPassthrough: true, QueryPassthrough: QueryPreferRequest}})
+	require.NoError(t, err)
+
+	recorder := handle(app, httptest.NewRequest(http.MethodGet, short+"/guide/intro?utm_source=x", nil))
+	assert.Equal(t, http.StatusTemporaryRedirect, recorder.Code)
+	assert.Equal(t, "https://example.com/docs/guide/intro?utm_source=x", recorder.Header().Get("Location"))
+	count, _ := app.countStore.Get(short)
+	assert.Equal(t, 1, count)
+}
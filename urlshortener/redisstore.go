@@ -0,0 +1,413 @@
+package urlshortener
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisURLPrefix           = "url:"
+	redisCountPrefix         = "count:"
+	redisCampaignsKey        = "campaigns"
+	redisCampaignLinksPrefix = "campaign-links:"
+)
+
+type RedisStore struct {
+	client *redis.Client
+}
+
+func (r *RedisStore) Get(shortened string) (URL, error) {
+	values, err := r.client.HGetAll(context.Background(), redisURLPrefix+shortened).Result()
+	if err != nil {
+		return URL{}, err
+	}
+	association, err := redisAssociation(shortened, values)
+	if err != nil {
+		return URL{}, err
+	}
+	return association.toURL()
+}
+
+func redisAssociation(shortened string, values map[string]string) (URLAssociation, error) {
+	rawURL, ok := values["url"]
+	if !ok {
+		return URLAssociation{}, ErrNotFound
+	}
+	association := URLAssociation{URL: rawURL, Shortened: shortened, Campaign: values["campaign"],
+		WorkspaceID: workspaceOrDefault(values["workspace_id"]), CreatedBy: values["created_by"],
+		Quarantined: values["quarantined"] == "true"}
+	if values["expiration"] != "" {
+		expiration, err := time.Parse(time.RFC3339Nano, values["expiration"])
+		if err != nil {
+			return URLAssociation{}, err
+		}
+		association.Expiration = sql.NullTime{Time: expiration, Valid: true}
+	}
+	if values["created_at"] != "" {
+		createdAt, err := time.Parse(time.RFC3339Nano, values["created_at"])
+		if err != nil {
+			return URLAssociation{}, err
+		}
+		association.CreatedAt = &createdAt
+	}
+	if values["options"] != "" {
+		if err := json.Unmarshal([]byte(values["options"]), &association.Options); err != nil {
+			return URLAssociation{}, err
+		}
+	}
+	if values["targets"] != "" {
+		if err := json.Unmarshal([]byte(values["targets"]), &association.Targets); err != nil {
+			return URLAssociation{}, err
+		}
+	}
+	if values["geo_targets"] != "" {
+		if err := json.Unmarshal([]byte(values["geo_targets"]), &association.GeoTargets); err != nil {
+			return URLAssociation{}, err
+		}
+	}
+	if values["variants"] != "" {
+		if err := json.Unmarshal([]byte(values["variants"]), &association.Variants); err != nil {
+			return URLAssociation{}, err
+		}
+	}
+	return association, nil
+}
+
+// Save fails with ErrConflict when the code is taken, watching the link so
+// that a concurrent save cannot slip in between.
+func (r *RedisStore) Save(association URLAssociation) error {
+	ctx := context.Background()
+	key := redisURLPrefix + association.Shortened
+	for {
+		err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+			exists, err := tx.Exists(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			if exists > 0 {
+				return ErrConflict
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				return r.save(ctx, pipe, association)
+			})
+			return err
+		}, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+}
+
+func (r *RedisStore) save(ctx context.Context, pipe redis.Pipeliner, association URLAssociation) error {
+	key := redisURLPrefix + association.Shortened
+	options, err := json.Marshal(association.Options)
+	if err != nil {
+		return err
+	}
+	targets, err := json.Marshal(association.Targets)
+	if err != nil {
+		return err
+	}
+	geoTargets, err := json.Marshal(association.GeoTargets)
+	if err != nil {
+		return err
+	}
+	variants, err := json.Marshal(association.Variants)
+	if err != nil {
+		return err
+	}
+	values := map[string]any{"url": association.URL, "expiration": "", "created_at": "", "options": string(options),
+		"campaign": association.Campaign, "targets": string(targets), "geo_targets": string(geoTargets),
+		"variants": string(variants), "workspace_id": workspaceOrDefault(association.WorkspaceID),
+		"created_by": association.CreatedBy, "quarantined": strconv.FormatBool(association.Quarantined)}
+	if association.Expiration.Valid {
+		values["expiration"] = association.Expiration.Time.Format(time.RFC3339Nano)
+	}
+	if association.CreatedAt != nil {
+		values["created_at"] = association.CreatedAt.Format(time.RFC3339Nano)
+	}
+	pipe.HSet(ctx, key, values)
+	if association.Expiration.Valid {
+		pipe.ExpireAt(ctx, key, association.Expiration.Time)
+	} else {
+		pipe.Persist(ctx, key)
+	}
+	if association.Campaign != "" {
+		pipe.SAdd(ctx, redisCampaignLinksPrefix+association.Campaign, association.Shortened)
+	}
+	return nil
+}
+
+// SaveBatch keeps the links whose code is taken, watching the links so that a
+// concurrent save cannot slip in between.
+func (r *RedisStore) SaveBatch(associations []URLAssociation) ([]URLAssociation, int, error) {
+	if len(associations) == 0 {
+		return nil, 0, nil
+	}
+	ctx := context.Background()
+	keys := make([]string, 0, len(associations))
+	for _, association := range associations {
+		keys = append(keys, redisURLPrefix+association.Shortened)
+	}
+	for {
+		var stored []URLAssociation
+		created := 0
+		err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+			commands, err := tx.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				for _, key := range keys {
+					pipe.HGet(ctx, key, "url")
+				}
+				return nil
+			})
+			if err != nil && !errors.Is(err, redis.Nil) {
+				return err
+			}
+			stored, created = make([]URLAssociation, 0, len(associations)), 0
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				for i, association := range associations {
+					if url, err := commands[i].(*redis.StringCmd).Result(); err == nil {
+						association.URL = url
+					} else {
+						if err := r.save(ctx, pipe, association); err != nil {
+							return err
+						}
+						created++
+					}
+					stored = append(stored, association)
+				}
+				return nil
+			})
+			return err
+		}, keys...)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return stored, created, err
+		}
+	}
+}
+
+// Update applies the change optimistically, retrying when the link is
+// modified concurrently.
+func (r *RedisStore) Update(shortened string, update func(association *URLAssociation) error) error {
+	ctx := context.Background()
+	key := redisURLPrefix + shortened
+	for {
+		err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+			values, err := tx.HGetAll(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			association, err := redisAssociation(shortened, values)
+			if err != nil {
+				return err
+			}
+			if err := update(&association); err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				return r.save(ctx, pipe, association)
+			})
+			return err
+		}, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+}
+
+func (r *RedisStore) Delete(shortened string) error {
+	ctx := context.Background()
+	campaign, err := r.client.HGet(ctx, redisURLPrefix+shortened, "campaign").Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, redisURLPrefix+shortened)
+		if campaign != "" {
+			pipe.SRem(ctx, redisCampaignLinksPrefix+campaign, shortened)
+		}
+		return nil
+	})
+	return err
+}
+
+type RedisCountStore struct {
+	client *redis.Client
+}
+
+func (r *RedisCountStore) Increment(url string) error {
+	return r.client.Incr(context.Background(), redisCountPrefix+url).Err()
+}
+
+func (r *RedisCountStore) Get(url string) (int, error) {
+	hits, err := r.client.Get(context.Background(), redisCountPrefix+url).Int()
+	if errors.Is(err, redis.Nil) {
+		return 0, ErrNotFound
+	}
+	return hits, err
+}
+
+func (r *RedisCountStore) Set(url string, hits int) error {
+	return r.client.Set(context.Background(), redisCountPrefix+url, hits, 0).Err()
+}
+
+func (r *RedisCountStore) Delete(url string) error {
+	return r.client.Del(context.Background(), redisCountPrefix+url).Err()
+}
+
+type RedisLinkExporter struct {
+	client *redis.Client
+}
+
+func (r *RedisLinkExporter) ExportLinks(workspaceID string, f func(LinkRecord) error) error {
+	ctx := context.Background()
+	store := NewRedisStoreFromClient(r.client)
+	countStore := NewRedisCountStoreFromClient(r.client)
+	iterator := r.client.Scan(ctx, 0, redisURLPrefix+"*", 0).Iterator()
+	for iterator.Next(ctx) {
+		shortened := strings.TrimPrefix(iterator.Val(), redisURLPrefix)
+		u, err := store.Get(shortened)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if workspaceID != "" && u.Workspace() != workspaceID {
+			continue
+		}
+		hits, err := countStore.Get(shortened)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err := f(LinkRecord{Shortened: shortened, URL: u.String(), Expiration: u.expiration, Hits: hits, Options: u.options,
+			Targets: u.targets, GeoTargets: u.geoTargets, Variants: u.variants,
+			Workspace: exportedWorkspace(u.Workspace()), CreatedBy: u.createdBy}); err != nil {
+			return err
+		}
+	}
+	return iterator.Err()
+}
+
+type RedisCampaignStore struct {
+	client *redis.Client
+}
+
+// redisCampaign keeps the workspace, which the API representation of a
+// campaign leaves out.
+type redisCampaign struct {
+	Campaign
+	WorkspaceID string `json:"workspace_id,omitempty"`
+}
+
+func (c redisCampaign) campaign() Campaign {
+	campaign := c.Campaign
+	campaign.WorkspaceID = workspaceOrDefault(c.WorkspaceID)
+	return campaign
+}
+
+func (r *RedisCampaignStore) Get(name string) (Campaign, error) {
+	value, err := r.client.HGet(context.Background(), redisCampaignsKey, name).Result()
+	if errors.Is(err, redis.Nil) {
+		return Campaign{}, ErrCampaignNotFound
+	}
+	if err != nil {
+		return Campaign{}, err
+	}
+	var campaign redisCampaign
+	err = json.Unmarshal([]byte(value), &campaign)
+	return campaign.campaign(), err
+}
+
+func (r *RedisCampaignStore) Save(campaign Campaign) error {
+	value, err := json.Marshal(redisCampaign{Campaign: campaign, WorkspaceID: campaign.WorkspaceID})
+	if err != nil {
+		return err
+	}
+	return r.client.HSet(context.Background(), redisCampaignsKey, campaign.Name, value).Err()
+}
+
+func (r *RedisCampaignStore) List(workspaceID string) ([]Campaign, error) {
+	values, err := r.client.HGetAll(context.Background(), redisCampaignsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	campaigns := make([]Campaign, 0, len(values))
+	for _, value := range values {
+		var campaign redisCampaign
+		if err := json.Unmarshal([]byte(value), &campaign); err != nil {
+			return nil, err
+		}
+		if workspaceID != "" && campaign.campaign().WorkspaceID != workspaceID {
+			continue
+		}
+		campaigns = append(campaigns, campaign.campaign())
+	}
+	slices.SortFunc(campaigns, func(a, b Campaign) int { return strings.Compare(a.Name, b.Name) })
+	return campaigns, nil
+}
+
+func (r *RedisCampaignStore) Stats(name string) (CampaignStats, error) {
+	if _, err := r.Get(name); err != nil {
+		return CampaignStats{}, err
+	}
+	ctx := context.Background()
+	links, err := r.client.SMembers(ctx, redisCampaignLinksPrefix+name).Result()
+	if err != nil {
+		return CampaignStats{}, err
+	}
+	stats := CampaignStats{Campaign: name, Links: len(links)}
+	if len(links) == 0 {
+		return stats, nil
+	}
+	keys := make([]string, 0, len(links))
+	for _, link := range links {
+		keys = append(keys, redisCountPrefix+link)
+	}
+	hits, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return CampaignStats{}, err
+	}
+	for _, h := range hits {
+		if s, ok := h.(string); ok {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return CampaignStats{}, err
+			}
+			stats.Clicks += n
+		}
+	}
+	return stats, nil
+}
+
+func NewRedisCampaignStoreFromClient(client *redis.Client) *RedisCampaignStore {
+	return &RedisCampaignStore{client: client}
+}
+
+func NewRedisStoreFromClient(client *redis.Client) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+func NewRedisCountStoreFromClient(client *redis.Client) *RedisCountStore {
+	return &RedisCountStore{client: client}
+}
+
+func NewRedisClient() *redis.Client {
+	options, err := redis.ParseURL(os.Getenv("REDIS_URL"))
+	if err != nil {
+		panic("failed to parse redis URL")
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		panic("failed to connect redis")
+	}
+	return client
+}
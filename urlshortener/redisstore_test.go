@@ -0,0 +1,101 @@
+package urlshortener
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMiniredisClient(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	server := miniredis.RunT(t)
+	return server, redis.NewClient(&redis.Options{Addr: server.Addr()})
+}
+
+func TestRedisShortenUnshortener(t *testing.T) {
+	ShortenUnshortenerFromBuilder(t, func() ShortenUnshortener {
+		_, client := newMiniredisClient(t)
+		return NewApplicationFromInfrastructure(NewRedisInfrastructureFromClient(client, true))
+	})
+}
+
+func TestRedisStoreWithExpiration(t *testing.T) {
+	server, client := newMiniredisClient(t)
+	s := NewRedisStoreFromClient(client)
+	expiration := time.Now().Add(1 * time.Hour)
+	err := s.Save(NewURLAssociation("http://long.net", "http://short.uk", &expiration))
+	require.NoError(t, err)
+
+	u, err := s.Get("http://short.uk")
+	require.NoError(t, err)
+	assert.Equal(t, expiration.Format(time.RFC3339), u.expiration.Format(time.RFC3339))
+
+	server.FastForward(2 * time.Hour)
+
+	_, err = s.Get("http://short.uk")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestRedisCountStore(t *testing.T) {
+	_, client := newMiniredisClient(t)
+	c := NewRedisCountStoreFromClient(client)
+
+	_, err := c.Get("http://short.uk")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	for range 3 {
+		require.NoError(t, c.Increment("http://short.uk"))
+	}
+	count, err := c.Get("http://short.uk")
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
+
+func TestRedisStoreSaveBatch(t *testing.T) {
+	_, client := newMiniredisClient(t)
+	s := NewRedisStoreFromClient(client)
+	require.NoError(t, s.Save(NewURLAssociation("http://long.net/existing", "http://short.uk/1", nil)))
+
+	stored, created, err := s.SaveBatch([]URLAssociation{
+		NewURLAssociation("http://long.net/other", "http://short.uk/1", nil),
+		NewURLAssociation("http://long.net/new", "http://short.uk/2", nil),
+	})
+	require.NoError(t, err)
+	require.Len(t, stored, 2)
+	assert.Equal(t, 1, created)
+	assert.Equal(t, "http://long.net/existing", stored[0].URL)
+	assert.Equal(t, "http://long.net/new", stored[1].URL)
+
+	u, err := s.Get("http://short.uk/2")
+	require.NoError(t, err)
+	assert.Equal(t, "http://long.net/new", u.String())
+}
+
+func TestRedisStoreConflict(t *testing.T) {
+	_, client := newMiniredisClient(t)
+	s := NewRedisStoreFromClient(client)
+	require.NoError(t, s.Save(NewURLAssociation("http://long.net/existing", "http://short.uk/1", nil)))
+
+	err := s.Save(NewURLAssociation("http://long.net/other", "http://short.uk/1", nil))
+	assert.ErrorIs(t, err, ErrConflict)
+	u, err := s.Get("http://short.uk/1")
+	require.NoError(t, err)
+	assert.Equal(t, "http://long.net/existing", u.String(), "a taken code keeps its destination")
+}
+
+func TestRedisShortenQuarantined(t *testing.T) {
+	_, client := newMiniredisClient(t)
+	app := NewApplicationFromInfrastructure(NewRedisInfrastructureFromClient(client, true))
+	shortened, err := app.Shorten("https://example.com/phishing", nil)
+	require.NoError(t, err)
+	require.NoError(t, app.Quarantine(shortened, "phishing"))
+
+	again, err := app.Shorten("https://example.com/phishing", nil)
+	require.NoError(t, err)
+	assert.Equal(t, shortened, again)
+	_, err = app.Resolve(shortened, Visitor{})
+	assert.ErrorIs(t, err, ErrQuarantined, "shortening the destination again does not release the link")
+}
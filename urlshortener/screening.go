@@ -0,0 +1,469 @@
+package urlshortener
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrForbiddenScheme = errors.New("URL scheme is not allowed")
+var ErrPrivateDestination = errors.New("destination is a private address")
+var ErrNonCanonicalAddress = errors.New("destination address is not in dotted decimal form")
+var ErrBlockedDomain = errors.New("domain is blocked")
+var ErrDomainNotAllowed = errors.New("domain is not allowed")
+var ErrThreatMatch = errors.New("URL matches a known threat")
+var ErrNestedShortener = errors.New("too many nested short links")
+
+// ScreeningError tells why a URL was rejected: Reason is one of the screening
+// errors above and Rule what matched, such as the blocked domain.
+type ScreeningError struct {
+	URL    string
+	Reason error
+	Rule   string
+}
+
+func (e *ScreeningError) Error() string {
+	return e.Reason.Error()
+}
+
+func (e *ScreeningError) Unwrap() error {
+	return e.Reason
+}
+
+func rejected(u *url.URL, reason error, rule string) error {
+	return &ScreeningError{URL: u.String(), Reason: reason, Rule: rule}
+}
+
+// URLScreener rejects URLs that must not be shortened, with a ScreeningError.
+type URLScreener interface {
+	Screen(u *url.URL) error
+}
+
+type URLScreenerFunc func(u *url.URL) error
+
+func (f URLScreenerFunc) Screen(u *url.URL) error { return f(u) }
+
+// ScreenerChain runs every screener in order and returns the first rejection.
+type ScreenerChain []URLScreener
+
+func (c ScreenerChain) Screen(u *url.URL) error {
+	for _, screener := range c {
+		if err := screener.Screen(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScreenRawURL parses the URL before screening it.
+func ScreenRawURL(screener URLScreener, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ErrInvalidURL
+	}
+	return screener.Screen(u)
+}
+
+var forbiddenSchemes = []string{"javascript", "data", "vbscript", "file"}
+
+// SchemeScreener rejects the schemes that run code or read local files in the
+// browser of the visitor.
+var SchemeScreener = URLScreenerFunc(func(u *url.URL) error {
+	scheme := strings.ToLower(u.Scheme)
+	for _, forbidden := range forbiddenSchemes {
+		if scheme == forbidden {
+			return rejected(u, ErrForbiddenScheme, scheme)
+		}
+	}
+	return nil
+})
+
+// PrivateAddressScreener rejects destinations on loopback, private,
+// link-local or unspecified addresses, on localhost and its subdomains, and
+// on IPv4 addresses written in any other form than dotted decimal, such as
+// 2130706433 or 0x7f.1, which browsers still read as addresses. Other host
+// names are only resolved when Resolve is set, since resolving delays every
+// creation: without it, a name pointing at a private address goes through.
+type PrivateAddressScreener struct {
+	Resolve func(host string) ([]netip.Addr, error)
+}
+
+func (s PrivateAddressScreener) Screen(u *url.URL) error {
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "" {
+		return nil
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return rejected(u, ErrPrivateDestination, host)
+	}
+	addrs := []netip.Addr{}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = append(addrs, addr)
+	} else if addr, ok := parseLegacyIPv4(host); ok {
+		return rejected(u, ErrNonCanonicalAddress, addr.String())
+	} else if s.Resolve != nil {
+		// unresolvable hosts are left to the other checks
+		addrs, _ = s.Resolve(host)
+	}
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+			addr.IsUnspecified() {
+			return rejected(u, ErrPrivateDestination, addr.String())
+		}
+	}
+	return nil
+}
+
+// parseLegacyIPv4 reads hosts the way browsers do when their last label is a
+// number: up to four decimal, octal (leading 0) or hexadecimal (leading 0x)
+// parts, the last one filling the remaining bytes.
+func parseLegacyIPv4(host string) (netip.Addr, bool) {
+	parts := strings.Split(host, ".")
+	if len(parts) > 4 {
+		return netip.Addr{}, false
+	}
+	var value uint64
+	for i, part := range parts {
+		n, ok := parseLegacyIPv4Part(part)
+		if !ok {
+			return netip.Addr{}, false
+		}
+		bits := uint(8 * (4 - i))
+		if i < len(parts)-1 {
+			if n > 0xff {
+				return netip.Addr{}, false
+			}
+			value |= n << (bits - 8)
+		} else {
+			if n >= 1<<bits {
+				return netip.Addr{}, false
+			}
+			value |= n
+		}
+	}
+	return netip.AddrFrom4([4]byte{byte(value >> 24), byte(value >> 16), byte(value >> 8), byte(value)}), true
+}
+
+func parseLegacyIPv4Part(part string) (uint64, bool) {
+	base, digits := 10, part
+	switch {
+	case strings.HasPrefix(part, "0x") || strings.HasPrefix(part, "0X"):
+		base, digits = 16, part[2:]
+		if digits == "" {
+			return 0, true
+		}
+	case len(part) > 1 && part[0] == '0':
+		base, digits = 8, part[1:]
+	}
+	if digits == "" || strings.Trim(strings.ToLower(digits), "0123456789abcdef"[:base]) != "" {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(digits, base, 32)
+	return n, err == nil
+}
+
+func resolveHost(host string) ([]netip.Addr, error) {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]netip.Addr, 0, len(ips))
+	for _, ip := range ips {
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+// DomainListScreener rejects the blocked domains and, when the allowlist is
+// not empty, every domain not on it. Domains cover their subdomains.
+type DomainListScreener struct {
+	Blocked []string
+	Allowed []string
+}
+
+func (s DomainListScreener) Screen(u *url.URL) error {
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if domain, ok := matchDomain(host, s.Blocked); ok {
+		return rejected(u, ErrBlockedDomain, domain)
+	}
+	if _, ok := matchDomain(host, s.Allowed); len(s.Allowed) > 0 && !ok {
+		return rejected(u, ErrDomainNotAllowed, host)
+	}
+	return nil
+}
+
+func matchDomain(host string, domains []string) (string, bool) {
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return domain, true
+		}
+	}
+	return "", false
+}
+
+// LoadDomainList reads one domain per line, ignoring blank lines and
+// comments starting with #.
+func LoadDomainList(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var domains []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if domain := strings.ToLower(strings.Trim(strings.TrimSpace(line), ".")); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains, scanner.Err()
+}
+
+// ThreatListScreener matches URLs against hash prefixes in the Safe Browsing
+// format: the SHA-256 of each host suffix and path prefix expression of the
+// canonical URL is looked up by its prefixes. The full hashes are not
+// available locally, so a prefix match counts as a threat.
+type ThreatListScreener struct {
+	prefixes     map[string]struct{}
+	prefixLength map[int]struct{}
+}
+
+func NewThreatListScreener(prefixes [][]byte) *ThreatListScreener {
+	s := &ThreatListScreener{prefixes: map[string]struct{}{}, prefixLength: map[int]struct{}{}}
+	for _, prefix := range prefixes {
+		s.prefixes[string(prefix)] = struct{}{}
+		s.prefixLength[len(prefix)] = struct{}{}
+	}
+	return s
+}
+
+// LoadThreatList reads the raw hashes of the additions of a Safe Browsing
+// threat list update, as returned by threatListUpdates:fetch.
+func LoadThreatList(filename string) (*ThreatListScreener, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var update struct {
+		ListUpdateResponses []struct {
+			Additions []struct {
+				RawHashes struct {
+					PrefixSize int    `json:"prefixSize"`
+					RawHashes  string `json:"rawHashes"`
+				} `json:"rawHashes"`
+			} `json:"additions"`
+		} `json:"listUpdateResponses"`
+	}
+	if err := json.Unmarshal(b, &update); err != nil {
+		return nil, fmt.Errorf("invalid threat list: %w", err)
+	}
+	var prefixes [][]byte
+	for _, response := range update.ListUpdateResponses {
+		for _, addition := range response.Additions {
+			raw, err := base64.StdEncoding.DecodeString(addition.RawHashes.RawHashes)
+			size := addition.RawHashes.PrefixSize
+			if err != nil || size < 4 || size > sha256.Size || len(raw)%size != 0 {
+				return nil, errors.New("invalid threat list: malformed raw hashes")
+			}
+			for i := 0; i < len(raw); i += size {
+				prefixes = append(prefixes, raw[i:i+size])
+			}
+		}
+	}
+	return NewThreatListScreener(prefixes), nil
+}
+
+func (s *ThreatListScreener) Screen(u *url.URL) error {
+	for _, expression := range threatExpressions(u) {
+		hash := sha256.Sum256([]byte(expression))
+		for length := range s.prefixLength {
+			if _, ok := s.prefixes[string(hash[:length])]; ok {
+				return rejected(u, ErrThreatMatch, expression)
+			}
+		}
+	}
+	return nil
+}
+
+// threatExpressions are the host suffix and path prefix combinations of the
+// canonical URL that Safe Browsing lists are made of, such as "a.b.c/1/2.html"
+// or "b.c/".
+func threatExpressions(u *url.URL) []string {
+	host := strings.ToLower(strings.Trim(u.Hostname(), "."))
+	for strings.Contains(host, "..") {
+		host = strings.ReplaceAll(host, "..", ".")
+	}
+	if host == "" {
+		return nil
+	}
+	hosts := []string{host}
+	if _, err := netip.ParseAddr(host); err != nil {
+		components := strings.Split(host, ".")
+		// the last five components at most, without the top-level domain alone
+		for i := max(1, len(components)-5); i < len(components)-1; i++ {
+			hosts = append(hosts, strings.Join(components[i:], "."))
+		}
+	}
+
+	p := u.EscapedPath()
+	if p == "" {
+		p = "/"
+	}
+	trailingSlash := strings.HasSuffix(p, "/")
+	p = path.Clean(p)
+	if trailingSlash && p != "/" {
+		p += "/"
+	}
+	paths := []string{p}
+	if u.RawQuery != "" {
+		paths = append([]string{p + "?" + u.RawQuery}, paths...)
+	}
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+	prefix := "/"
+	for i := 0; i < len(segments) && i < 4; i++ {
+		if prefix != p {
+			paths = append(paths, prefix)
+		}
+		prefix += segments[i] + "/"
+	}
+
+	var expressions []string
+	for _, h := range hosts {
+		for _, p := range paths {
+			expressions = append(expressions, h+p)
+		}
+	}
+	return expressions
+}
+
+var defaultShortenerDomains = []string{"bit.ly", "t.co", "tinyurl.com", "goo.gl", "ow.ly", "is.gd", "buff.ly", "rebrand.ly",
+	"cutt.ly", "shorturl.at", "rb.gy", "tiny.cc"}
+
+// NestedShortenerScreener limits chains of short links, which hide the final
+// destination from the other screeners. Short links of the known domains are
+// followed with the client, without following their destinations, until they
+// lead elsewhere or the chain goes over MaxDepth.
+type NestedShortenerScreener struct {
+	Domains  []string
+	MaxDepth int
+	Client   *http.Client
+	// Next screens the destinations the chain leads to.
+	Next URLScreener
+}
+
+func (s NestedShortenerScreener) Screen(u *url.URL) error {
+	current := u
+	for depth := 0; ; depth++ {
+		host := strings.ToLower(strings.TrimSuffix(current.Hostname(), "."))
+		domain, ok := matchDomain(host, s.Domains)
+		if !ok {
+			if current != u && s.Next != nil {
+				return s.Next.Screen(current)
+			}
+			return nil
+		}
+		if depth >= s.MaxDepth {
+			return rejected(u, ErrNestedShortener, domain)
+		}
+		if s.Client == nil {
+			return nil
+		}
+		next, err := s.follow(current)
+		if err != nil || next == nil {
+			// dead short links are the concern of the link checker
+			return nil
+		}
+		current = next
+	}
+}
+
+func (s NestedShortenerScreener) follow(u *url.URL) (*url.URL, error) {
+	client := *s.Client
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	response, err := client.Head(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	location, err := response.Location()
+	if errors.Is(err, http.ErrNoLocation) {
+		return nil, nil
+	}
+	return location, err
+}
+
+// urlScreenerFromEnv always rejects dangerous schemes and private addresses.
+// SCREEN_BLOCKLIST_PATH and SCREEN_ALLOWLIST_PATH name domain lists,
+// SCREEN_THREAT_LIST_PATH a Safe Browsing list update, SCREEN_RESOLVE_HOSTS
+// enables resolving host names to check their addresses, which catches the
+// public names of private addresses, and
+// SCREEN_SHORTENER_DOMAINS and SCREEN_MAX_SHORTENER_DEPTH tune the short link
+// chains that are followed.
+func urlScreenerFromEnv() URLScreener {
+	var chain ScreenerChain
+	chain = append(chain, SchemeScreener)
+	private := PrivateAddressScreener{}
+	if os.Getenv("SCREEN_RESOLVE_HOSTS") == "true" {
+		private.Resolve = resolveHost
+	}
+	chain = append(chain, private)
+	var lists DomainListScreener
+	for key, list := range map[string]*[]string{"SCREEN_BLOCKLIST_PATH": &lists.Blocked, "SCREEN_ALLOWLIST_PATH": &lists.Allowed} {
+		if filename := os.Getenv(key); filename != "" {
+			domains, err := LoadDomainList(filename)
+			if err != nil {
+				panic(fmt.Sprintf("failed to load %s: %s", key, err))
+			}
+			*list = domains
+		}
+	}
+	chain = append(chain, lists)
+	if filename := os.Getenv("SCREEN_THREAT_LIST_PATH"); filename != "" {
+		threats, err := LoadThreatList(filename)
+		if err != nil {
+			panic(fmt.Sprintf("failed to load SCREEN_THREAT_LIST_PATH: %s", err))
+		}
+		chain = append(chain, threats)
+	}
+	domains := defaultShortenerDomains
+	if value := os.Getenv("SCREEN_SHORTENER_DOMAINS"); value != "" {
+		domains = strings.Split(value, ",")
+	}
+	// the destinations of nested short links go through the same checks
+	nested := NestedShortenerScreener{Domains: domains, MaxDepth: envInt("SCREEN_MAX_SHORTENER_DEPTH", 1),
+		Client: &http.Client{Timeout: 5 * time.Second}, Next: slices.Clone(chain)}
+	return append(chain, nested)
+}
+
+// screenedURLs lists every destination of a request: the link itself and its
+// platform, country and variant targets.
+func screenedURLs(destination string, request ShortenRequest) []string {
+	urls := []string{destination}
+	for _, target := range request.Targets {
+		urls = append(urls, target.URL)
+	}
+	for _, target := range request.GeoTargets {
+		urls = append(urls, target)
+	}
+	for _, variant := range request.Variants {
+		urls = append(urls, variant.URL)
+	}
+	return urls
+}
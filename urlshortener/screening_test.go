@@ -0,0 +1,224 @@
+package urlshortener
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScreeners(t *testing.T) {
+	dir := t.TempDir()
+	blocklist := filepath.Join(dir, "blocklist.txt")
+	require.NoError(t, os.WriteFile(blocklist, []byte("# phishing\nEvil.example.com.\n\nmalware.test # reported\n"), 0o600))
+	blocked, err := LoadDomainList(blocklist)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"evil.example.com", "malware.test"}, blocked)
+
+	resolve := func(host string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("10.0.0.8")}, nil
+	}
+	tests := []struct {
+		screener URLScreener
+		rawURL   string
+		reason   error
+		rule     string
+	}{
+		{SchemeScreener, "javascript:alert(1)", ErrForbiddenScheme, "javascript"},
+		{SchemeScreener, "DATA:text/html,<script>", ErrForbiddenScheme, "data"},
+		{SchemeScreener, "file:///etc/passwd", ErrForbiddenScheme, "file"},
+		{SchemeScreener, "https://example.com", nil, ""},
+		{PrivateAddressScreener{}, "http://127.0.0.1:8080/admin", ErrPrivateDestination, "127.0.0.1"},
+		{PrivateAddressScreener{}, "http://192.168.1.1", ErrPrivateDestination, "192.168.1.1"},
+		{PrivateAddressScreener{}, "http://[::1]/", ErrPrivateDestination, "::1"},
+		{PrivateAddressScreener{}, "http://169.254.169.254/latest/meta-data", ErrPrivateDestination, "169.254.169.254"},
+		{PrivateAddressScreener{}, "http://[::ffff:10.0.0.1]/", ErrPrivateDestination, "10.0.0.1"},
+		{PrivateAddressScreener{}, "http://localhost:8080/", ErrPrivateDestination, "localhost"},
+		{PrivateAddressScreener{}, "http://admin.LOCALHOST./", ErrPrivateDestination, "admin.localhost"},
+		{PrivateAddressScreener{}, "http://2130706433/", ErrNonCanonicalAddress, "127.0.0.1"},
+		{PrivateAddressScreener{}, "http://0x7f.1/", ErrNonCanonicalAddress, "127.0.0.1"},
+		{PrivateAddressScreener{}, "http://0177.0.0.01/", ErrNonCanonicalAddress, "127.0.0.1"},
+		{PrivateAddressScreener{}, "http://10.1/", ErrNonCanonicalAddress, "10.0.0.1"},
+		{PrivateAddressScreener{}, "http://1572395042/", ErrNonCanonicalAddress, "93.184.216.34"},
+		{PrivateAddressScreener{}, "http://4294967296/", nil, ""},
+		{PrivateAddressScreener{}, "http://93.184.216.34/", nil, ""},
+		{PrivateAddressScreener{}, "http://1password.com/", nil, ""},
+		{PrivateAddressScreener{}, "http://internal.example.com/", nil, ""},
+		{PrivateAddressScreener{Resolve: resolve}, "http://internal.example.com/", ErrPrivateDestination, "10.0.0.8"},
+		{DomainListScreener{Blocked: blocked}, "https://evil.example.com/login", ErrBlockedDomain, "evil.example.com"},
+		{DomainListScreener{Blocked: blocked}, "https://www.EVIL.example.com./", ErrBlockedDomain, "evil.example.com"},
+		{DomainListScreener{Blocked: blocked}, "https://notevil.example.com/", nil, ""},
+		{DomainListScreener{Allowed: []string{"example.com"}}, "https://docs.example.com/", nil, ""},
+		{DomainListScreener{Allowed: []string{"example.com"}}, "https://example.org/", ErrDomainNotAllowed, "example.org"},
+	}
+	for _, test := range tests {
+		t.Run(test.rawURL, func(t *testing.T) {
+			err := ScreenRawURL(test.screener, test.rawURL)
+			if test.reason == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, test.reason)
+			var screeningErr *ScreeningError
+			require.ErrorAs(t, err, &screeningErr)
+			assert.Equal(t, test.rule, screeningErr.Rule)
+		})
+	}
+}
+
+func TestThreatListScreener(t *testing.T) {
+	prefix := func(expression string, size int) []byte {
+		hash := sha256.Sum256([]byte(expression))
+		return hash[:size]
+	}
+	rawHashes := append(prefix("evil.example.com/", 4), prefix("example.org/malware/", 4)...)
+	update, err := json.Marshal(map[string]any{"listUpdateResponses": []any{map[string]any{
+		"additions": []any{map[string]any{"rawHashes": map[string]any{"prefixSize": 4,
+			"rawHashes": base64.StdEncoding.EncodeToString(rawHashes)}}},
+	}}})
+	require.NoError(t, err)
+	filename := filepath.Join(t.TempDir(), "threats.json")
+	require.NoError(t, os.WriteFile(filename, update, 0o600))
+	threats, err := LoadThreatList(filename)
+	require.NoError(t, err)
+
+	for rawURL, expression := range map[string]string{
+		"https://evil.example.com/":                   "evil.example.com/",
+		"https://a.b.evil.example.com/login?next=%2F": "evil.example.com/",
+		"http://example.org/malware/payload.exe":      "example.org/malware/",
+		"http://www.example.org/malware/a/../b":       "example.org/malware/",
+		"https://example.org/":                        "",
+		"https://example.org/malwares":                "",
+	} {
+		t.Run(rawURL, func(t *testing.T) {
+			err := ScreenRawURL(threats, rawURL)
+			if expression == "" {
+				assert.NoError(t, err)
+				return
+			}
+			var screeningErr *ScreeningError
+			require.ErrorAs(t, err, &screeningErr)
+			assert.ErrorIs(t, err, ErrThreatMatch)
+			assert.Equal(t, expression, screeningErr.Rule)
+		})
+	}
+
+	u, err := url.Parse("http://a.b.c/1/2.html?param=1")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"a.b.c/1/2.html?param=1", "a.b.c/1/2.html", "a.b.c/", "a.b.c/1/",
+		"b.c/1/2.html?param=1", "b.c/1/2.html", "b.c/", "b.c/1/",
+	}, threatExpressions(u))
+}
+
+func TestNestedShortenerScreener(t *testing.T) {
+	redirects := map[string]string{
+		"/once":    "https://example.com/docs",
+		"/twice":   "https://sho.rt/once",
+		"/private": "http://127.0.0.1/admin",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		http.Redirect(writer, request, redirects[request.URL.Path], http.StatusMovedPermanently)
+	}))
+	defer server.Close()
+	// every short link domain is served by the test server
+	client := &http.Client{Transport: rewriteTransport{target: server.URL}}
+	screener := NestedShortenerScreener{Domains: []string{"sho.rt"}, MaxDepth: 1, Client: client,
+		Next: PrivateAddressScreener{}}
+
+	assert.NoError(t, ScreenRawURL(screener, "https://example.com/docs"))
+	assert.NoError(t, ScreenRawURL(screener, "https://sho.rt/once"))
+	assert.ErrorIs(t, ScreenRawURL(screener, "https://sho.rt/twice"), ErrNestedShortener)
+	assert.ErrorIs(t, ScreenRawURL(screener, "https://sho.rt/private"), ErrPrivateDestination)
+	screener.MaxDepth = 2
+	assert.NoError(t, ScreenRawURL(screener, "https://sho.rt/twice"))
+	screener.MaxDepth = 0
+	assert.ErrorIs(t, ScreenRawURL(screener, "https://sho.rt/once"), ErrNestedShortener)
+}
+
+type rewriteTransport struct {
+	target string
+}
+
+func (r rewriteTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	target, err := url.Parse(r.target)
+	if err != nil {
+		return nil, err
+	}
+	request = request.Clone(request.Context())
+	request.URL.Scheme, request.URL.Host = target.Scheme, target.Host
+	return http.DefaultTransport.RoundTrip(request)
+}
+
+func TestScreenedShortening(t *testing.T) {
+	app := NewInMemoryApplication()
+	app.WithScreener(ScreenerChain{SchemeScreener, DomainListScreener{Blocked: []string{"evil.example.com"}}})
+
+	_, err := app.Shorten("javascript:alert(document.cookie)", nil)
+	assert.ErrorIs(t, err, ErrForbiddenScheme)
+	_, err = app.ShortenWithOptions(ShortenRequest{URL: "https://example.com/app",
+		Targets: []Target{{Platforms: []string{PlatformIOS}, URL: "https://evil.example.com/app"}}})
+	var screeningErr *ScreeningError
+	require.ErrorAs(t, err, &screeningErr)
+	assert.Equal(t, "https://evil.example.com/app", screeningErr.URL)
+
+	results, err := app.ShortenBatch([]ShortenRequest{{URL: "https://example.com/a"}, {URL: "https://evil.example.com/b"}})
+	require.NoError(t, err)
+	assert.NoError(t, results[0].Err)
+	assert.ErrorIs(t, results[1].Err, ErrBlockedDomain)
+
+	testServer := httptest.NewServer(app.server.mux)
+	defer testServer.Close()
+	client := NewHTTPClientFromResty(resty.NewWithClient(testServer.Client()).SetBaseURL(testServer.URL))
+	_, err = client.Shorten("https://evil.example.com/login", nil)
+	assert.ErrorIs(t, err, ErrBlockedDomain)
+
+	short, err := app.Shorten("https://example.com/split", nil)
+	require.NoError(t, err)
+	err = app.SetVariants(short, []Variant{{URL: "https://example.com/a", Weight: 1},
+		{URL: "https://evil.example.com/b", Weight: 1}})
+	require.ErrorAs(t, err, &screeningErr)
+	assert.Equal(t, "https://evil.example.com/b", screeningErr.URL)
+
+	reader, err := NewLinkRecordReader("ndjson", strings.NewReader(`{"shortened":"good","url":"https://example.com/good"}
+{"shortened":"evil","url":"https://evil.example.com/"}
+{"shortened":"target","url":"https://example.com/","targets":[{"platforms":["ios"],"url":"https://evil.example.com/"}]}
+{"shortened":"variant","url":"https://example.com/","variants":[{"url":"https://evil.example.com/","weight":1}]}
+`))
+	require.NoError(t, err)
+	report, err := app.Import(reader, ImportOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Created)
+	assert.Equal(t, 3, report.Failed, "imported links are screened like created ones")
+	_, err = app.Unshorten(NewShortURL("evil").String())
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestHTTPScreenedShortening(t *testing.T) {
+	app := NewInMemoryApplication()
+	testServer := httptest.NewServer(app.server.mux)
+	defer testServer.Close()
+	client := NewHTTPClientFromResty(resty.NewWithClient(testServer.Client()).SetBaseURL(testServer.URL))
+
+	recorder := handle(app, httptest.NewRequest(http.MethodPost, "/shorten?url=http%3A%2F%2F2130706433%2F", nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), ErrNonCanonicalAddress.Error())
+	_, err := client.Shorten("http://0x7f.1/", nil)
+	assert.ErrorIs(t, err, ErrNonCanonicalAddress)
+
+	short, err := client.Shorten("https://example.com/split", nil)
+	require.NoError(t, err)
+	err = client.SetVariants(short, []Variant{{URL: "http://localhost/", Weight: 1}})
+	assert.ErrorIs(t, err, ErrPrivateDestination)
+}
@@ -2,6 +2,7 @@ package urlshortener
 
 import (
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/jonboulle/clockwork"
@@ -11,29 +12,75 @@ var ErrNotFound = errors.New("URL not found")
 var ErrMissingHostname = errors.New("missing hostname")
 var ErrMissingScheme = errors.New("missing scheme")
 var ErrExpired = errors.New("URL expired")
+var ErrConflict = errors.New("short URL already used by another URL")
 
 type Shortener interface {
 	Shorten(rawURL string, expiration *time.Time) (string, error)
+	ShortenWithOptions(request ShortenRequest) (string, error)
 }
 
 type Unshortener interface {
 	Unshorten(rawURL string) (string, error)
 }
 
+type ShortenRequest struct {
+	URL        string
+	Expiration *time.Time
+	Options    LinkOptions
+	Campaign   string
+	UTM        UTMParams
+	Targets    []Target
+	GeoTargets map[string]string
+	Variants   []Variant
+	// Signed mints a random signed code instead of deriving it from the
+	// destination.
+	Signed bool
+}
+
+type ShortenResult struct {
+	Shortened string
+	Err       error
+}
+
+type BatchShortener interface {
+	ShortenBatch(requests []ShortenRequest) ([]ShortenResult, error)
+}
+
+type LinkPreview struct {
+	Shortened   string
+	Destination string
+	CreatedAt   *time.Time
+	Expiration  *time.Time
+	Expired     bool
+	Quarantined bool
+	Clicks      int
+}
+
+type Previewer interface {
+	Preview(rawURL string) (LinkPreview, error)
+}
+
 type ShortenUnshortener interface {
 	Shortener
 	Unshortener
 }
 
 type Usecase struct {
-	store Storer
-	clock clockwork.Clock
+	store          Storer
+	campaigns      CampaignStorer
+	clock          clockwork.Clock
+	redirectPolicy RedirectPolicy
+	quotas         *QuotaUsecase
+	screener       URLScreener
+	signer         *CodeSigner
+	principal      *Principal
 }
 
 func NewUsecase(store Storer) *Usecase {
 	return &Usecase{
-		store: store,
-		clock: clockwork.NewRealClock(),
+		store:          store,
+		clock:          clockwork.NewRealClock(),
+		redirectPolicy: DefaultRedirectPolicy(),
 	}
 }
 
@@ -41,48 +88,365 @@ func (u *Usecase) WithClock(clock clockwork.Clock) {
 	u.clock = clock
 }
 
+func (u *Usecase) WithCampaigns(campaigns CampaignStorer) {
+	u.campaigns = campaigns
+}
+
+func (u *Usecase) WithRedirectPolicy(policy RedirectPolicy) {
+	u.redirectPolicy = policy
+}
+
+// WithQuotas counts the links created by each workspace against its monthly
+// quota.
+func (u *Usecase) WithQuotas(quotas *QuotaUsecase) {
+	u.quotas = quotas
+}
+
+// WithScreener rejects the destinations the screener finds unsafe before
+// links are created.
+func (u *Usecase) WithScreener(screener URLScreener) {
+	u.screener = screener
+}
+
+// WithSigner lets links be created with signed codes, which cannot be
+// guessed or enumerated.
+func (u *Usecase) WithSigner(signer *CodeSigner) {
+	u.signer = signer
+}
+
+// shortURL derives the code from the destination, unless the link is signed.
+func (u *Usecase) shortURL(destination URL, signed bool) (URL, error) {
+	if !signed && !u.signer.Required() {
+		return destination.ShortenIn(workspaceOf(u.principal))
+	}
+	if u.signer == nil {
+		return URL{}, ErrSigningDisabled
+	}
+	if err := destination.Validate(); err != nil {
+		return URL{}, err
+	}
+	code, err := u.signer.Sign()
+	if err != nil {
+		return URL{}, err
+	}
+	s := NewShortURL(code)
+	s.expiration = destination.expiration
+	return s, nil
+}
+
+func (u *Usecase) screen(destination string, request ShortenRequest) error {
+	return u.screenURLs(screenedURLs(destination, request))
+}
+
+func (u *Usecase) screenURLs(rawURLs []string) error {
+	if u.screener == nil {
+		return nil
+	}
+	for _, rawURL := range rawURLs {
+		if err := ScreenRawURL(u.screener, rawURL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *Usecase) consumeQuota(n int) error {
+	if u.quotas == nil || n == 0 {
+		return nil
+	}
+	return u.quotas.consume(workspaceOf(u.principal), n)
+}
+
+func (u *Usecase) releaseQuota(n int) {
+	if u.quotas != nil && n > 0 {
+		u.quotas.release(workspaceOf(u.principal), n)
+	}
+}
+
+// As returns a copy of the use case acting for the principal: links are
+// created in its workspace, and links of other workspaces cannot be changed.
+func (u *Usecase) As(principal Principal) *Usecase {
+	c := *u
+	c.principal = &principal
+	return &c
+}
+
 func (c *Usecase) Shorten(rawURL string, expiration *time.Time) (string, error) {
-	u, err := NewURL(rawURL, expiration)
+	return c.ShortenWithOptions(ShortenRequest{URL: rawURL, Expiration: expiration})
+}
+
+func (c *Usecase) ShortenWithOptions(request ShortenRequest) (string, error) {
+	if err := authorize(c.principal, ActionCreateLinks); err != nil {
+		return "", err
+	}
+	if err := request.Options.Validate(); err != nil {
+		return "", err
+	}
+	if err := validateTargets(request.Targets); err != nil {
+		return "", err
+	}
+	if err := validateGeoTargets(request.GeoTargets); err != nil {
+		return "", err
+	}
+	if err := validateVariants(request.Variants); err != nil {
+		return "", err
+	}
+	destination, err := c.destination(request)
 	if err != nil {
 		return "", err
 	}
-	s, err := u.Shorten()
+	if err := c.screen(destination, request); err != nil {
+		return "", err
+	}
+	u, err := NewURL(destination, request.Expiration)
 	if err != nil {
 		return "", err
 	}
-	err = c.store.Save(rawURL, s.String(), expiration)
+	s, err := c.shortURL(u, request.Signed)
+	if err != nil {
+		return "", err
+	}
+	if err := c.consumeQuota(1); err != nil {
+		return "", err
+	}
+	err = c.store.Save(c.association(request, destination, s.String()))
+	if err != nil {
+		c.releaseQuota(1)
+	}
+	if errors.Is(err, ErrConflict) {
+		// shortening the same destination again returns the existing link
+		if existing, getErr := c.store.Get(s.String()); getErr == nil && existing.String() == destination {
+			return s.String(), nil
+		}
+	}
 	return s.String(), err
 }
 
+func (c *Usecase) association(request ShortenRequest, destination, shortened string) URLAssociation {
+	association := newURLAssociationAt(destination, shortened, request.Expiration, c.clock.Now())
+	association.Options = request.Options
+	association.Campaign = request.Campaign
+	association.Targets = request.Targets
+	association.GeoTargets = request.GeoTargets
+	association.Variants = request.Variants
+	association.WorkspaceID = workspaceOf(c.principal)
+	if c.principal != nil {
+		association.CreatedBy = c.principal.UserID
+	}
+	return association
+}
+
+// destination merges the campaign defaults and the request UTM parameters
+// into the URL to shorten.
+func (c *Usecase) destination(request ShortenRequest) (string, error) {
+	params := request.UTM
+	if request.Campaign != "" {
+		if c.campaigns == nil {
+			return "", ErrCampaignNotFound
+		}
+		campaign, err := c.campaigns.Get(request.Campaign)
+		if err != nil {
+			return "", err
+		}
+		if !canAccess(c.principal, campaign.WorkspaceID) {
+			return "", ErrCampaignNotFound
+		}
+		params = campaign.defaults().merge(request.UTM)
+	}
+	return params.apply(request.URL)
+}
+
+func (c *Usecase) ShortenBatch(requests []ShortenRequest) ([]ShortenResult, error) {
+	if err := authorize(c.principal, ActionCreateLinks); err != nil {
+		return nil, err
+	}
+	results := make([]ShortenResult, len(requests))
+	destinations := make([]string, len(requests))
+	requested := make(map[string]string)
+	var associations []URLAssociation
+	for i, request := range requests {
+		if err := request.Options.Validate(); err != nil {
+			results[i].Err = err
+			continue
+		}
+		if err := validateTargets(request.Targets); err != nil {
+			results[i].Err = err
+			continue
+		}
+		if err := validateGeoTargets(request.GeoTargets); err != nil {
+			results[i].Err = err
+			continue
+		}
+		if err := validateVariants(request.Variants); err != nil {
+			results[i].Err = err
+			continue
+		}
+		destination, err := c.destination(request)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		if err := c.screen(destination, request); err != nil {
+			results[i].Err = err
+			continue
+		}
+		destinations[i] = destination
+		u, err := NewURL(destination, request.Expiration)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		s, err := c.shortURL(u, request.Signed)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i].Shortened = s.String()
+		if previous, ok := requested[s.String()]; ok {
+			if previous != destination {
+				results[i] = ShortenResult{Err: ErrConflict}
+			}
+			continue
+		}
+		requested[s.String()] = destination
+		associations = append(associations, c.association(request, destination, s.String()))
+	}
+	if err := c.consumeQuota(len(associations)); errors.Is(err, ErrQuotaExceeded) {
+		for i := range results {
+			if results[i].Err == nil {
+				results[i] = ShortenResult{Err: err}
+			}
+		}
+		return results, nil
+	} else if err != nil {
+		return nil, err
+	}
+	stored, created, err := c.store.SaveBatch(associations)
+	if err != nil {
+		c.releaseQuota(len(associations))
+		return nil, err
+	}
+	// the links that already existed were paid for when they were created
+	c.releaseQuota(len(associations) - created)
+	for _, association := range stored {
+		if association.URL != requested[association.Shortened] {
+			requested[association.Shortened] = ""
+		}
+	}
+	for i, result := range results {
+		if result.Err == nil && requested[result.Shortened] != destinations[i] {
+			results[i] = ShortenResult{Err: ErrConflict}
+		}
+	}
+	return results, nil
+}
+
 func (c *Usecase) Unshorten(rawURL string) (string, error) {
-	u, err := NewURL(rawURL, nil)
+	if err := authorize(c.principal, ActionViewLinks); err != nil {
+		return "", err
+	}
+	storedURL, err := c.lookup(rawURL)
 	if err != nil {
 		return "", err
 	}
+	return storedURL.String(), nil
+}
+
+// Resolve accepts short links followed by extra path segments or a query
+// string, which are passed through to the destination when the link allows it.
+// The destination is the first of the link targets matching the visitor.
+func (c *Usecase) Resolve(rawURL string, visitor Visitor) (Redirect, error) {
+	shortened, extraPath, query := splitShortURL(rawURL)
+	storedURL, err := c.lookup(shortened)
+	if err != nil {
+		return Redirect{}, err
+	}
+	if storedURL.Quarantined() {
+		return Redirect{}, ErrQuarantined
+	}
+	options := storedURL.Options()
+	if extraPath != "" && !options.PathPassthrough {
+		return Redirect{}, ErrNotFound
+	}
+	destination, rule, variant, err := storedURL.pick(shortened, visitor)
+	if err != nil {
+		return Redirect{}, err
+	}
+	redirect := c.redirectPolicy.redirectFor(options.passthrough(destination, extraPath, query), c.clock.Now())
+	redirect.Shortened = shortened
+	redirect.Rule = rule
+	redirect.Variant = variant
+	redirect.SetVisitorCookie = variant != "" && !visitor.identified
+	if len(storedURL.targets) > 0 {
+		redirect.Vary = []string{"User-Agent", "Accept-Language"}
+	}
+	if len(storedURL.variants) > 0 {
+		redirect.Vary = append(redirect.Vary, "Cookie")
+	}
+	if len(storedURL.geoTargets) > 0 || len(storedURL.variants) > 0 {
+		// the country and fingerprint depend on the client address, which shared caches cannot vary on
+		redirect.CacheControl = strings.Replace(redirect.CacheControl, "public", "private", 1)
+	}
+	return redirect, nil
+}
+
+func (c *Usecase) lookup(rawURL string) (URL, error) {
+	u, err := NewURL(rawURL, nil)
+	if err != nil {
+		return URL{}, err
+	}
 	if err := u.Validate(); err != nil {
-		return "", err
+		return URL{}, err
 	}
 	storedURL, err := c.store.Get(rawURL)
 	if err != nil {
-		return "", ErrNotFound
+		return URL{}, ErrNotFound
 	}
 	location, err := time.LoadLocation("Local")
 	if err != nil {
-		return "", err
+		return URL{}, err
 	}
 	if storedURL.ExpiredAt(c.clock.Now().In(location)) {
-		return "", ErrExpired
+		return URL{}, ErrExpired
 	}
-	return storedURL.String(), nil
+	return storedURL, nil
 }
 
 type CountingUsecase struct {
 	*Usecase
 	countStore CountStorer
+	clickStore ClickStorer
+	transactor Transactor
+}
+
+func NewCountingUsecase(store Storer, countStore CountStorer, transactor Transactor) *CountingUsecase {
+	return &CountingUsecase{Usecase: NewUsecase(store), countStore: countStore, transactor: transactor}
+}
+
+func (c *CountingUsecase) As(principal Principal) *CountingUsecase {
+	u := *c
+	u.Usecase = c.Usecase.As(principal)
+	return &u
+}
+
+// owned returns ErrNotFound for links of another workspace than the
+// principal's, so that their existence does not leak either.
+func (c *CountingUsecase) owned(rawURL string) error {
+	if c.principal == nil {
+		return nil
+	}
+	storedURL, err := c.store.Get(rawURL)
+	if err != nil {
+		return ErrNotFound
+	}
+	if !canAccess(c.principal, storedURL.Workspace()) {
+		return ErrNotFound
+	}
+	return nil
 }
 
-func NewCountingUsecase(store Storer, countStore CountStorer) *CountingUsecase {
-	return &CountingUsecase{Usecase: NewUsecase(store), countStore: countStore}
+func (c *CountingUsecase) WithClickStore(clickStore ClickStorer) {
+	c.clickStore = clickStore
 }
 
 func (c *CountingUsecase) Unshorten(rawURL string) (string, error) {
@@ -93,3 +457,93 @@ func (c *CountingUsecase) Unshorten(rawURL string) (string, error) {
 
 	return got, err
 }
+
+func (c *CountingUsecase) Resolve(rawURL string, visitor Visitor) (Redirect, error) {
+	got, err := c.Usecase.Resolve(rawURL, visitor)
+	if err == nil {
+		_ = c.countStore.Increment(got.Shortened)
+		if c.clickStore != nil {
+			_ = c.clickStore.Record(ClickEvent{Shortened: got.Shortened, ClickedAt: c.clock.Now(), Rule: got.Rule,
+				Country: visitor.Country, Variant: got.Variant})
+		}
+	}
+
+	return got, err
+}
+
+func (c *CountingUsecase) Count(rawURL string) (int, error) {
+	if err := authorize(c.principal, ActionViewStats); err != nil {
+		return 0, err
+	}
+	if err := c.owned(rawURL); err != nil {
+		return 0, err
+	}
+	return c.countStore.Get(rawURL)
+}
+
+func (c *CountingUsecase) Clicks(rawURL, dimension string) (map[string]int, error) {
+	if err := authorize(c.principal, ActionViewStats); err != nil {
+		return nil, err
+	}
+	if err := c.owned(rawURL); err != nil {
+		return nil, err
+	}
+	if c.clickStore == nil {
+		return map[string]int{}, nil
+	}
+	return c.clickStore.CountBy(rawURL, dimension)
+}
+
+func (c *CountingUsecase) Delete(rawURL string) error {
+	if err := authorize(c.principal, ActionDeleteLinks); err != nil {
+		return err
+	}
+	u, err := NewURL(rawURL, nil)
+	if err != nil {
+		return err
+	}
+	if err := u.Validate(); err != nil {
+		return err
+	}
+	return c.transactor.Transaction(func(store Storer, countStore CountStorer) error {
+		storedURL, err := store.Get(rawURL)
+		if err != nil {
+			return err
+		}
+		if !canAccess(c.principal, storedURL.Workspace()) {
+			return ErrNotFound
+		}
+		if err := store.Delete(rawURL); err != nil {
+			return err
+		}
+		return countStore.Delete(rawURL)
+	})
+}
+
+func (c *CountingUsecase) Preview(rawURL string) (LinkPreview, error) {
+	u, err := NewURL(rawURL, nil)
+	if err != nil {
+		return LinkPreview{}, err
+	}
+	if err := u.Validate(); err != nil {
+		return LinkPreview{}, err
+	}
+	storedURL, err := c.store.Get(rawURL)
+	if err != nil {
+		return LinkPreview{}, ErrNotFound
+	}
+	location, err := time.LoadLocation("Local")
+	if err != nil {
+		return LinkPreview{}, err
+	}
+	clicks, _ := c.countStore.Get(rawURL)
+	return LinkPreview{
+		Shortened:   rawURL,
+		Destination: storedURL.String(),
+		CreatedAt:   storedURL.CreatedAt(),
+		Expiration:  storedURL.Expiration(),
+		Expired:     storedURL.ExpiredAt(c.clock.Now().In(location)),
+		Quarantined: storedURL.Quarantined(),
+		Clicks:      clicks,
+	}, nil
+}
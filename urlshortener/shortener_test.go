@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -86,7 +87,7 @@ func ShortenUnshortenerFromBuilder(t *testing.T, builder func() ShortenUnshorten
 
 	t.Run("ok_random_path", func(t *testing.T) {
 		app := builder()
-		url := "https://localhost/bla/bla/bla"
+		url := "https://example.com/bla/bla/bla"
 		shortenedURL, err := app.Shorten(url, nil)
 		require.NoError(t, err)
 
@@ -181,3 +182,136 @@ func TestShortenWithExpiration(t *testing.T) {
 	_, err = app.Unshorten(short)
 	require.ErrorIs(t, err, ErrExpired)
 }
+
+func TestShortenCreatedAtClock(t *testing.T) {
+	app := NewInMemoryApplication()
+	clock := clockwork.NewFakeClockAt(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	app.WithClock(clock)
+	app.ArchiveUsecase.clock = clock
+
+	short, err := app.Shorten("https://example.com/created", nil)
+	require.NoError(t, err)
+	preview, err := app.Preview(short)
+	require.NoError(t, err)
+	require.NotNil(t, preview.CreatedAt)
+	assert.True(t, clock.Now().Equal(*preview.CreatedAt))
+
+	reader, err := NewLinkRecordReader("ndjson", strings.NewReader(`{"shortened":"imported","url":"https://example.com/i"}`))
+	require.NoError(t, err)
+	_, err = app.Import(reader, ImportOptions{})
+	require.NoError(t, err)
+	preview, err = app.Preview(NewShortURL("imported").String())
+	require.NoError(t, err)
+	require.NotNil(t, preview.CreatedAt)
+	assert.True(t, clock.Now().Equal(*preview.CreatedAt))
+}
+
+func TestDeleteWithCounts(t *testing.T) {
+	app := NewInMemoryApplication()
+	short, err := app.Shorten("https://developer.hashicorp.com/vault/tutorials/get-started/understand-static-dynamic-secrets", nil)
+	require.NoError(t, err)
+	_, err = app.Unshorten(short)
+	require.NoError(t, err)
+
+	require.NoError(t, app.Delete(short))
+
+	_, err = app.Unshorten(short)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = app.countStore.Get(short)
+	assert.Error(t, err)
+	assert.ErrorIs(t, app.Delete(short), ErrNotFound)
+}
+
+func TestShortenBatchConflicts(t *testing.T) {
+	app := NewInMemoryApplication()
+	existing, err := app.Shorten("https://example.com/path?campaign=a", nil)
+	require.NoError(t, err)
+
+	results, err := app.ShortenBatch([]ShortenRequest{
+		{URL: "https://example.com/path?campaign=a"},
+		{URL: "https://example.com/path?campaign=b"},
+		{URL: "https://example.com/other"},
+		{URL: "https://example.com/other?campaign=c"},
+		{URL: "https://example.com/other?campaign=c"},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, ShortenResult{Shortened: existing}, results[0])
+	codes := map[string]bool{}
+	for _, result := range results[1:4] {
+		require.NoError(t, result.Err)
+		codes[result.Shortened] = true
+	}
+	assert.Len(t, codes, 3, "destinations differing by their query get their own code")
+	assert.NotContains(t, codes, existing)
+	assert.Equal(t, results[3], results[4])
+}
+
+func TestShortenConflict(t *testing.T) {
+	app := NewInMemoryApplication()
+	short, err := app.Shorten("https://example.com/path?utm_source=a", nil)
+	require.NoError(t, err)
+	again, err := app.Shorten("https://example.com/path?utm_source=a", nil)
+	require.NoError(t, err)
+	assert.Equal(t, short, again, "shortening a destination again returns its link")
+
+	taken := NewShortURL(MustNewURL("https://example.com/taken", nil).encode()).String()
+	require.NoError(t, app.store.Save(NewURLAssociation("https://example.com/other", taken, nil)))
+	_, err = app.Shorten("https://example.com/taken", nil)
+	assert.ErrorIs(t, err, ErrConflict)
+	recorder := handle(app, httptest.NewRequest(http.MethodPost, "/shorten?url="+url.QueryEscape("https://example.com/taken"), nil))
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+
+	testServer := httptest.NewServer(app.server.mux)
+	defer testServer.Close()
+	client := NewHTTPClientFromResty(resty.NewWithClient(testServer.Client()).SetBaseURL(testServer.URL))
+	_, err = client.Shorten("https://example.com/taken", nil)
+	assert.ErrorIs(t, err, ErrConflict)
+}
+
+func TestHTTPPreview(t *testing.T) {
+	app := NewInMemoryApplication()
+	rawURL := "https://developer.hashicorp.com/vault/tutorials/get-started/understand-static-dynamic-secrets"
+	short, err := app.Shorten(rawURL, nil)
+	require.NoError(t, err)
+	handle(app, httptest.NewRequest("GET", short, nil))
+
+	for _, target := range []string{short + "+", short + "?preview=1"} {
+		recorder := handle(app, httptest.NewRequest("GET", target, nil))
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "text/html; charset=utf-8", recorder.Header().Get("Content-Type"))
+		body := recorder.Body.String()
+		assert.Contains(t, body, rawURL)
+		assert.Contains(t, body, "never expires")
+		assert.Contains(t, body, "<dd>1</dd>")
+		assert.Contains(t, body, `href="/u/6Hgh0HxUDE0TQs8NYZDHtP"`)
+	}
+
+	count, err := app.countStore.Get(short)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	recorder := handle(app, httptest.NewRequest("GET", "/u/unknown+", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestPreviewExpired(t *testing.T) {
+	app := NewInMemoryApplication()
+	clock := clockwork.NewFakeClock()
+	app.WithClock(clock)
+	expiration := clock.Now().Add(1 * time.Hour)
+	short, err := app.Shorten("https://example.com/expiring", &expiration)
+	require.NoError(t, err)
+
+	preview, err := app.Preview(short)
+	require.NoError(t, err)
+	assert.False(t, preview.Expired)
+	assert.NotNil(t, preview.CreatedAt)
+
+	clock.Advance(2 * time.Hour)
+	preview, err = app.Preview(short)
+	require.NoError(t, err)
+	assert.True(t, preview.Expired)
+	assert.Equal(t, 0, preview.Clicks)
+}
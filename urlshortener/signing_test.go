@@ -0,0 +1,206 @@
+package urlshortener
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestKey is a 32 byte key, which fits signing, encryption and hashing.
+func newTestKey(seed byte) []byte {
+	return bytes.Repeat([]byte{seed}, 32)
+}
+
+func newTestCodeSigner(t *testing.T) *CodeSigner {
+	signer, err := NewCodeSigner("k1", map[string][]byte{"k1": newTestKey(1)})
+	require.NoError(t, err)
+	return signer
+}
+
+func TestCodeSigner(t *testing.T) {
+	signer := newTestCodeSigner(t)
+	code, err := signer.Sign()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(code, "k1_"))
+	assert.NoError(t, signer.Verify(code))
+	other, err := signer.Sign()
+	require.NoError(t, err)
+	assert.NotEqual(t, code, other)
+	assert.NoError(t, signer.Verify("1oPzkR9KEQU5LZniKkpIub"), "unsigned codes pass unless signing is required")
+
+	parts := strings.Split(code, "_")
+	flip := func(s string) string {
+		if s[0] == 'a' {
+			return "b" + s[1:]
+		}
+		return "a" + s[1:]
+	}
+	for name, tampered := range map[string]string{
+		"nonce":       strings.Join([]string{parts[0], flip(parts[1]), parts[2]}, "_"),
+		"signature":   strings.Join([]string{parts[0], parts[1], flip(parts[2])}, "_"),
+		"unknown key": strings.Join([]string{"k9", parts[1], parts[2]}, "_"),
+		"truncated":   parts[0] + "_" + parts[1],
+		"extra part":  code + "_x",
+		"empty":       "_",
+	} {
+		assert.ErrorIs(t, signer.Verify(tampered), ErrInvalidSignature, name)
+	}
+
+	rotated, err := NewCodeSigner("k2", map[string][]byte{"k1": newTestKey(1), "k2": newTestKey(2)})
+	require.NoError(t, err)
+	assert.NoError(t, rotated.Verify(code), "codes signed with a previous key stay valid")
+	newCode, err := rotated.Sign()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(newCode, "k2_"))
+	assert.ErrorIs(t, signer.Verify(newCode), ErrInvalidSignature)
+	retired, err := NewCodeSigner("k2", map[string][]byte{"k2": newTestKey(2)})
+	require.NoError(t, err)
+	assert.ErrorIs(t, retired.Verify(code), ErrInvalidSignature, "removing a key revokes its codes")
+
+	retired.WithRequired(true)
+	assert.ErrorIs(t, retired.Verify("1oPzkR9KEQU5LZniKkpIub"), ErrInvalidSignature)
+	assert.NoError(t, (*CodeSigner)(nil).Verify(code))
+
+	_, err = NewCodeSigner("k1", map[string][]byte{"k1": []byte("short")})
+	assert.ErrorIs(t, err, ErrInvalidSigningKey)
+	_, err = NewCodeSigner("k_1", map[string][]byte{"k_1": newTestKey(1)})
+	assert.ErrorIs(t, err, ErrInvalidSigningKey)
+	_, err = NewCodeSigner("k2", map[string][]byte{"k1": newTestKey(1)})
+	assert.ErrorIs(t, err, ErrInvalidSigningKey)
+}
+
+func TestCodeSignerFromEnv(t *testing.T) {
+	t.Setenv("SIGNING_KEYS", "k2:"+base64.StdEncoding.EncodeToString(newTestKey(2))+
+		", k1:"+base64.StdEncoding.EncodeToString(newTestKey(1)))
+	signer := codeSignerFromEnv()
+	code, err := signer.Sign()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(code, "k2_"))
+	assert.False(t, signer.Required())
+
+	t.Setenv("SIGNING_KEY_ID", "k1")
+	t.Setenv("SIGNED_CODES_ONLY", "true")
+	signer = codeSignerFromEnv()
+	code, err = signer.Sign()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(code, "k1_"))
+	assert.True(t, signer.Required())
+
+	t.Setenv("SIGNING_KEYS", "")
+	assert.Nil(t, codeSignerFromEnv())
+}
+
+func TestSignedShortening(t *testing.T) {
+	app := NewInMemoryApplication()
+	_, err := app.ShortenWithOptions(ShortenRequest{URL: "https://example.com/", Signed: true})
+	assert.ErrorIs(t, err, ErrSigningDisabled)
+
+	signer := newTestCodeSigner(t)
+	app.CountingUsecase.WithSigner(signer)
+	first, err := app.ShortenWithOptions(ShortenRequest{URL: "https://example.com/", Signed: true})
+	require.NoError(t, err)
+	second, err := app.ShortenWithOptions(ShortenRequest{URL: "https://example.com/", Signed: true})
+	require.NoError(t, err)
+	assert.NotEqual(t, first, second, "signed codes are not derived from the destination")
+	unsigned, err := app.Shorten("https://example.com/", nil)
+	require.NoError(t, err)
+	assert.NotContains(t, unsigned, signedCodeSeparator)
+	_, err = app.ShortenWithOptions(ShortenRequest{URL: "example.com", Signed: true})
+	assert.ErrorIs(t, err, ErrMissingScheme)
+
+	redirect, err := app.Resolve(first, Visitor{})
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/", redirect.Location)
+	results, err := app.ShortenBatch([]ShortenRequest{{URL: "https://example.org/", Signed: true},
+		{URL: "https://example.org/", Signed: true}})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.NoError(t, results[0].Err)
+	require.NoError(t, results[1].Err)
+	assert.NotEqual(t, results[0].Shortened, results[1].Shortened)
+
+	signer.WithRequired(true)
+	required, err := app.Shorten("https://example.net/", nil)
+	require.NoError(t, err)
+	code := strings.TrimPrefix(required, NewShortURL("").String())
+	assert.NoError(t, signer.Verify(code), "every link is signed once signing is required")
+}
+
+func TestSignedImport(t *testing.T) {
+	app := NewInMemoryApplication()
+	signer := newTestCodeSigner(t)
+	code, err := signer.Sign()
+	require.NoError(t, err)
+	forged := code[:len(code)-1] + "a"
+	if strings.HasSuffix(code, "a") {
+		forged = code[:len(code)-1] + "b"
+	}
+	records := func() LinkRecordReader {
+		reader, err := NewLinkRecordReader("csv", strings.NewReader(code+",https://example.com/signed\n"+
+			NewShortURL(forged).String()+",https://example.com/forged\nplain,https://example.com/plain\n"))
+		require.NoError(t, err)
+		return reader
+	}
+
+	report, err := app.Import(records(), ImportOptions{DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Created)
+	assert.Equal(t, []ImportError{{Record: 1, Error: ErrSigningDisabled.Error()},
+		{Record: 2, Error: ErrSigningDisabled.Error()}}, report.Errors, "signed codes cannot be checked")
+
+	app.CountingUsecase.WithSigner(signer)
+	report, err = app.Import(records(), ImportOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Created)
+	assert.Equal(t, []ImportError{{Record: 2, Error: ErrInvalidSignature.Error()}}, report.Errors)
+	redirect, err := app.Resolve(NewShortURL(code).String(), Visitor{})
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/signed", redirect.Location)
+
+	signer.WithRequired(true)
+	report, err = app.Import(records(), ImportOptions{Policy: ConflictOverwrite})
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Overwritten)
+	assert.Equal(t, 2, report.Failed, "unsigned codes are rejected once signing is required")
+}
+
+func TestHTTPSignedRedirect(t *testing.T) {
+	t.Setenv("SIGNING_KEYS", "k1:"+base64.StdEncoding.EncodeToString(newTestKey(1)))
+	infra := NewInMemoryInfrastructure()
+	store := &countingStore{Storer: infra.store}
+	infra.store = store
+	app := NewApplicationFromInfrastructure(infra)
+
+	recorder := handle(app, httptest.NewRequest(http.MethodPost, "/shorten?signed=true&url="+
+		"https%3A%2F%2Fexample.com%2F", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var response shortenResponse
+	require.NoError(t, json.NewDecoder(recorder.Body).Decode(&response))
+	code := strings.TrimPrefix(response.Shortened, NewShortURL("").String())
+	require.Contains(t, code, signedCodeSeparator)
+
+	recorder = handle(app, httptest.NewRequest(http.MethodGet, "/u/"+code, nil))
+	assert.Equal(t, http.StatusTemporaryRedirect, recorder.Code)
+	recorder = handle(app, httptest.NewRequest(http.MethodGet, "/u/"+code+"+", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	forged := code[:len(code)-1] + "a"
+	if strings.HasSuffix(code, "a") {
+		forged = code[:len(code)-1] + "b"
+	}
+	gets := store.gets.Load()
+	for _, path := range []string{forged, forged + "+", forged + "/extra", forged + "/qr", "k9_" + code[3:], "k1_",
+		"k1_0000_0000"} {
+		recorder = handle(app, httptest.NewRequest(http.MethodGet, "/u/"+path, nil))
+		assert.Contains(t, []int{http.StatusBadRequest, http.StatusNotFound}, recorder.Code, path)
+		assert.Contains(t, recorder.Body.String(), ErrInvalidSignature.Error(), path)
+	}
+	assert.Equal(t, gets, store.gets.Load(), "tampered codes never reach the store")
+}
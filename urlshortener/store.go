@@ -2,20 +2,26 @@ package urlshortener
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
-	"os"
 	"time"
 
-	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/plugin/dbresolver"
 )
-import "gorm.io/driver/sqlite"
 
 type Storer interface {
 	Get(shortened string) (URL, error)
-	Save(url, shortened string, expiration *time.Time) error
+	Save(association URLAssociation) error
+	// SaveBatch also returns how many of the associations were created.
+	SaveBatch(associations []URLAssociation) ([]URLAssociation, int, error)
+	Update(shortened string, update func(association *URLAssociation) error) error
+	Delete(shortened string) error
 }
 
+const storeBatchSize = 500
+
 type InMemoryStore struct {
 	data map[string]string
 }
@@ -37,61 +43,237 @@ func (s *InMemoryStore) Save(url, shortened string) error {
 	return nil
 }
 
+func (s *InMemoryStore) Delete(shortened string) error {
+	delete(s.data, shortened)
+	return nil
+}
+
 type PGStore struct {
-	db *gorm.DB
+	db     *gorm.DB
+	cipher *URLCipher
 }
 
 type URLAssociation struct {
 	URL        string
 	Shortened  string `gorm:"primaryKey"`
 	Expiration sql.NullTime
+	CreatedAt  *time.Time
+	Options    LinkOptions `gorm:"serializer:json"`
+	Campaign   string
+	Targets    []Target          `gorm:"serializer:json"`
+	GeoTargets map[string]string `gorm:"serializer:json"`
+	Variants   []Variant         `gorm:"serializer:json"`
+	// WorkspaceID owns the link; codes stay unique across workspaces.
+	WorkspaceID string
+	CreatedBy   string
+	// Quarantined links serve a warning instead of redirecting.
+	Quarantined bool
+	// URLHash is the keyed hash of the destination, which is looked up
+	// instead of the destination once it is encrypted.
+	URLHash string
+}
+
+func NewURLAssociation(url, shortened string, expiration *time.Time) URLAssociation {
+	return newURLAssociationAt(url, shortened, expiration, time.Now())
+}
+
+// newURLAssociationAt takes the creation time from the clock of the use case
+// creating the link.
+func newURLAssociationAt(url, shortened string, expiration *time.Time, createdAt time.Time) URLAssociation {
+	var t sql.NullTime
+	if expiration != nil {
+		t.Valid = true
+		t.Time = *expiration
+	}
+	return URLAssociation{URL: url, Shortened: shortened, Expiration: t, CreatedAt: &createdAt, WorkspaceID: DefaultWorkspace}
+}
+
+func (a URLAssociation) toURL() (URL, error) {
+	location, err := time.LoadLocation("Local")
+	if err != nil {
+		return URL{}, err
+	}
+	var expiration *time.Time
+	if a.Expiration.Valid {
+		local := a.Expiration.Time.In(location)
+		expiration = &local
+	}
+	u, err := NewURL(a.URL, expiration)
+	if err != nil {
+		return URL{}, err
+	}
+	if a.CreatedAt != nil {
+		createdAt := a.CreatedAt.In(location)
+		u.createdAt = &createdAt
+	}
+	u.options = a.Options
+	u.targets = a.Targets
+	u.geoTargets = a.GeoTargets
+	u.variants = a.Variants
+	u.workspace = a.WorkspaceID
+	u.createdBy = a.CreatedBy
+	u.quarantined = a.Quarantined
+	return u, nil
 }
 
 func (p PGStore) Get(shortened string) (URL, error) {
 	var association = URLAssociation{}
 	tx := p.db.First(&association, "shortened = ?", shortened)
+	if errors.Is(tx.Error, gorm.ErrRecordNotFound) && hasReadReplicas(p.db) {
+		// replicas may lag behind a link that was just created on the primary
+		tx = p.db.Clauses(dbresolver.Write).First(&association, "shortened = ?", shortened)
+	}
+	if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		return URL{}, ErrNotFound
+	}
 	if tx.Error != nil {
 		return URL{}, tx.Error
 	}
-	if association.Expiration.Valid {
-		location, err := time.LoadLocation("Local")
-		if err != nil {
-			return URL{}, err
-		}
-		utc := association.Expiration.Time.In(location)
-		return NewURL(association.URL, &utc)
+	if err := p.open(&association); err != nil {
+		return URL{}, err
 	}
-	return NewURL(association.URL, nil)
+	return association.toURL()
 }
 
-func (p PGStore) Save(url, shortened string, expiration *time.Time) error {
-	var t sql.NullTime
-	if expiration == nil {
-		t.Valid = false
-	} else {
-		t.Valid = true
-		t.Time = *expiration
+// WithCipher encrypts the destinations saved from now on and decrypts the
+// destinations read, whether they were encrypted or not.
+func (p *PGStore) WithCipher(cipher *URLCipher) {
+	p.cipher = cipher
+}
+
+// seal returns the association as stored: with an encrypted destination
+// and its keyed hash.
+func (p PGStore) seal(association URLAssociation) (URLAssociation, error) {
+	if p.cipher == nil {
+		return association, nil
 	}
-	tx := p.db.Create(&URLAssociation{URL: url, Shortened: shortened, Expiration: t})
-	return tx.Error
+	encrypted, err := p.cipher.Encrypt(association.URL)
+	if err != nil {
+		return URLAssociation{}, err
+	}
+	association.URLHash = p.cipher.Hash(association.URL)
+	association.URL = encrypted
+	return association, nil
 }
 
-func NewInMemorySqlite() *PGStore {
-	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+func (p PGStore) open(association *URLAssociation) error {
+	destination, err := decryptURL(p.cipher, association.URL)
 	if err != nil {
-		panic("failed to connect database")
+		return fmt.Errorf("%s: %w", association.Shortened, err)
 	}
-	_ = db.AutoMigrate(&URLAssociation{})
-	return &PGStore{db: db}
+	association.URL = destination
+	return nil
 }
 
-func NewPG() *PGStore {
-	dsn := fmt.Sprintf("host=%s dbname=%s port=5432 user=%s password=%s",
-		os.Getenv("DB_HOST"), os.Getenv("DB_NAME"), os.Getenv("DB_USERNAME"), os.Getenv("DB_PASSWORD"))
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+func (p PGStore) Save(association URLAssociation) error {
+	association, err := p.seal(association)
 	if err != nil {
-		panic("failed to connect database")
+		return err
 	}
-	_ = db.AutoMigrate(&URLAssociation{})
+	tx := p.db.Create(&association)
+	if errors.Is(tx.Error, gorm.ErrDuplicatedKey) {
+		return ErrConflict
+	}
+	return tx.Error
+}
+
+// SaveBatch inserts the associations whose code is still free and returns
+// every association as stored, so callers can detect codes already taken.
+// Encrypted destinations are compared through their keyed hash: only the
+// ones taken by other destinations are decrypted.
+func (p PGStore) SaveBatch(associations []URLAssociation) ([]URLAssociation, int, error) {
+	if len(associations) == 0 {
+		return nil, 0, nil
+	}
+	requested := make(map[string]URLAssociation, len(associations))
+	sealed := make([]URLAssociation, 0, len(associations))
+	for _, association := range associations {
+		s, err := p.seal(association)
+		if err != nil {
+			return nil, 0, err
+		}
+		requested[association.Shortened] = URLAssociation{URL: association.URL, URLHash: s.URLHash}
+		sealed = append(sealed, s)
+	}
+	associations = sealed
+	tx := p.db.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&associations, storeBatchSize)
+	if tx.Error != nil {
+		return nil, 0, tx.Error
+	}
+	created := int(tx.RowsAffected)
+	stored := make([]URLAssociation, 0, len(associations))
+	for start := 0; start < len(associations); start += storeBatchSize {
+		end := min(start+storeBatchSize, len(associations))
+		codes := make([]string, 0, end-start)
+		for _, association := range associations[start:end] {
+			codes = append(codes, association.Shortened)
+		}
+		var chunk []URLAssociation
+		if err := p.db.Clauses(dbresolver.Write).Where("shortened IN ?", codes).Find(&chunk).Error; err != nil {
+			return nil, 0, err
+		}
+		for i := range chunk {
+			if request := requested[chunk[i].Shortened]; p.cipher != nil && chunk[i].URLHash == request.URLHash {
+				chunk[i].URL = request.URL
+			} else if err := p.open(&chunk[i]); err != nil {
+				return nil, 0, err
+			}
+		}
+		stored = append(stored, chunk...)
+	}
+	return stored, created, nil
+}
+
+func (p PGStore) Update(shortened string, update func(association *URLAssociation) error) error {
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		var association URLAssociation
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&association, "shortened = ?", shortened).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := p.open(&association); err != nil {
+			return err
+		}
+		if err := update(&association); err != nil {
+			return err
+		}
+		association, err = p.seal(association)
+		if err != nil {
+			return err
+		}
+		return tx.Save(&association).Error
+	})
+}
+
+// Find returns the codes of the links to the destination. Destinations
+// stored before encryption was enabled are still found until they are
+// encrypted.
+func (p PGStore) Find(destination string) ([]string, error) {
+	query := p.db.Model(&URLAssociation{}).Where("url = ?", destination)
+	if p.cipher != nil {
+		query = p.db.Model(&URLAssociation{}).Where("url_hash = ? OR url = ?", p.cipher.Hash(destination), destination)
+	}
+	var codes []string
+	return codes, query.Order("shortened").Pluck("shortened", &codes).Error
+}
+
+// Reencrypt encrypts the destinations under the active key, batch by batch,
+// and returns how many links changed.
+func (p PGStore) Reencrypt(batchSize int) (int, error) {
+	return reencryptTable(p.db, p.cipher, "url_associations", batchSize, true, "url")
+}
+
+func (p PGStore) Delete(shortened string) error {
+	return p.db.Delete(&URLAssociation{}, "shortened = ?", shortened).Error
+}
+
+func NewInMemorySqlite() *PGStore {
+	return NewPGStoreFromDB(NewInMemoryDB())
+}
+
+func NewPGStoreFromDB(db *gorm.DB) *PGStore {
 	return &PGStore{db: db}
 }
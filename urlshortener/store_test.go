@@ -10,7 +10,7 @@ import (
 func TestStoreWithExpiration(t *testing.T) {
 	s := NewInMemorySqlite()
 	now := time.Now()
-	err := s.Save("http://long.net", "http://short.uk", &now)
+	err := s.Save(NewURLAssociation("http://long.net", "http://short.uk", &now))
 	require.NoError(t, err)
 
 	u, err := s.Get("http://short.uk")
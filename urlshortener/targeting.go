@@ -0,0 +1,169 @@
+package urlshortener
+
+import (
+	"errors"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidTarget = errors.New("invalid target")
+
+const DefaultRule = "default"
+
+const (
+	PlatformIOS     = "ios"
+	PlatformAndroid = "android"
+	PlatformWindows = "windows"
+	PlatformMacOS   = "macos"
+	PlatformLinux   = "linux"
+	PlatformOther   = "other"
+)
+
+var platforms = []string{PlatformIOS, PlatformAndroid, PlatformWindows, PlatformMacOS, PlatformLinux, PlatformOther}
+
+// Target is a conditional destination; a link's targets are tried in order
+// and the first one matching the visitor wins over the link URL.
+type Target struct {
+	Name      string   `json:"name,omitempty"`
+	URL       string   `json:"url"`
+	Platforms []string `json:"platforms,omitempty"`
+	Languages []string `json:"languages,omitempty"`
+}
+
+func (t Target) Validate() error {
+	u, err := NewURL(t.URL, nil)
+	if err != nil || u.Validate() != nil {
+		return ErrInvalidTarget
+	}
+	for _, platform := range t.Platforms {
+		if !slices.Contains(platforms, platform) {
+			return ErrInvalidTarget
+		}
+	}
+	for _, language := range t.Languages {
+		if language == "" {
+			return ErrInvalidTarget
+		}
+	}
+	return nil
+}
+
+func (t Target) matches(visitor Visitor) bool {
+	if len(t.Platforms) > 0 && !slices.Contains(t.Platforms, visitor.Platform) {
+		return false
+	}
+	if len(t.Languages) > 0 && !slices.ContainsFunc(visitor.Languages, func(language string) bool {
+		return slices.ContainsFunc(t.Languages, func(l string) bool { return strings.EqualFold(l, language) })
+	}) {
+		return false
+	}
+	return true
+}
+
+// rule names the target in analytics, falling back to its position.
+func (t Target) rule(index int) string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return "target-" + strconv.Itoa(index)
+}
+
+func validateTargets(targets []Target) error {
+	for _, target := range targets {
+		if err := target.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateGeoTargets checks a country-to-destination map keyed by ISO 3166
+// alpha-2 codes.
+func validateGeoTargets(geoTargets map[string]string) error {
+	for country, destination := range geoTargets {
+		if len(country) != 2 || strings.Trim(country, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			return ErrInvalidTarget
+		}
+		if err := (Target{URL: destination}).Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Visitor holds what is known about whoever follows a short link.
+type Visitor struct {
+	Platform  string
+	Languages []string
+	Country   string
+	ID        string
+	// identified is set when the ID comes from the visitor cookie
+	identified bool
+}
+
+func platformFromUserAgent(userAgent string) string {
+	switch {
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"), strings.Contains(userAgent, "iPod"):
+		return PlatformIOS
+	case strings.Contains(userAgent, "Android"):
+		return PlatformAndroid
+	case strings.Contains(userAgent, "Windows"):
+		return PlatformWindows
+	case strings.Contains(userAgent, "Macintosh"), strings.Contains(userAgent, "Mac OS X"):
+		return PlatformMacOS
+	case strings.Contains(userAgent, "Linux"):
+		return PlatformLinux
+	default:
+		return PlatformOther
+	}
+}
+
+// languagesFromHeader returns the primary language subtags of an
+// Accept-Language header in order of appearance, skipping refused ones.
+func languagesFromHeader(header string) []string {
+	var languages []string
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err != nil || weight == 0 {
+				continue
+			}
+		}
+		language, _, _ := strings.Cut(tag, "-")
+		language = strings.ToLower(strings.TrimSpace(language))
+		if language != "" && language != "*" && !slices.Contains(languages, language) {
+			languages = append(languages, language)
+		}
+	}
+	return languages
+}
+
+// pick returns the destination of the first target matching the visitor, then
+// of the visitor country, falling back to the link URL itself or one of its
+// variants, along with the name of the matched rule and chosen variant.
+func (u URL) pick(shortened string, visitor Visitor) (URL, string, string, error) {
+	for i, target := range u.targets {
+		if target.matches(visitor) {
+			return u.retarget(target.URL, target.rule(i), "")
+		}
+	}
+	if destination, ok := u.geoTargets[visitor.Country]; ok && visitor.Country != "" {
+		return u.retarget(destination, "country-"+visitor.Country, "")
+	}
+	if len(u.variants) > 0 {
+		variant, label := chooseVariant(u.variants, shortened, visitor.ID)
+		return u.retarget(variant.URL, DefaultRule, label)
+	}
+	return u, DefaultRule, "", nil
+}
+
+func (u URL) retarget(rawURL, rule, variant string) (URL, string, string, error) {
+	destination, err := url.Parse(rawURL)
+	if err != nil {
+		return URL{}, "", "", err
+	}
+	u.URL = destination
+	return u, rule, variant, nil
+}
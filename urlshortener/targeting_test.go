@@ -0,0 +1,89 @@
+package urlshortener
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	iPhoneUserAgent  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15"
+	androidUserAgent = "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36"
+	desktopUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36"
+)
+
+var appTargets = []Target{
+	{Name: "ios", URL: "https://apps.apple.com/app/id1", Platforms: []string{PlatformIOS}},
+	{URL: "https://play.google.com/store/apps/details?id=fr", Platforms: []string{PlatformAndroid}, Languages: []string{"fr"}},
+	{Name: "android", URL: "https://play.google.com/store/apps/details?id=app", Platforms: []string{PlatformAndroid}},
+}
+
+func TestPlatformFromUserAgent(t *testing.T) {
+	assert.Equal(t, PlatformIOS, platformFromUserAgent(iPhoneUserAgent))
+	assert.Equal(t, PlatformAndroid, platformFromUserAgent(androidUserAgent))
+	assert.Equal(t, PlatformWindows, platformFromUserAgent(desktopUserAgent))
+	assert.Equal(t, PlatformOther, platformFromUserAgent("curl/8.0"))
+}
+
+func TestLanguagesFromHeader(t *testing.T) {
+	assert.Equal(t, []string{"fr", "en"}, languagesFromHeader("fr-CH, fr;q=0.9, de;q=0, en;q=0.8, *;q=0.5"))
+	assert.Empty(t, languagesFromHeader(""))
+}
+
+func TestResolveTargets(t *testing.T) {
+	usecase := NewUsecase(NewInMemorySqlite())
+	short, err := usecase.ShortenWithOptions(ShortenRequest{URL: "https://example.com/app", Targets: appTargets})
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		visitor  Visitor
+		location string
+		rule     string
+	}{
+		{Visitor{Platform: PlatformIOS}, "https://apps.apple.com/app/id1", "ios"},
+		{Visitor{Platform: PlatformAndroid, Languages: []string{"de", "fr"}}, "https://play.google.com/store/apps/details?id=fr", "target-1"},
+		{Visitor{Platform: PlatformAndroid, Languages: []string{"en"}}, "https://play.google.com/store/apps/details?id=app", "android"},
+		{Visitor{Platform: PlatformWindows}, "https://example.com/app", DefaultRule},
+	} {
+		redirect, err := usecase.Resolve(short, test.visitor)
+		require.NoError(t, err)
+		assert.Equal(t, test.location, redirect.Location)
+		assert.Equal(t, test.rule, redirect.Rule)
+		assert.Equal(t, []string{"User-Agent", "Accept-Language"}, redirect.Vary)
+	}
+
+	_, err = usecase.ShortenWithOptions(ShortenRequest{URL: "https://example.com/app", Targets: []Target{{URL: "https://example.com", Platforms: []string{"beos"}}}})
+	assert.ErrorIs(t, err, ErrInvalidTarget)
+}
+
+func testHTTPTargets(t *testing.T, app *Application) {
+	short, err := app.ShortenWithOptions(ShortenRequest{URL: "https://example.com/app", Targets: appTargets})
+	require.NoError(t, err)
+
+	for _, userAgent := range []string{iPhoneUserAgent, iPhoneUserAgent, androidUserAgent, desktopUserAgent} {
+		request := httptest.NewRequest(http.MethodGet, short, nil)
+		request.Header.Set("User-Agent", userAgent)
+		recorder := handle(app, request)
+		assert.Equal(t, http.StatusTemporaryRedirect, recorder.Code)
+		assert.Equal(t, "User-Agent, Accept-Language", recorder.Header().Get("Vary"))
+	}
+
+	recorder := handle(app, httptest.NewRequest(http.MethodGet, "/api/v1/links/"+MustNewURL("https://example.com/app", nil).encode()+"/clicks?by=rule", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"shortened": "`+short+`", "by": "rule", "counts": {"ios": 2, "android": 1, "default": 1}}`, recorder.Body.String())
+
+	recorder = handle(app, httptest.NewRequest(http.MethodGet, "/api/v1/links/abc/clicks?by=browser", nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestHTTPTargets(t *testing.T) {
+	testHTTPTargets(t, NewInMemoryApplication())
+}
+
+func TestRedisHTTPTargets(t *testing.T) {
+	_, client := newMiniredisClient(t)
+	testHTTPTargets(t, NewApplicationFromInfrastructure(NewRedisInfrastructureFromClient(client, false)))
+}
@@ -11,7 +11,15 @@ import (
 
 type URL struct {
 	*url.URL
-	expiration *time.Time
+	expiration  *time.Time
+	createdAt   *time.Time
+	options     LinkOptions
+	targets     []Target
+	geoTargets  map[string]string
+	variants    []Variant
+	workspace   string
+	createdBy   string
+	quarantined bool
 }
 
 var ErrInvalidURL = errors.New("invalid URL")
@@ -43,7 +51,23 @@ func (u URL) Validate() error {
 }
 
 func (u URL) encode() string {
+	return u.encodeIn("")
+}
+
+// encodeIn hashes the whole destination, query and fragment included, so
+// that links differing only by their campaign or UTM parameters get their own
+// code. Destinations without either keep the codes they always had.
+func (u URL) encodeIn(namespace string) string {
 	payload := fmt.Sprintf("%s://%s/%s", u.Scheme, u.Host, u.Path)
+	if u.RawQuery != "" {
+		payload += "?" + u.RawQuery
+	}
+	if u.Fragment != "" {
+		payload += "#" + u.Fragment
+	}
+	if namespace != "" {
+		payload = namespace + "|" + payload
+	}
 	m := md5.Sum([]byte(payload))
 
 	// base62 encoding from https://ucarion.com/go-base62
@@ -56,8 +80,64 @@ func (u URL) Shorten() (URL, error) {
 	if err := u.Validate(); err != nil {
 		return URL{}, err
 	}
-	shortenedPath := fmt.Sprintf("u/%s", u.encode())
-	return URL{URL: &url.URL{Scheme: "https", Host: "localhost:8080", Path: shortenedPath}, expiration: u.expiration}, nil
+	s := NewShortURL(u.encode())
+	s.expiration = u.expiration
+	return s, nil
+}
+
+// ShortenIn derives the code from the workspace as well, so that workspaces
+// shortening the same destination do not claim each other's code. Links of
+// the default workspace keep the codes they always had.
+func (u URL) ShortenIn(workspace string) (URL, error) {
+	if workspaceOrDefault(workspace) == DefaultWorkspace {
+		return u.Shorten()
+	}
+	if err := u.Validate(); err != nil {
+		return URL{}, err
+	}
+	s := NewShortURL(u.encodeIn(workspace))
+	s.expiration = u.expiration
+	return s, nil
+}
+
+func NewShortURL(code string) URL {
+	return URL{URL: &url.URL{Scheme: "https", Host: "localhost:8080", Path: fmt.Sprintf("u/%s", code)}}
+}
+
+func (u URL) Expiration() *time.Time {
+	return u.expiration
+}
+
+func (u URL) CreatedAt() *time.Time {
+	return u.createdAt
+}
+
+func (u URL) Options() LinkOptions {
+	return u.options
+}
+
+func (u URL) Targets() []Target {
+	return u.targets
+}
+
+func (u URL) GeoTargets() map[string]string {
+	return u.geoTargets
+}
+
+func (u URL) Variants() []Variant {
+	return u.variants
+}
+
+func (u URL) Workspace() string {
+	return workspaceOrDefault(u.workspace)
+}
+
+func (u URL) CreatedBy() string {
+	return u.createdBy
+}
+
+func (u URL) Quarantined() bool {
+	return u.quarantined
 }
 
 func (u URL) Expiring() bool {
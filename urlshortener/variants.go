@@ -0,0 +1,120 @@
+package urlshortener
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var ErrInvalidVariant = errors.New("invalid variant")
+
+const (
+	visitorCookie       = "visitor"
+	visitorCookieMaxAge = 365 * 24 * time.Hour
+)
+
+// Variant is one of the weighted destinations of an A/B split link.
+type Variant struct {
+	Name   string `json:"name,omitempty"`
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+func validateVariants(variants []Variant) error {
+	total := 0
+	for _, variant := range variants {
+		if variant.Weight < 0 {
+			return ErrInvalidVariant
+		}
+		if err := (Target{URL: variant.URL}).Validate(); err != nil {
+			return ErrInvalidVariant
+		}
+		total += variant.Weight
+	}
+	if len(variants) > 0 && total == 0 {
+		return ErrInvalidVariant
+	}
+	return nil
+}
+
+func (v Variant) label(index int) string {
+	if v.Name != "" {
+		return v.Name
+	}
+	return "variant-" + strconv.Itoa(index)
+}
+
+// chooseVariant hashes the visitor with the link so that a visitor keeps the
+// same variant as long as the weights do not change.
+func chooseVariant(variants []Variant, shortened, visitorID string) (Variant, string) {
+	total := 0
+	for _, variant := range variants {
+		total += variant.Weight
+	}
+	sum := sha256.Sum256([]byte(shortened + "|" + visitorID))
+	bucket := int(binary.BigEndian.Uint64(sum[:8]) % uint64(total))
+	for i, variant := range variants {
+		if bucket < variant.Weight {
+			return variant, variant.label(i)
+		}
+		bucket -= variant.Weight
+	}
+	return variants[len(variants)-1], variants[len(variants)-1].label(len(variants) - 1)
+}
+
+// visitorID returns the visitor cookie if present, or a fingerprint of the
+// client address and headers; the second result tells if it came from the
+// cookie.
+func (e *VisitorExtractor) visitorID(request *http.Request) (string, bool) {
+	if cookie, err := request.Cookie(visitorCookie); err == nil && cookie.Value != "" {
+		return cookie.Value, true
+	}
+	ip, _ := e.clientIP(request)
+	sum := sha256.Sum256([]byte(ip.String() + "|" + request.UserAgent() + "|" + request.Header.Get("Accept-Language")))
+	return hex.EncodeToString(sum[:16]), false
+}
+
+func setVisitorCookie(writer http.ResponseWriter, id string) {
+	http.SetCookie(writer, &http.Cookie{
+		Name:     visitorCookie,
+		Value:    id,
+		Path:     "/u/",
+		MaxAge:   int(visitorCookieMaxAge.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (c *Usecase) SetVariants(rawURL string, variants []Variant) error {
+	if err := authorize(c.principal, ActionRetargetLinks); err != nil {
+		return err
+	}
+	if err := validateVariants(variants); err != nil {
+		return err
+	}
+	destinations := make([]string, 0, len(variants))
+	for _, variant := range variants {
+		destinations = append(destinations, variant.URL)
+	}
+	if err := c.screenURLs(destinations); err != nil {
+		return err
+	}
+	u, err := NewURL(rawURL, nil)
+	if err != nil {
+		return err
+	}
+	if err := u.Validate(); err != nil {
+		return err
+	}
+	return c.store.Update(rawURL, func(association *URLAssociation) error {
+		if !canAccess(c.principal, association.WorkspaceID) {
+			return ErrNotFound
+		}
+		association.Variants = variants
+		return nil
+	})
+}
@@ -0,0 +1,89 @@
+package urlshortener
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var splitVariants = []Variant{
+	{Name: "a", URL: "https://example.com/landing-a", Weight: 3},
+	{Name: "b", URL: "https://example.com/landing-b", Weight: 1},
+}
+
+func TestChooseVariant(t *testing.T) {
+	counts := map[string]int{}
+	for i := range 4000 {
+		visitor := fmt.Sprintf("visitor-%d", i)
+		_, label := chooseVariant(splitVariants, "https://localhost:8080/u/abc", visitor)
+		again, _ := chooseVariant(splitVariants, "https://localhost:8080/u/abc", visitor)
+		assert.Equal(t, label, again.Name)
+		counts[label]++
+	}
+	assert.InDelta(t, 3000, counts["a"], 150)
+	assert.InDelta(t, 1000, counts["b"], 150)
+
+	_, label := chooseVariant([]Variant{{URL: "https://localhost/x", Weight: 0}, {URL: "https://localhost/y", Weight: 1}}, "abc", "v")
+	assert.Equal(t, "variant-1", label)
+}
+
+func TestValidateVariants(t *testing.T) {
+	assert.NoError(t, validateVariants(nil))
+	assert.ErrorIs(t, validateVariants([]Variant{{URL: "https://localhost/x", Weight: 0}}), ErrInvalidVariant)
+	assert.ErrorIs(t, validateVariants([]Variant{{URL: "https://localhost/x", Weight: -1}}), ErrInvalidVariant)
+	assert.ErrorIs(t, validateVariants([]Variant{{URL: "localhost", Weight: 1}}), ErrInvalidVariant)
+}
+
+func testHTTPVariants(t *testing.T, app *Application) {
+	short, err := app.ShortenWithOptions(ShortenRequest{URL: "https://example.com/landing", Variants: splitVariants})
+	require.NoError(t, err)
+
+	recorder := handle(app, httptest.NewRequest(http.MethodGet, short, nil))
+	assert.Equal(t, http.StatusTemporaryRedirect, recorder.Code)
+	cookies := recorder.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, visitorCookie, cookies[0].Name)
+	location := recorder.Header().Get("Location")
+	assert.Contains(t, []string{"https://example.com/landing-a", "https://example.com/landing-b"}, location)
+	assert.Equal(t, "Cookie", recorder.Header().Get("Vary"))
+
+	for range 5 {
+		request := httptest.NewRequest(http.MethodGet, short, nil)
+		request.RemoteAddr = "203.0.113.7:1234"
+		request.AddCookie(cookies[0])
+		recorder = handle(app, request)
+		assert.Equal(t, location, recorder.Header().Get("Location"))
+		assert.Empty(t, recorder.Result().Cookies())
+	}
+
+	counts, err := app.Clicks(short, "variant")
+	require.NoError(t, err)
+	assert.Equal(t, 6, counts[splitVariants[0].Name]+counts[splitVariants[1].Name])
+
+	testServer := httptest.NewServer(app.server.mux)
+	defer testServer.Close()
+	client := NewHTTPClientFromResty(resty.NewWithClient(testServer.Client()).SetBaseURL(testServer.URL))
+	require.NoError(t, client.SetVariants(short, []Variant{{Name: "c", URL: "https://example.com/landing-c", Weight: 1}}))
+	recorder = handle(app, httptest.NewRequest(http.MethodGet, short, nil))
+	assert.Equal(t, "https://example.com/landing-c", recorder.Header().Get("Location"))
+	got, err := app.Unshorten(short)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/landing", got)
+
+	assert.ErrorIs(t, client.SetVariants(short, []Variant{{URL: "https://example.com/x"}}), ErrInvalidVariant)
+	assert.ErrorIs(t, client.SetVariants("https://localhost:8080/u/unknown", splitVariants), ErrNotFound)
+}
+
+func TestHTTPVariants(t *testing.T) {
+	testHTTPVariants(t, NewInMemoryApplication())
+}
+
+func TestRedisHTTPVariants(t *testing.T) {
+	_, client := newMiniredisClient(t)
+	testHTTPVariants(t, NewApplicationFromInfrastructure(NewRedisInfrastructureFromClient(client, false)))
+}
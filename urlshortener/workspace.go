@@ -0,0 +1,318 @@
+package urlshortener
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrUserNotFound = errors.New("user not found")
+var ErrWorkspaceNotFound = errors.New("workspace not found")
+var ErrNotMember = errors.New("user is not a member of the workspace")
+
+// DefaultWorkspace holds the links created before workspaces existed, and
+// those created without an authenticated principal.
+const DefaultWorkspace = "default"
+
+type User struct {
+	ID        string    `json:"id" gorm:"primaryKey"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Workspace struct {
+	ID        string    `json:"id" gorm:"primaryKey"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Membership struct {
+	WorkspaceID string    `json:"workspace_id" gorm:"primaryKey"`
+	UserID      string    `json:"user_id" gorm:"primaryKey"`
+	Role        Role      `json:"role"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (Membership) TableName() string {
+	return "workspace_members"
+}
+
+// DefaultMemberRole is the role of the members added before roles existed.
+const DefaultMemberRole = RoleEditor
+
+func (m Membership) withDefaultRole() Membership {
+	if m.Role == "" {
+		m.Role = DefaultMemberRole
+	}
+	return m
+}
+
+func workspaceOrDefault(workspaceID string) string {
+	if workspaceID == "" {
+		return DefaultWorkspace
+	}
+	return workspaceID
+}
+
+// workspaceOf returns the workspace a principal acts in; a nil principal is
+// the system itself, acting in the default workspace.
+func workspaceOf(principal *Principal) string {
+	if principal == nil {
+		return DefaultWorkspace
+	}
+	return workspaceOrDefault(principal.WorkspaceID)
+}
+
+// canAccess tells if the principal may see and change what belongs to the
+// workspace; the system can access every workspace.
+func canAccess(principal *Principal, workspaceID string) bool {
+	return principal == nil || workspaceOf(principal) == workspaceOrDefault(workspaceID)
+}
+
+func randomID() (string, error) {
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+type WorkspaceStorer interface {
+	CreateUser(user User) error
+	GetUser(id string) (User, error)
+	CreateWorkspace(workspace Workspace) error
+	GetWorkspace(id string) (Workspace, error)
+	// AddMember adds the user to the workspace, or changes its role.
+	AddMember(membership Membership) error
+	Member(workspaceID, userID string) (Membership, error)
+	Members(workspaceID string) ([]Membership, error)
+}
+
+type WorkspaceUsecase struct {
+	workspaces WorkspaceStorer
+	clock      clockwork.Clock
+	principal  *Principal
+}
+
+func NewWorkspaceUsecase(workspaces WorkspaceStorer) *WorkspaceUsecase {
+	return &WorkspaceUsecase{workspaces: workspaces, clock: clockwork.NewRealClock()}
+}
+
+func (w *WorkspaceUsecase) As(principal Principal) *WorkspaceUsecase {
+	u := *w
+	u.principal = &principal
+	return &u
+}
+
+func (w *WorkspaceUsecase) CreateUser(name string) (User, error) {
+	id, err := randomID()
+	if err != nil {
+		return User{}, err
+	}
+	user := User{ID: id, Name: name, CreatedAt: w.clock.Now()}
+	return user, w.workspaces.CreateUser(user)
+}
+
+func (w *WorkspaceUsecase) CreateWorkspace(name string) (Workspace, error) {
+	id, err := randomID()
+	if err != nil {
+		return Workspace{}, err
+	}
+	workspace := Workspace{ID: id, Name: name, CreatedAt: w.clock.Now()}
+	return workspace, w.workspaces.CreateWorkspace(workspace)
+}
+
+func (w *WorkspaceUsecase) AddMember(workspaceID, userID string, role Role) error {
+	if _, err := ParseRole(string(role)); err != nil {
+		return err
+	}
+	if err := w.workspace(workspaceID, ActionManageMembers); err != nil {
+		return err
+	}
+	if _, err := w.workspaces.GetUser(userID); err != nil {
+		return err
+	}
+	return w.workspaces.AddMember(Membership{WorkspaceID: workspaceID, UserID: userID, Role: role, CreatedAt: w.clock.Now()})
+}
+
+func (w *WorkspaceUsecase) Members(workspaceID string) ([]Membership, error) {
+	if err := w.workspace(workspaceID, ActionViewLinks); err != nil {
+		return nil, err
+	}
+	return w.workspaces.Members(workspaceID)
+}
+
+// workspace checks that the workspace exists and that the principal may act
+// on it.
+func (w *WorkspaceUsecase) workspace(workspaceID string, action Action) error {
+	if !canAccess(w.principal, workspaceID) {
+		return ErrWorkspaceNotFound
+	}
+	if err := authorize(w.principal, action); err != nil {
+		return err
+	}
+	_, err := w.workspaces.GetWorkspace(workspaceID)
+	return err
+}
+
+type PGWorkspaceStore struct {
+	db *gorm.DB
+}
+
+func NewPGWorkspaceStoreFromDB(db *gorm.DB) *PGWorkspaceStore {
+	return &PGWorkspaceStore{db: db}
+}
+
+func (p *PGWorkspaceStore) CreateUser(user User) error {
+	return p.db.Create(&user).Error
+}
+
+func (p *PGWorkspaceStore) GetUser(id string) (User, error) {
+	var user User
+	err := p.db.First(&user, "id = ?", id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return User{}, ErrUserNotFound
+	}
+	return user, err
+}
+
+func (p *PGWorkspaceStore) CreateWorkspace(workspace Workspace) error {
+	return p.db.Create(&workspace).Error
+}
+
+func (p *PGWorkspaceStore) GetWorkspace(id string) (Workspace, error) {
+	var workspace Workspace
+	err := p.db.First(&workspace, "id = ?", id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Workspace{}, ErrWorkspaceNotFound
+	}
+	return workspace, err
+}
+
+func (p *PGWorkspaceStore) AddMember(membership Membership) error {
+	return p.db.Clauses(clause.OnConflict{DoUpdates: clause.AssignmentColumns([]string{"role"})}).Create(&membership).Error
+}
+
+func (p *PGWorkspaceStore) Member(workspaceID, userID string) (Membership, error) {
+	var membership Membership
+	err := p.db.First(&membership, "workspace_id = ? AND user_id = ?", workspaceID, userID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Membership{}, ErrNotMember
+	}
+	return membership, err
+}
+
+func (p *PGWorkspaceStore) Members(workspaceID string) ([]Membership, error) {
+	var members []Membership
+	err := p.db.Where("workspace_id = ?", workspaceID).Order("created_at").Find(&members).Error
+	return members, err
+}
+
+const (
+	redisUsersKey               = "users"
+	redisWorkspacesKey          = "workspaces"
+	redisWorkspaceMembersPrefix = "workspace-members:"
+)
+
+type RedisWorkspaceStore struct {
+	client *redis.Client
+}
+
+func NewRedisWorkspaceStoreFromClient(client *redis.Client) *RedisWorkspaceStore {
+	return &RedisWorkspaceStore{client: client}
+}
+
+func (r *RedisWorkspaceStore) CreateUser(user User) error {
+	return r.set(redisUsersKey, user.ID, user)
+}
+
+func (r *RedisWorkspaceStore) GetUser(id string) (User, error) {
+	var user User
+	err := r.get(redisUsersKey, id, &user)
+	if errors.Is(err, redis.Nil) {
+		return User{}, ErrUserNotFound
+	}
+	return user, err
+}
+
+func (r *RedisWorkspaceStore) CreateWorkspace(workspace Workspace) error {
+	return r.set(redisWorkspacesKey, workspace.ID, workspace)
+}
+
+// GetWorkspace also knows the default workspace, which Redis deployments
+// never had to create.
+func (r *RedisWorkspaceStore) GetWorkspace(id string) (Workspace, error) {
+	var workspace Workspace
+	err := r.get(redisWorkspacesKey, id, &workspace)
+	if errors.Is(err, redis.Nil) && id == DefaultWorkspace {
+		return Workspace{ID: DefaultWorkspace, Name: "Default"}, nil
+	}
+	if errors.Is(err, redis.Nil) {
+		return Workspace{}, ErrWorkspaceNotFound
+	}
+	return workspace, err
+}
+
+func (r *RedisWorkspaceStore) AddMember(membership Membership) error {
+	if existing, err := r.Member(membership.WorkspaceID, membership.UserID); err == nil {
+		membership.CreatedAt = existing.CreatedAt
+	}
+	return r.set(redisWorkspaceMembersPrefix+membership.WorkspaceID, membership.UserID, membership)
+}
+
+func (r *RedisWorkspaceStore) Member(workspaceID, userID string) (Membership, error) {
+	var membership Membership
+	err := r.get(redisWorkspaceMembersPrefix+workspaceID, userID, &membership)
+	if errors.Is(err, redis.Nil) {
+		return Membership{}, ErrNotMember
+	}
+	return membership.withDefaultRole(), err
+}
+
+func (r *RedisWorkspaceStore) Members(workspaceID string) ([]Membership, error) {
+	values, err := r.client.HGetAll(context.Background(), redisWorkspaceMembersPrefix+workspaceID).Result()
+	if err != nil {
+		return nil, err
+	}
+	members := make([]Membership, 0, len(values))
+	for _, value := range values {
+		var membership Membership
+		if err := json.Unmarshal([]byte(value), &membership); err != nil {
+			return nil, err
+		}
+		members = append(members, membership.withDefaultRole())
+	}
+	slices.SortFunc(members, func(a, b Membership) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.UserID, b.UserID)
+	})
+	return members, nil
+}
+
+func (r *RedisWorkspaceStore) set(key, field string, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return r.client.HSet(context.Background(), key, field, value).Err()
+}
+
+func (r *RedisWorkspaceStore) get(key, field string, v any) error {
+	value, err := r.client.HGet(context.Background(), key, field).Result()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(value), v)
+}
@@ -0,0 +1,147 @@
+package urlshortener
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testWorkspaceMember struct {
+	user      User
+	workspace Workspace
+	role      Role
+}
+
+func (m testWorkspaceMember) principal() Principal {
+	return Principal{UserID: m.user.ID, WorkspaceID: m.workspace.ID, Role: m.role, Scopes: knownScopes}
+}
+
+func newTestWorkspaceMember(t *testing.T, app *Application, name string) testWorkspaceMember {
+	user, err := app.CreateUser(name)
+	require.NoError(t, err)
+	workspace, err := app.CreateWorkspace(name + "-team")
+	require.NoError(t, err)
+	require.NoError(t, app.AddMember(workspace.ID, user.ID, RoleOwner))
+	return testWorkspaceMember{user: user, workspace: workspace, role: RoleOwner}
+}
+
+func testWorkspaces(t *testing.T, app *Application) {
+	alice := newTestWorkspaceMember(t, app, "alice")
+	bob := newTestWorkspaceMember(t, app, "bob")
+	members, err := app.Members(alice.workspace.ID)
+	require.NoError(t, err)
+	require.Len(t, members, 1)
+	assert.Equal(t, alice.user.ID, members[0].UserID)
+	assert.Equal(t, RoleOwner, members[0].Role)
+	assert.ErrorIs(t, app.AddMember("unknown", alice.user.ID, RoleEditor), ErrWorkspaceNotFound)
+	assert.ErrorIs(t, app.AddMember(alice.workspace.ID, "unknown", RoleEditor), ErrUserNotFound)
+	assert.ErrorIs(t, app.AddMember(alice.workspace.ID, bob.user.ID, "superuser"), ErrInvalidRole)
+
+	asAlice := app.CountingUsecase.As(alice.principal())
+	asBob := app.CountingUsecase.As(bob.principal())
+	aliceShort, err := asAlice.Shorten("https://example.com/docs", nil)
+	require.NoError(t, err)
+	bobShort, err := asBob.Shorten("https://example.com/docs", nil)
+	require.NoError(t, err)
+	defaultShort, err := app.Shorten("https://example.com/docs", nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, aliceShort, bobShort)
+	assert.Equal(t, NewShortURL(MustNewURL("https://example.com/docs", nil).encode()).String(), defaultShort)
+
+	stored, err := app.store.Get(aliceShort)
+	require.NoError(t, err)
+	assert.Equal(t, alice.workspace.ID, stored.Workspace())
+	assert.Equal(t, alice.user.ID, stored.CreatedBy())
+	stored, err = app.store.Get(defaultShort)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultWorkspace, stored.Workspace())
+
+	assert.ErrorIs(t, asBob.SetVariants(aliceShort, splitVariants), ErrNotFound)
+	assert.NoError(t, asAlice.SetVariants(aliceShort, splitVariants))
+	_, err = asBob.Clicks(aliceShort, "rule")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = asAlice.Clicks(aliceShort, "rule")
+	assert.NoError(t, err)
+	_, err = asBob.Count(aliceShort)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	var exported bytes.Buffer
+	writer, err := NewLinkRecordWriter("ndjson", &exported)
+	require.NoError(t, err)
+	count, err := app.ArchiveUsecase.As(bob.principal()).Export(writer)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	var record LinkRecord
+	require.NoError(t, json.Unmarshal(exported.Bytes(), &record))
+	assert.Equal(t, bobShort, record.Shortened)
+	assert.Equal(t, bob.workspace.ID, record.Workspace)
+
+	aliceCampaigns := app.CampaignUsecase.As(alice.principal())
+	bobCampaigns := app.CampaignUsecase.As(bob.principal())
+	require.NoError(t, aliceCampaigns.SaveCampaign(Campaign{Name: "launch"}))
+	assert.ErrorIs(t, bobCampaigns.SaveCampaign(Campaign{Name: "launch"}), ErrInvalidCampaign)
+	campaigns, err := bobCampaigns.Campaigns()
+	require.NoError(t, err)
+	assert.Empty(t, campaigns)
+	campaigns, err = app.Campaigns()
+	require.NoError(t, err)
+	assert.Len(t, campaigns, 1)
+	_, err = bobCampaigns.CampaignStats("launch")
+	assert.ErrorIs(t, err, ErrCampaignNotFound)
+	_, err = asBob.ShortenWithOptions(ShortenRequest{URL: "https://example.com/launch", Campaign: "launch"})
+	assert.ErrorIs(t, err, ErrCampaignNotFound)
+
+	assert.ErrorIs(t, asBob.Delete(aliceShort), ErrNotFound)
+	require.NoError(t, asAlice.Delete(aliceShort))
+	_, err = app.Unshorten(bobShort)
+	assert.NoError(t, err)
+
+	_, _, err = app.IssueKey(APIKey{Name: "bob", Scopes: knownScopes, UserID: bob.user.ID, WorkspaceID: alice.workspace.ID})
+	assert.ErrorIs(t, err, ErrNotMember)
+}
+
+func TestWorkspaces(t *testing.T) {
+	testWorkspaces(t, NewInMemoryApplication())
+}
+
+func TestRedisWorkspaces(t *testing.T) {
+	_, client := newMiniredisClient(t)
+	testWorkspaces(t, NewApplicationFromInfrastructure(NewRedisInfrastructureFromClient(client, false)))
+}
+
+func TestHTTPWorkspaces(t *testing.T) {
+	t.Setenv("API_AUTH", "required")
+	app := NewInMemoryApplication()
+	alice := newTestWorkspaceMember(t, app, "alice")
+	bob := newTestWorkspaceMember(t, app, "bob")
+	aliceKey, _, err := app.IssueKey(APIKey{Name: "alice", Scopes: knownScopes, UserID: alice.user.ID, WorkspaceID: alice.workspace.ID})
+	require.NoError(t, err)
+	bobKey, _, err := app.IssueKey(APIKey{Name: "bob", Scopes: knownScopes, UserID: bob.user.ID, WorkspaceID: bob.workspace.ID})
+	require.NoError(t, err)
+
+	testServer := httptest.NewServer(app.server.mux)
+	defer testServer.Close()
+	newClient := func(key string) *HTTPClient {
+		return NewHTTPClientFromResty(resty.NewWithClient(testServer.Client()).SetBaseURL(testServer.URL)).WithAPIKey(key)
+	}
+
+	short, err := newClient(aliceKey).Shorten("https://example.com/docs", nil)
+	require.NoError(t, err)
+	assert.ErrorIs(t, newClient(bobKey).SetVariants(short, splitVariants), ErrNotFound)
+	require.NoError(t, newClient(aliceKey).SetVariants(short, splitVariants))
+
+	handle(app, httptest.NewRequest(http.MethodGet, short, nil))
+	for key, expected := range map[string]int{aliceKey: 1, bobKey: 0} {
+		request := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/count?url=%s", url.QueryEscape(short)), nil)
+		request.Header.Set("Authorization", "Bearer "+key)
+		assert.JSONEq(t, fmt.Sprintf(`{"count": %d}`, expected), handle(app, request).Body.String())
+	}
+}